@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"time"
 
 	"github.com/hryang/stable-diffusion-webui-proxy/pkg/agent"
 	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
@@ -12,6 +13,8 @@ func main() {
 	target := flag.String("target", "", "the downstream service endpoint")
 	port := flag.Int("port", 0, "the agent port number")
 	sqliteFile := flag.String("sqlite-file", "", "the sqlite file")
+	asyncRetention := flag.Duration("async-retention", 10*time.Minute, "the time the response of a background sdapi call is kept after it is ready")
+	interruptGrace := flag.Duration("interrupt-grace", 5*time.Second, "the time to wait before interrupting the task whose client is gone")
 
 	flag.Parse()
 
@@ -30,6 +33,8 @@ func main() {
 	// TODO: Make dbType configurable.
 	s := agent.NewAgent(*target, datastore.SQLite, *sqliteFile)
 	defer s.Close()
+	s.InterruptGrace = *interruptGrace
+	s.AsyncRetention = *asyncRetention
 
 	s.Echo.Logger.Fatal(s.Start(fmt.Sprintf("0.0.0.0:%d", *port)))
 }
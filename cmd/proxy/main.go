@@ -1,18 +1,206 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
 
 	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
 	"github.com/hryang/stable-diffusion-webui-proxy/pkg/proxy"
 )
 
+// stringList is a comma separated list flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// intList is a comma separated list of integers flag.
+type intList []int
+
+func (l *intList) String() string {
+	values := make([]string, len(*l))
+	for i, v := range *l {
+		values[i] = strconv.Itoa(v)
+	}
+	return strings.Join(values, ",")
+}
+
+func (l *intList) Set(value string) error {
+	*l = nil
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid integer %s: %v", s, err)
+		}
+		*l = append(*l, v)
+	}
+	return nil
+}
+
+// stringMap is a comma separated list of name=value flag.
+type stringMap map[string]string
+
+func (m *stringMap) String() string {
+	var pairs []string
+	for k, v := range *m {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *stringMap) Set(value string) error {
+	*m = make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		k, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			return fmt.Errorf("invalid pair %s, expect name=value", pair)
+		}
+		(*m)[k] = v
+	}
+	return nil
+}
+
+// weightMap is a comma separated list of name=weight flag.
+type weightMap map[string]float64
+
+func (m *weightMap) String() string {
+	var pairs []string
+	for k, v := range *m {
+		pairs = append(pairs, fmt.Sprintf("%s=%g", k, v))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *weightMap) Set(value string) error {
+	*m = make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		k, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			return fmt.Errorf("invalid weight %s, expect name=weight", pair)
+		}
+		w, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("invalid weight %s: %v", pair, err)
+		}
+		(*m)[k] = w
+	}
+	return nil
+}
+
 func main() {
 	target := flag.String("target", "", "the downstream service endpoint")
 	port := flag.Int("port", 0, "the agent port number")
 	sqliteFile := flag.String("sqlite-file", "", "the sqlite file")
 
+	config := proxy.DefaultConfig()
+	flag.StringVar(&config.HealthCheck.Path, "health-check-path", config.HealthCheck.Path, "the path of the backend health probe")
+	flag.DurationVar(&config.HealthCheck.Interval, "health-check-interval", config.HealthCheck.Interval, "the interval of the backend health probes, 0 disables the active probes")
+	flag.DurationVar(&config.HealthCheck.Timeout, "health-check-timeout", config.HealthCheck.Timeout, "the timeout of one backend health probe")
+	flag.IntVar(&config.HealthCheck.HealthyThreshold, "health-check-healthy-threshold", config.HealthCheck.HealthyThreshold, "the consecutive successes to consider a backend healthy again")
+	flag.IntVar(&config.HealthCheck.UnhealthyThreshold, "health-check-unhealthy-threshold", config.HealthCheck.UnhealthyThreshold, "the consecutive probe failures to eject a backend")
+	flag.IntVar(&config.HealthCheck.PassiveThreshold, "health-check-passive-threshold", config.HealthCheck.PassiveThreshold, "the consecutive failed requests to eject a backend, 0 disables the passive checking")
+	flag.Var((*intList)(&config.HealthCheck.PassiveStatusCodes), "health-check-passive-status-codes", "the comma separated response statuses counted as the failures by the passive checking, besides the connection errors")
+	flag.DurationVar(&config.HealthCheck.BaseEjectionTime, "health-check-base-ejection-time", config.HealthCheck.BaseEjectionTime, "the ejection time of the first ejection, doubled for each consecutive ejection")
+	flag.DurationVar(&config.HealthCheck.MaxEjectionTime, "health-check-max-ejection-time", config.HealthCheck.MaxEjectionTime, "the upper bound of the ejection time")
+	flag.DurationVar(&config.Membership.ReloadInterval, "reload-interval", config.Membership.ReloadInterval, "the interval to reload the backend services from the datastore, 0 disables the periodic reloading")
+	flag.DurationVar(&config.Membership.DrainTimeout, "drain-timeout", config.Membership.DrainTimeout, "the max time to wait for the in-flight requests of a removed backend")
+	flag.IntVar(&config.Retry.MaxRetries, "retry-max-retries", config.Retry.MaxRetries, "the retry budget of one request, 0 disables the retries")
+	flag.DurationVar(&config.Retry.BackoffBase, "retry-backoff-base", config.Retry.BackoffBase, "the base of the jittered exponential backoff between retries")
+	flag.DurationVar(&config.Retry.BackoffMax, "retry-backoff-max", config.Retry.BackoffMax, "the upper bound of the backoff between retries")
+	flag.Int64Var(&config.Retry.MaxBodyBytes, "retry-max-body-bytes", config.Retry.MaxBodyBytes, "the requests with larger body are not retried")
+	flag.Var((*stringList)(&config.Retry.IdempotentPaths), "retry-idempotent-paths", "the comma separated GET paths which are also retried on 502/503/504 and errors after the request is sent")
+	flag.Var((*stringList)(&config.Queue.Paths), "queue-paths", "the comma separated generation paths which wait in the proxy queue for a free backend slot")
+	flag.IntVar(&config.Queue.MaxLength, "queue-max-length", config.Queue.MaxLength, "the max number of queued requests, 0 means unlimited")
+	flag.StringVar(&config.Queue.Policy, "queue-policy", config.Queue.Policy, "the dispatching order of the queued requests, fifo, wfq or edf")
+	flag.Var((*weightMap)(&config.Queue.ClassWeights), "priority-class-weights", "the comma separated class=weight of the priority classes")
+	flag.StringVar(&config.Queue.DefaultClass, "default-priority-class", config.Queue.DefaultClass, "the priority class of the requests without API key")
+	flag.BoolVar(&config.Batching.Enabled, "batching", config.Batching.Enabled, "coalesce the compatible txt2img requests into one batched generation")
+	flag.DurationVar(&config.Batching.Window, "batching-window", config.Batching.Window, "the time to wait for more compatible txt2img requests")
+	flag.IntVar(&config.Batching.MaxBatchSize, "batching-max-batch-size", config.Batching.MaxBatchSize, "the max number of txt2img requests in one batch")
+	flag.BoolVar(&config.Batching.PerImagePrompts, "batching-per-image-prompts", config.Batching.PerImagePrompts, "the backends accept a list of prompts and seeds in one batch")
+	flag.BoolVar(&config.ResultCache.Enabled, "result-cache", config.ResultCache.Enabled, "serve the repeated generations with a fixed seed from the cache")
+	flag.Var((*stringList)(&config.ResultCache.Paths), "result-cache-paths", "the comma separated generation paths whose results are cached")
+	flag.DurationVar(&config.ResultCache.TTL, "result-cache-ttl", config.ResultCache.TTL, "the time to live of the cached results, 0 means forever")
+	flag.Int64Var(&config.ResultCache.MaxBytes, "result-cache-max-bytes", config.ResultCache.MaxBytes, "the size bound of the in-memory result cache")
+	flag.StringVar(&config.ResultCache.Backing, "result-cache-backing", config.ResultCache.Backing, "where the cached results are kept, memory or datastore")
+	flag.BoolVar(&config.MetadataCache.Enabled, "metadata-cache", config.MetadataCache.Enabled, "coalesce and cache the metadata GETs per backend pool")
+	flag.Var((*stringList)(&config.MetadataCache.Paths), "metadata-cache-paths", "the comma separated GET paths which are coalesced and cached")
+	flag.DurationVar(&config.MetadataCache.TTL, "metadata-cache-ttl", config.MetadataCache.TTL, "the time a cached metadata result is fresh")
+	flag.DurationVar(&config.MetadataCache.MaxStale, "metadata-cache-max-stale", config.MetadataCache.MaxStale, "the max time a stale metadata result is served while it is refreshed")
+	flag.BoolVar(&config.Aggregation.Enabled, "aggregation", config.Aggregation.Enabled, "answer the listing endpoints with the union of all the backends, and route by the models the backends have")
+	flag.DurationVar(&config.Aggregation.Timeout, "aggregation-timeout", config.Aggregation.Timeout, "the timeout of the listing request to one backend")
+	flag.DurationVar(&config.Aggregation.RefreshInterval, "aggregation-refresh-interval", config.Aggregation.RefreshInterval, "the interval to refresh the model catalog for the model-aware routing")
+	flag.Var((*stringList)(&config.Broadcast.Paths), "broadcast-paths", "the comma separated paths whose non-GET requests are always sent to all the backends, the admin broadcasts any request with the X-SD-Broadcast header")
+	flag.DurationVar(&config.Broadcast.Timeout, "broadcast-timeout", config.Broadcast.Timeout, "the timeout of the broadcast request to one backend")
+	flag.DurationVar(&config.Reconciler.Interval, "reconcile-interval", config.Reconciler.Interval, "the interval to check the backend options against the pool profiles, 0 disables the periodic checking")
+	flag.DurationVar(&config.Reconciler.Timeout, "reconcile-timeout", config.Reconciler.Timeout, "the timeout of the options request to one backend")
+	flag.StringVar(&config.Mirror.Pool, "mirror-pool", config.Mirror.Pool, "the shadow pool which receives a copy of the sampled requests, empty disables the mirroring")
+	flag.Float64Var(&config.Mirror.Percentage, "mirror-percentage", config.Mirror.Percentage, "the percentage of the matching requests which are mirrored")
+	flag.Var((*stringList)(&config.Mirror.Paths), "mirror-paths", "the comma separated POST paths which are mirrored")
+	flag.DurationVar(&config.Mirror.Timeout, "mirror-timeout", config.Mirror.Timeout, "the timeout of the mirrored request")
+	flag.Int64Var(&config.Mirror.MaxInFlight, "mirror-max-in-flight", config.Mirror.MaxInFlight, "the max number of in-flight mirrored requests")
+	flag.DurationVar(&config.Mirror.Retention, "mirror-retention", config.Mirror.Retention, "the time the results of the mirrored requests are kept, 0 keeps them forever")
+	flag.Var((*stringList)(&config.Jobs.Endpoints), "job-endpoints", "the comma separated sdapi paths which can be run as asynchronous jobs")
+	flag.DurationVar(&config.Jobs.ProgressInterval, "job-progress-interval", config.Jobs.ProgressInterval, "the interval to poll the progress and the cancellation of a running job")
+	flag.DurationVar(&config.Jobs.Timeout, "job-timeout", config.Jobs.Timeout, "the max time of an asynchronous job, including the time in the queue")
+	flag.Int64Var(&config.Jobs.MaxAttempts, "job-max-attempts", config.Jobs.MaxAttempts, "the asynchronous job is moved to the dead-letter table after the attempts")
+	flag.DurationVar(&config.Jobs.VisibilityTimeout, "job-visibility-timeout", config.Jobs.VisibilityTimeout, "the lease of a job expires unless it is renewed within the time, then the job is run again")
+	flag.DurationVar(&config.Jobs.PollInterval, "job-poll-interval", config.Jobs.PollInterval, "the interval to scan the job queue for the due jobs and the expired leases")
+	flag.DurationVar(&config.Jobs.BackoffBase, "job-backoff-base", config.Jobs.BackoffBase, "the base of the exponential backoff between the attempts of a job")
+	flag.DurationVar(&config.Jobs.BackoffMax, "job-backoff-max", config.Jobs.BackoffMax, "the upper bound of the backoff between the attempts of a job")
+	flag.IntVar(&config.Jobs.MaxConcurrency, "job-max-concurrency", config.Jobs.MaxConcurrency, "the max number of the asynchronous jobs run by this proxy replica at the same time")
+	flag.DurationVar(&config.Jobs.Retention, "job-retention", config.Jobs.Retention, "the finished asynchronous jobs are purged after the time, 0 keeps them forever")
+	flag.IntVar(&config.Jobs.MaxPipelineSteps, "pipeline-max-steps", config.Jobs.MaxPipelineSteps, "the max number of the steps of a generation pipeline")
+	flag.DurationVar(&config.Webhooks.Timeout, "webhook-timeout", config.Webhooks.Timeout, "the timeout of one webhook delivery attempt")
+	flag.Int64Var(&config.Webhooks.MaxAttempts, "webhook-max-attempts", config.Webhooks.MaxAttempts, "the webhook delivery fails after the attempts")
+	flag.DurationVar(&config.Webhooks.BackoffBase, "webhook-backoff-base", config.Webhooks.BackoffBase, "the base of the exponential backoff between the webhook delivery attempts")
+	flag.DurationVar(&config.Webhooks.BackoffMax, "webhook-backoff-max", config.Webhooks.BackoffMax, "the upper bound of the backoff between the webhook delivery attempts")
+	flag.DurationVar(&config.Webhooks.Interval, "webhook-retry-interval", config.Webhooks.Interval, "the interval to scan the webhook retry queue for the due deliveries")
+	flag.DurationVar(&config.Webhooks.Retention, "webhook-retention", config.Webhooks.Retention, "the finished webhook deliveries are purged after the time, 0 keeps them forever")
+	flag.StringVar(&config.Webhooks.BaseUrl, "webhook-base-url", config.Webhooks.BaseUrl, "the public url of the proxy in the job urls of the webhook events, the urls are relative if it is empty")
+	flag.DurationVar(&config.TaskEvents.PollInterval, "task-events-poll-interval", config.TaskEvents.PollInterval, "the interval to read the progress of a task watched by the event streams")
+	flag.DurationVar(&config.TaskEvents.Heartbeat, "task-events-heartbeat", config.TaskEvents.Heartbeat, "the interval of the keep-alive comments of the event streams")
+	flag.DurationVar(&config.TaskEvents.Timeout, "task-events-timeout", config.TaskEvents.Timeout, "the max duration of one event stream, the client resumes it with Last-Event-ID")
+	flag.Var((*stringMap)(&config.OpenAI.Models), "openai-models", "the comma separated model=checkpoint of the OpenAI-compatible Images API")
+	flag.StringVar(&config.OpenAI.DefaultModel, "openai-default-model", config.OpenAI.DefaultModel, "the model of the OpenAI image requests without a model")
+	flag.IntVar(&config.OpenAI.MaxImages, "openai-max-images", config.OpenAI.MaxImages, "the max number of images of one OpenAI image request")
+	flag.DurationVar(&config.OpenAI.ImageTTL, "openai-image-ttl", config.OpenAI.ImageTTL, "the time the generated images are served by url, 0 means forever")
+	flag.StringVar(&config.OpenAI.BaseUrl, "openai-base-url", config.OpenAI.BaseUrl, "the public url of the proxy in the image urls, the url response format is rejected if it is empty")
+	flag.BoolVar(&config.InterruptOnDisconnect, "interrupt-on-disconnect", config.InterruptOnDisconnect, "interrupt the generation on the backend when its client is gone")
+	flag.BoolVar(&config.Async.Enabled, "async", config.Async.Enabled, "run the long sdapi requests as background tasks on the agents, to survive the gateway timeouts in front of the agents")
+	flag.Var((*stringList)(&config.Async.Paths), "async-paths", "the comma separated POST paths which are run as background tasks on the agents")
+	flag.DurationVar(&config.Async.PollWait, "async-poll-wait", config.Async.PollWait, "the wait of one long-poll for the background task, must be shorter than the gateway timeout in front of the agents")
+	flag.DurationVar(&config.Async.Heartbeat, "async-heartbeat", config.Async.Heartbeat, "the interval of the whitespace heartbeats to the clients which opt in with X-SD-Heartbeat: true while the background task is running")
+	flag.DurationVar(&config.Async.Timeout, "async-timeout", config.Async.Timeout, "the max time to wait for a background task")
+	flag.Var((*stringList)(&config.Idempotency.Paths), "idempotency-paths", "the comma separated POST paths which honour the Idempotency-Key header")
+	flag.DurationVar(&config.Idempotency.TTL, "idempotency-ttl", config.Idempotency.TTL, "the time the response is replayed for an idempotency key")
+	flag.DurationVar(&config.Idempotency.PendingTimeout, "idempotency-pending-timeout", config.Idempotency.PendingTimeout, "the lease of the first request with an idempotency key, renewed while it is served, after which a retry takes over the key")
+	flag.StringVar(&config.Webhooks.DefaultSecret, "webhook-default-secret", config.Webhooks.DefaultSecret, "the secret to sign the webhooks of the tenants not in the webhook secrets file, the callback_url is rejected for them if empty")
+	flag.BoolVar(&config.Webhooks.AllowPrivate, "webhook-allow-private", config.Webhooks.AllowPrivate, "allow the webhooks to the loopback, private and link-local addresses")
+	webhookSecretsFile := flag.String("webhook-secrets-file", "", "the json file which maps the tenants to the secrets to sign their webhooks")
+	apiKeysFile := flag.String("api-keys-file", "", "the json file which maps the API keys to {\"tenant\": ..., \"class\": ...}")
+	flag.StringVar(&config.AdminToken, "admin-token", config.AdminToken, "the bearer token to access the admin API, the admin API is disabled if it is empty")
+	flag.StringVar(&config.SessionSecret, "session-secret", config.SessionSecret, "the key to sign the session affinity cookie, must be the same among proxy replicas")
+	flag.DurationVar(&config.SessionTTL, "session-ttl", config.SessionTTL, "the idle time after which the session to backend mapping is purged, 0 keeps the mappings forever")
+
 	flag.Parse()
 
 	if *port == 0 {
@@ -21,10 +209,29 @@ func main() {
 	if *sqliteFile == "" {
 		panic("invalid datastore")
 	}
+	if *apiKeysFile != "" {
+		data, err := os.ReadFile(*apiKeysFile)
+		if err != nil {
+			panic(fmt.Errorf("read api keys file failed: %v", err))
+		}
+		if err := json.Unmarshal(data, &config.APIKeys); err != nil {
+			panic(fmt.Errorf("parse api keys file failed: %v", err))
+		}
+	}
+
+	if *webhookSecretsFile != "" {
+		data, err := os.ReadFile(*webhookSecretsFile)
+		if err != nil {
+			panic(fmt.Errorf("read webhook secrets file failed: %v", err))
+		}
+		if err := json.Unmarshal(data, &config.Webhooks.Secrets); err != nil {
+			panic(fmt.Errorf("parse webhook secrets file failed: %v", err))
+		}
+	}
 
 	fmt.Printf("target: %s, port: %d, sqlite file: %s\n", *target, *port, *sqliteFile)
 	// TODO: Make dbType configurable.
-	s := proxy.NewServer(*target, datastore.SQLite, *sqliteFile)
+	s := proxy.NewServer(*target, datastore.SQLite, *sqliteFile, config)
 
 	s.Echo.Logger.Fatal(s.Start(fmt.Sprintf("0.0.0.0:%d", *port)))
 }
@@ -12,6 +12,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -26,12 +27,19 @@ type Agent struct {
 	Proxy                 *httputil.ReverseProxy  // the underlying reverse proxy
 	TaskProgressDatastore *datastore.TaskProgress // the datastore to store the task progress states
 	HttpClient            *http.Client            // the http client
+	InterruptGrace        time.Duration           // the time to wait before interrupting the task whose client is gone
+	AsyncRetention        time.Duration           // the time the response of a background sdapi call is kept after it is ready
+
+	interrupts sync.Map // the task id to its *pendingInterrupt
+	asyncTasks sync.Map // the task id to its *asyncTask
 }
 
 func NewAgent(targetStr string, dbType datastore.DatastoreType, dbName string) *Agent {
 	a := &Agent{
-		Echo:       echo.New(),
-		HttpClient: &http.Client{},
+		Echo:           echo.New(),
+		HttpClient:     &http.Client{},
+		InterruptGrace: 5 * time.Second,
+		AsyncRetention: 10 * time.Minute,
 	}
 	tpds, err := datastore.NewTaskProgress(dbType, dbName)
 	if err != nil {
@@ -44,10 +52,13 @@ func NewAgent(targetStr string, dbType datastore.DatastoreType, dbName string) *
 
 	a.Echo.Use(middleware.Logger())
 	a.Echo.Use(middleware.Recover())
+	a.Echo.Use(a.asyncMiddleware)
 
 	a.Proxy = httputil.NewSingleHostReverseProxy(a.Target)
 
 	a.Echo.GET("/queue/join", a.queueJoinHandler)
+	a.Echo.POST("/internal/interrupt", a.interruptHandler)
+	a.Echo.GET("/internal/async-tasks/:id", a.asyncTaskHandler)
 
 	// Handler for all other cases.
 	a.Echo.Any("/*", func(c echo.Context) error {
@@ -105,10 +116,6 @@ func (a *Agent) updateTaskProgress(ctx context.Context, taskId string) error {
 			return err
 		}
 
-		// Update the task progress to DB.
-		a.TaskProgressDatastore.PutProgress(taskId, string(body))
-		a.Echo.Logger.Debugf("update task progress: %s", string(body))
-
 		var m map[string]interface{}
 		if err := json.Unmarshal(body, &m); err != nil {
 			return err
@@ -133,14 +140,28 @@ func (a *Agent) updateTaskProgress(ctx context.Context, taskId string) error {
 		if !ok {
 			return fmt.Errorf("wrong completed: %v", completed)
 		}
+		// Update the task progress to DB.
+		// notifyDone means the update-progress is notified by other goroutine to finish,
+		// the task is aborted if it is still not completed, unless its pending interruption is waited for.
+		state := datastore.TaskRunning
+		pi := a.pendingInterruptOf(taskId)
+		done := completed
 		if completed {
-			a.Echo.Logger.Infof("the task %s is done", taskId)
-			return nil
+			state = datastore.TaskCompleted
+		} else if notifyDone && (pi == nil || pi.resolved()) {
+			state = datastore.TaskFailed
+			done = true
 		}
-		// notifyDone means the update-progress is notified by other goroutine to finish,
-		// either because the task has been aborted or succeed.
-		if notifyDone {
-			a.Echo.Logger.Infof("the task %s is done, either success or failed", taskId)
+		if done && pi != nil && pi.resolved() && pi.cancelled {
+			state = datastore.TaskCancelled
+		}
+		if err := a.TaskProgressDatastore.PutProgressState(taskId, string(body), state); err != nil {
+			return err
+		}
+		a.Echo.Logger.Debugf("update task progress: %s", string(body))
+
+		if done {
+			a.Echo.Logger.Infof("the task %s is %s", taskId, state)
 			return nil
 		}
 
@@ -148,6 +169,17 @@ func (a *Agent) updateTaskProgress(ctx context.Context, taskId string) error {
 	}
 }
 
+// failTask mark the task failed with its last progress, so that the progress watchers stop waiting for it.
+func (a *Agent) failTask(taskId string) {
+	progress, err := a.TaskProgressDatastore.GetProgress(taskId)
+	if err == nil {
+		err = a.TaskProgressDatastore.PutProgressState(taskId, progress, datastore.TaskFailed)
+	}
+	if err != nil {
+		a.Echo.Logger.Errorf("mark task %s failed error: %v", taskId, err)
+	}
+}
+
 func (a *Agent) queueJoinHandler(c echo.Context) error {
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -173,6 +205,7 @@ func (a *Agent) queueJoinHandler(c echo.Context) error {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	var wg sync.WaitGroup
+	var launched atomic.Pointer[string] // the id of the last task launched by the client
 
 	// Create goroutine to handle client-to-server request.
 	wg.Add(1)
@@ -181,12 +214,16 @@ func (a *Agent) queueJoinHandler(c echo.Context) error {
 		for {
 			// Read message.
 			messageType, message, err := clientConn.ReadMessage()
-			if _, ok := err.(*websocket.CloseError); ok {
-				a.Echo.Logger.Infof("close the websocket connection.")
-				return
-			}
 			if err != nil {
-				a.Echo.Logger.Errorf("read from websocket client error: %v", err)
+				if _, ok := err.(*websocket.CloseError); ok {
+					a.Echo.Logger.Infof("close the websocket connection.")
+				} else {
+					a.Echo.Logger.Errorf("read from websocket client error: %v", err)
+				}
+				// The client is gone, interrupt its task if it is still running.
+				if taskId := launched.Load(); taskId != nil && !InterruptOptedOut(c.Request()) {
+					a.interruptUnfinished(*taskId)
+				}
 				return
 			}
 			a.Echo.Logger.Debugf("websocket send message: %s", string(message))
@@ -213,6 +250,7 @@ func (a *Agent) queueJoinHandler(c echo.Context) error {
 			// {"fn_index": 89, "data": ["task(yx99r25qdxzgrue)", "city, cute boy", ...], ...}
 			// {"fn_index": 94, "data": ["city, cute boy, ..."], ...}
 			if strings.HasPrefix(taskId, "task") {
+				launched.Store(&taskId)
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
@@ -220,6 +258,7 @@ func (a *Agent) queueJoinHandler(c echo.Context) error {
 					err := a.updateTaskProgress(ctx, taskId)
 					if err != nil {
 						a.Echo.Logger.Errorf("update task progress error: %v", err)
+						a.failTask(taskId)
 					}
 				}()
 			}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The client asks to run the sdapi call in the background with X-SD-Async: true. The agent returns 202 with
+// the task id in the X-SD-Async-Task header, and the client long-polls GET /internal/async-tasks/:id for the response.
+const kAsyncHeaderName = "X-SD-Async"
+const kAsyncTaskHeaderName = "X-SD-Async-Task"
+const kAsyncStatusHeaderName = "X-SD-Async-Status"
+
+// kMaxAsyncWait is the upper bound of the wait of one long-poll.
+const kMaxAsyncWait = time.Minute
+
+// asyncTask is an sdapi call run in the background.
+type asyncTask struct {
+	done   chan struct{} // closed when the response is ready
+	code   int
+	header http.Header
+	body   []byte
+}
+
+func randomTaskId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "task(" + hex.EncodeToString(b) + ")", nil
+}
+
+// asyncMiddleware run the sdapi POST call in the background if the client asks so, which lets the response
+// outlive the timeout of the gateway in front of the agent.
+func (a *Agent) asyncMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method != http.MethodPost || req.Header.Get(kAsyncHeaderName) != "true" {
+			return next(c)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		// The task id is the sd task id if the client sets one, so that the progress of the task can be queried.
+		var payload struct {
+			TaskId string `json:"force_task_id"`
+		}
+		_ = json.Unmarshal(body, &payload)
+		id := payload.TaskId
+		if id == "" {
+			if id, err = randomTaskId(); err != nil {
+				return err
+			}
+		}
+		// The task submitted again, e.g. by a retry of the client, is not run twice, the existing one is returned.
+		t := &asyncTask{done: make(chan struct{})}
+		if _, loaded := a.asyncTasks.LoadOrStore(id, t); !loaded {
+			go a.runAsync(id, t, req, body)
+		}
+
+		c.Response().Header().Set(kAsyncTaskHeaderName, id)
+		c.Response().Header().Set(kAsyncStatusHeaderName, "running")
+		c.Response().Header().Set(echo.HeaderLocation, "/internal/async-tasks/"+id)
+		return c.JSON(http.StatusAccepted, map[string]string{"task_id": id, "status": "running"})
+	}
+}
+
+// runAsync send the call to the backend regardless of the client, and keep its response for the retention time.
+func (a *Agent) runAsync(id string, t *asyncTask, req *http.Request, body []byte) {
+	defer func() {
+		close(t.done)
+		time.AfterFunc(a.AsyncRetention, func() { a.asyncTasks.Delete(id) })
+	}()
+	u := a.Target.JoinPath(req.URL.Path)
+	u.RawQuery = req.URL.RawQuery
+	r, err := http.NewRequestWithContext(context.Background(), req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		t.code, t.body = http.StatusInternalServerError, []byte(err.Error())
+		return
+	}
+	r.Header = req.Header.Clone()
+	r.Header.Del(kAsyncHeaderName)
+	resp, err := a.HttpClient.Do(r)
+	if err != nil {
+		a.Echo.Logger.Errorf("async task %s error: %v", id, err)
+		t.code, t.body = http.StatusBadGateway, []byte(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	t.body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		a.Echo.Logger.Errorf("read response of async task %s error: %v", id, err)
+		t.code, t.body = http.StatusBadGateway, []byte(err.Error())
+		return
+	}
+	t.code, t.header = resp.StatusCode, resp.Header
+}
+
+// asyncTaskHandler wait for the response of the task for up to the wait query parameter, e.g. wait=25s.
+// It returns the response of the backend once it is ready, or 202 if the task is still running.
+func (a *Agent) asyncTaskHandler(c echo.Context) error {
+	id := c.Param("id")
+	v, ok := a.asyncTasks.Load(id)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "async task does not exist")
+	}
+	t := v.(*asyncTask)
+	wait, err := time.ParseDuration(c.QueryParam("wait"))
+	if err != nil || wait > kMaxAsyncWait {
+		wait = kMaxAsyncWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+	case <-timer.C:
+		c.Response().Header().Set(kAsyncStatusHeaderName, "running")
+		return c.JSON(http.StatusAccepted, map[string]string{"task_id": id, "status": "running"})
+	case <-c.Request().Context().Done():
+		return nil
+	}
+	c.Response().Header().Set(kAsyncStatusHeaderName, "done")
+	contentType := "text/plain; charset=UTF-8"
+	if t.header != nil && t.header.Get(echo.HeaderContentType) != "" {
+		contentType = t.header.Get(echo.HeaderContentType)
+	}
+	return c.Blob(t.code, contentType, t.body)
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncTask(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		require.Empty(t, r.Header.Get(kAsyncHeaderName))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"detail": "invalid sampler"}`))
+	}))
+	defer backend.Close()
+
+	a := NewAgent(backend.URL, datastore.SQLite, ":memory:")
+	defer a.Close()
+
+	poll := func(id string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/internal/async-tasks/"+id+"?wait=10ms", nil))
+		return rec
+	}
+
+	t.Run("Test run the call in the background", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img", strings.NewReader(`{"prompt": "cat", "force_task_id": "task1"}`))
+		req.Header.Set(kAsyncHeaderName, "true")
+		a.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		require.Equal(t, "task1", rec.Header().Get(kAsyncTaskHeaderName))
+		var body map[string]string
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		require.Equal(t, "task1", body["task_id"])
+
+		rec = poll("task1")
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		require.Equal(t, "running", rec.Header().Get(kAsyncStatusHeaderName))
+
+		// The task submitted again is returned instead of run twice.
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img", strings.NewReader(`{"prompt": "cat", "force_task_id": "task1"}`))
+		req.Header.Set(kAsyncHeaderName, "true")
+		a.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		require.Equal(t, "task1", rec.Header().Get(kAsyncTaskHeaderName))
+
+		close(release)
+		rec = httptest.NewRecorder()
+		a.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/internal/async-tasks/task1?wait=5s", nil))
+		require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		require.Equal(t, "done", rec.Header().Get(kAsyncStatusHeaderName))
+		require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		require.JSONEq(t, `{"detail": "invalid sampler"}`, rec.Body.String())
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Test the unknown task", func(t *testing.T) {
+		rec := poll("task2")
+		require.Equal(t, http.StatusNotFound, rec.Code)
+		require.Empty(t, rec.Header().Get(kAsyncStatusHeaderName))
+	})
+}
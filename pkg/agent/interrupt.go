@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+// The client opts out of the interruption on disconnect with "false" in the header or the query parameter.
+// They are shared with the proxy, which interrupts the tasks of its disconnected clients through the agent.
+const InterruptHeaderName = "X-SD-Interrupt-On-Disconnect"
+const InterruptQueryName = "interrupt_on_disconnect"
+
+// kInterruptSkipProgress is the progress from which the task is left to finish instead of interrupted.
+const kInterruptSkipProgress = 0.95
+
+// kInterruptRetention is how long the result of an interruption is kept for the progress updater of the task.
+const kInterruptRetention = 10 * time.Minute
+
+// InterruptOptedOut report whether the client keeps its task running after it disconnects.
+func InterruptOptedOut(req *http.Request) bool {
+	v := req.Header.Get(InterruptHeaderName)
+	if v == "" {
+		v = req.URL.Query().Get(InterruptQueryName)
+	}
+	return v == "false" || v == "0"
+}
+
+// pendingInterrupt is the interruption of a task whose client is gone.
+type pendingInterrupt struct {
+	done      chan struct{} // closed when the interruption is resolved
+	cancelled bool          // whether the task is interrupted, valid after done is closed
+}
+
+func (pi *pendingInterrupt) resolved() bool {
+	select {
+	case <-pi.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// interruptUnfinished interrupt the task unless it is already finished.
+func (a *Agent) interruptUnfinished(taskId string) {
+	state, err := a.TaskProgressDatastore.GetProgressState(taskId)
+	if err != nil {
+		a.Echo.Logger.Errorf("get progress state of task %s error: %v", taskId, err)
+	}
+	if state != nil && state.Done() {
+		return
+	}
+	a.interruptTask(taskId, a.InterruptGrace)
+}
+
+// interruptTask interrupt the task on the backend after the grace, if the task is still the running one then,
+// and record the task as cancelled. It is a no-op if the task is already being interrupted.
+//
+// The backend interrupts whatever task is running, not a task by its id. So if the task finishes between the
+// progress check and the interrupt, the next task is interrupted instead. The window is short, and the task
+// close to done is left to finish to make the race unlikely, but it is not closed.
+func (a *Agent) interruptTask(taskId string, grace time.Duration) *pendingInterrupt {
+	pi := &pendingInterrupt{done: make(chan struct{})}
+	if actual, loaded := a.interrupts.LoadOrStore(taskId, pi); loaded {
+		return actual.(*pendingInterrupt)
+	}
+	time.AfterFunc(kInterruptRetention, func() { a.interrupts.Delete(taskId) })
+	go func() {
+		defer close(pi.done)
+		time.Sleep(grace)
+		active, fraction, progress, err := a.taskActive(taskId)
+		if err != nil {
+			a.Echo.Logger.Errorf("get progress of task %s error: %v", taskId, err)
+			return
+		}
+		if !active {
+			a.Echo.Logger.Infof("the task %s is not running after its client is gone", taskId)
+			return
+		}
+		if fraction >= kInterruptSkipProgress {
+			a.Echo.Logger.Infof("the task %s is left to finish since it is %.0f%% done", taskId, fraction*100)
+			return
+		}
+		if err := a.interruptBackend(); err != nil {
+			a.Echo.Logger.Errorf("interrupt task %s error: %v", taskId, err)
+			return
+		}
+		pi.cancelled = true
+		a.Echo.Logger.Infof("the task %s is interrupted since its client is gone", taskId)
+		if err := a.TaskProgressDatastore.PutProgressState(taskId, progress, datastore.TaskCancelled); err != nil {
+			a.Echo.Logger.Errorf("mark task %s cancelled error: %v", taskId, err)
+		}
+	}()
+	return pi
+}
+
+// pendingInterruptOf return the interruption of the task, or nil if its client is not gone.
+func (a *Agent) pendingInterruptOf(taskId string) *pendingInterrupt {
+	if pi, ok := a.interrupts.Load(taskId); ok {
+		return pi.(*pendingInterrupt)
+	}
+	return nil
+}
+
+// taskActive report whether the task is the one running on the backend, and return its progress fraction
+// and its progress.
+func (a *Agent) taskActive(taskId string) (bool, float64, string, error) {
+	progressUrl, err := url.JoinPath(a.Target.String(), "/internal/progress")
+	if err != nil {
+		return false, 0, "", err
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{"id_task": taskId, "id_live_preview": -1})
+	if err != nil {
+		return false, 0, "", err
+	}
+	resp, err := a.HttpClient.Post(progressUrl, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return false, 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, 0, "", err
+	}
+	var m struct {
+		Active   bool    `json:"active"`
+		Progress float64 `json:"progress"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return false, 0, "", err
+	}
+	return m.Active, m.Progress, string(body), nil
+}
+
+// interruptBackend stop the generation running on the backend.
+func (a *Agent) interruptBackend() error {
+	interruptUrl, err := url.JoinPath(a.Target.String(), "/sdapi/v1/interrupt")
+	if err != nil {
+		return err
+	}
+	resp, err := a.HttpClient.Post(interruptUrl, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("interrupt returns status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// interruptHandler interrupt the task whose client is gone, e.g. the proxy reports the disconnected clients
+// of the generation requests with {"id_task": "..."}, and the tasks which miss their deadline with "immediate": true.
+func (a *Agent) interruptHandler(c echo.Context) error {
+	var body struct {
+		TaskId    string `json:"id_task"`
+		Immediate bool   `json:"immediate"` // skip the grace, e.g. the task has missed its deadline
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.TaskId == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id_task is required")
+	}
+	grace := a.InterruptGrace
+	if body.Immediate {
+		grace = 0
+	}
+	a.interruptTask(body.TaskId, grace)
+	return c.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterruptTask(t *testing.T) {
+	var interrupts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/progress":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			// All the tasks except task2 are running on the backend, and task4 is almost done.
+			active := body["id_task"] != "task2"
+			progress := 0.5
+			if body["id_task"] == "task4" {
+				progress = 0.99
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": active, "completed": !active, "progress": progress})
+		case "/sdapi/v1/interrupt":
+			interrupts.Add(1)
+		}
+	}))
+	defer backend.Close()
+
+	a := NewAgent(backend.URL, datastore.SQLite, ":memory:")
+	defer a.Close()
+	a.InterruptGrace = 10 * time.Millisecond
+
+	interrupt := func(taskId string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/internal/interrupt", strings.NewReader(`{"id_task": "`+taskId+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		a.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+	}
+
+	t.Run("Test interrupt the running task", func(t *testing.T) {
+		interrupt("task1")
+		// The repeated report is ignored.
+		interrupt("task1")
+		pi := a.pendingInterruptOf("task1")
+		require.NotNil(t, pi)
+		<-pi.done
+		require.True(t, pi.cancelled)
+		require.Equal(t, int32(1), interrupts.Load())
+		state, err := a.TaskProgressDatastore.GetProgressState("task1")
+		require.NoError(t, err)
+		require.Equal(t, datastore.TaskCancelled, state.State)
+	})
+
+	t.Run("Test the task which is not running is not interrupted", func(t *testing.T) {
+		interrupt("task2")
+		pi := a.pendingInterruptOf("task2")
+		<-pi.done
+		require.False(t, pi.cancelled)
+		require.Equal(t, int32(1), interrupts.Load())
+		state, err := a.TaskProgressDatastore.GetProgressState("task2")
+		require.NoError(t, err)
+		require.Nil(t, state)
+	})
+
+	t.Run("Test the task close to done is left to finish", func(t *testing.T) {
+		interrupt("task4")
+		pi := a.pendingInterruptOf("task4")
+		<-pi.done
+		require.False(t, pi.cancelled)
+		require.Equal(t, int32(1), interrupts.Load())
+	})
+
+	t.Run("Test immediate interruption skips the grace", func(t *testing.T) {
+		a.InterruptGrace = time.Hour
+		defer func() { a.InterruptGrace = 10 * time.Millisecond }()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/internal/interrupt", strings.NewReader(`{"id_task": "task3", "immediate": true}`))
+		req.Header.Set("Content-Type", "application/json")
+		a.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		select {
+		case <-a.pendingInterruptOf("task3").done:
+		case <-time.After(time.Second):
+			require.Fail(t, "the task is not interrupted at once")
+		}
+		require.Equal(t, int32(2), interrupts.Load())
+	})
+
+	t.Run("Test opt out of the interruption", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/queue/join?interrupt_on_disconnect=false", nil)
+		require.True(t, InterruptOptedOut(req))
+		req = httptest.NewRequest(http.MethodGet, "/queue/join", nil)
+		require.False(t, InterruptOptedOut(req))
+	})
+}
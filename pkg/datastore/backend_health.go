@@ -0,0 +1,120 @@
+package datastore
+
+import "fmt"
+
+const kBackendHealthTableName = "backend_health"
+const kBackendHealthServiceNameColumnName = "SERVICE_NAME"
+const kBackendHealthHealthyColumnName = "HEALTHY"
+const kBackendHealthEjectionsColumnName = "EJECTIONS"
+const kBackendHealthEjectedUntilColumnName = "EJECTED_UNTIL"
+const kBackendHealthLastErrorColumnName = "LAST_ERROR"
+const kBackendHealthUpdatedAtColumnName = "UPDATED_AT"
+
+// BackendHealthState is the health state of a backend service observed by a proxy.
+type BackendHealthState struct {
+	ServiceName  string `json:"service_name"`
+	Healthy      bool   `json:"healthy"`
+	Ejections    int64  `json:"ejections"`     // the number of consecutive ejections
+	EjectedUntil int64  `json:"ejected_until"` // the unix time in milliseconds until which the service is ejected
+	LastError    string `json:"last_error"`    // the last probe or request error
+	UpdatedAt    int64  `json:"updated_at"`    // the unix time in milliseconds of the last update
+}
+
+// BackendHealth read/write the backend services' health states, so that all the proxy replicas share them.
+type BackendHealth struct {
+	ds Datastore
+}
+
+// NewBackendHealth create the backend health datastore.
+func NewBackendHealth(dbType DatastoreType, dbName string) (*BackendHealth, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kBackendHealthTableName,
+		ColumnConfig: map[string]string{
+			kBackendHealthServiceNameColumnName:  "text primary key not null",
+			kBackendHealthHealthyColumnName:      "int",
+			kBackendHealthEjectionsColumnName:    "int",
+			kBackendHealthEjectedUntilColumnName: "int",
+			kBackendHealthLastErrorColumnName:    "text",
+			kBackendHealthUpdatedAtColumnName:    "int",
+		},
+		PrimaryKeyColumnName: kBackendHealthServiceNameColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	b := &BackendHealth{
+		ds: ds,
+	}
+	return b, nil
+}
+
+// Close close the underlying datastore.
+func (b *BackendHealth) Close() error {
+	return b.ds.Close()
+}
+
+// PutHealth persist the health state of the service.
+func (b *BackendHealth) PutHealth(state *BackendHealthState) error {
+	if state.ServiceName == "" {
+		return fmt.Errorf("service name cannot be empty")
+	}
+	err := b.ds.Put(state.ServiceName, map[string]interface{}{
+		kBackendHealthHealthyColumnName:      fromBool(state.Healthy),
+		kBackendHealthEjectionsColumnName:    state.Ejections,
+		kBackendHealthEjectedUntilColumnName: state.EjectedUntil,
+		kBackendHealthLastErrorColumnName:    state.LastError,
+		kBackendHealthUpdatedAtColumnName:    state.UpdatedAt,
+	})
+	return err
+}
+
+// GetHealth get the health state of the service. It returns nil if the state does not exist.
+func (b *BackendHealth) GetHealth(serviceName string) (*BackendHealthState, error) {
+	result, err := b.ds.Get(serviceName, []string{
+		kBackendHealthHealthyColumnName,
+		kBackendHealthEjectionsColumnName,
+		kBackendHealthEjectedUntilColumnName,
+		kBackendHealthLastErrorColumnName,
+		kBackendHealthUpdatedAtColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return toBackendHealthState(serviceName, result), nil
+}
+
+// ListAllHealth return the health states of all the services.
+func (b *BackendHealth) ListAllHealth() ([]BackendHealthState, error) {
+	result, err := b.ds.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	var ret []BackendHealthState
+	for k, v := range result {
+		ret = append(ret, *toBackendHealthState(k, v))
+	}
+	return ret, nil
+}
+
+// DeleteHealth remove the health state of the service.
+func (b *BackendHealth) DeleteHealth(serviceName string) error {
+	return b.ds.Delete(serviceName)
+}
+
+func toBackendHealthState(serviceName string, m map[string]interface{}) *BackendHealthState {
+	return &BackendHealthState{
+		ServiceName:  serviceName,
+		Healthy:      toBool(m[kBackendHealthHealthyColumnName]),
+		Ejections:    toInt64(m[kBackendHealthEjectionsColumnName]),
+		EjectedUntil: toInt64(m[kBackendHealthEjectedUntilColumnName]),
+		LastError:    toString(m[kBackendHealthLastErrorColumnName]),
+		UpdatedAt:    toInt64(m[kBackendHealthUpdatedAtColumnName]),
+	}
+}
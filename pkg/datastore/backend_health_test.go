@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackendHealth(t *testing.T) {
+	t.Run("Test PutHealth and GetHealth", func(t *testing.T) {
+		ds, err := NewBackendHealth(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		state := &BackendHealthState{
+			ServiceName:  "service1",
+			Healthy:      false,
+			Ejections:    2,
+			EjectedUntil: 1000,
+			LastError:    "connection refused",
+			UpdatedAt:    900,
+		}
+		err = ds.PutHealth(state)
+		require.NoError(t, err)
+
+		result, err := ds.GetHealth("service1")
+		require.NoError(t, err)
+		require.Equal(t, state, result)
+
+		// Test get a non-exist service
+		result, err = ds.GetHealth("non_exist_service")
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		// Test put with empty service name
+		err = ds.PutHealth(&BackendHealthState{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test ListAllHealth and DeleteHealth", func(t *testing.T) {
+		ds, err := NewBackendHealth(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		for _, name := range []string{"service1", "service2"} {
+			err = ds.PutHealth(&BackendHealthState{ServiceName: name, Healthy: true})
+			require.NoError(t, err)
+		}
+		result, err := ds.ListAllHealth()
+		require.NoError(t, err)
+		require.Equal(t, 2, len(result))
+		for _, state := range result {
+			require.True(t, state.Healthy)
+		}
+
+		err = ds.DeleteHealth("service1")
+		require.NoError(t, err)
+		result, err = ds.ListAllHealth()
+		require.NoError(t, err)
+		require.Equal(t, 1, len(result))
+		require.Equal(t, "service2", result[0].ServiceName)
+	})
+}
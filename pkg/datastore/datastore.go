@@ -31,6 +31,15 @@ type Datastore interface {
 	// If the key does not exist, the returned map and error are both nil.
 	Get(key string, columns []string) (map[string]interface{}, error)
 
+	// PutIfAbsent inserts the column values only if the key does not exist.
+	// It reports whether the values are inserted.
+	PutIfAbsent(key string, values map[string]interface{}) (bool, error)
+
+	// CompareAndPut updates the column values only if the current value of the compared column equals the expected value,
+	// which lets the writers detect the concurrent updates. A NULL column equals the zero value of its type.
+	// It reports whether the values are updated, it returns false if the key does not exist.
+	CompareAndPut(key string, column string, expected interface{}, values map[string]interface{}) (bool, error)
+
 	//Put(key string, value string) error
 	//Get(key string) (string, error)
 
@@ -44,6 +53,18 @@ type Datastore interface {
 	// Note: since it reads all data and store them in memory, so do not call this function on a large datastore.
 	ListAll() (map[string]map[string]interface{}, error)
 
+	// ListWhere read the given columns of the rows whose column equals one of the values,
+	// so that the callers can scan a large datastore without reading the large columns.
+	// It returns the same nested map as ListAll.
+	ListWhere(columns []string, column string, values []interface{}) (map[string]map[string]interface{}, error)
+
+	// DeleteBefore removes the rows whose int column is set, i.e. neither NULL nor 0, and no larger than the bound,
+	// e.g. the rows whose expiry time has passed. It returns the number of the removed rows.
+	DeleteBefore(column string, bound int64) (int64, error)
+
+	// DeleteAll removes all the rows in one statement, and returns the number of the removed rows.
+	DeleteAll() (int64, error)
+
 	// Close close the datastore.
 	Close() error
 }
@@ -0,0 +1,167 @@
+package datastore
+
+import "fmt"
+
+const kIdempotencyKeysTableName = "idempotency_keys"
+const kIdempotencyKeyColumnName = "IDEMPOTENCY_KEY"
+const kIdempotencyFingerprintColumnName = "FINGERPRINT"
+const kIdempotencyStatusColumnName = "STATUS"
+const kIdempotencyStatusCodeColumnName = "STATUS_CODE"
+const kIdempotencyContentTypeColumnName = "CONTENT_TYPE"
+const kIdempotencyBodyColumnName = "BODY"
+const kIdempotencyJobIdColumnName = "JOB_ID"
+const kIdempotencyTaskIdColumnName = "TASK_ID"
+const kIdempotencyCreatedAtColumnName = "CREATED_AT"
+const kIdempotencyExpiresAtColumnName = "EXPIRES_AT"
+
+// The statuses of the idempotent requests.
+const (
+	IdempotencyPending   = "pending"   // the first request with the key is being served
+	IdempotencyCompleted = "completed" // the response is recorded to be replayed
+	IdempotencyTruncated = "truncated" // the request is served, but its response is too large or not delivered to be recorded
+)
+
+// IdempotencyRecord is the recorded request and response of an idempotency key.
+type IdempotencyRecord struct {
+	Key         string // the idempotency key scoped by the tenant
+	Fingerprint string // the hash of the request, a reused key with a different request is rejected
+	Status      string
+	StatusCode  int64
+	ContentType string
+	Body        string
+	JobId       string // the job submitted by the request, whose latest status is replayed
+	TaskId      string // the generation task of the request, referenced by the replay of the truncated record
+	CreatedAt   int64  // the unix time in milliseconds
+	ExpiresAt   int64  // the unix time in milliseconds after which the key can be reused
+}
+
+// IdempotencyKeys read/write the idempotency keys, so that a request retried through any proxy replica is served once.
+type IdempotencyKeys struct {
+	ds Datastore
+}
+
+// NewIdempotencyKeys create the idempotency keys datastore.
+func NewIdempotencyKeys(dbType DatastoreType, dbName string) (*IdempotencyKeys, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kIdempotencyKeysTableName,
+		ColumnConfig: map[string]string{
+			kIdempotencyKeyColumnName:         "text primary key not null",
+			kIdempotencyFingerprintColumnName: "text",
+			kIdempotencyStatusColumnName:      "text",
+			kIdempotencyStatusCodeColumnName:  "int",
+			kIdempotencyContentTypeColumnName: "text",
+			kIdempotencyBodyColumnName:        "text",
+			kIdempotencyJobIdColumnName:       "text",
+			kIdempotencyTaskIdColumnName:      "text",
+			kIdempotencyCreatedAtColumnName:   "int",
+			kIdempotencyExpiresAtColumnName:   "int",
+		},
+		PrimaryKeyColumnName: kIdempotencyKeyColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	k := &IdempotencyKeys{
+		ds: ds,
+	}
+	return k, nil
+}
+
+// Close close the underlying datastore.
+func (k *IdempotencyKeys) Close() error {
+	return k.ds.Close()
+}
+
+func idempotencyValues(r *IdempotencyRecord) map[string]interface{} {
+	return map[string]interface{}{
+		kIdempotencyFingerprintColumnName: r.Fingerprint,
+		kIdempotencyStatusColumnName:      r.Status,
+		kIdempotencyStatusCodeColumnName:  r.StatusCode,
+		kIdempotencyContentTypeColumnName: r.ContentType,
+		kIdempotencyBodyColumnName:        r.Body,
+		kIdempotencyJobIdColumnName:       r.JobId,
+		kIdempotencyTaskIdColumnName:      r.TaskId,
+		kIdempotencyCreatedAtColumnName:   r.CreatedAt,
+		kIdempotencyExpiresAtColumnName:   r.ExpiresAt,
+	}
+}
+
+// CreateRecord persist the record only if the key is not recorded, and report whether it is persisted.
+func (k *IdempotencyKeys) CreateRecord(r *IdempotencyRecord) (bool, error) {
+	if r.Key == "" {
+		return false, fmt.Errorf("idempotency key cannot be empty")
+	}
+	return k.ds.PutIfAbsent(r.Key, idempotencyValues(r))
+}
+
+// ReplaceRecord persist the record only if the recorded one still expires at expiresAt, e.g. to take over
+// an expired key, and report whether it is persisted.
+func (k *IdempotencyKeys) ReplaceRecord(r *IdempotencyRecord, expiresAt int64) (bool, error) {
+	if r.Key == "" {
+		return false, fmt.Errorf("idempotency key cannot be empty")
+	}
+	return k.ds.CompareAndPut(r.Key, kIdempotencyExpiresAtColumnName, expiresAt, idempotencyValues(r))
+}
+
+// RenewRecord extend the expiry of the record to renewed only if it still expires at expiresAt,
+// e.g. the pending record of the request in progress, and report whether it is renewed.
+func (k *IdempotencyKeys) RenewRecord(key string, expiresAt int64, renewed int64) (bool, error) {
+	return k.ds.CompareAndPut(key, kIdempotencyExpiresAtColumnName, expiresAt, map[string]interface{}{
+		kIdempotencyExpiresAtColumnName: renewed,
+	})
+}
+
+// PutRecord persist the record.
+func (k *IdempotencyKeys) PutRecord(r *IdempotencyRecord) error {
+	if r.Key == "" {
+		return fmt.Errorf("idempotency key cannot be empty")
+	}
+	return k.ds.Put(r.Key, idempotencyValues(r))
+}
+
+// GetRecord get the record of the key. It returns nil if the key is not recorded.
+func (k *IdempotencyKeys) GetRecord(key string) (*IdempotencyRecord, error) {
+	result, err := k.ds.Get(key, []string{
+		kIdempotencyFingerprintColumnName,
+		kIdempotencyStatusColumnName,
+		kIdempotencyStatusCodeColumnName,
+		kIdempotencyContentTypeColumnName,
+		kIdempotencyBodyColumnName,
+		kIdempotencyJobIdColumnName,
+		kIdempotencyTaskIdColumnName,
+		kIdempotencyCreatedAtColumnName,
+		kIdempotencyExpiresAtColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return &IdempotencyRecord{
+		Key:         key,
+		Fingerprint: toString(result[kIdempotencyFingerprintColumnName]),
+		Status:      toString(result[kIdempotencyStatusColumnName]),
+		StatusCode:  toInt64(result[kIdempotencyStatusCodeColumnName]),
+		ContentType: toString(result[kIdempotencyContentTypeColumnName]),
+		Body:        toString(result[kIdempotencyBodyColumnName]),
+		JobId:       toString(result[kIdempotencyJobIdColumnName]),
+		TaskId:      toString(result[kIdempotencyTaskIdColumnName]),
+		CreatedAt:   toInt64(result[kIdempotencyCreatedAtColumnName]),
+		ExpiresAt:   toInt64(result[kIdempotencyExpiresAtColumnName]),
+	}, nil
+}
+
+// DeleteRecord remove the record, e.g. the request failed and it can be retried with the same key.
+func (k *IdempotencyKeys) DeleteRecord(key string) error {
+	return k.ds.Delete(key)
+}
+
+// PurgeExpiredRecords remove the records expired before now, and return the number of the removed records.
+func (k *IdempotencyKeys) PurgeExpiredRecords(now int64) (int64, error) {
+	return k.ds.DeleteBefore(kIdempotencyExpiresAtColumnName, now)
+}
@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	t.Run("Test CreateRecord and GetRecord", func(t *testing.T) {
+		ds, err := NewIdempotencyKeys(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		record := &IdempotencyRecord{
+			Key:         "tenant1/key1",
+			Fingerprint: "fingerprint1",
+			Status:      IdempotencyPending,
+			CreatedAt:   1000,
+			ExpiresAt:   2000,
+		}
+		ok, err := ds.CreateRecord(record)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		// The key is recorded once.
+		ok, err = ds.CreateRecord(&IdempotencyRecord{Key: "tenant1/key1", Fingerprint: "fingerprint2"})
+		require.NoError(t, err)
+		require.False(t, ok)
+		result, err := ds.GetRecord("tenant1/key1")
+		require.NoError(t, err)
+		require.Equal(t, record, result)
+
+		// Test get a non-exist key
+		result, err = ds.GetRecord("non_exist_key")
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		// Test create with empty key
+		_, err = ds.CreateRecord(&IdempotencyRecord{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test PutRecord and DeleteRecord", func(t *testing.T) {
+		ds, err := NewIdempotencyKeys(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		record := &IdempotencyRecord{
+			Key:         "tenant1/key1",
+			Fingerprint: "fingerprint1",
+			Status:      IdempotencyCompleted,
+			StatusCode:  200,
+			ContentType: "application/json",
+			Body:        `{"images": []}`,
+			JobId:       "job1",
+			TaskId:      "task1",
+			CreatedAt:   1000,
+			ExpiresAt:   2000,
+		}
+		err = ds.PutRecord(record)
+		require.NoError(t, err)
+		result, err := ds.GetRecord("tenant1/key1")
+		require.NoError(t, err)
+		require.Equal(t, record, result)
+
+		// The failed request can be retried with the same key.
+		err = ds.DeleteRecord("tenant1/key1")
+		require.NoError(t, err)
+		ok, err := ds.CreateRecord(&IdempotencyRecord{Key: "tenant1/key1", Status: IdempotencyPending})
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		// Test put with empty key
+		err = ds.PutRecord(&IdempotencyRecord{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test ReplaceRecord", func(t *testing.T) {
+		ds, err := NewIdempotencyKeys(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		_, err = ds.CreateRecord(&IdempotencyRecord{Key: "tenant1/key1", Fingerprint: "fingerprint1", ExpiresAt: 2000})
+		require.NoError(t, err)
+
+		// The record is replaced only by the one who observes its expiration.
+		replaced := &IdempotencyRecord{Key: "tenant1/key1", Fingerprint: "fingerprint2", ExpiresAt: 3000}
+		ok, err := ds.ReplaceRecord(replaced, 1500)
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = ds.ReplaceRecord(replaced, 2000)
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = ds.ReplaceRecord(&IdempotencyRecord{Key: "tenant1/key1", Fingerprint: "fingerprint3"}, 2000)
+		require.NoError(t, err)
+		require.False(t, ok)
+		result, err := ds.GetRecord("tenant1/key1")
+		require.NoError(t, err)
+		require.Equal(t, replaced, result)
+
+		// The record without the expiry, e.g. written by hand, is replaced by the zero expiry.
+		err = ds.ds.Put("tenant1/key2", map[string]interface{}{kIdempotencyStatusColumnName: IdempotencyPending})
+		require.NoError(t, err)
+		ok, err = ds.ReplaceRecord(&IdempotencyRecord{Key: "tenant1/key2", Status: IdempotencyPending, ExpiresAt: 3000}, 0)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("Test RenewRecord", func(t *testing.T) {
+		ds, err := NewIdempotencyKeys(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		record := &IdempotencyRecord{Key: "tenant1/key1", Fingerprint: "fingerprint1", Status: IdempotencyPending, ExpiresAt: 2000}
+		_, err = ds.CreateRecord(record)
+		require.NoError(t, err)
+
+		// The record is renewed only by the one who observes its expiry.
+		ok, err := ds.RenewRecord("tenant1/key1", 1500, 3000)
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = ds.RenewRecord("tenant1/key1", 2000, 3000)
+		require.NoError(t, err)
+		require.True(t, ok)
+		result, err := ds.GetRecord("tenant1/key1")
+		require.NoError(t, err)
+		record.ExpiresAt = 3000
+		require.Equal(t, record, result)
+
+		// The removed record is not renewed.
+		require.NoError(t, ds.DeleteRecord("tenant1/key1"))
+		ok, err = ds.RenewRecord("tenant1/key1", 3000, 4000)
+		require.NoError(t, err)
+		require.False(t, ok)
+		result, err = ds.GetRecord("tenant1/key1")
+		require.NoError(t, err)
+		require.Nil(t, result)
+	})
+
+	t.Run("Test PurgeExpiredRecords", func(t *testing.T) {
+		ds, err := NewIdempotencyKeys(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutRecord(&IdempotencyRecord{Key: "tenant1/key1", ExpiresAt: 2000})
+		require.NoError(t, err)
+		err = ds.PutRecord(&IdempotencyRecord{Key: "tenant1/key2", ExpiresAt: 5000})
+		require.NoError(t, err)
+
+		n, err := ds.PurgeExpiredRecords(2000)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+		result, err := ds.GetRecord("tenant1/key1")
+		require.NoError(t, err)
+		require.Nil(t, result)
+		result, err = ds.GetRecord("tenant1/key2")
+		require.NoError(t, err)
+		require.NotNil(t, result)
+	})
+}
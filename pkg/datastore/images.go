@@ -0,0 +1,107 @@
+package datastore
+
+import "fmt"
+
+const kImagesTableName = "images"
+const kImageIdColumnName = "IMAGE_ID"
+const kImageContentTypeColumnName = "CONTENT_TYPE"
+const kImageDataColumnName = "DATA"
+const kImageTenantColumnName = "TENANT"
+const kImageCreatedAtColumnName = "CREATED_AT"
+const kImageExpiresAtColumnName = "EXPIRES_AT"
+
+// Image is a generated image served by url.
+type Image struct {
+	Id          string
+	ContentType string
+	Data        string // the base64 encoded image
+	Tenant      string
+	CreatedAt   int64 // the unix time in milliseconds
+	ExpiresAt   int64 // the unix time in milliseconds after which the image is not served, 0 means never
+}
+
+// Images read/write the generated images.
+type Images struct {
+	ds Datastore
+}
+
+// NewImages create the images datastore.
+func NewImages(dbType DatastoreType, dbName string) (*Images, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kImagesTableName,
+		ColumnConfig: map[string]string{
+			kImageIdColumnName:          "text primary key not null",
+			kImageContentTypeColumnName: "text",
+			kImageDataColumnName:        "text",
+			kImageTenantColumnName:      "text",
+			kImageCreatedAtColumnName:   "int",
+			kImageExpiresAtColumnName:   "int",
+		},
+		PrimaryKeyColumnName: kImageIdColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	i := &Images{
+		ds: ds,
+	}
+	return i, nil
+}
+
+// Close close the underlying datastore.
+func (i *Images) Close() error {
+	return i.ds.Close()
+}
+
+// PutImage persist the image.
+func (i *Images) PutImage(image *Image) error {
+	if image.Id == "" {
+		return fmt.Errorf("image id cannot be empty")
+	}
+	return i.ds.Put(image.Id, map[string]interface{}{
+		kImageContentTypeColumnName: image.ContentType,
+		kImageDataColumnName:        image.Data,
+		kImageTenantColumnName:      image.Tenant,
+		kImageCreatedAtColumnName:   image.CreatedAt,
+		kImageExpiresAtColumnName:   image.ExpiresAt,
+	})
+}
+
+// GetImage get the image. It returns nil if the image does not exist.
+func (i *Images) GetImage(id string) (*Image, error) {
+	result, err := i.ds.Get(id, []string{
+		kImageContentTypeColumnName,
+		kImageDataColumnName,
+		kImageTenantColumnName,
+		kImageCreatedAtColumnName,
+		kImageExpiresAtColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return &Image{
+		Id:          id,
+		ContentType: toString(result[kImageContentTypeColumnName]),
+		Data:        toString(result[kImageDataColumnName]),
+		Tenant:      toString(result[kImageTenantColumnName]),
+		CreatedAt:   toInt64(result[kImageCreatedAtColumnName]),
+		ExpiresAt:   toInt64(result[kImageExpiresAtColumnName]),
+	}, nil
+}
+
+// DeleteImage remove the image.
+func (i *Images) DeleteImage(id string) error {
+	return i.ds.Delete(id)
+}
+
+// PurgeExpiredImages remove the images expired before now, and return the number of the removed images.
+func (i *Images) PurgeExpiredImages(now int64) (int64, error) {
+	return i.ds.DeleteBefore(kImageExpiresAtColumnName, now)
+}
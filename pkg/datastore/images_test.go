@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImages(t *testing.T) {
+	t.Run("Test PutImage and GetImage", func(t *testing.T) {
+		ds, err := NewImages(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		image := &Image{
+			Id:          "image1",
+			ContentType: "image/png",
+			Data:        "aW1hZ2U=",
+			Tenant:      "tenant1",
+			CreatedAt:   1000,
+			ExpiresAt:   2000,
+		}
+		err = ds.PutImage(image)
+		require.NoError(t, err)
+
+		result, err := ds.GetImage("image1")
+		require.NoError(t, err)
+		require.Equal(t, image, result)
+
+		// Test get a non-exist image
+		result, err = ds.GetImage("non_exist_image")
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		// Test put with empty id
+		err = ds.PutImage(&Image{})
+		require.Error(t, err)
+
+		err = ds.DeleteImage("image1")
+		require.NoError(t, err)
+		result, err = ds.GetImage("image1")
+		require.NoError(t, err)
+		require.Nil(t, result)
+	})
+
+	t.Run("Test PurgeExpiredImages", func(t *testing.T) {
+		ds, err := NewImages(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutImage(&Image{Id: "image1", Data: "aW1hZ2U=", ExpiresAt: 2000})
+		require.NoError(t, err)
+		// The image without expiration is kept.
+		err = ds.PutImage(&Image{Id: "image2", Data: "aW1hZ2U="})
+		require.NoError(t, err)
+		err = ds.ds.Put("image3", map[string]interface{}{kImageDataColumnName: "aW1hZ2U="})
+		require.NoError(t, err)
+
+		n, err := ds.PurgeExpiredImages(1500)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), n)
+		n, err = ds.PurgeExpiredImages(2000)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+
+		result, err := ds.GetImage("image1")
+		require.NoError(t, err)
+		require.Nil(t, result)
+		for _, id := range []string{"image2", "image3"} {
+			result, err = ds.GetImage(id)
+			require.NoError(t, err)
+			require.Equal(t, &Image{Id: id, Data: "aW1hZ2U="}, result)
+		}
+	})
+}
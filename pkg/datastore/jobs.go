@@ -0,0 +1,309 @@
+package datastore
+
+import "fmt"
+
+const kJobsTableName = "jobs"
+const kDeadJobsTableName = "dead_jobs"
+const kJobIdColumnName = "JOB_ID"
+const kJobStatusColumnName = "STATUS"
+const kJobEndpointColumnName = "ENDPOINT"
+const kJobPayloadColumnName = "PAYLOAD"
+const kJobTenantColumnName = "TENANT"
+const kJobClassColumnName = "CLASS"
+const kJobBackendColumnName = "BACKEND"
+const kJobProgressColumnName = "PROGRESS"
+const kJobEtaColumnName = "ETA"
+const kJobResultColumnName = "RESULT"
+const kJobErrorColumnName = "ERROR"
+const kJobCancelRequestedColumnName = "CANCEL_REQUESTED"
+const kJobCallbackUrlColumnName = "CALLBACK_URL"
+const kJobCreatedAtColumnName = "CREATED_AT"
+const kJobUpdatedAtColumnName = "UPDATED_AT"
+const kJobVersionColumnName = "VERSION"
+const kJobAttemptsColumnName = "ATTEMPTS"
+const kJobMaxAttemptsColumnName = "MAX_ATTEMPTS"
+const kJobNextAttemptAtColumnName = "NEXT_ATTEMPT_AT"
+const kJobLeaseOwnerColumnName = "LEASE_OWNER"
+const kJobLeaseExpiresAtColumnName = "LEASE_EXPIRES_AT"
+const kJobDeadlineColumnName = "DEADLINE"
+const kJobPipelineColumnName = "PIPELINE_ID"
+const kJobExpiresAtColumnName = "EXPIRES_AT"
+
+// The job statuses.
+const (
+	JobQueued    = "queued"
+	JobLeased    = "leased" // claimed by a worker, waiting for a backend
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+	JobDead      = "dead" // failed after all the attempts, and moved to the dead-letter table
+)
+
+// Job is an asynchronous generation job.
+type Job struct {
+	Id              string  `json:"id"`
+	Status          string  `json:"status"`
+	Endpoint        string  `json:"endpoint"` // the sdapi path, e.g. /sdapi/v1/txt2img
+	Payload         string  `json:"-"`        // the serialized sdapi request
+	Tenant          string  `json:"-"`
+	Class           string  `json:"-"`
+	Backend         string  `json:"backend,omitempty"` // the backend which runs the job
+	Progress        float64 `json:"progress"`          // the progress in [0, 1]
+	Eta             float64 `json:"eta"`               // the estimated seconds to finish
+	Result          string  `json:"-"`                 // the serialized sdapi response
+	Error           string  `json:"error,omitempty"`
+	CancelRequested bool    `json:"cancel_requested"`
+	CallbackUrl     string  `json:"callback_url,omitempty"` // the url to POST the completion event to
+	CreatedAt       int64   `json:"created_at"`             // the unix time in milliseconds
+	UpdatedAt       int64   `json:"updated_at"`             // the unix time in milliseconds
+	Version         int64   `json:"-"`                      // increased by each CompareAndPutJob
+	Attempts        int64   `json:"attempts"`               // the number of the leases, including the running one
+	MaxAttempts     int64   `json:"max_attempts"`
+	NextAttemptAt   int64   `json:"-"`                  // the unix time in milliseconds before which the queued job is not leased
+	LeaseOwner      string  `json:"-"`                  // the worker which holds the lease
+	LeaseExpiresAt  int64   `json:"-"`                  // the unix time in milliseconds when the lease expires unless it is renewed
+	Deadline        int64   `json:"deadline,omitempty"` // the unix time in milliseconds by which the job must finish, 0 means no deadline
+	Pipeline        string  `json:"pipeline,omitempty"` // the pipeline which the job is a step of
+	ExpiresAt       int64   `json:"-"`                  // the unix time in milliseconds when the finished job is purged, 0 means never
+}
+
+// Done report whether the job is finished.
+func (j *Job) Done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled || j.Status == JobDead
+}
+
+// Leased report whether a worker holds the lease of the job.
+func (j *Job) Leased() bool {
+	return j.Status == JobLeased || j.Status == JobRunning
+}
+
+// Jobs read/write the asynchronous jobs, so that any proxy replica can answer the status of any job.
+type Jobs struct {
+	ds Datastore
+}
+
+// NewJobs create the jobs datastore.
+func NewJobs(dbType DatastoreType, dbName string) (*Jobs, error) {
+	return newJobs(dbType, dbName, kJobsTableName)
+}
+
+// NewDeadJobs create the dead-letter datastore of the jobs which fail after all the attempts.
+func NewDeadJobs(dbType DatastoreType, dbName string) (*Jobs, error) {
+	return newJobs(dbType, dbName, kDeadJobsTableName)
+}
+
+func newJobs(dbType DatastoreType, dbName string, tableName string) (*Jobs, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: tableName,
+		ColumnConfig: map[string]string{
+			kJobIdColumnName:              "text primary key not null",
+			kJobStatusColumnName:          "text",
+			kJobEndpointColumnName:        "text",
+			kJobPayloadColumnName:         "text",
+			kJobTenantColumnName:          "text",
+			kJobClassColumnName:           "text",
+			kJobBackendColumnName:         "text",
+			kJobProgressColumnName:        "float",
+			kJobEtaColumnName:             "float",
+			kJobResultColumnName:          "text",
+			kJobErrorColumnName:           "text",
+			kJobCancelRequestedColumnName: "int",
+			kJobCallbackUrlColumnName:     "text",
+			kJobCreatedAtColumnName:       "int",
+			kJobUpdatedAtColumnName:       "int",
+			kJobVersionColumnName:         "int",
+			kJobAttemptsColumnName:        "int",
+			kJobMaxAttemptsColumnName:     "int",
+			kJobNextAttemptAtColumnName:   "int",
+			kJobLeaseOwnerColumnName:      "text",
+			kJobLeaseExpiresAtColumnName:  "int",
+			kJobDeadlineColumnName:        "int",
+			kJobPipelineColumnName:        "text",
+			kJobExpiresAtColumnName:       "int",
+		},
+		PrimaryKeyColumnName: kJobIdColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	j := &Jobs{
+		ds: ds,
+	}
+	return j, nil
+}
+
+// Close close the underlying datastore.
+func (j *Jobs) Close() error {
+	return j.ds.Close()
+}
+
+// PutJob persist the job.
+func (j *Jobs) PutJob(job *Job) error {
+	if job.Id == "" {
+		return fmt.Errorf("job id cannot be empty")
+	}
+	return j.ds.Put(job.Id, jobValues(job))
+}
+
+// CreateJob persist the new job, it reports false and leaves the existing job as is if the id is taken.
+func (j *Jobs) CreateJob(job *Job) (bool, error) {
+	if job.Id == "" {
+		return false, fmt.Errorf("job id cannot be empty")
+	}
+	return j.ds.PutIfAbsent(job.Id, jobValues(job))
+}
+
+// CompareAndPutJob persist the job only if it is not changed since it is read, i.e. its version in the datastore
+// is still job.Version. It increases the version on success, and reports whether the job is persisted.
+func (j *Jobs) CompareAndPutJob(job *Job) (bool, error) {
+	values := jobValues(job)
+	values[kJobVersionColumnName] = job.Version + 1
+	ok, err := j.ds.CompareAndPut(job.Id, kJobVersionColumnName, job.Version, values)
+	if err != nil || !ok {
+		return false, err
+	}
+	job.Version++
+	return true, nil
+}
+
+func jobValues(job *Job) map[string]interface{} {
+	return map[string]interface{}{
+		kJobStatusColumnName:          job.Status,
+		kJobEndpointColumnName:        job.Endpoint,
+		kJobPayloadColumnName:         job.Payload,
+		kJobTenantColumnName:          job.Tenant,
+		kJobClassColumnName:           job.Class,
+		kJobBackendColumnName:         job.Backend,
+		kJobProgressColumnName:        job.Progress,
+		kJobEtaColumnName:             job.Eta,
+		kJobResultColumnName:          job.Result,
+		kJobErrorColumnName:           job.Error,
+		kJobCancelRequestedColumnName: fromBool(job.CancelRequested),
+		kJobCallbackUrlColumnName:     job.CallbackUrl,
+		kJobCreatedAtColumnName:       job.CreatedAt,
+		kJobUpdatedAtColumnName:       job.UpdatedAt,
+		kJobVersionColumnName:         job.Version,
+		kJobAttemptsColumnName:        job.Attempts,
+		kJobMaxAttemptsColumnName:     job.MaxAttempts,
+		kJobNextAttemptAtColumnName:   job.NextAttemptAt,
+		kJobLeaseOwnerColumnName:      job.LeaseOwner,
+		kJobLeaseExpiresAtColumnName:  job.LeaseExpiresAt,
+		kJobDeadlineColumnName:        job.Deadline,
+		kJobPipelineColumnName:        job.Pipeline,
+		kJobExpiresAtColumnName:       job.ExpiresAt,
+	}
+}
+
+// GetJob get the job. It returns nil if the job does not exist.
+func (j *Jobs) GetJob(id string) (*Job, error) {
+	result, err := j.ds.Get(id, []string{
+		kJobStatusColumnName,
+		kJobEndpointColumnName,
+		kJobPayloadColumnName,
+		kJobTenantColumnName,
+		kJobClassColumnName,
+		kJobBackendColumnName,
+		kJobProgressColumnName,
+		kJobEtaColumnName,
+		kJobResultColumnName,
+		kJobErrorColumnName,
+		kJobCancelRequestedColumnName,
+		kJobCallbackUrlColumnName,
+		kJobCreatedAtColumnName,
+		kJobUpdatedAtColumnName,
+		kJobVersionColumnName,
+		kJobAttemptsColumnName,
+		kJobMaxAttemptsColumnName,
+		kJobNextAttemptAtColumnName,
+		kJobLeaseOwnerColumnName,
+		kJobLeaseExpiresAtColumnName,
+		kJobDeadlineColumnName,
+		kJobPipelineColumnName,
+		kJobExpiresAtColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return toJob(id, result), nil
+}
+
+// ListAllJobs return all the jobs.
+func (j *Jobs) ListAllJobs() ([]Job, error) {
+	result, err := j.ds.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	var ret []Job
+	for k, v := range result {
+		ret = append(ret, *toJob(k, v))
+	}
+	return ret, nil
+}
+
+// ListUnfinishedJobs return the jobs which are not finished, with only the columns to schedule them,
+// i.e. the status, the endpoint, the pipeline, the creation time, the next attempt time and the lease expiry.
+func (j *Jobs) ListUnfinishedJobs() ([]Job, error) {
+	result, err := j.ds.ListWhere([]string{
+		kJobStatusColumnName,
+		kJobEndpointColumnName,
+		kJobPipelineColumnName,
+		kJobCreatedAtColumnName,
+		kJobNextAttemptAtColumnName,
+		kJobLeaseExpiresAtColumnName,
+	}, kJobStatusColumnName, []interface{}{JobQueued, JobLeased, JobRunning})
+	if err != nil {
+		return nil, err
+	}
+	var ret []Job
+	for k, v := range result {
+		ret = append(ret, *toJob(k, v))
+	}
+	return ret, nil
+}
+
+// PurgeExpiredJobs remove the finished jobs whose retention has passed, and return the number of them.
+func (j *Jobs) PurgeExpiredJobs(now int64) (int64, error) {
+	return j.ds.DeleteBefore(kJobExpiresAtColumnName, now)
+}
+
+// DeleteJob remove the job.
+func (j *Jobs) DeleteJob(id string) error {
+	return j.ds.Delete(id)
+}
+
+func toJob(id string, m map[string]interface{}) *Job {
+	return &Job{
+		Id:              id,
+		Status:          toString(m[kJobStatusColumnName]),
+		Endpoint:        toString(m[kJobEndpointColumnName]),
+		Payload:         toString(m[kJobPayloadColumnName]),
+		Tenant:          toString(m[kJobTenantColumnName]),
+		Class:           toString(m[kJobClassColumnName]),
+		Backend:         toString(m[kJobBackendColumnName]),
+		Progress:        toFloat64(m[kJobProgressColumnName]),
+		Eta:             toFloat64(m[kJobEtaColumnName]),
+		Result:          toString(m[kJobResultColumnName]),
+		Error:           toString(m[kJobErrorColumnName]),
+		CancelRequested: toBool(m[kJobCancelRequestedColumnName]),
+		CallbackUrl:     toString(m[kJobCallbackUrlColumnName]),
+		CreatedAt:       toInt64(m[kJobCreatedAtColumnName]),
+		UpdatedAt:       toInt64(m[kJobUpdatedAtColumnName]),
+		Version:         toInt64(m[kJobVersionColumnName]),
+		Attempts:        toInt64(m[kJobAttemptsColumnName]),
+		MaxAttempts:     toInt64(m[kJobMaxAttemptsColumnName]),
+		NextAttemptAt:   toInt64(m[kJobNextAttemptAtColumnName]),
+		LeaseOwner:      toString(m[kJobLeaseOwnerColumnName]),
+		LeaseExpiresAt:  toInt64(m[kJobLeaseExpiresAtColumnName]),
+		Deadline:        toInt64(m[kJobDeadlineColumnName]),
+		Pipeline:        toString(m[kJobPipelineColumnName]),
+		ExpiresAt:       toInt64(m[kJobExpiresAtColumnName]),
+	}
+}
@@ -0,0 +1,229 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobs(t *testing.T) {
+	t.Run("Test PutJob and GetJob", func(t *testing.T) {
+		ds, err := NewJobs(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		job := &Job{
+			Id:              "job1",
+			Status:          JobRunning,
+			Endpoint:        "/sdapi/v1/txt2img",
+			Payload:         `{"prompt": "cat"}`,
+			Tenant:          "tenant1",
+			Class:           "api",
+			Backend:         "s0",
+			Progress:        0.5,
+			Eta:             3.2,
+			CancelRequested: true,
+			CallbackUrl:     "http://example.com/hook",
+			CreatedAt:       1000,
+			UpdatedAt:       2000,
+			Attempts:        1,
+			MaxAttempts:     3,
+			NextAttemptAt:   1000,
+			LeaseOwner:      "worker1",
+			LeaseExpiresAt:  3000,
+			Deadline:        4000,
+			Pipeline:        "pipeline1",
+			ExpiresAt:       5000,
+		}
+		err = ds.PutJob(job)
+		require.NoError(t, err)
+
+		result, err := ds.GetJob("job1")
+		require.NoError(t, err)
+		require.Equal(t, job, result)
+		require.False(t, result.Done())
+		require.True(t, result.Leased())
+
+		// Test get a non-exist job
+		result, err = ds.GetJob("non_exist_job")
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		// Test put with empty id
+		err = ds.PutJob(&Job{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test ListAllJobs and DeleteJob", func(t *testing.T) {
+		ds, err := NewJobs(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		for _, id := range []string{"job1", "job2"} {
+			err = ds.PutJob(&Job{Id: id, Status: JobSucceeded})
+			require.NoError(t, err)
+		}
+		jobs, err := ds.ListAllJobs()
+		require.NoError(t, err)
+		require.Len(t, jobs, 2)
+
+		err = ds.DeleteJob("job2")
+		require.NoError(t, err)
+		jobs, err = ds.ListAllJobs()
+		require.NoError(t, err)
+		require.Equal(t, []Job{{Id: "job1", Status: JobSucceeded}}, jobs)
+	})
+
+	t.Run("Test ListUnfinishedJobs without the large columns", func(t *testing.T) {
+		ds, err := NewJobs(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutJob(&Job{Id: "job1", Status: JobQueued, Endpoint: "/sdapi/v1/txt2img", Payload: `{"prompt": "cat"}`, NextAttemptAt: 1000})
+		require.NoError(t, err)
+		err = ds.PutJob(&Job{Id: "job2", Status: JobRunning, Payload: `{"prompt": "dog"}`, Pipeline: "pipeline1", LeaseExpiresAt: 3000})
+		require.NoError(t, err)
+		err = ds.PutJob(&Job{Id: "job3", Status: JobSucceeded, Result: `{"images": []}`})
+		require.NoError(t, err)
+
+		jobs, err := ds.ListUnfinishedJobs()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []Job{
+			{Id: "job1", Status: JobQueued, Endpoint: "/sdapi/v1/txt2img", NextAttemptAt: 1000},
+			{Id: "job2", Status: JobRunning, Pipeline: "pipeline1", LeaseExpiresAt: 3000},
+		}, jobs)
+	})
+
+	t.Run("Test PurgeExpiredJobs", func(t *testing.T) {
+		ds, err := NewJobs(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutJob(&Job{Id: "job1", Status: JobSucceeded, ExpiresAt: 1000})
+		require.NoError(t, err)
+		err = ds.PutJob(&Job{Id: "job2", Status: JobFailed, ExpiresAt: 5000})
+		require.NoError(t, err)
+		err = ds.PutJob(&Job{Id: "job3", Status: JobFailed, ExpiresAt: 9000})
+		require.NoError(t, err)
+		// The unfinished job has no expiry, and is never purged.
+		err = ds.PutJob(&Job{Id: "job4", Status: JobQueued})
+		require.NoError(t, err)
+
+		n, err := ds.PurgeExpiredJobs(5000)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), n)
+		jobs, err := ds.ListAllJobs()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []Job{{Id: "job3", Status: JobFailed, ExpiresAt: 9000}, {Id: "job4", Status: JobQueued}}, jobs)
+	})
+
+	t.Run("Test CreateJob", func(t *testing.T) {
+		ds, err := NewJobs(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		ok, err := ds.CreateJob(&Job{Id: "job1", Status: JobQueued})
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = ds.CreateJob(&Job{Id: "job1", Status: JobFailed})
+		require.NoError(t, err)
+		require.False(t, ok)
+		result, err := ds.GetJob("job1")
+		require.NoError(t, err)
+		require.Equal(t, JobQueued, result.Status)
+	})
+
+	t.Run("Test CompareAndPutJob", func(t *testing.T) {
+		ds, err := NewJobs(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutJob(&Job{Id: "job1", Status: JobRunning})
+		require.NoError(t, err)
+		job, err := ds.GetJob("job1")
+		require.NoError(t, err)
+		stale := *job
+		job.Status = JobSucceeded
+		ok, err := ds.CompareAndPutJob(job)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, int64(1), job.Version)
+
+		stale.Status = JobFailed
+		ok, err = ds.CompareAndPutJob(&stale)
+		require.NoError(t, err)
+		require.False(t, ok)
+		result, err := ds.GetJob("job1")
+		require.NoError(t, err)
+		require.Equal(t, job, result)
+		require.True(t, result.Done())
+	})
+
+	t.Run("Test job with NULL migrated columns", func(t *testing.T) {
+		dbName := "file:TestJobsMigration?mode=memory&cache=shared"
+		// The jobs table before the retries, the webhooks, the deadlines and the pipelines.
+		old := NewSQLiteDatastore(&Config{
+			DBName:    dbName,
+			TableName: kJobsTableName,
+			ColumnConfig: map[string]string{
+				kJobIdColumnName:        "text primary key not null",
+				kJobStatusColumnName:    "text",
+				kJobEndpointColumnName:  "text",
+				kJobPayloadColumnName:   "text",
+				kJobCreatedAtColumnName: "int",
+			},
+			PrimaryKeyColumnName: kJobIdColumnName,
+		})
+		defer old.Close()
+		err := old.Put("job1", map[string]interface{}{
+			kJobStatusColumnName:    JobQueued,
+			kJobEndpointColumnName:  "/sdapi/v1/txt2img",
+			kJobPayloadColumnName:   `{"prompt": "cat"}`,
+			kJobCreatedAtColumnName: 1000,
+		})
+		require.NoError(t, err)
+
+		ds, err := NewJobs(SQLite, dbName)
+		require.NoError(t, err)
+		defer ds.Close()
+
+		expected := &Job{Id: "job1", Status: JobQueued, Endpoint: "/sdapi/v1/txt2img", Payload: `{"prompt": "cat"}`, CreatedAt: 1000}
+		result, err := ds.GetJob("job1")
+		require.NoError(t, err)
+		require.Equal(t, expected, result)
+
+		// The job without the expiry is kept.
+		n, err := ds.PurgeExpiredJobs(5000)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), n)
+
+		// The NULL version matches the zero version.
+		result.Status = JobLeased
+		ok, err := ds.CompareAndPutJob(result)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, int64(1), result.Version)
+	})
+}
+
+func TestDeadJobs(t *testing.T) {
+	t.Run("Test PutJob and GetJob", func(t *testing.T) {
+		ds, err := NewDeadJobs(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		job := &Job{Id: "job1", Status: JobDead, Attempts: 3, MaxAttempts: 3, Error: "status 502"}
+		err = ds.PutJob(job)
+		require.NoError(t, err)
+		result, err := ds.GetJob("job1")
+		require.NoError(t, err)
+		require.Equal(t, job, result)
+		require.True(t, result.Done())
+		require.False(t, result.Leased())
+
+		// The dead job is not scheduled again.
+		jobs, err := ds.ListUnfinishedJobs()
+		require.NoError(t, err)
+		require.Empty(t, jobs)
+	})
+}
@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const kMirrorResultTableName = "mirror_results"
+const kMirrorResultIdColumnName = "ID"
+const kMirrorResultPathColumnName = "PATH"
+const kMirrorResultPrimaryStatusColumnName = "PRIMARY_STATUS"
+const kMirrorResultPrimaryLatencyColumnName = "PRIMARY_LATENCY_MS"
+const kMirrorResultPrimaryImagesColumnName = "PRIMARY_IMAGE_HASHES"
+const kMirrorResultShadowBackendColumnName = "SHADOW_BACKEND"
+const kMirrorResultShadowStatusColumnName = "SHADOW_STATUS"
+const kMirrorResultShadowLatencyColumnName = "SHADOW_LATENCY_MS"
+const kMirrorResultShadowImagesColumnName = "SHADOW_IMAGE_HASHES"
+const kMirrorResultShadowErrorColumnName = "SHADOW_ERROR"
+const kMirrorResultCreatedAtColumnName = "CREATED_AT"
+
+// MirrorResult is the comparison of a production request and its copy sent to the shadow pool.
+type MirrorResult struct {
+	Id                 string   `json:"id"`
+	Path               string   `json:"path"`
+	PrimaryStatus      int64    `json:"primary_status"`
+	PrimaryLatencyMs   int64    `json:"primary_latency_ms"`
+	PrimaryImageHashes []string `json:"primary_image_hashes"`
+	ShadowBackend      string   `json:"shadow_backend"`
+	ShadowStatus       int64    `json:"shadow_status"` // 0 if the shadow request failed without response
+	ShadowLatencyMs    int64    `json:"shadow_latency_ms"`
+	ShadowImageHashes  []string `json:"shadow_image_hashes"`
+	ShadowError        string   `json:"shadow_error"`
+	CreatedAt          int64    `json:"created_at"` // the unix time in milliseconds when the request is mirrored
+}
+
+// MirrorResults read/write the results of the mirrored requests.
+type MirrorResults struct {
+	ds Datastore
+}
+
+// NewMirrorResults create the mirror results datastore.
+func NewMirrorResults(dbType DatastoreType, dbName string) (*MirrorResults, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kMirrorResultTableName,
+		ColumnConfig: map[string]string{
+			kMirrorResultIdColumnName:             "text primary key not null",
+			kMirrorResultPathColumnName:           "text",
+			kMirrorResultPrimaryStatusColumnName:  "int",
+			kMirrorResultPrimaryLatencyColumnName: "int",
+			kMirrorResultPrimaryImagesColumnName:  "text",
+			kMirrorResultShadowBackendColumnName:  "text",
+			kMirrorResultShadowStatusColumnName:   "int",
+			kMirrorResultShadowLatencyColumnName:  "int",
+			kMirrorResultShadowImagesColumnName:   "text",
+			kMirrorResultShadowErrorColumnName:    "text",
+			kMirrorResultCreatedAtColumnName:      "int",
+		},
+		PrimaryKeyColumnName: kMirrorResultIdColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	m := &MirrorResults{
+		ds: ds,
+	}
+	return m, nil
+}
+
+// Close close the underlying datastore.
+func (m *MirrorResults) Close() error {
+	return m.ds.Close()
+}
+
+// PutMirrorResult persist the result of the mirrored request.
+func (m *MirrorResults) PutMirrorResult(result *MirrorResult) error {
+	if result.Id == "" {
+		return fmt.Errorf("mirror result id cannot be empty")
+	}
+	primaryImages, err := json.Marshal(result.PrimaryImageHashes)
+	if err != nil {
+		return err
+	}
+	shadowImages, err := json.Marshal(result.ShadowImageHashes)
+	if err != nil {
+		return err
+	}
+	return m.ds.Put(result.Id, map[string]interface{}{
+		kMirrorResultPathColumnName:           result.Path,
+		kMirrorResultPrimaryStatusColumnName:  result.PrimaryStatus,
+		kMirrorResultPrimaryLatencyColumnName: result.PrimaryLatencyMs,
+		kMirrorResultPrimaryImagesColumnName:  string(primaryImages),
+		kMirrorResultShadowBackendColumnName:  result.ShadowBackend,
+		kMirrorResultShadowStatusColumnName:   result.ShadowStatus,
+		kMirrorResultShadowLatencyColumnName:  result.ShadowLatencyMs,
+		kMirrorResultShadowImagesColumnName:   string(shadowImages),
+		kMirrorResultShadowErrorColumnName:    result.ShadowError,
+		kMirrorResultCreatedAtColumnName:      result.CreatedAt,
+	})
+}
+
+// GetMirrorResult get the result of the mirrored request. It returns nil if the result does not exist.
+func (m *MirrorResults) GetMirrorResult(id string) (*MirrorResult, error) {
+	result, err := m.ds.Get(id, []string{
+		kMirrorResultPathColumnName,
+		kMirrorResultPrimaryStatusColumnName,
+		kMirrorResultPrimaryLatencyColumnName,
+		kMirrorResultPrimaryImagesColumnName,
+		kMirrorResultShadowBackendColumnName,
+		kMirrorResultShadowStatusColumnName,
+		kMirrorResultShadowLatencyColumnName,
+		kMirrorResultShadowImagesColumnName,
+		kMirrorResultShadowErrorColumnName,
+		kMirrorResultCreatedAtColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return toMirrorResult(id, result), nil
+}
+
+// ListAllMirrorResults return the results of all the mirrored requests.
+func (m *MirrorResults) ListAllMirrorResults() ([]MirrorResult, error) {
+	result, err := m.ds.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	var ret []MirrorResult
+	for k, v := range result {
+		ret = append(ret, *toMirrorResult(k, v))
+	}
+	return ret, nil
+}
+
+// DeleteMirrorResult remove the result of the mirrored request.
+func (m *MirrorResults) DeleteMirrorResult(id string) error {
+	return m.ds.Delete(id)
+}
+
+// PurgeMirrorResults remove the results mirrored at or before the time, and return the number of the removed results.
+func (m *MirrorResults) PurgeMirrorResults(before int64) (int64, error) {
+	return m.ds.DeleteBefore(kMirrorResultCreatedAtColumnName, before)
+}
+
+func toMirrorResult(id string, m map[string]interface{}) *MirrorResult {
+	result := &MirrorResult{
+		Id:               id,
+		Path:             toString(m[kMirrorResultPathColumnName]),
+		PrimaryStatus:    toInt64(m[kMirrorResultPrimaryStatusColumnName]),
+		PrimaryLatencyMs: toInt64(m[kMirrorResultPrimaryLatencyColumnName]),
+		ShadowBackend:    toString(m[kMirrorResultShadowBackendColumnName]),
+		ShadowStatus:     toInt64(m[kMirrorResultShadowStatusColumnName]),
+		ShadowLatencyMs:  toInt64(m[kMirrorResultShadowLatencyColumnName]),
+		ShadowError:      toString(m[kMirrorResultShadowErrorColumnName]),
+		CreatedAt:        toInt64(m[kMirrorResultCreatedAtColumnName]),
+	}
+	fromJSON(m[kMirrorResultPrimaryImagesColumnName], &result.PrimaryImageHashes)
+	fromJSON(m[kMirrorResultShadowImagesColumnName], &result.ShadowImageHashes)
+	return result
+}
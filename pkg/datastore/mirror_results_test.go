@@ -0,0 +1,100 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorResults(t *testing.T) {
+	t.Run("Test PutMirrorResult and GetMirrorResult", func(t *testing.T) {
+		ds, err := NewMirrorResults(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		result := &MirrorResult{
+			Id:                 "req1",
+			Path:               "/sdapi/v1/txt2img",
+			PrimaryStatus:      200,
+			PrimaryLatencyMs:   1200,
+			PrimaryImageHashes: []string{"h1", "h2"},
+			ShadowBackend:      "shadow0",
+			ShadowStatus:       200,
+			ShadowLatencyMs:    900,
+			ShadowImageHashes:  []string{"h1", "h3"},
+			CreatedAt:          1000,
+		}
+		err = ds.PutMirrorResult(result)
+		require.NoError(t, err)
+
+		got, err := ds.GetMirrorResult("req1")
+		require.NoError(t, err)
+		require.Equal(t, result, got)
+
+		// Test get a non-exist result
+		got, err = ds.GetMirrorResult("non_exist_id")
+		require.NoError(t, err)
+		require.Nil(t, got)
+
+		// Test put with empty id
+		err = ds.PutMirrorResult(&MirrorResult{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test failed shadow request", func(t *testing.T) {
+		ds, err := NewMirrorResults(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		// The shadow request fails before any response, so it has no status and no images.
+		result := &MirrorResult{Id: "req1", PrimaryStatus: 200, PrimaryImageHashes: []string{"h1"}, ShadowError: "timeout"}
+		err = ds.PutMirrorResult(result)
+		require.NoError(t, err)
+		got, err := ds.GetMirrorResult("req1")
+		require.NoError(t, err)
+		require.Equal(t, result, got)
+		require.Nil(t, got.ShadowImageHashes)
+	})
+
+	t.Run("Test result with malformed image hashes", func(t *testing.T) {
+		ds, err := NewMirrorResults(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.ds.Put("req1", map[string]interface{}{
+			kMirrorResultPrimaryImagesColumnName: `["h1"`,
+			kMirrorResultShadowImagesColumnName:  `{"h1": 1}`,
+			kMirrorResultShadowStatusColumnName:  500,
+		})
+		require.NoError(t, err)
+		got, err := ds.GetMirrorResult("req1")
+		require.NoError(t, err)
+		require.Equal(t, &MirrorResult{Id: "req1", ShadowStatus: 500}, got)
+	})
+
+	t.Run("Test ListAllMirrorResults, DeleteMirrorResult and PurgeMirrorResults", func(t *testing.T) {
+		ds, err := NewMirrorResults(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		for id, createdAt := range map[string]int64{"req1": 1000, "req2": 2000, "req3": 3000} {
+			err = ds.PutMirrorResult(&MirrorResult{Id: id, CreatedAt: createdAt})
+			require.NoError(t, err)
+		}
+		results, err := ds.ListAllMirrorResults()
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+
+		err = ds.DeleteMirrorResult("req3")
+		require.NoError(t, err)
+		n, err := ds.PurgeMirrorResults(999)
+		require.NoError(t, err)
+		require.Equal(t, int64(0), n)
+		n, err = ds.PurgeMirrorResults(1000)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+		results, err = ds.ListAllMirrorResults()
+		require.NoError(t, err)
+		require.Equal(t, []MirrorResult{{Id: "req2", CreatedAt: 2000}}, results)
+	})
+}
@@ -0,0 +1,115 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const kOptionsProfileTableName = "options_profiles"
+const kOptionsProfilePoolColumnName = "POOL"
+const kOptionsProfileOptionsColumnName = "OPTIONS"
+const kOptionsProfileAutoHealColumnName = "AUTO_HEAL"
+const kOptionsProfileUpdatedAtColumnName = "UPDATED_AT"
+
+// OptionsProfile is the desired /sdapi/v1/options of the backends in a pool.
+type OptionsProfile struct {
+	Pool      string                 `json:"pool"`
+	Options   map[string]interface{} `json:"options"`    // the desired values, the options not in the profile are not checked
+	AutoHeal  bool                   `json:"auto_heal"`  // push the desired values to the drifted backends
+	UpdatedAt int64                  `json:"updated_at"` // the unix time in milliseconds of the last update
+}
+
+// OptionsProfiles read/write the desired options profiles of the backend pools.
+type OptionsProfiles struct {
+	ds Datastore
+}
+
+// NewOptionsProfiles create the options profiles datastore.
+func NewOptionsProfiles(dbType DatastoreType, dbName string) (*OptionsProfiles, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kOptionsProfileTableName,
+		ColumnConfig: map[string]string{
+			kOptionsProfilePoolColumnName:      "text primary key not null",
+			kOptionsProfileOptionsColumnName:   "text",
+			kOptionsProfileAutoHealColumnName:  "int",
+			kOptionsProfileUpdatedAtColumnName: "int",
+		},
+		PrimaryKeyColumnName: kOptionsProfilePoolColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	o := &OptionsProfiles{
+		ds: ds,
+	}
+	return o, nil
+}
+
+// Close close the underlying datastore.
+func (o *OptionsProfiles) Close() error {
+	return o.ds.Close()
+}
+
+// PutProfile persist the options profile of the pool.
+func (o *OptionsProfiles) PutProfile(profile *OptionsProfile) error {
+	if profile.Pool == "" {
+		return fmt.Errorf("pool cannot be empty")
+	}
+	options, err := json.Marshal(profile.Options)
+	if err != nil {
+		return fmt.Errorf("marshal options failed: %v", err)
+	}
+	return o.ds.Put(profile.Pool, map[string]interface{}{
+		kOptionsProfileOptionsColumnName:   string(options),
+		kOptionsProfileAutoHealColumnName:  fromBool(profile.AutoHeal),
+		kOptionsProfileUpdatedAtColumnName: profile.UpdatedAt,
+	})
+}
+
+// GetProfile get the options profile of the pool. It returns nil if the profile does not exist.
+func (o *OptionsProfiles) GetProfile(pool string) (*OptionsProfile, error) {
+	result, err := o.ds.Get(pool, []string{
+		kOptionsProfileOptionsColumnName,
+		kOptionsProfileAutoHealColumnName,
+		kOptionsProfileUpdatedAtColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return toOptionsProfile(pool, result), nil
+}
+
+// ListAllProfiles return the options profiles of all the pools.
+func (o *OptionsProfiles) ListAllProfiles() ([]OptionsProfile, error) {
+	result, err := o.ds.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	var ret []OptionsProfile
+	for k, v := range result {
+		ret = append(ret, *toOptionsProfile(k, v))
+	}
+	return ret, nil
+}
+
+// DeleteProfile remove the options profile of the pool.
+func (o *OptionsProfiles) DeleteProfile(pool string) error {
+	return o.ds.Delete(pool)
+}
+
+func toOptionsProfile(pool string, m map[string]interface{}) *OptionsProfile {
+	profile := &OptionsProfile{
+		Pool:      pool,
+		AutoHeal:  toBool(m[kOptionsProfileAutoHealColumnName]),
+		UpdatedAt: toInt64(m[kOptionsProfileUpdatedAtColumnName]),
+	}
+	fromJSON(m[kOptionsProfileOptionsColumnName], &profile.Options)
+	return profile
+}
@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptionsProfiles(t *testing.T) {
+	t.Run("Test PutProfile and GetProfile", func(t *testing.T) {
+		ds, err := NewOptionsProfiles(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		profile := &OptionsProfile{
+			Pool:      "default",
+			Options:   map[string]interface{}{"CLIP_stop_at_last_layers": float64(2), "sd_vae": "auto"},
+			AutoHeal:  true,
+			UpdatedAt: 1000,
+		}
+		err = ds.PutProfile(profile)
+		require.NoError(t, err)
+
+		result, err := ds.GetProfile("default")
+		require.NoError(t, err)
+		require.Equal(t, profile, result)
+
+		// Test get a non-exist pool
+		result, err = ds.GetProfile("non_exist_pool")
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		// Test put with empty pool
+		err = ds.PutProfile(&OptionsProfile{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test ListAllProfiles and DeleteProfile", func(t *testing.T) {
+		ds, err := NewOptionsProfiles(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		for _, pool := range []string{"default", "gpu"} {
+			err = ds.PutProfile(&OptionsProfile{Pool: pool})
+			require.NoError(t, err)
+		}
+		profiles, err := ds.ListAllProfiles()
+		require.NoError(t, err)
+		require.Len(t, profiles, 2)
+
+		err = ds.DeleteProfile("gpu")
+		require.NoError(t, err)
+		profiles, err = ds.ListAllProfiles()
+		require.NoError(t, err)
+		require.Equal(t, []OptionsProfile{{Pool: "default"}}, profiles)
+	})
+
+	t.Run("Test profile with NULL or malformed options", func(t *testing.T) {
+		ds, err := NewOptionsProfiles(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		// The profile written by hand without the options.
+		err = ds.ds.Put("default", map[string]interface{}{kOptionsProfileAutoHealColumnName: 1})
+		require.NoError(t, err)
+		result, err := ds.GetProfile("default")
+		require.NoError(t, err)
+		require.Equal(t, &OptionsProfile{Pool: "default", AutoHeal: true}, result)
+
+		err = ds.ds.Put("gpu", map[string]interface{}{kOptionsProfileOptionsColumnName: `{"sd_vae": `, kOptionsProfileUpdatedAtColumnName: 1000})
+		require.NoError(t, err)
+		result, err = ds.GetProfile("gpu")
+		require.NoError(t, err)
+		require.Equal(t, &OptionsProfile{Pool: "gpu", UpdatedAt: 1000}, result)
+	})
+}
@@ -0,0 +1,108 @@
+package datastore
+
+import "fmt"
+
+const kResultCacheTableName = "result_cache"
+const kResultCacheKeyColumnName = "CACHE_KEY"
+const kResultCacheContentTypeColumnName = "CONTENT_TYPE"
+const kResultCacheBodyColumnName = "BODY"
+const kResultCacheCreatedAtColumnName = "CREATED_AT"
+const kResultCacheExpiresAtColumnName = "EXPIRES_AT"
+
+// CachedResult is a cached generation response.
+type CachedResult struct {
+	Key         string
+	ContentType string
+	Body        string
+	CreatedAt   int64 // the unix time in milliseconds when the result is cached
+	ExpiresAt   int64 // the unix time in milliseconds when the result is purged, 0 means never
+}
+
+// ResultCache read/write the cached generation responses, so that all the proxy replicas share them.
+type ResultCache struct {
+	ds Datastore
+}
+
+// NewResultCache create the result cache datastore.
+func NewResultCache(dbType DatastoreType, dbName string) (*ResultCache, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kResultCacheTableName,
+		ColumnConfig: map[string]string{
+			kResultCacheKeyColumnName:         "text primary key not null",
+			kResultCacheContentTypeColumnName: "text",
+			kResultCacheBodyColumnName:        "text",
+			kResultCacheCreatedAtColumnName:   "int",
+			kResultCacheExpiresAtColumnName:   "int",
+		},
+		PrimaryKeyColumnName: kResultCacheKeyColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	r := &ResultCache{
+		ds: ds,
+	}
+	return r, nil
+}
+
+// Close close the underlying datastore.
+func (r *ResultCache) Close() error {
+	return r.ds.Close()
+}
+
+// PutResult persist the cached result.
+func (r *ResultCache) PutResult(result *CachedResult) error {
+	if result.Key == "" {
+		return fmt.Errorf("cache key cannot be empty")
+	}
+	err := r.ds.Put(result.Key, map[string]interface{}{
+		kResultCacheContentTypeColumnName: result.ContentType,
+		kResultCacheBodyColumnName:        result.Body,
+		kResultCacheCreatedAtColumnName:   result.CreatedAt,
+		kResultCacheExpiresAtColumnName:   result.ExpiresAt,
+	})
+	return err
+}
+
+// GetResult get the cached result. It returns nil if the result does not exist.
+func (r *ResultCache) GetResult(key string) (*CachedResult, error) {
+	result, err := r.ds.Get(key, []string{
+		kResultCacheContentTypeColumnName,
+		kResultCacheBodyColumnName,
+		kResultCacheCreatedAtColumnName,
+		kResultCacheExpiresAtColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return &CachedResult{
+		Key:         key,
+		ContentType: toString(result[kResultCacheContentTypeColumnName]),
+		Body:        toString(result[kResultCacheBodyColumnName]),
+		CreatedAt:   toInt64(result[kResultCacheCreatedAtColumnName]),
+		ExpiresAt:   toInt64(result[kResultCacheExpiresAtColumnName]),
+	}, nil
+}
+
+// DeleteResult remove the cached result.
+func (r *ResultCache) DeleteResult(key string) error {
+	return r.ds.Delete(key)
+}
+
+// PurgeResults remove all the cached results.
+func (r *ResultCache) PurgeResults() error {
+	_, err := r.ds.DeleteAll()
+	return err
+}
+
+// PurgeExpiredResults remove the cached results whose time to live has passed, and return the number of them.
+func (r *ResultCache) PurgeExpiredResults(now int64) (int64, error) {
+	return r.ds.DeleteBefore(kResultCacheExpiresAtColumnName, now)
+}
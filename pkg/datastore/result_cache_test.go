@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultCache(t *testing.T) {
+	t.Run("Test PutResult and GetResult", func(t *testing.T) {
+		ds, err := NewResultCache(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		result := &CachedResult{Key: "key1", ContentType: "application/json", Body: `{"images":[]}`, CreatedAt: 1000, ExpiresAt: 2000}
+		err = ds.PutResult(result)
+		require.NoError(t, err)
+
+		got, err := ds.GetResult("key1")
+		require.NoError(t, err)
+		require.Equal(t, result, got)
+
+		// Test get a non-exist result
+		got, err = ds.GetResult("non_exist_key")
+		require.NoError(t, err)
+		require.Nil(t, got)
+
+		// Test put with empty key
+		err = ds.PutResult(&CachedResult{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test DeleteResult and PurgeResults", func(t *testing.T) {
+		ds, err := NewResultCache(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		for _, key := range []string{"key1", "key2", "key3"} {
+			err = ds.PutResult(&CachedResult{Key: key, Body: key})
+			require.NoError(t, err)
+		}
+
+		err = ds.DeleteResult("key1")
+		require.NoError(t, err)
+		got, err := ds.GetResult("key1")
+		require.NoError(t, err)
+		require.Nil(t, got)
+
+		err = ds.PurgeResults()
+		require.NoError(t, err)
+		got, err = ds.GetResult("key2")
+		require.NoError(t, err)
+		require.Nil(t, got)
+	})
+
+	t.Run("Test PurgeExpiredResults", func(t *testing.T) {
+		ds, err := NewResultCache(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutResult(&CachedResult{Key: "key1", Body: "key1", ExpiresAt: 2000})
+		require.NoError(t, err)
+		// The result without the time to live is kept.
+		err = ds.PutResult(&CachedResult{Key: "key2", Body: "key2"})
+		require.NoError(t, err)
+
+		n, err := ds.PurgeExpiredResults(2000)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+		got, err := ds.GetResult("key1")
+		require.NoError(t, err)
+		require.Nil(t, got)
+		got, err = ds.GetResult("key2")
+		require.NoError(t, err)
+		require.NotNil(t, got)
+	})
+}
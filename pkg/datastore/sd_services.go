@@ -1,17 +1,28 @@
 package datastore
 
 import (
+	"encoding/json"
 	"fmt"
 )
 
 const kSDServicesTableName = "stable_diffusion_services"
 const kSDServiceNameColumnName = "SERVICE_NAME"
 const kSDServiceEndpointColumnName = "SERVICE_ENDPOINT"
+const kSDServiceWeightColumnName = "WEIGHT"
+const kSDServiceLabelsColumnName = "LABELS"
+const kSDServiceMaxConcurrencyColumnName = "MAX_CONCURRENCY"
+const kSDServiceCordonedColumnName = "CORDONED"
+const kSDServiceVersionColumnName = "VERSION"
 
 // SDServiceEndpoint is the backend stable diffusion service endpoint.
 type SDServiceEndpoint struct {
-	Name     string
-	Endpoint string
+	Name           string            `json:"name"`
+	Endpoint       string            `json:"endpoint"`
+	Weight         int64             `json:"weight"`          // the relative weight for load balancing, 0 means the default weight 1
+	Labels         map[string]string `json:"labels"`          // the labels to group and select the services
+	MaxConcurrency int64             `json:"max_concurrency"` // the max concurrent generations, 0 means unlimited
+	Cordoned       bool              `json:"cordoned"`        // the cordoned service does not receive new requests
+	Version        string            `json:"version"`         // the version tag of the model and webui, for the traffic splitting
 }
 
 // SDServices datastore stores the stable-diffusion backend services' endpoints.
@@ -26,8 +37,13 @@ func NewSDServices(dbType DatastoreType, dbName string) (*SDServices, error) {
 		DBName:    dbName,
 		TableName: kSDServicesTableName,
 		ColumnConfig: map[string]string{
-			kSDServiceNameColumnName:     "text primary key not null",
-			kSDServiceEndpointColumnName: "text",
+			kSDServiceNameColumnName:           "text primary key not null",
+			kSDServiceEndpointColumnName:       "text",
+			kSDServiceWeightColumnName:         "int",
+			kSDServiceLabelsColumnName:         "text",
+			kSDServiceMaxConcurrencyColumnName: "int",
+			kSDServiceCordonedColumnName:       "int",
+			kSDServiceVersionColumnName:        "text",
 		},
 		PrimaryKeyColumnName: kSDServiceNameColumnName,
 	}
@@ -70,7 +86,52 @@ func (s *SDServices) GetServiceEndpoint(serviceName string) (string, error) {
 	return val.(string), nil
 }
 
+// PutService put the service endpoint with its metadata to the underlying datastore.
+func (s *SDServices) PutService(srv *SDServiceEndpoint) error {
+	if srv.Name == "" {
+		return fmt.Errorf("service name cannot be empty")
+	}
+	labels, err := json.Marshal(srv.Labels)
+	if err != nil {
+		return err
+	}
+	err = s.ds.Put(srv.Name, map[string]interface{}{
+		kSDServiceEndpointColumnName:       srv.Endpoint,
+		kSDServiceWeightColumnName:         srv.Weight,
+		kSDServiceLabelsColumnName:         string(labels),
+		kSDServiceMaxConcurrencyColumnName: srv.MaxConcurrency,
+		kSDServiceCordonedColumnName:       fromBool(srv.Cordoned),
+		kSDServiceVersionColumnName:        srv.Version,
+	})
+	return err
+}
+
+// GetService get the service endpoint with its metadata. It returns nil if the service does not exist.
+func (s *SDServices) GetService(serviceName string) (*SDServiceEndpoint, error) {
+	result, err := s.ds.Get(serviceName, []string{
+		kSDServiceEndpointColumnName,
+		kSDServiceWeightColumnName,
+		kSDServiceLabelsColumnName,
+		kSDServiceMaxConcurrencyColumnName,
+		kSDServiceCordonedColumnName,
+		kSDServiceVersionColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return toSDServiceEndpoint(serviceName, result), nil
+}
+
+// DeleteServiceEndpoint remove the service from the underlying datastore.
+func (s *SDServices) DeleteServiceEndpoint(serviceName string) error {
+	return s.ds.Delete(serviceName)
+}
+
 // ListAllServiceEndpoints return all the service endpoints as an array of [service_name, service_endpoint].
+// The metadata of the services is also filled.
 func (s *SDServices) ListAllServiceEndpoints() ([]SDServiceEndpoint, error) {
 	result, err := s.ds.ListAll()
 	if err != nil {
@@ -79,12 +140,21 @@ func (s *SDServices) ListAllServiceEndpoints() ([]SDServiceEndpoint, error) {
 
 	var ret []SDServiceEndpoint
 	for k, v := range result {
-		serviceName := k
-		serviceEndpoint := v[kSDServiceEndpointColumnName].(string)
-		ret = append(ret, SDServiceEndpoint{
-			Name:     serviceName,
-			Endpoint: serviceEndpoint})
+		ret = append(ret, *toSDServiceEndpoint(k, v))
 	}
 
 	return ret, nil
 }
+
+func toSDServiceEndpoint(serviceName string, m map[string]interface{}) *SDServiceEndpoint {
+	srv := &SDServiceEndpoint{
+		Name:           serviceName,
+		Endpoint:       toString(m[kSDServiceEndpointColumnName]),
+		Weight:         toInt64(m[kSDServiceWeightColumnName]),
+		MaxConcurrency: toInt64(m[kSDServiceMaxConcurrencyColumnName]),
+		Cordoned:       toBool(m[kSDServiceCordonedColumnName]),
+		Version:        toString(m[kSDServiceVersionColumnName]),
+	}
+	fromJSON(m[kSDServiceLabelsColumnName], &srv.Labels)
+	return srv
+}
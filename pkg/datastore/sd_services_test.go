@@ -74,4 +74,77 @@ func TestSDServices(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, 0, len(result))
 	})
+
+	t.Run("Test DeleteServiceEndpoint", func(t *testing.T) {
+		sds, err := NewSDServices(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer sds.Close()
+
+		err = sds.PutService(&SDServiceEndpoint{Name: "model1", Endpoint: "endpoint1", Labels: map[string]string{"pool": "gpu"}})
+		require.NoError(t, err)
+		err = sds.PutServiceEndpoint("model2", "endpoint2")
+		require.NoError(t, err)
+
+		// The metadata is removed with the service.
+		err = sds.DeleteServiceEndpoint("model1")
+		require.NoError(t, err)
+		srv, err := sds.GetService("model1")
+		require.NoError(t, err)
+		require.Nil(t, srv)
+		endpoint, err := sds.GetServiceEndpoint("model2")
+		require.NoError(t, err)
+		require.Equal(t, "endpoint2", endpoint)
+
+		// Test delete a non-exist model
+		err = sds.DeleteServiceEndpoint("non_exist_model")
+		require.NoError(t, err)
+	})
+}
+
+func TestSDServicesMetadata(t *testing.T) {
+	t.Run("Test PutService and GetService", func(t *testing.T) {
+		sds, err := NewSDServices(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer sds.Close()
+
+		srv := &SDServiceEndpoint{
+			Name:           "service1",
+			Endpoint:       "endpoint1",
+			Weight:         3,
+			Labels:         map[string]string{"gpu": "a10"},
+			MaxConcurrency: 2,
+			Cordoned:       true,
+			Version:        "v2",
+		}
+		err = sds.PutService(srv)
+		require.NoError(t, err)
+
+		result, err := sds.GetService("service1")
+		require.NoError(t, err)
+		require.Equal(t, srv, result)
+
+		result, err = sds.GetService("non_exist_service")
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		err = sds.PutService(&SDServiceEndpoint{Endpoint: "endpoint1"})
+		require.Error(t, err)
+	})
+
+	t.Run("Test service without metadata", func(t *testing.T) {
+		sds, err := NewSDServices(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer sds.Close()
+
+		err = sds.PutServiceEndpoint("service1", "endpoint1")
+		require.NoError(t, err)
+
+		result, err := sds.GetService("service1")
+		require.NoError(t, err)
+		require.Equal(t, &SDServiceEndpoint{Name: "service1", Endpoint: "endpoint1"}, result)
+
+		list, err := sds.ListAllServiceEndpoints()
+		require.NoError(t, err)
+		require.Equal(t, []SDServiceEndpoint{{Name: "service1", Endpoint: "endpoint1"}}, list)
+	})
 }
@@ -0,0 +1,126 @@
+package datastore
+
+import "fmt"
+
+const kSessionAffinityTableName = "session_affinity"
+const kSessionIdColumnName = "SESSION_ID"
+const kSessionServiceNameColumnName = "SERVICE_NAME"
+const kSessionExpiresAtColumnName = "EXPIRES_AT"
+
+// Session is the mapping of a browser session to its backend service.
+type Session struct {
+	ServiceName string
+	ExpiresAt   int64 // the unix time in milliseconds when the idle session is purged, 0 means never
+}
+
+// SessionAffinity read/write the browser session to backend service mappings,
+// so that all the proxy replicas route the same session to the same backend.
+type SessionAffinity struct {
+	ds Datastore
+}
+
+// NewSessionAffinity create the session affinity datastore.
+func NewSessionAffinity(dbType DatastoreType, dbName string) (*SessionAffinity, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kSessionAffinityTableName,
+		ColumnConfig: map[string]string{
+			kSessionIdColumnName:          "text primary key not null",
+			kSessionServiceNameColumnName: "text",
+			kSessionExpiresAtColumnName:   "int",
+		},
+		PrimaryKeyColumnName: kSessionIdColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	s := &SessionAffinity{
+		ds: ds,
+	}
+	return s, nil
+}
+
+// Close close the underlying datastore.
+func (s *SessionAffinity) Close() error {
+	return s.ds.Close()
+}
+
+// PutSession pin the session to the specified backend service.
+func (s *SessionAffinity) PutSession(sessionId string, serviceName string) error {
+	if sessionId == "" {
+		return fmt.Errorf("session id cannot be empty")
+	}
+	err := s.ds.Put(sessionId, map[string]interface{}{
+		kSessionServiceNameColumnName: serviceName,
+	})
+	return err
+}
+
+// PinSession pin the session to the specified backend service with the expiry, if the session is not pinned yet,
+// or it is still pinned to the expected service, e.g. the one which is ejected. Otherwise the session is left to
+// the concurrent writer. It returns the service which the session is pinned to after the write.
+func (s *SessionAffinity) PinSession(sessionId string, serviceName string, expected string, expiresAt int64) (string, error) {
+	if sessionId == "" {
+		return "", fmt.Errorf("session id cannot be empty")
+	}
+	values := map[string]interface{}{
+		kSessionServiceNameColumnName: serviceName,
+		kSessionExpiresAtColumnName:   expiresAt,
+	}
+	var err error
+	if expected == "" {
+		_, err = s.ds.PutIfAbsent(sessionId, values)
+	} else {
+		_, err = s.ds.CompareAndPut(sessionId, kSessionServiceNameColumnName, expected, values)
+	}
+	if err != nil {
+		return "", err
+	}
+	return s.GetSession(sessionId)
+}
+
+// RenewSession extend the expiry of the session if it is still pinned to the service.
+func (s *SessionAffinity) RenewSession(sessionId string, serviceName string, expiresAt int64) error {
+	_, err := s.ds.CompareAndPut(sessionId, kSessionServiceNameColumnName, serviceName, map[string]interface{}{
+		kSessionExpiresAtColumnName: expiresAt,
+	})
+	return err
+}
+
+// GetSession get the backend service name which the session is pinned to.
+// It returns empty string if the session is not pinned yet.
+func (s *SessionAffinity) GetSession(sessionId string) (string, error) {
+	session, err := s.LookupSession(sessionId)
+	if err != nil || session == nil {
+		return "", err
+	}
+	return session.ServiceName, nil
+}
+
+// LookupSession get the session with its expiry. It returns nil if the session is not pinned yet.
+func (s *SessionAffinity) LookupSession(sessionId string) (*Session, error) {
+	result, err := s.ds.Get(sessionId, []string{kSessionServiceNameColumnName, kSessionExpiresAtColumnName})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil || result[kSessionServiceNameColumnName] == nil {
+		return nil, nil
+	}
+	return &Session{
+		ServiceName: toString(result[kSessionServiceNameColumnName]),
+		ExpiresAt:   toInt64(result[kSessionExpiresAtColumnName]),
+	}, nil
+}
+
+// PurgeExpiredSessions remove the sessions which are idle after their expiry, and return the number of them.
+func (s *SessionAffinity) PurgeExpiredSessions(now int64) (int64, error) {
+	return s.ds.DeleteBefore(kSessionExpiresAtColumnName, now)
+}
+
+// DeleteSession unpin the session.
+func (s *SessionAffinity) DeleteSession(sessionId string) error {
+	return s.ds.Delete(sessionId)
+}
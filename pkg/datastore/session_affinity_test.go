@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionAffinity(t *testing.T) {
+	t.Run("Test PutSession and GetSession", func(t *testing.T) {
+		ds, err := NewSessionAffinity(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutSession("session1", "service1")
+		require.NoError(t, err)
+
+		service, err := ds.GetSession("session1")
+		require.NoError(t, err)
+		require.Equal(t, "service1", service)
+
+		// Remap the session to another service.
+		err = ds.PutSession("session1", "service2")
+		require.NoError(t, err)
+		service, err = ds.GetSession("session1")
+		require.NoError(t, err)
+		require.Equal(t, "service2", service)
+
+		// Test get a non-exist session
+		service, err = ds.GetSession("non_exist_session")
+		require.NoError(t, err)
+		require.Equal(t, "", service)
+
+		// Test put with empty session id
+		err = ds.PutSession("", "service1")
+		require.Error(t, err)
+	})
+
+	t.Run("Test DeleteSession", func(t *testing.T) {
+		ds, err := NewSessionAffinity(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutSession("session1", "service1")
+		require.NoError(t, err)
+		err = ds.DeleteSession("session1")
+		require.NoError(t, err)
+
+		service, err := ds.GetSession("session1")
+		require.NoError(t, err)
+		require.Equal(t, "", service)
+	})
+
+	t.Run("Test PinSession keeps the concurrent mapping", func(t *testing.T) {
+		ds, err := NewSessionAffinity(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		service, err := ds.PinSession("session1", "service1", "", 2000)
+		require.NoError(t, err)
+		require.Equal(t, "service1", service)
+		// The session is already pinned by another writer.
+		service, err = ds.PinSession("session1", "service2", "", 2000)
+		require.NoError(t, err)
+		require.Equal(t, "service1", service)
+
+		// The session is remapped only from the expected service.
+		service, err = ds.PinSession("session1", "service3", "service2", 3000)
+		require.NoError(t, err)
+		require.Equal(t, "service1", service)
+		service, err = ds.PinSession("session1", "service3", "service1", 3000)
+		require.NoError(t, err)
+		require.Equal(t, "service3", service)
+		session, err := ds.LookupSession("session1")
+		require.NoError(t, err)
+		require.Equal(t, &Session{ServiceName: "service3", ExpiresAt: 3000}, session)
+
+		// Test pin with empty session id
+		_, err = ds.PinSession("", "service1", "", 2000)
+		require.Error(t, err)
+	})
+
+	t.Run("Test RenewSession and PurgeExpiredSessions", func(t *testing.T) {
+		ds, err := NewSessionAffinity(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		_, err = ds.PinSession("session1", "service1", "", 2000)
+		require.NoError(t, err)
+		_, err = ds.PinSession("session2", "service1", "", 2000)
+		require.NoError(t, err)
+		// The session without expiry is kept.
+		err = ds.PutSession("session3", "service1")
+		require.NoError(t, err)
+
+		err = ds.RenewSession("session1", "service1", 5000)
+		require.NoError(t, err)
+		// The session which is remapped is not renewed.
+		err = ds.RenewSession("session2", "service2", 5000)
+		require.NoError(t, err)
+
+		n, err := ds.PurgeExpiredSessions(2000)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+		for session, expected := range map[string]string{"session1": "service1", "session2": "", "session3": "service1"} {
+			service, err := ds.GetSession(session)
+			require.NoError(t, err)
+			require.Equal(t, expected, service)
+		}
+	})
+}
@@ -2,8 +2,8 @@ package datastore
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
-	"reflect"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -19,6 +19,10 @@ func NewSQLiteDatastore(config *Config) *SQLiteDatastore {
 	if err != nil {
 		panic(fmt.Errorf("failed to open database: %v", err))
 	}
+	if config.DBName == ":memory:" {
+		// Each connection opens its own in-memory database, so only one connection is kept to share it.
+		db.SetMaxOpenConns(1)
+	}
 
 	// Create table if it doesn't exist.
 	columnDefs := make([]string, 0, len(config.ColumnConfig))
@@ -34,12 +38,60 @@ func NewSQLiteDatastore(config *Config) *SQLiteDatastore {
 	if err != nil {
 		panic(fmt.Errorf("failed to create table %s: %v", config.TableName, err))
 	}
+	if err := addMissingColumns(db, config); err != nil {
+		panic(fmt.Errorf("failed to migrate table %s: %v", config.TableName, err))
+	}
 	return &SQLiteDatastore{
 		db:     db,
 		config: config,
 	}
 }
 
+// addMissingColumns add the columns which are in the config but not in the existing table,
+// e.g. the table is created by an older version or by the deploy scripts.
+func addMissingColumns(db *sql.DB, config *Config) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", config.TableName))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		pointers := make([]interface{}, len(cols))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return err
+		}
+		for i, col := range cols {
+			if col == "name" {
+				existing[fmt.Sprint(values[i])] = true
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for name, typ := range config.ColumnConfig {
+		if existing[name] || name == config.PrimaryKeyColumnName {
+			continue
+		}
+		_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", config.TableName, name, typ))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ds *SQLiteDatastore) Close() error {
 	return ds.db.Close()
 }
@@ -55,15 +107,16 @@ func (ds *SQLiteDatastore) Get(key string, columns []string) (map[string]interfa
 	values := make([]interface{}, len(columns))
 	for i, column := range columns {
 		// We use the type information stored in the Config to create a variable of the correct type.
+		// The nullable types are used, since the columns added by the migration are NULL for the existing rows.
 		var value interface{}
 		switch ds.config.ColumnConfig[column] {
 		case "text":
-			value = new(string)
+			value = new(sql.NullString)
 		case "int":
 			// For simplicity, we use int64 for all integers.
-			value = new(int64)
+			value = new(sql.NullInt64)
 		case "float":
-			value = new(float64)
+			value = new(sql.NullFloat64)
 		default:
 			// If the column type is not supported, we return an error.
 			return nil, fmt.Errorf("unsupported column type: %s", ds.config.ColumnConfig[column])
@@ -81,11 +134,13 @@ func (ds *SQLiteDatastore) Get(key string, columns []string) (map[string]interfa
 		return nil, err
 	}
 
-	// Prepare the result map and fill it with values.
+	// Prepare the result map and fill it with values, the NULL values are returned as nil.
 	result := make(map[string]interface{})
 	for i, column := range columns {
-		// We use the reflect package to dereference the pointer.
-		value := reflect.ValueOf(values[i]).Elem().Interface()
+		value, err := values[i].(driver.Valuer).Value()
+		if err != nil {
+			return nil, err
+		}
 		result[column] = value
 	}
 
@@ -111,6 +166,80 @@ func (ds *SQLiteDatastore) Put(key string, values map[string]interface{}) error
 	return err
 }
 
+func (ds *SQLiteDatastore) PutIfAbsent(key string, values map[string]interface{}) (bool, error) {
+	columns := []string{ds.config.PrimaryKeyColumnName}
+	placeholders := []string{"?"}
+	args := []interface{}{key}
+	for column, value := range values {
+		columns = append(columns, column)
+		placeholders = append(placeholders, "?")
+		args = append(args, value)
+	}
+	query := fmt.Sprintf(
+		"INSERT OR IGNORE INTO %s (%s) VALUES (%s)",
+		ds.config.TableName,
+		strings.Join(columns, ", "),
+		strings.Join(placeholders, ", "),
+	)
+	result, err := ds.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (ds *SQLiteDatastore) CompareAndPut(key string, column string, expected interface{}, values map[string]interface{}) (bool, error) {
+	assignments := make([]string, 0, len(values))
+	args := make([]interface{}, 0, len(values)+2)
+	for c, value := range values {
+		assignments = append(assignments, c+" = ?")
+		args = append(args, value)
+	}
+	condition := column + " = ?"
+	if isZero(expected) {
+		// The columns added by the migration are NULL for the existing rows.
+		condition = fmt.Sprintf("(%s = ? OR %s IS NULL)", column, column)
+	}
+	args = append(args, key, expected)
+	query := fmt.Sprintf(
+		"UPDATE %s SET %s WHERE %s = ? AND %s",
+		ds.config.TableName,
+		strings.Join(assignments, ", "),
+		ds.config.PrimaryKeyColumnName,
+		condition,
+	)
+	result, err := ds.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case int:
+		return v == 0
+	case int64:
+		return v == 0
+	case float64:
+		return v == 0
+	default:
+		return false
+	}
+}
+
 func (ds *SQLiteDatastore) Delete(key string) error {
 	_, err := ds.db.Exec(
 		fmt.Sprintf(
@@ -124,6 +253,51 @@ func (ds *SQLiteDatastore) ListAll() (map[string]map[string]interface{}, error)
 	if err != nil {
 		return nil, err
 	}
+	return ds.scanRows(rows)
+}
+
+func (ds *SQLiteDatastore) ListWhere(columns []string, column string, values []interface{}) (map[string]map[string]interface{}, error) {
+	if len(values) == 0 {
+		return map[string]map[string]interface{}{}, nil
+	}
+	placeholders := make([]string, len(values))
+	for i := range values {
+		placeholders[i] = "?"
+	}
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s IN (%s)",
+		strings.Join(append([]string{ds.config.PrimaryKeyColumnName}, columns...), ", "),
+		ds.config.TableName,
+		column,
+		strings.Join(placeholders, ", "),
+	)
+	rows, err := ds.db.Query(query, values...)
+	if err != nil {
+		return nil, err
+	}
+	return ds.scanRows(rows)
+}
+
+func (ds *SQLiteDatastore) DeleteBefore(column string, bound int64) (int64, error) {
+	result, err := ds.db.Exec(
+		fmt.Sprintf("DELETE FROM %s WHERE %s > 0 AND %s <= ?", ds.config.TableName, column, column),
+		bound)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (ds *SQLiteDatastore) DeleteAll() (int64, error) {
+	result, err := ds.db.Exec(fmt.Sprintf("DELETE FROM %s", ds.config.TableName))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// scanRows read the rows into the nested map keyed by the primary key, and close them.
+func (ds *SQLiteDatastore) scanRows(rows *sql.Rows) (map[string]map[string]interface{}, error) {
 	defer rows.Close()
 
 	cols, err := rows.Columns()
@@ -119,3 +119,197 @@ func TestListAll(t *testing.T) {
 	assert.Equal(t, 0, len(result))
 
 }
+
+func TestAddMissingColumns(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    "file:TestAddMissingColumns?mode=memory&cache=shared",
+		TableName: "TestAddMissingColumns",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "text primary key not null",
+			"value":              "text",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+
+	err := ds.Put("key1", map[string]interface{}{"value": "value1"})
+	assert.NoError(t, err)
+
+	// Reopen the table with more columns.
+	config.ColumnConfig["intCol"] = "int"
+	config.ColumnConfig["floatCol"] = "float"
+	migrated := NewSQLiteDatastore(config)
+	defer migrated.Close()
+
+	// The new columns of the existing rows are NULL.
+	result, err := migrated.Get("key1", []string{"value", "intCol", "floatCol"})
+	assert.NoError(t, err)
+	assert.Equal(t, "value1", result["value"])
+	assert.Nil(t, result["intCol"])
+	assert.Nil(t, result["floatCol"])
+
+	err = migrated.Put("key2", map[string]interface{}{"value": "value2", "intCol": 2, "floatCol": 2.2})
+	assert.NoError(t, err)
+	result, err = migrated.Get("key2", []string{"value", "intCol", "floatCol"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), result["intCol"])
+	assert.Equal(t, 2.2, result["floatCol"])
+}
+
+func TestCompareAndPut(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    ":memory:", // the memory database for testing purposes
+		TableName: "TestCompareAndPut",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "text primary key not null",
+			"value":              "text",
+			"version":            "int",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+
+	// The NULL column equals the zero value.
+	assert.NoError(t, ds.Put("key1", map[string]interface{}{"value": "value1"}))
+	ok, err := ds.CompareAndPut("key1", "version", int64(0), map[string]interface{}{"value": "value2", "version": 1})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The stale update is rejected.
+	ok, err = ds.CompareAndPut("key1", "version", int64(0), map[string]interface{}{"value": "value3", "version": 1})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	result, err := ds.Get("key1", []string{"value", "version"})
+	assert.NoError(t, err)
+	assert.Equal(t, "value2", result["value"])
+	assert.Equal(t, int64(1), result["version"])
+
+	// The non-existent key is not inserted.
+	ok, err = ds.CompareAndPut("key2", "version", int64(0), map[string]interface{}{"value": "value1", "version": 1})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	result, err = ds.Get("key2", []string{"value"})
+	assert.NoError(t, err)
+	assert.Nil(t, result)
+}
+
+func TestPutIfAbsent(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    ":memory:", // the memory database for testing purposes
+		TableName: "TestPutIfAbsent",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "text primary key not null",
+			"value":              "text",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+
+	ok, err := ds.PutIfAbsent("key1", map[string]interface{}{"value": "value1"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// The existing key is not overwritten.
+	ok, err = ds.PutIfAbsent("key1", map[string]interface{}{"value": "value2"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	result, err := ds.Get("key1", []string{"value"})
+	assert.NoError(t, err)
+	assert.Equal(t, "value1", result["value"])
+}
+
+func TestListWhere(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    ":memory:", // the memory database for testing purposes
+		TableName: "TestListWhere",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "text primary key not null",
+			"status":             "text",
+			"large":              "text",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+
+	assert.NoError(t, ds.Put("key1", map[string]interface{}{"status": "queued", "large": "data1"}))
+	assert.NoError(t, ds.Put("key2", map[string]interface{}{"status": "running", "large": "data2"}))
+	assert.NoError(t, ds.Put("key3", map[string]interface{}{"status": "done", "large": "data3"}))
+
+	// Only the requested columns of the matching rows are read.
+	result, err := ds.ListWhere([]string{"status"}, "status", []interface{}{"queued", "running"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]interface{}{
+		"key1": {primaryKeyColumnName: "key1", "status": "queued"},
+		"key2": {primaryKeyColumnName: "key2", "status": "running"},
+	}, result)
+
+	result, err = ds.ListWhere([]string{"status"}, "status", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+}
+
+func TestDeleteBefore(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    ":memory:", // the memory database for testing purposes
+		TableName: "TestDeleteBefore",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "text primary key not null",
+			"value":              "text",
+			"expiresAt":          "int",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+
+	assert.NoError(t, ds.Put("expired", map[string]interface{}{"expiresAt": 1000}))
+	assert.NoError(t, ds.Put("bound", map[string]interface{}{"expiresAt": 2000}))
+	assert.NoError(t, ds.Put("live", map[string]interface{}{"expiresAt": 3000}))
+	assert.NoError(t, ds.Put("never", map[string]interface{}{"expiresAt": 0}))
+	// The NULL column of the migrated rows never expires either.
+	assert.NoError(t, ds.Put("null", map[string]interface{}{"value": "value"}))
+
+	n, err := ds.DeleteBefore("expiresAt", 2000)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	result, err := ds.ListAll()
+	assert.NoError(t, err)
+	assert.Len(t, result, 3)
+	assert.Contains(t, result, "live")
+	assert.Contains(t, result, "never")
+	assert.Contains(t, result, "null")
+}
+
+func TestDeleteAll(t *testing.T) {
+	primaryKeyColumnName := "primaryKey"
+	config := &Config{
+		DBName:    ":memory:", // the memory database for testing purposes
+		TableName: "TestDeleteAll",
+		ColumnConfig: map[string]string{
+			primaryKeyColumnName: "text primary key not null",
+			"value":              "text",
+		},
+		PrimaryKeyColumnName: primaryKeyColumnName,
+	}
+	ds := NewSQLiteDatastore(config)
+	defer ds.Close()
+
+	assert.NoError(t, ds.Put("key1", map[string]interface{}{"value": "value1"}))
+	assert.NoError(t, ds.Put("key2", map[string]interface{}{"value": "value2"}))
+
+	n, err := ds.DeleteAll()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	result, err := ds.ListAll()
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+}
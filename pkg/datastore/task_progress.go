@@ -1,10 +1,34 @@
 package datastore
 
-import "fmt"
+import (
+	"fmt"
+)
 
 const kTaskProgressTableName = "task_progress"
 const kTaskIdColumnName = "TASK_ID"
 const kTaskProgressColumnName = "TASK_PROGRESS"
+const kTaskStateColumnName = "TASK_STATE"
+const kTaskRevisionColumnName = "REVISION"
+
+// The task states.
+const (
+	TaskRunning   = "running"
+	TaskCompleted = "completed"
+	TaskFailed    = "failed"
+	TaskCancelled = "cancelled" // the task is interrupted since its client is gone
+)
+
+// TaskProgressState is the progress of a task with its state and revision.
+type TaskProgressState struct {
+	Progress string // the json serialized response of the backend /internal/progress
+	State    string
+	Revision int64 // increases by 1 on each update of the task
+}
+
+// Done report whether the task is finished.
+func (s *TaskProgressState) Done() bool {
+	return s.State == TaskCompleted || s.State == TaskFailed || s.State == TaskCancelled
+}
 
 // TaskProgress read/write the task progress to the underlying datastore.
 type TaskProgress struct {
@@ -19,6 +43,8 @@ func NewTaskProgress(dbType DatastoreType, dbName string) (*TaskProgress, error)
 		ColumnConfig: map[string]string{
 			kTaskIdColumnName:       "text primary key not null",
 			kTaskProgressColumnName: "text",
+			kTaskStateColumnName:    "text",
+			kTaskRevisionColumnName: "int",
 		},
 		PrimaryKeyColumnName: kTaskIdColumnName,
 	}
@@ -38,15 +64,40 @@ func (t *TaskProgress) Close() error {
 	return t.ds.Close()
 }
 
-// PutProgress persist the task progress to the underlying datastore.
+// PutProgress persist the progress of the running task to the underlying datastore.
 func (t *TaskProgress) PutProgress(taskId string, serializedProgress string) error {
+	return t.PutProgressState(taskId, serializedProgress, TaskRunning)
+}
+
+// PutProgressState persist the task progress and state to the underlying datastore, and bump its revision
+// to the previous one plus 1. The concurrent writers of the task are serialized by the revision.
+func (t *TaskProgress) PutProgressState(taskId string, serializedProgress string, state string) error {
 	if taskId == "" {
 		return fmt.Errorf("task id cannot be empty")
 	}
-	err := t.ds.Put(taskId, map[string]interface{}{
-		kTaskProgressColumnName: serializedProgress,
-	})
-	return err
+	for {
+		result, err := t.ds.Get(taskId, []string{kTaskRevisionColumnName})
+		if err != nil {
+			return err
+		}
+		values := map[string]interface{}{
+			kTaskProgressColumnName: serializedProgress,
+			kTaskStateColumnName:    state,
+		}
+		var ok bool
+		if result == nil {
+			values[kTaskRevisionColumnName] = int64(1)
+			ok, err = t.ds.PutIfAbsent(taskId, values)
+		} else {
+			revision := toInt64(result[kTaskRevisionColumnName])
+			values[kTaskRevisionColumnName] = revision + 1
+			ok, err = t.ds.CompareAndPut(taskId, kTaskRevisionColumnName, revision, values)
+		}
+		if err != nil || ok {
+			return err
+		}
+		// The task is updated by another writer since it is read, retry on its revision.
+	}
 }
 
 // GetProgress get the specified task progress from the underlying datastore,
@@ -62,3 +113,25 @@ func (t *TaskProgress) GetProgress(taskId string) (string, error) {
 	}
 	return val.(string), nil
 }
+
+// GetProgressState get the specified task progress with its state and revision.
+// It returns nil if the task does not exist.
+func (t *TaskProgress) GetProgressState(taskId string) (*TaskProgressState, error) {
+	result, err := t.ds.Get(taskId, []string{kTaskProgressColumnName, kTaskStateColumnName, kTaskRevisionColumnName})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	state := &TaskProgressState{
+		Progress: toString(result[kTaskProgressColumnName]),
+		State:    toString(result[kTaskStateColumnName]),
+		Revision: toInt64(result[kTaskRevisionColumnName]),
+	}
+	if state.State == "" {
+		// The progress written before the states are introduced.
+		state.State = TaskRunning
+	}
+	return state, nil
+}
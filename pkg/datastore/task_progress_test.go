@@ -34,6 +34,51 @@ func TestTaskProgressDatastore(t *testing.T) {
 		require.Equal(t, "", progress)
 	})
 
+	t.Run("Test PutProgressState and GetProgressState", func(t *testing.T) {
+		ds, err := NewTaskProgress(SQLite, ":memory:")
+		defer ds.Close()
+		require.NoError(t, err)
+
+		err = ds.PutProgress("task1", "progress1")
+		require.NoError(t, err)
+		state, err := ds.GetProgressState("task1")
+		require.NoError(t, err)
+		require.Equal(t, "progress1", state.Progress)
+		require.Equal(t, TaskRunning, state.State)
+		require.False(t, state.Done())
+
+		err = ds.PutProgressState("task1", "progress2", TaskCompleted)
+		require.NoError(t, err)
+		next, err := ds.GetProgressState("task1")
+		require.NoError(t, err)
+		require.Equal(t, "progress2", next.Progress)
+		require.True(t, next.Done())
+		require.Equal(t, int64(1), state.Revision)
+		require.Equal(t, int64(2), next.Revision)
+
+		// Test get a non-exist task
+		state, err = ds.GetProgressState("non_exist_task")
+		require.NoError(t, err)
+		require.Nil(t, state)
+	})
+
+	t.Run("Test the revision of the task written before the revisions are introduced", func(t *testing.T) {
+		ds, err := NewTaskProgress(SQLite, ":memory:")
+		defer ds.Close()
+		require.NoError(t, err)
+
+		require.NoError(t, ds.ds.Put("task1", map[string]interface{}{kTaskProgressColumnName: "progress1"}))
+		state, err := ds.GetProgressState("task1")
+		require.NoError(t, err)
+		require.Equal(t, int64(0), state.Revision)
+
+		require.NoError(t, ds.PutProgressState("task1", "progress2", TaskCancelled))
+		state, err = ds.GetProgressState("task1")
+		require.NoError(t, err)
+		require.Equal(t, int64(1), state.Revision)
+		require.Equal(t, TaskCancelled, state.State)
+	})
+
 	t.Run("Test PutProgress with empty task id", func(t *testing.T) {
 		ds, err := NewTaskProgress(SQLite, ":memory:")
 		defer ds.Close()
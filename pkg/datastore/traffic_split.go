@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const kTrafficSplitTableName = "traffic_splits"
+const kTrafficSplitPoolColumnName = "POOL"
+const kTrafficSplitWeightsColumnName = "WEIGHTS"
+const kTrafficSplitPreviousWeightsColumnName = "PREVIOUS_WEIGHTS"
+const kTrafficSplitUpdatedAtColumnName = "UPDATED_AT"
+
+// TrafficSplit is how the traffic of a backend pool is split between the backend versions.
+type TrafficSplit struct {
+	Pool            string             `json:"pool"`
+	Weights         map[string]float64 `json:"weights"`          // the version to the percentage of the traffic
+	PreviousWeights map[string]float64 `json:"previous_weights"` // the weights before the last update, for the rollback
+	UpdatedAt       int64              `json:"updated_at"`       // the unix time in milliseconds of the last update
+}
+
+// TrafficSplits read/write the traffic splits of the backend pools.
+type TrafficSplits struct {
+	ds Datastore
+}
+
+// NewTrafficSplits create the traffic splits datastore.
+func NewTrafficSplits(dbType DatastoreType, dbName string) (*TrafficSplits, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kTrafficSplitTableName,
+		ColumnConfig: map[string]string{
+			kTrafficSplitPoolColumnName:            "text primary key not null",
+			kTrafficSplitWeightsColumnName:         "text",
+			kTrafficSplitPreviousWeightsColumnName: "text",
+			kTrafficSplitUpdatedAtColumnName:       "int",
+		},
+		PrimaryKeyColumnName: kTrafficSplitPoolColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	t := &TrafficSplits{
+		ds: ds,
+	}
+	return t, nil
+}
+
+// Close close the underlying datastore.
+func (t *TrafficSplits) Close() error {
+	return t.ds.Close()
+}
+
+// PutSplit persist the traffic split of the pool.
+func (t *TrafficSplits) PutSplit(split *TrafficSplit) error {
+	if split.Pool == "" {
+		return fmt.Errorf("pool cannot be empty")
+	}
+	weights, err := json.Marshal(split.Weights)
+	if err != nil {
+		return err
+	}
+	previous, err := json.Marshal(split.PreviousWeights)
+	if err != nil {
+		return err
+	}
+	return t.ds.Put(split.Pool, map[string]interface{}{
+		kTrafficSplitWeightsColumnName:         string(weights),
+		kTrafficSplitPreviousWeightsColumnName: string(previous),
+		kTrafficSplitUpdatedAtColumnName:       split.UpdatedAt,
+	})
+}
+
+// GetSplit get the traffic split of the pool. It returns nil if the split does not exist.
+func (t *TrafficSplits) GetSplit(pool string) (*TrafficSplit, error) {
+	result, err := t.ds.Get(pool, []string{
+		kTrafficSplitWeightsColumnName,
+		kTrafficSplitPreviousWeightsColumnName,
+		kTrafficSplitUpdatedAtColumnName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return toTrafficSplit(pool, result), nil
+}
+
+// ListAllSplits return the traffic splits of all the pools.
+func (t *TrafficSplits) ListAllSplits() ([]TrafficSplit, error) {
+	result, err := t.ds.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	var ret []TrafficSplit
+	for k, v := range result {
+		ret = append(ret, *toTrafficSplit(k, v))
+	}
+	return ret, nil
+}
+
+// DeleteSplit remove the traffic split of the pool.
+func (t *TrafficSplits) DeleteSplit(pool string) error {
+	return t.ds.Delete(pool)
+}
+
+func toTrafficSplit(pool string, m map[string]interface{}) *TrafficSplit {
+	split := &TrafficSplit{
+		Pool:      pool,
+		UpdatedAt: toInt64(m[kTrafficSplitUpdatedAtColumnName]),
+	}
+	fromJSON(m[kTrafficSplitWeightsColumnName], &split.Weights)
+	fromJSON(m[kTrafficSplitPreviousWeightsColumnName], &split.PreviousWeights)
+	return split
+}
@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficSplits(t *testing.T) {
+	t.Run("Test PutSplit and GetSplit", func(t *testing.T) {
+		ds, err := NewTrafficSplits(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		split := &TrafficSplit{
+			Pool:            "default",
+			Weights:         map[string]float64{"v1": 90, "v2": 10},
+			PreviousWeights: map[string]float64{"v1": 100},
+			UpdatedAt:       1000,
+		}
+		err = ds.PutSplit(split)
+		require.NoError(t, err)
+
+		result, err := ds.GetSplit("default")
+		require.NoError(t, err)
+		require.Equal(t, split, result)
+
+		// Test get a non-exist pool
+		result, err = ds.GetSplit("non_exist_pool")
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		// Test put with empty pool
+		err = ds.PutSplit(&TrafficSplit{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test ListAllSplits and DeleteSplit", func(t *testing.T) {
+		ds, err := NewTrafficSplits(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		for _, pool := range []string{"default", "gpu"} {
+			err = ds.PutSplit(&TrafficSplit{Pool: pool, Weights: map[string]float64{"v1": 100}})
+			require.NoError(t, err)
+		}
+		splits, err := ds.ListAllSplits()
+		require.NoError(t, err)
+		require.Len(t, splits, 2)
+
+		err = ds.DeleteSplit("gpu")
+		require.NoError(t, err)
+		splits, err = ds.ListAllSplits()
+		require.NoError(t, err)
+		require.Equal(t, []TrafficSplit{{Pool: "default", Weights: map[string]float64{"v1": 100}}}, splits)
+	})
+
+	t.Run("Test split without previous weights", func(t *testing.T) {
+		ds, err := NewTrafficSplits(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		// The split which is never changed has no weights to roll back to.
+		err = ds.ds.Put("default", map[string]interface{}{kTrafficSplitWeightsColumnName: `{"v1": 100}`})
+		require.NoError(t, err)
+		result, err := ds.GetSplit("default")
+		require.NoError(t, err)
+		require.Equal(t, map[string]float64{"v1": 100}, result.Weights)
+		require.Nil(t, result.PreviousWeights)
+	})
+
+	t.Run("Test split with malformed weights", func(t *testing.T) {
+		ds, err := NewTrafficSplits(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.ds.Put("default", map[string]interface{}{
+			kTrafficSplitWeightsColumnName:         `{"v1": 100`,
+			kTrafficSplitPreviousWeightsColumnName: `[`,
+			kTrafficSplitUpdatedAtColumnName:       1000,
+		})
+		require.NoError(t, err)
+		result, err := ds.GetSplit("default")
+		require.NoError(t, err)
+		require.Nil(t, result.Weights)
+		require.Nil(t, result.PreviousWeights)
+		require.Equal(t, int64(1000), result.UpdatedAt)
+	})
+}
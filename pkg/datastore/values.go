@@ -0,0 +1,62 @@
+package datastore
+
+import "encoding/json"
+
+// The helpers below convert the raw column values returned by Datastore.ListAll and Datastore.ListWhere,
+// whose types depend on the underlying database driver and may be nil for NULL columns.
+
+func toString(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return ""
+	}
+}
+
+func toInt64(val interface{}) int64 {
+	switch v := val.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	default:
+		return 0
+	}
+}
+
+func toFloat64(val interface{}) float64 {
+	switch v := val.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	default:
+		return 0
+	}
+}
+
+func toBool(val interface{}) bool {
+	return toInt64(val) != 0
+}
+
+func fromBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// fromJSON decode the json column into v. The column may be NULL, or malformed if it is written by hand,
+// in which case v is left as is.
+func fromJSON(val interface{}, v interface{}) {
+	if s := toString(val); s != "" {
+		_ = json.Unmarshal([]byte(s), v)
+	}
+}
@@ -0,0 +1,249 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const kWebhookDeliveryTableName = "webhook_deliveries"
+const kWebhookDeliveryIdColumnName = "DELIVERY_ID"
+const kWebhookDeliveryJobIdColumnName = "JOB_ID"
+const kWebhookDeliveryTenantColumnName = "TENANT"
+const kWebhookDeliveryUrlColumnName = "URL"
+const kWebhookDeliveryEventTypeColumnName = "EVENT_TYPE"
+const kWebhookDeliveryPayloadColumnName = "PAYLOAD"
+const kWebhookDeliveryStatusColumnName = "STATUS"
+const kWebhookDeliveryAttemptsColumnName = "ATTEMPTS"
+const kWebhookDeliveryNextAttemptAtColumnName = "NEXT_ATTEMPT_AT"
+const kWebhookDeliveryLogColumnName = "ATTEMPT_LOG"
+const kWebhookDeliveryCreatedAtColumnName = "CREATED_AT"
+const kWebhookDeliveryUpdatedAtColumnName = "UPDATED_AT"
+const kWebhookDeliveryExpiresAtColumnName = "EXPIRES_AT"
+
+// kWebhookDeliveryColumns is all the columns of the delivery except the id.
+var kWebhookDeliveryColumns = []string{
+	kWebhookDeliveryJobIdColumnName,
+	kWebhookDeliveryTenantColumnName,
+	kWebhookDeliveryUrlColumnName,
+	kWebhookDeliveryEventTypeColumnName,
+	kWebhookDeliveryPayloadColumnName,
+	kWebhookDeliveryStatusColumnName,
+	kWebhookDeliveryAttemptsColumnName,
+	kWebhookDeliveryNextAttemptAtColumnName,
+	kWebhookDeliveryLogColumnName,
+	kWebhookDeliveryCreatedAtColumnName,
+	kWebhookDeliveryUpdatedAtColumnName,
+	kWebhookDeliveryExpiresAtColumnName,
+}
+
+// The webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // the delivery gives up after the max attempts
+)
+
+// DeliveryAttempt is one attempt to deliver a webhook.
+type DeliveryAttempt struct {
+	At         int64  `json:"at"`          // the unix time in milliseconds
+	StatusCode int64  `json:"status_code"` // 0 if the attempt failed without response
+	Error      string `json:"error,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
+}
+
+// WebhookDelivery is a webhook event to deliver, which is both an entry of the retry queue and of the delivery log.
+type WebhookDelivery struct {
+	Id            string            `json:"id"`
+	JobId         string            `json:"job_id"`
+	Tenant        string            `json:"tenant"`
+	Url           string            `json:"url"`
+	EventType     string            `json:"event_type"`
+	Payload       string            `json:"-"` // the serialized event
+	Status        string            `json:"status"`
+	Attempts      int64             `json:"attempts"`
+	NextAttemptAt int64             `json:"next_attempt_at"` // the unix time in milliseconds of the next attempt of the pending delivery
+	Log           []DeliveryAttempt `json:"log"`
+	CreatedAt     int64             `json:"created_at"`
+	UpdatedAt     int64             `json:"updated_at"`
+	ExpiresAt     int64             `json:"expires_at,omitempty"` // the unix time in milliseconds when the finished delivery is purged, 0 means never
+}
+
+// DeliveryFilter select the webhook deliveries, the empty fields match any delivery.
+type DeliveryFilter struct {
+	JobId  string
+	Tenant string
+	Status string
+}
+
+func (f *DeliveryFilter) match(d *WebhookDelivery) bool {
+	return (f.JobId == "" || d.JobId == f.JobId) &&
+		(f.Tenant == "" || d.Tenant == f.Tenant) &&
+		(f.Status == "" || d.Status == f.Status)
+}
+
+// WebhookDeliveries read/write the webhook deliveries.
+type WebhookDeliveries struct {
+	ds Datastore
+}
+
+// NewWebhookDeliveries create the webhook deliveries datastore.
+func NewWebhookDeliveries(dbType DatastoreType, dbName string) (*WebhookDeliveries, error) {
+	config := &Config{
+		Type:      dbType,
+		DBName:    dbName,
+		TableName: kWebhookDeliveryTableName,
+		ColumnConfig: map[string]string{
+			kWebhookDeliveryIdColumnName:            "text primary key not null",
+			kWebhookDeliveryJobIdColumnName:         "text",
+			kWebhookDeliveryTenantColumnName:        "text",
+			kWebhookDeliveryUrlColumnName:           "text",
+			kWebhookDeliveryEventTypeColumnName:     "text",
+			kWebhookDeliveryPayloadColumnName:       "text",
+			kWebhookDeliveryStatusColumnName:        "text",
+			kWebhookDeliveryAttemptsColumnName:      "int",
+			kWebhookDeliveryNextAttemptAtColumnName: "int",
+			kWebhookDeliveryLogColumnName:           "text",
+			kWebhookDeliveryCreatedAtColumnName:     "int",
+			kWebhookDeliveryUpdatedAtColumnName:     "int",
+			kWebhookDeliveryExpiresAtColumnName:     "int",
+		},
+		PrimaryKeyColumnName: kWebhookDeliveryIdColumnName,
+	}
+	df := DatastoreFactory{}
+	ds, err := df.New(config)
+	if err != nil {
+		return nil, err
+	}
+	w := &WebhookDeliveries{
+		ds: ds,
+	}
+	return w, nil
+}
+
+// Close close the underlying datastore.
+func (w *WebhookDeliveries) Close() error {
+	return w.ds.Close()
+}
+
+// PutDelivery persist the webhook delivery.
+func (w *WebhookDeliveries) PutDelivery(d *WebhookDelivery) error {
+	if d.Id == "" {
+		return fmt.Errorf("webhook delivery id cannot be empty")
+	}
+	log, err := json.Marshal(d.Log)
+	if err != nil {
+		return err
+	}
+	return w.ds.Put(d.Id, map[string]interface{}{
+		kWebhookDeliveryJobIdColumnName:         d.JobId,
+		kWebhookDeliveryTenantColumnName:        d.Tenant,
+		kWebhookDeliveryUrlColumnName:           d.Url,
+		kWebhookDeliveryEventTypeColumnName:     d.EventType,
+		kWebhookDeliveryPayloadColumnName:       d.Payload,
+		kWebhookDeliveryStatusColumnName:        d.Status,
+		kWebhookDeliveryAttemptsColumnName:      d.Attempts,
+		kWebhookDeliveryNextAttemptAtColumnName: d.NextAttemptAt,
+		kWebhookDeliveryLogColumnName:           string(log),
+		kWebhookDeliveryCreatedAtColumnName:     d.CreatedAt,
+		kWebhookDeliveryUpdatedAtColumnName:     d.UpdatedAt,
+		kWebhookDeliveryExpiresAtColumnName:     d.ExpiresAt,
+	})
+}
+
+// GetDelivery get the webhook delivery. It returns nil if the delivery does not exist.
+func (w *WebhookDeliveries) GetDelivery(id string) (*WebhookDelivery, error) {
+	result, err := w.ds.Get(id, kWebhookDeliveryColumns)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return toWebhookDelivery(id, result), nil
+}
+
+// ListAllDeliveries return all the webhook deliveries.
+func (w *WebhookDeliveries) ListAllDeliveries() ([]WebhookDelivery, error) {
+	result, err := w.ds.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	var ret []WebhookDelivery
+	for k, v := range result {
+		ret = append(ret, *toWebhookDelivery(k, v))
+	}
+	return ret, nil
+}
+
+// ListDeliveries return the webhook deliveries selected by the filter. The rows are selected in the datastore
+// by the job id, the tenant or the status, in this order of preference, and then by the other fields.
+func (w *WebhookDeliveries) ListDeliveries(filter DeliveryFilter) ([]WebhookDelivery, error) {
+	var result map[string]map[string]interface{}
+	var err error
+	switch {
+	case filter.JobId != "":
+		result, err = w.ds.ListWhere(kWebhookDeliveryColumns, kWebhookDeliveryJobIdColumnName, []interface{}{filter.JobId})
+	case filter.Tenant != "":
+		result, err = w.ds.ListWhere(kWebhookDeliveryColumns, kWebhookDeliveryTenantColumnName, []interface{}{filter.Tenant})
+	case filter.Status != "":
+		result, err = w.ds.ListWhere(kWebhookDeliveryColumns, kWebhookDeliveryStatusColumnName, []interface{}{filter.Status})
+	default:
+		result, err = w.ds.ListAll()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []WebhookDelivery
+	for k, v := range result {
+		if d := toWebhookDelivery(k, v); filter.match(d) {
+			ret = append(ret, *d)
+		}
+	}
+	return ret, nil
+}
+
+// ListPendingDeliveries return the deliveries which are still to be attempted, with only their status
+// and their next attempt time.
+func (w *WebhookDeliveries) ListPendingDeliveries() ([]WebhookDelivery, error) {
+	result, err := w.ds.ListWhere([]string{
+		kWebhookDeliveryStatusColumnName,
+		kWebhookDeliveryNextAttemptAtColumnName,
+	}, kWebhookDeliveryStatusColumnName, []interface{}{DeliveryPending})
+	if err != nil {
+		return nil, err
+	}
+	var ret []WebhookDelivery
+	for k, v := range result {
+		ret = append(ret, *toWebhookDelivery(k, v))
+	}
+	return ret, nil
+}
+
+// PurgeExpiredDeliveries remove the finished deliveries whose retention has passed, and return the number of them.
+func (w *WebhookDeliveries) PurgeExpiredDeliveries(now int64) (int64, error) {
+	return w.ds.DeleteBefore(kWebhookDeliveryExpiresAtColumnName, now)
+}
+
+// DeleteDelivery remove the webhook delivery.
+func (w *WebhookDeliveries) DeleteDelivery(id string) error {
+	return w.ds.Delete(id)
+}
+
+func toWebhookDelivery(id string, m map[string]interface{}) *WebhookDelivery {
+	d := &WebhookDelivery{
+		Id:            id,
+		JobId:         toString(m[kWebhookDeliveryJobIdColumnName]),
+		Tenant:        toString(m[kWebhookDeliveryTenantColumnName]),
+		Url:           toString(m[kWebhookDeliveryUrlColumnName]),
+		EventType:     toString(m[kWebhookDeliveryEventTypeColumnName]),
+		Payload:       toString(m[kWebhookDeliveryPayloadColumnName]),
+		Status:        toString(m[kWebhookDeliveryStatusColumnName]),
+		Attempts:      toInt64(m[kWebhookDeliveryAttemptsColumnName]),
+		NextAttemptAt: toInt64(m[kWebhookDeliveryNextAttemptAtColumnName]),
+		CreatedAt:     toInt64(m[kWebhookDeliveryCreatedAtColumnName]),
+		UpdatedAt:     toInt64(m[kWebhookDeliveryUpdatedAtColumnName]),
+		ExpiresAt:     toInt64(m[kWebhookDeliveryExpiresAtColumnName]),
+	}
+	fromJSON(m[kWebhookDeliveryLogColumnName], &d.Log)
+	return d
+}
@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDeliveries(t *testing.T) {
+	t.Run("Test PutDelivery and GetDelivery", func(t *testing.T) {
+		ds, err := NewWebhookDeliveries(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		d := &WebhookDelivery{
+			Id:            "d1",
+			JobId:         "job1",
+			Tenant:        "tenant1",
+			Url:           "http://example.com/hook",
+			EventType:     "job.succeeded",
+			Payload:       `{"type": "job.succeeded"}`,
+			Status:        DeliveryPending,
+			Attempts:      2,
+			NextAttemptAt: 3000,
+			Log: []DeliveryAttempt{
+				{At: 1000, StatusCode: 500, LatencyMs: 12},
+				{At: 2000, Error: "connection refused"},
+			},
+			CreatedAt: 1000,
+			UpdatedAt: 2000,
+			ExpiresAt: 5000,
+		}
+		err = ds.PutDelivery(d)
+		require.NoError(t, err)
+
+		result, err := ds.GetDelivery("d1")
+		require.NoError(t, err)
+		require.Equal(t, d, result)
+
+		// Test get a non-exist delivery
+		result, err = ds.GetDelivery("non_exist_delivery")
+		require.NoError(t, err)
+		require.Nil(t, result)
+
+		// Test put with empty id
+		err = ds.PutDelivery(&WebhookDelivery{})
+		require.Error(t, err)
+	})
+
+	t.Run("Test ListAllDeliveries and DeleteDelivery", func(t *testing.T) {
+		ds, err := NewWebhookDeliveries(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		for _, id := range []string{"d1", "d2"} {
+			err = ds.PutDelivery(&WebhookDelivery{Id: id, Status: DeliveryDelivered})
+			require.NoError(t, err)
+		}
+		deliveries, err := ds.ListAllDeliveries()
+		require.NoError(t, err)
+		require.Len(t, deliveries, 2)
+
+		err = ds.DeleteDelivery("d2")
+		require.NoError(t, err)
+		deliveries, err = ds.ListAllDeliveries()
+		require.NoError(t, err)
+		require.Equal(t, []WebhookDelivery{{Id: "d1", Status: DeliveryDelivered}}, deliveries)
+	})
+
+	t.Run("Test ListPendingDeliveries without the payload", func(t *testing.T) {
+		ds, err := NewWebhookDeliveries(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutDelivery(&WebhookDelivery{Id: "d1", Status: DeliveryPending, Payload: "{}", NextAttemptAt: 3000})
+		require.NoError(t, err)
+		err = ds.PutDelivery(&WebhookDelivery{Id: "d2", Status: DeliveryFailed, Payload: "{}"})
+		require.NoError(t, err)
+		err = ds.PutDelivery(&WebhookDelivery{Id: "d3", Status: DeliveryDelivered, Payload: "{}"})
+		require.NoError(t, err)
+
+		pending, err := ds.ListPendingDeliveries()
+		require.NoError(t, err)
+		require.Equal(t, []WebhookDelivery{{Id: "d1", Status: DeliveryPending, NextAttemptAt: 3000}}, pending)
+	})
+
+	t.Run("Test ListDeliveries with filter", func(t *testing.T) {
+		ds, err := NewWebhookDeliveries(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		deliveries := []WebhookDelivery{
+			{Id: "d1", JobId: "job1", Tenant: "tenant1", Status: DeliveryDelivered},
+			{Id: "d2", JobId: "job1", Tenant: "tenant1", Status: DeliveryFailed},
+			{Id: "d3", JobId: "job2", Tenant: "tenant2", Status: DeliveryFailed},
+		}
+		for i := range deliveries {
+			err = ds.PutDelivery(&deliveries[i])
+			require.NoError(t, err)
+		}
+		ids := func(filter DeliveryFilter) []string {
+			result, err := ds.ListDeliveries(filter)
+			require.NoError(t, err)
+			var ret []string
+			for _, d := range result {
+				ret = append(ret, d.Id)
+			}
+			return ret
+		}
+		require.ElementsMatch(t, []string{"d1", "d2", "d3"}, ids(DeliveryFilter{}))
+		require.ElementsMatch(t, []string{"d1", "d2"}, ids(DeliveryFilter{JobId: "job1"}))
+		require.ElementsMatch(t, []string{"d2"}, ids(DeliveryFilter{Tenant: "tenant1", Status: DeliveryFailed}))
+		require.ElementsMatch(t, []string{"d2", "d3"}, ids(DeliveryFilter{Status: DeliveryFailed}))
+		require.Empty(t, ids(DeliveryFilter{JobId: "job2", Tenant: "tenant1"}))
+	})
+
+	t.Run("Test PurgeExpiredDeliveries", func(t *testing.T) {
+		ds, err := NewWebhookDeliveries(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		err = ds.PutDelivery(&WebhookDelivery{Id: "d1", Status: DeliveryDelivered, ExpiresAt: 2000})
+		require.NoError(t, err)
+		// The pending delivery is not expired.
+		err = ds.PutDelivery(&WebhookDelivery{Id: "d2", Status: DeliveryPending})
+		require.NoError(t, err)
+
+		n, err := ds.PurgeExpiredDeliveries(2000)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+		result, err := ds.GetDelivery("d1")
+		require.NoError(t, err)
+		require.Nil(t, result)
+		result, err = ds.GetDelivery("d2")
+		require.NoError(t, err)
+		require.NotNil(t, result)
+	})
+
+	t.Run("Test delivery with NULL or malformed attempt log", func(t *testing.T) {
+		ds, err := NewWebhookDeliveries(SQLite, ":memory:")
+		require.NoError(t, err)
+		defer ds.Close()
+
+		// The delivery which is never attempted.
+		err = ds.ds.Put("d1", map[string]interface{}{kWebhookDeliveryStatusColumnName: DeliveryPending})
+		require.NoError(t, err)
+		result, err := ds.GetDelivery("d1")
+		require.NoError(t, err)
+		require.Equal(t, &WebhookDelivery{Id: "d1", Status: DeliveryPending}, result)
+
+		err = ds.ds.Put("d2", map[string]interface{}{
+			kWebhookDeliveryStatusColumnName:   DeliveryFailed,
+			kWebhookDeliveryAttemptsColumnName: 1,
+			kWebhookDeliveryLogColumnName:      `[{"at": 1000, "status_code": "500"}]`,
+		})
+		require.NoError(t, err)
+		result, err = ds.GetDelivery("d2")
+		require.NoError(t, err)
+		require.Equal(t, DeliveryFailed, result.Status)
+		require.Equal(t, int64(1), result.Attempts)
+	})
+}
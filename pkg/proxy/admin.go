@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+// adminAuth authenticate the admin API requests with the bearer token.
+func (s *Server) adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.Config.AdminToken == "" {
+			return echo.NewHTTPError(http.StatusForbidden, "admin API is disabled")
+		}
+		if !s.isAdmin(c.Request()) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid admin token")
+		}
+		return next(c)
+	}
+}
+
+// isAdmin report whether the request carries the admin token.
+func (s *Server) isAdmin(req *http.Request) bool {
+	if s.Config.AdminToken == "" {
+		return false
+	}
+	token, found := strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(s.Config.AdminToken)) == 1
+}
+
+// serviceView is the service metadata together with the live state of its backend.
+type serviceView struct {
+	datastore.SDServiceEndpoint
+	Live *backendLiveState `json:"live"` // nil if the backend is not loaded by this proxy yet
+}
+
+type backendLiveState struct {
+	InFlight    int64                         `json:"in_flight"`
+	Health      *datastore.BackendHealthState `json:"health"`
+	LoadedModel string                        `json:"loaded_model,omitempty"`
+	ModelError  string                        `json:"model_error,omitempty"`
+}
+
+// liveState return the live state of the backend. The loaded model is queried from the backend only if withModel is true,
+// since it may wake up a cold serverless backend.
+func (s *Server) liveState(ctx context.Context, p *ReverseProxy, withModel bool) *backendLiveState {
+	state := &backendLiveState{
+		InFlight: p.InFlight(),
+		Health:   p.Health.snapshot(p.Name),
+	}
+	if withModel {
+		model, err := s.loadedModel(ctx, p)
+		if err != nil {
+			state.ModelError = err.Error()
+		}
+		state.LoadedModel = model
+	}
+	return state
+}
+
+// loadedModel return the checkpoint loaded by the backend.
+func (s *Server) loadedModel(ctx context.Context, p *ReverseProxy) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Target.JoinPath("/sdapi/v1/options").String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.HttpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get options returns status %d", resp.StatusCode)
+	}
+	var options struct {
+		Checkpoint string `json:"sd_model_checkpoint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&options); err != nil {
+		return "", err
+	}
+	return options.Checkpoint, nil
+}
+
+func (s *Server) viewService(ctx context.Context, srv *datastore.SDServiceEndpoint, withModel bool) *serviceView {
+	view := &serviceView{SDServiceEndpoint: *srv}
+	if p := s.findProxy(srv.Name); p != nil {
+		view.Live = s.liveState(ctx, p, withModel)
+	}
+	return view
+}
+
+func (s *Server) listServicesHandler(c echo.Context) error {
+	services, err := s.SDServicesDatastore.ListAllServiceEndpoints()
+	if err != nil {
+		return err
+	}
+	withModel := c.QueryParam("model") == "true"
+	views := make([]*serviceView, len(services))
+	var wg sync.WaitGroup
+	for i := range services {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			views[i] = s.viewService(c.Request().Context(), &services[i], withModel)
+		}(i)
+	}
+	wg.Wait()
+	return c.JSON(http.StatusOK, views)
+}
+
+func (s *Server) getServiceHandler(c echo.Context) error {
+	srv, err := s.SDServicesDatastore.GetService(c.Param("name"))
+	if err != nil {
+		return err
+	}
+	if srv == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "service not found")
+	}
+	return c.JSON(http.StatusOK, s.viewService(c.Request().Context(), srv, c.QueryParam("model") == "true"))
+}
+
+func (s *Server) createServiceHandler(c echo.Context) error {
+	srv := &datastore.SDServiceEndpoint{}
+	if err := c.Bind(srv); err != nil {
+		return err
+	}
+	if err := validateService(srv); err != nil {
+		return err
+	}
+	existing, err := s.SDServicesDatastore.GetService(srv.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return echo.NewHTTPError(http.StatusConflict, "service already exists")
+	}
+	return s.putService(c, http.StatusCreated, srv)
+}
+
+func (s *Server) updateServiceHandler(c echo.Context) error {
+	existing, err := s.SDServicesDatastore.GetService(c.Param("name"))
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "service not found")
+	}
+	// The fields absent in the request body keep their values.
+	var patch struct {
+		Endpoint       *string            `json:"endpoint"`
+		Weight         *int64             `json:"weight"`
+		Labels         *map[string]string `json:"labels"`
+		MaxConcurrency *int64             `json:"max_concurrency"`
+		Cordoned       *bool              `json:"cordoned"`
+		Version        *string            `json:"version"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&patch); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	srv := existing
+	if patch.Endpoint != nil {
+		srv.Endpoint = *patch.Endpoint
+	}
+	if patch.Weight != nil {
+		srv.Weight = *patch.Weight
+	}
+	if patch.Labels != nil {
+		srv.Labels = *patch.Labels
+	}
+	if patch.MaxConcurrency != nil {
+		srv.MaxConcurrency = *patch.MaxConcurrency
+	}
+	if patch.Cordoned != nil {
+		srv.Cordoned = *patch.Cordoned
+	}
+	if patch.Version != nil {
+		srv.Version = *patch.Version
+	}
+	if err := validateService(srv); err != nil {
+		return err
+	}
+	return s.putService(c, http.StatusOK, srv)
+}
+
+func (s *Server) deleteServiceHandler(c echo.Context) error {
+	if err := s.SDServicesDatastore.DeleteServiceEndpoint(c.Param("name")); err != nil {
+		return err
+	}
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// cordonServiceHandler stop or resume sending new requests to the service.
+func (s *Server) cordonServiceHandler(cordoned bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		srv, err := s.SDServicesDatastore.GetService(c.Param("name"))
+		if err != nil {
+			return err
+		}
+		if srv == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "service not found")
+		}
+		srv.Cordoned = cordoned
+		return s.putService(c, http.StatusOK, srv)
+	}
+}
+
+// putService persist the service and apply it to this proxy at once.
+// The other proxy replicas apply it on their next reload.
+func (s *Server) putService(c echo.Context, code int, srv *datastore.SDServiceEndpoint) error {
+	if err := s.SDServicesDatastore.PutService(srv); err != nil {
+		return err
+	}
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	return c.JSON(code, s.viewService(c.Request().Context(), srv, false))
+}
+
+func validateService(srv *datastore.SDServiceEndpoint) error {
+	if srv.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	target, err := url.Parse(srv.Endpoint)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid endpoint: %s", srv.Endpoint))
+	}
+	if srv.Weight < 0 || srv.MaxConcurrency < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "weight and max_concurrency cannot be negative")
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminServices(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "token"
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	do := func(method string, path string, body string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Test authentication", func(t *testing.T) {
+		require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/services", "", "").Code)
+		require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/admin/services", "", "wrong").Code)
+		require.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/services", "", "token").Code)
+	})
+
+	t.Run("Test create, update and delete", func(t *testing.T) {
+		rec := do(http.MethodPost, "/admin/services", `{"name":"s0","endpoint":"http://127.0.0.1:1235","weight":2,"labels":{"gpu":"a10"}}`, "token")
+		require.Equal(t, http.StatusCreated, rec.Code)
+		require.NotNil(t, s.findProxy("s0"))
+		require.Equal(t, int64(2), s.findProxy("s0").Weight())
+
+		rec = do(http.MethodPost, "/admin/services", `{"name":"s0","endpoint":"http://127.0.0.1:1235"}`, "token")
+		require.Equal(t, http.StatusConflict, rec.Code)
+		rec = do(http.MethodPost, "/admin/services", `{"name":"s1","endpoint":"invalid"}`, "token")
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+
+		rec = do(http.MethodPut, "/admin/services/s0", `{"max_concurrency":1}`, "token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		srv := s.findProxy("s0").Service()
+		require.Equal(t, int64(1), srv.MaxConcurrency)
+		require.Equal(t, int64(2), srv.Weight)
+		require.Equal(t, map[string]string{"gpu": "a10"}, srv.Labels)
+
+		rec = do(http.MethodGet, "/admin/services/s0", "", "token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), `"in_flight":0`)
+
+		rec = do(http.MethodDelete, "/admin/services/s0", "", "token")
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		require.Nil(t, s.findProxy("s0"))
+		require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/services/s0", "", "token").Code)
+	})
+
+	t.Run("Test cordon and uncordon", func(t *testing.T) {
+		do(http.MethodPost, "/admin/services", `{"name":"s0","endpoint":"http://127.0.0.1:1235"}`, "token")
+		do(http.MethodPost, "/admin/services", `{"name":"s1","endpoint":"http://127.0.0.1:1236"}`, "token")
+
+		require.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/services/s0/cordon", "", "token").Code)
+		for i := 0; i < 4; i++ {
+			p, err := s.selectProxy(httptest.NewRequest(http.MethodGet, "/sdapi/v1/sd-models", nil), nil)
+			require.NoError(t, err)
+			require.Equal(t, "s1", p.Name)
+		}
+
+		require.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/services/s0/uncordon", "", "token").Code)
+		selected := make(map[string]bool)
+		for i := 0; i < 4; i++ {
+			p, err := s.selectProxy(httptest.NewRequest(http.MethodGet, "/sdapi/v1/sd-models", nil), nil)
+			require.NoError(t, err)
+			selected[p.Name] = true
+		}
+		require.Equal(t, 2, len(selected))
+	})
+}
+
+func TestWeightedRoundRobinReverseProxySelector(t *testing.T) {
+	p0 := &ReverseProxy{Name: "s0"}
+	p0.setService(&datastore.SDServiceEndpoint{Name: "s0", Weight: 3})
+	p1 := &ReverseProxy{Name: "s1"}
+	proxies := []*ReverseProxy{p0, p1}
+
+	selector := NewWeightedRoundRobinReverseProxySelector()
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		p, err := selector.Select(proxies, nil)
+		require.NoError(t, err)
+		counts[p.Name]++
+	}
+	require.Equal(t, map[string]int{"s0": 6, "s1": 2}, counts)
+
+	// The current weights of the backends outside the candidates are kept.
+	p2 := &ReverseProxy{Name: "s2"}
+	for i := 0; i < 2; i++ {
+		p, err := selector.Select([]*ReverseProxy{p0, p1}, nil)
+		require.NoError(t, err)
+		require.Equal(t, "s0", p.Name)
+		p, err = selector.Select([]*ReverseProxy{p2}, nil)
+		require.NoError(t, err)
+		require.Equal(t, "s2", p.Name)
+	}
+	p, err := selector.Select(proxies, nil)
+	require.NoError(t, err)
+	require.Equal(t, "s1", p.Name)
+	require.Len(t, selector.current, 3)
+
+	// The removed backend is forgotten.
+	p2.removed.Store(true)
+	_, err = selector.Select(proxies, nil)
+	require.NoError(t, err)
+	require.Len(t, selector.current, 2)
+
+	_, err = selector.Select(nil, nil)
+	require.ErrorIs(t, err, ErrNoReverseProxy)
+}
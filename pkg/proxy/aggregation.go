@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const kSDModelsPath = "/sdapi/v1/sd-models"
+const kLorasPath = "/sdapi/v1/loras"
+
+// AggregationConfig is the configuration of the cluster-wide listings.
+type AggregationConfig struct {
+	Enabled         bool
+	Timeout         time.Duration // the timeout of the listing request to one backend
+	RefreshInterval time.Duration // the interval to refresh the model catalog for the model-aware routing, 0 disables the refreshing
+}
+
+// listing is how a listing endpoint is merged across the backends.
+type listing struct {
+	path string
+	// idField is the field which identifies the item of the list, e.g. "title" of the checkpoints.
+	// The listing is a map of lists or a map of maps if it is empty.
+	idField string
+}
+
+var listings = []listing{
+	{path: kSDModelsPath, idField: "title"},
+	{path: kLorasPath, idField: "name"},
+	{path: "/sdapi/v1/hypernetworks", idField: "name"},
+	{path: "/sdapi/v1/extensions", idField: "name"},
+	{path: "/sdapi/v1/embeddings"},
+	{path: "/sdapi/v1/scripts"},
+}
+
+// backendListing is the listing returned by one backend.
+type backendListing struct {
+	backend string
+	body    []byte
+}
+
+// Aggregator answers the listing endpoints with the union of the listings of all the available backends,
+// where each item is annotated with the backends which provide it.
+// The checkpoints and the LoRAs of the backends are kept in the catalog for the model-aware routing.
+type Aggregator struct {
+	Config  *AggregationConfig
+	Catalog *ModelCatalog
+	server  *Server
+}
+
+func NewAggregator(cfg *AggregationConfig, catalog *ModelCatalog, s *Server) *Aggregator {
+	return &Aggregator{
+		Config:  cfg,
+		Catalog: catalog,
+		server:  s,
+	}
+}
+
+// Run refresh the model catalog periodically until the context is canceled.
+func (a *Aggregator) Run(ctx context.Context) {
+	if a.Config.RefreshInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(a.Config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		for _, path := range []string{kSDModelsPath, kLorasPath} {
+			a.fanOut(ctx, path, "", "")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Aggregator) handler(l listing) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		results := a.fanOut(req.Context(), l.path, req.URL.RawQuery, requestPool(req))
+		if len(results) == 0 {
+			return echo.NewHTTPError(http.StatusBadGateway, fmt.Sprintf("no backend returns %s", l.path))
+		}
+		var merged interface{}
+		var err error
+		if l.idField != "" {
+			merged, err = mergeLists(results, l.idField)
+		} else {
+			merged, err = mergeMaps(results)
+		}
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, merged)
+	}
+}
+
+// fanOut get the listing from all the available backends of the pool, the failed backends are skipped.
+// The results are ordered by the backend name.
+func (a *Aggregator) fanOut(ctx context.Context, path string, query string, pool string) []backendListing {
+	var proxies []*ReverseProxy
+	for _, p := range a.server.candidates(nil) {
+		if pool == "" || p.Pool() == pool {
+			proxies = append(proxies, p)
+		}
+	}
+	results := make([]*backendListing, len(proxies))
+	var wg sync.WaitGroup
+	for i, p := range proxies {
+		wg.Add(1)
+		go func(i int, p *ReverseProxy) {
+			defer wg.Done()
+			body, err := a.get(ctx, p, path, query)
+			if err != nil {
+				a.server.Echo.Logger.Warnf("get %s from %s failed, it is skipped in the listing: %v", path, p.Name, err)
+				return
+			}
+			results[i] = &backendListing{backend: p.Name, body: body}
+		}(i, p)
+	}
+	wg.Wait()
+
+	var found []backendListing
+	for _, r := range results {
+		if r != nil {
+			found = append(found, *r)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].backend < found[j].backend })
+	if path == kSDModelsPath || path == kLorasPath {
+		a.Catalog.update(path, found, a.server.currentProxies())
+	}
+	return found
+}
+
+func (a *Aggregator) get(ctx context.Context, p *ReverseProxy, path string, query string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.Config.Timeout)
+	defer cancel()
+	u := p.Target.JoinPath(path)
+	u.RawQuery = query
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.server.HttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s returns status %d", path, resp.StatusCode)
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// mergeLists merge the lists of objects by the id field, and annotate each object with the "backends" which provide it.
+// The object of the first backend is kept if the backends disagree.
+func mergeLists(results []backendListing, idField string) ([]map[string]interface{}, error) {
+	merged := []map[string]interface{}{}
+	index := make(map[string]map[string]interface{})
+	for _, r := range results {
+		var items []map[string]interface{}
+		if err := json.Unmarshal(r.body, &items); err != nil {
+			return nil, fmt.Errorf("invalid listing of %s: %v", r.backend, err)
+		}
+		for _, item := range items {
+			id := fmt.Sprint(item[idField])
+			if existing, ok := index[id]; ok {
+				existing["backends"] = append(existing["backends"].([]string), r.backend)
+				continue
+			}
+			item["backends"] = []string{r.backend}
+			index[id] = item
+			merged = append(merged, item)
+		}
+	}
+	return merged, nil
+}
+
+// mergeMaps merge the map listings, e.g. the embeddings {"loaded": {name: {...}}, "skipped": {...}}
+// and the scripts {"txt2img": [name, ...], "img2img": [...]}.
+// The objects are annotated with the "backends" which provide them, and the backends of the names in the lists
+// are in the "backends" map of the result, keyed by the name.
+func mergeMaps(results []backendListing) (map[string]interface{}, error) {
+	merged := make(map[string]interface{})
+	backends := make(map[string][]string)
+	listed := make(map[string]map[string]bool) // the names in each list
+	for _, r := range results {
+		var m map[string]interface{}
+		if err := json.Unmarshal(r.body, &m); err != nil {
+			return nil, fmt.Errorf("invalid listing of %s: %v", r.backend, err)
+		}
+		for key, val := range m {
+			switch v := val.(type) {
+			case map[string]interface{}:
+				group, _ := merged[key].(map[string]interface{})
+				if group == nil {
+					group = make(map[string]interface{})
+					merged[key] = group
+				}
+				for name, item := range v {
+					obj, ok := item.(map[string]interface{})
+					if !ok {
+						group[name] = item
+						continue
+					}
+					if existing, ok := group[name].(map[string]interface{}); ok {
+						existing["backends"] = append(existing["backends"].([]string), r.backend)
+						continue
+					}
+					obj["backends"] = []string{r.backend}
+					group[name] = obj
+				}
+			case []interface{}:
+				names, _ := merged[key].([]interface{})
+				if listed[key] == nil {
+					listed[key] = make(map[string]bool)
+				}
+				for _, item := range v {
+					name := fmt.Sprint(item)
+					if !listed[key][name] {
+						listed[key][name] = true
+						names = append(names, item)
+					}
+					if n := len(backends[name]); n == 0 || backends[name][n-1] != r.backend {
+						backends[name] = append(backends[name], r.backend)
+					}
+				}
+				merged[key] = names
+			default:
+				if _, ok := merged[key]; !ok {
+					merged[key] = val
+				}
+			}
+		}
+	}
+	if len(backends) > 0 {
+		merged["backends"] = backends
+	}
+	return merged, nil
+}
+
+// ModelCatalog is which checkpoints and LoRAs each backend has.
+type ModelCatalog struct {
+	mutex       sync.RWMutex
+	checkpoints map[string]map[string]bool // the backend name to the names, titles and hashes of its checkpoints
+	loras       map[string]map[string]bool // the backend name to the names of its LoRAs
+}
+
+func NewModelCatalog() *ModelCatalog {
+	return &ModelCatalog{
+		checkpoints: make(map[string]map[string]bool),
+		loras:       make(map[string]map[string]bool),
+	}
+}
+
+// update replace the catalog of the backends with their listings, and forget the backends which are removed.
+func (mc *ModelCatalog) update(path string, results []backendListing, proxies []*ReverseProxy) {
+	catalog := make(map[string]map[string]bool)
+	for _, r := range results {
+		var items []struct {
+			Title     string `json:"title"`
+			ModelName string `json:"model_name"`
+			Name      string `json:"name"`
+			Alias     string `json:"alias"`
+			Hash      string `json:"hash"`
+			Sha256    string `json:"sha256"`
+		}
+		if err := json.Unmarshal(r.body, &items); err != nil {
+			continue
+		}
+		names := make(map[string]bool)
+		for _, item := range items {
+			for _, name := range []string{item.Title, item.ModelName, item.Name, item.Alias, item.Hash, item.Sha256} {
+				if name != "" {
+					names[name] = true
+				}
+			}
+		}
+		catalog[r.backend] = names
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	target := mc.checkpoints
+	if path == kLorasPath {
+		target = mc.loras
+	}
+	for backend, names := range catalog {
+		target[backend] = names
+	}
+	current := make(map[string]bool)
+	for _, p := range proxies {
+		current[p.Name] = true
+	}
+	for _, models := range []map[string]map[string]bool{mc.checkpoints, mc.loras} {
+		for backend := range models {
+			if !current[backend] {
+				delete(models, backend)
+			}
+		}
+	}
+}
+
+// has report whether the backend is in the catalog, and whether it has the model.
+func (mc *ModelCatalog) has(models map[string]map[string]bool, backend string, name string) (bool, bool) {
+	names, known := models[backend]
+	return known, names[name]
+}
+
+// requirement is the checkpoint and the LoRAs a generation request needs.
+type requirement struct {
+	checkpoint string
+	loras      []string
+}
+
+type requirementKey struct{}
+
+var loraPattern = regexp.MustCompile(`<lora:([^:>]+)`)
+
+// parseRequirement return the checkpoint and the LoRAs required by the sdapi generation payload.
+func parseRequirement(body []byte) *requirement {
+	var payload struct {
+		Prompt           interface{}            `json:"prompt"`
+		OverrideSettings map[string]interface{} `json:"override_settings"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		return nil
+	}
+	r := &requirement{}
+	r.checkpoint, _ = payload.OverrideSettings["sd_model_checkpoint"].(string)
+	if prompt, ok := payload.Prompt.(string); ok {
+		for _, m := range loraPattern.FindAllStringSubmatch(prompt, -1) {
+			r.loras = append(r.loras, m[1])
+		}
+	}
+	if r.checkpoint == "" && len(r.loras) == 0 {
+		return nil
+	}
+	return r
+}
+
+// withRequirement attach the model requirement of the request body to the request, for the model-aware routing.
+func withRequirement(req *http.Request, body []byte) *http.Request {
+	if req.Method != http.MethodPost || body == nil {
+		return req
+	}
+	r := parseRequirement(body)
+	if r == nil {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), requirementKey{}, r))
+}
+
+// ModelSelector prefers the backends which have the checkpoint and the LoRAs the request needs,
+// so that the backend does not have to load or download them. The backends missing from the catalog
+// are considered to have everything. If no backend satisfies the request, all the candidates are kept.
+type ModelSelector struct {
+	Next    ReverseProxySelector
+	Catalog *ModelCatalog
+}
+
+func NewModelSelector(next ReverseProxySelector, catalog *ModelCatalog) *ModelSelector {
+	return &ModelSelector{
+		Next:    next,
+		Catalog: catalog,
+	}
+}
+
+func (s *ModelSelector) Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+	r, _ := req.Context().Value(requirementKey{}).(*requirement)
+	if r == nil {
+		return s.Next.Select(proxies, req)
+	}
+	s.Catalog.mutex.RLock()
+	var capable []*ReverseProxy
+	for _, p := range proxies {
+		if s.satisfiesLocked(p.Name, r) {
+			capable = append(capable, p)
+		}
+	}
+	s.Catalog.mutex.RUnlock()
+	if len(capable) == 0 {
+		return s.Next.Select(proxies, req)
+	}
+	return s.Next.Select(capable, req)
+}
+
+func (s *ModelSelector) satisfiesLocked(backend string, r *requirement) bool {
+	if r.checkpoint != "" {
+		if known, ok := s.Catalog.has(s.Catalog.checkpoints, backend, r.checkpoint); known && !ok {
+			return false
+		}
+	}
+	for _, lora := range r.loras {
+		if known, ok := s.Catalog.has(s.Catalog.loras, backend, lora); known && !ok {
+			return false
+		}
+	}
+	return true
+}
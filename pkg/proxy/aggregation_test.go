@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeListingBackend is a backend with its own checkpoints, LoRAs and scripts, which echoes its name on generations.
+func fakeListingBackend(name string, checkpoints []string, loras []string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case kSDModelsPath:
+			var models []map[string]string
+			for _, c := range checkpoints {
+				models = append(models, map[string]string{"title": c + ".safetensors", "model_name": c})
+			}
+			json.NewEncoder(w).Encode(models)
+		case kLorasPath:
+			var items []map[string]string
+			for _, l := range loras {
+				items = append(items, map[string]string{"name": l})
+			}
+			json.NewEncoder(w).Encode(items)
+		case "/sdapi/v1/scripts":
+			json.NewEncoder(w).Encode(map[string][]string{"txt2img": {"common", name}, "img2img": {"common"}})
+		default:
+			w.Write([]byte(name))
+		}
+	}))
+}
+
+func TestAggregator(t *testing.T) {
+	config := DefaultConfig()
+	config.Aggregation.Enabled = true
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	b0 := fakeListingBackend("s0", []string{"a", "b"}, []string{"x"})
+	defer b0.Close()
+	b1 := fakeListingBackend("s1", []string{"b", "c"}, []string{"y"})
+	defer b1.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", b0.URL))
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s1", b1.URL))
+	require.NoError(t, s.Reload())
+
+	get := func(path string, v interface{}) {
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+
+	t.Run("Test list union is annotated with backends", func(t *testing.T) {
+		var models []struct {
+			Title    string   `json:"title"`
+			Backends []string `json:"backends"`
+		}
+		get(kSDModelsPath, &models)
+		require.Len(t, models, 3)
+		backends := make(map[string][]string)
+		for _, m := range models {
+			backends[m.Title] = m.Backends
+		}
+		require.Equal(t, []string{"s0"}, backends["a.safetensors"])
+		require.Equal(t, []string{"s0", "s1"}, backends["b.safetensors"])
+		require.Equal(t, []string{"s1"}, backends["c.safetensors"])
+	})
+
+	t.Run("Test map union is annotated with backends", func(t *testing.T) {
+		var scripts struct {
+			Txt2Img  []string            `json:"txt2img"`
+			Img2Img  []string            `json:"img2img"`
+			Backends map[string][]string `json:"backends"`
+		}
+		get("/sdapi/v1/scripts", &scripts)
+		require.Equal(t, []string{"common", "s0", "s1"}, scripts.Txt2Img)
+		require.Equal(t, []string{"common"}, scripts.Img2Img)
+		require.Equal(t, []string{"s0", "s1"}, scripts.Backends["common"])
+		require.Equal(t, []string{"s1"}, scripts.Backends["s1"])
+	})
+
+	t.Run("Test routing by the models the backends have", func(t *testing.T) {
+		var loras []interface{}
+		get(kLorasPath, &loras)
+
+		generate := func(body string) string {
+			rec := httptest.NewRecorder()
+			s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img", strings.NewReader(body)))
+			require.Equal(t, http.StatusOK, rec.Code)
+			return rec.Body.String()
+		}
+		for i := 0; i < 4; i++ {
+			require.Equal(t, "s0", generate(`{"override_settings": {"sd_model_checkpoint": "a"}}`))
+			require.Equal(t, "s1", generate(`{"override_settings": {"sd_model_checkpoint": "c.safetensors"}}`))
+			require.Equal(t, "s1", generate(`{"prompt": "cat <lora:y:0.8>", "override_settings": {"sd_model_checkpoint": "b"}}`))
+		}
+	})
+
+	t.Run("Test removed backends are dropped from the catalog", func(t *testing.T) {
+		require.NoError(t, s.SDServicesDatastore.DeleteServiceEndpoint("s1"))
+		require.NoError(t, s.Reload())
+		var models []interface{}
+		get(kSDModelsPath, &models)
+		require.Len(t, models, 2)
+
+		s.Aggregator.Catalog.mutex.RLock()
+		defer s.Aggregator.Catalog.mutex.RUnlock()
+		require.Contains(t, s.Aggregator.Catalog.checkpoints, "s0")
+		require.NotContains(t, s.Aggregator.Catalog.checkpoints, "s1")
+		// The LoRAs are not listed again yet, but the removed backend is dropped too.
+		require.Contains(t, s.Aggregator.Catalog.loras, "s0")
+		require.NotContains(t, s.Aggregator.Catalog.loras, "s1")
+	})
+}
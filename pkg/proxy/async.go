@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The proxy asks the agent to run the call in the background with X-SD-Async: true, and the agent returns 202
+// with the task id in the X-SD-Async-Task header, see the agent package.
+const kAsyncHeaderName = "X-SD-Async"
+const kAsyncTaskHeaderName = "X-SD-Async-Task"
+const kAsyncStatusHeaderName = "X-SD-Async-Status"
+
+// kAsyncHeartbeatHeaderName is the request header by which the client opts in the heartbeats, e.g. X-SD-Heartbeat: true.
+// The client must then read the status code from the X-SD-Status-Code trailer, since the status line may be 200
+// before the response is known.
+const kAsyncHeartbeatHeaderName = "X-SD-Heartbeat"
+
+// kAsyncStatusCodeTrailerName is the trailer of the status code of the backend response,
+// which is sent when the status line is already sent with the heartbeats.
+const kAsyncStatusCodeTrailerName = "X-SD-Status-Code"
+
+// AsyncConfig is the configuration of the sync-to-async bridging between the proxy and the agents.
+type AsyncConfig struct {
+	Enabled   bool
+	Paths     []string      // the POST paths which are run in the background by the agents
+	PollWait  time.Duration // the wait of one long-poll to the agent, must be shorter than the gateway timeout in front of the agent
+	Heartbeat time.Duration // the interval of the whitespace heartbeats to the opted-in clients while the response is not ready
+	Timeout   time.Duration // the max time to wait for the response
+}
+
+func (cfg *AsyncConfig) match(req *http.Request) bool {
+	if !cfg.Enabled || req.Method != http.MethodPost {
+		return false
+	}
+	for _, path := range cfg.Paths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// asyncWriter passes the response of the backend to the client, unless the backend accepts the call
+// as a background task, in which case the response is swallowed and the task id is recorded.
+type asyncWriter struct {
+	http.ResponseWriter
+	taskId string
+}
+
+func (w *asyncWriter) WriteHeader(code int) {
+	if taskId := w.Header().Get(kAsyncTaskHeaderName); code == http.StatusAccepted && taskId != "" {
+		w.taskId = taskId
+		for _, h := range []string{kAsyncTaskHeaderName, kAsyncStatusHeaderName, echo.HeaderLocation, echo.HeaderContentLength, echo.HeaderContentType} {
+			w.Header().Del(h)
+		}
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *asyncWriter) Write(b []byte) (int, error) {
+	if w.taskId != "" {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush is required by the reverse proxy to stream the response.
+func (w *asyncWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.taskId == "" {
+		f.Flush()
+	}
+}
+
+// asyncResult is the response of a background task.
+type asyncResult struct {
+	code        int
+	contentType string
+	body        []byte
+	err         error
+}
+
+// bridgeAsync long-poll the agent for the response of the background task, and send it to the client as if
+// the call was synchronous. The status line is held until the response is ready, unless the client opts in the
+// heartbeats. Then if the response is not ready within the heartbeat interval, the status line is sent with 200
+// and whitespace is sent periodically to keep the connection alive, the status code of the backend is then sent
+// in the X-SD-Status-Code trailer.
+func (s *Server) bridgeAsync(c echo.Context, r *http.Request, p *ReverseProxy, taskId string) error {
+	cfg := &s.Config.Async
+	req := c.Request()
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Timeout)
+	defer cancel()
+	results := make(chan *asyncResult, 1)
+	go func() {
+		results <- s.pollAsync(ctx, p, taskId)
+	}()
+
+	resp := c.Response()
+	committed := false
+	var heartbeats <-chan time.Time
+	if req.Header.Get(kAsyncHeartbeatHeaderName) == "true" {
+		heartbeat := time.NewTicker(cfg.Heartbeat)
+		defer heartbeat.Stop()
+		heartbeats = heartbeat.C
+	}
+	for {
+		select {
+		case result := <-results:
+			if result.err != nil {
+				if req.Context().Err() != nil {
+					s.interruptOnDisconnect(req, p, taskId)
+					return nil
+				}
+				if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+					go s.notifyInterrupt(p, taskId, true)
+				}
+				result = &asyncResult{
+					code:        http.StatusGatewayTimeout,
+					contentType: echo.MIMEApplicationJSON,
+					body:        []byte(fmt.Sprintf(`{"message": %q}`, fmt.Sprintf("wait for async task %s failed: %v", taskId, result.err))),
+				}
+			}
+			if !committed {
+				resp.Header().Set(echo.HeaderContentType, result.contentType)
+				resp.WriteHeader(result.code)
+			} else {
+				resp.Header().Set(kAsyncStatusCodeTrailerName, strconv.Itoa(result.code))
+			}
+			_, err := resp.Write(result.body)
+			return err
+		case <-heartbeats:
+			if !committed {
+				resp.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+				resp.Header().Set("Trailer", kAsyncStatusCodeTrailerName)
+				resp.WriteHeader(http.StatusOK)
+				committed = true
+			}
+			// The leading whitespace of the json response is ignored by the clients.
+			if _, err := resp.Write([]byte("\n")); err != nil {
+				return nil
+			}
+			resp.Flush()
+		}
+	}
+}
+
+// pollAsync long-poll the agent until the response of the task is ready.
+func (s *Server) pollAsync(ctx context.Context, p *ReverseProxy, taskId string) *asyncResult {
+	u := p.Target.JoinPath("/internal/async-tasks", taskId)
+	u.RawQuery = "wait=" + s.Config.Async.PollWait.String()
+	for retry := 1; ; retry++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return &asyncResult{err: err}
+		}
+		resp, err := s.HttpClient.Do(req)
+		if err == nil {
+			body, rerr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case rerr != nil:
+				err = rerr
+			case resp.StatusCode == http.StatusAccepted && resp.Header.Get(kAsyncStatusHeaderName) == "running":
+				retry = 0
+				continue
+			case resp.StatusCode == http.StatusNotFound && resp.Header.Get(kAsyncStatusHeaderName) == "":
+				return &asyncResult{err: fmt.Errorf("the task is lost by %s", p.Name)}
+			default:
+				return &asyncResult{code: resp.StatusCode, contentType: resp.Header.Get(echo.HeaderContentType), body: body}
+			}
+		}
+		// The long-poll may be cut by the gateway, poll again after a backoff.
+		if ctx.Err() != nil {
+			return &asyncResult{err: ctx.Err()}
+		}
+		backoff := jitteredBackoff(s.Config.Retry.BackoffBase, s.Config.Retry.BackoffMax, int64(retry))
+		s.Echo.Logger.Warnf("poll async task %s on %s failed, retry in %s: %v", taskId, p.Name, backoff, err)
+		select {
+		case <-ctx.Done():
+			return &asyncResult{err: ctx.Err()}
+		case <-time.After(backoff):
+		}
+	}
+}
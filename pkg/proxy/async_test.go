@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/agent"
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncBridge(t *testing.T) {
+	config := DefaultConfig()
+	config.Async.Enabled = true
+	config.Async.PollWait = 30 * time.Millisecond
+	config.Async.Heartbeat = 50 * time.Millisecond
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Header().Set("Content-Type", "application/json")
+		if body["prompt"] == "slow" {
+			time.Sleep(300 * time.Millisecond)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"detail": "invalid sampler"}`))
+			return
+		}
+		w.Write([]byte(`{"images": ["cat"]}`))
+	}))
+	defer backend.Close()
+	a := agent.NewAgent(backend.URL, datastore.SQLite, ":memory:")
+	defer a.Close()
+	agentServer := httptest.NewServer(a.Echo)
+	defer agentServer.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", agentServer.URL))
+	require.NoError(t, s.Reload())
+	proxyServer := httptest.NewServer(s.Echo)
+	defer proxyServer.Close()
+
+	generate := func(prompt string, heartbeat bool) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodPost, proxyServer.URL+"/sdapi/v1/txt2img", strings.NewReader(`{"prompt": "`+prompt+`"}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if heartbeat {
+			req.Header.Set(kAsyncHeartbeatHeaderName, "true")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("Test the fast response is relayed as is", func(t *testing.T) {
+		resp, body := generate("fast", true)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.JSONEq(t, `{"images": ["cat"]}`, body)
+		require.Empty(t, resp.Trailer.Get(kAsyncStatusCodeTrailerName))
+	})
+
+	t.Run("Test the status line of the slow response is held without heartbeats", func(t *testing.T) {
+		resp, body := generate("slow", false)
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.JSONEq(t, `{"detail": "invalid sampler"}`, body)
+		require.False(t, strings.HasPrefix(body, "\n"))
+		require.Empty(t, resp.Trailer.Get(kAsyncStatusCodeTrailerName))
+	})
+
+	t.Run("Test the slow response is sent after the heartbeats", func(t *testing.T) {
+		resp, body := generate("slow", true)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.True(t, strings.HasPrefix(body, "\n"))
+		require.JSONEq(t, `{"detail": "invalid sampler"}`, body)
+		require.Equal(t, "422", resp.Trailer.Get(kAsyncStatusCodeTrailerName))
+	})
+
+	t.Run("Test the request is forwarded as is if async is disabled", func(t *testing.T) {
+		s.Config.Async.Enabled = false
+		defer func() { s.Config.Async.Enabled = true }()
+		resp, body := generate("slow", false)
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+		require.JSONEq(t, `{"detail": "invalid sampler"}`, body)
+	})
+}
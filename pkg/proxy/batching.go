@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/agent"
+	"github.com/labstack/echo/v4"
+)
+
+const kTxt2ImgPath = "/sdapi/v1/txt2img"
+
+// BatchingConfig is the configuration of the txt2img request coalescer.
+type BatchingConfig struct {
+	Enabled      bool          // coalesce the compatible txt2img requests into one batched generation
+	Window       time.Duration // the time to wait for more compatible requests after the first one arrives
+	MaxBatchSize int           // the max number of requests in one batch
+	// PerImagePrompts means the backends accept a list of prompts and a list of seeds in one batch,
+	// one for each image, so the requests which differ in prompt or seed can be batched together.
+	// Otherwise, only the requests with the same prompt and random seed are batched.
+	PerImagePrompts bool
+}
+
+// batchMember is one client request in a batch.
+type batchMember struct {
+	payload map[string]interface{}
+	result  chan *bufferedResponse
+}
+
+// batchGroup is the pending requests which can be batched together.
+type batchGroup struct {
+	key     string
+	who     identity
+	header  http.Header // the routing headers of the members, forwarded on the batched request
+	members []*batchMember
+	timer   *time.Timer
+}
+
+// Batcher coalesces the compatible txt2img requests within a short window into one batched backend call,
+// and splits the images and the info of the batched response back to each caller.
+type Batcher struct {
+	Config *BatchingConfig
+	server *Server
+	mutex  sync.Mutex
+	groups map[string]*batchGroup
+}
+
+func NewBatcher(cfg *BatchingConfig, s *Server) *Batcher {
+	return &Batcher{
+		Config: cfg,
+		server: s,
+		groups: make(map[string]*batchGroup),
+	}
+}
+
+// txt2imgHandler batch the compatible requests, and forward the others unchanged.
+func (b *Batcher) txt2imgHandler(c echo.Context) error {
+	req := c.Request()
+	if internalFromContext(req.Context()) != nil {
+		return b.server.forward(c)
+	}
+	body, replayable, err := bufferBody(req, b.server.Config.Retry.MaxBodyBytes)
+	if err != nil {
+		return err
+	}
+	if !replayable {
+		return b.server.forward(c)
+	}
+	who := b.server.identify(c)
+	header := routingHeader(req)
+	var payload map[string]interface{}
+	key, ok := "", json.Unmarshal(body, &payload) == nil
+	if ok {
+		key, ok = b.groupKey(who, header, payload)
+	}
+	if !ok {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		return b.server.forward(c)
+	}
+
+	member := &batchMember{
+		payload: payload,
+		result:  make(chan *bufferedResponse, 1),
+	}
+	b.join(key, who, header, member)
+	// The batch is generated even if the client goes away, since the other members are waiting for it.
+	resp := <-member.result
+	for k, v := range resp.header {
+		c.Response().Header()[k] = v
+	}
+	return c.Blob(resp.code, resp.header.Get(echo.HeaderContentType), resp.body.Bytes())
+}
+
+// routingHeader return the headers of the request which decide where and how it is run,
+// to forward them on the requests sent on its behalf, e.g. the batched request.
+// The interrupt opt-out of the query is moved to the header, since those requests have no query.
+func routingHeader(req *http.Request) http.Header {
+	header := make(http.Header)
+	for _, name := range []string{kPoolHeaderName, kVersionHeaderName, kDeadlineHeaderName} {
+		if v := req.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	if agent.InterruptOptedOut(req) {
+		header.Set(agent.InterruptHeaderName, "false")
+	}
+	return header
+}
+
+// groupKey return the key of the requests which can be batched together,
+// and false if the request can not be batched. Only the requests of the same tenant, class and routing headers
+// are batched, since the batch is queued, accounted, limited and routed as the requests of its first member.
+func (b *Batcher) groupKey(who identity, header http.Header, payload map[string]interface{}) (string, bool) {
+	if !isOne(payload["batch_size"]) || !isOne(payload["n_iter"]) {
+		return "", false
+	}
+	if _, ok := payload["prompt"].(string); !ok && payload["prompt"] != nil {
+		return "", false
+	}
+	seed, ok := seedOf(payload)
+	if !ok {
+		return "", false
+	}
+	rest := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		rest[k] = v
+	}
+	delete(rest, "batch_size")
+	delete(rest, "n_iter")
+	delete(rest, "seed")
+	if b.Config.PerImagePrompts {
+		delete(rest, "prompt")
+	} else if seed != -1 {
+		// The backend derives the seeds of the batch from the first one, so the fixed seeds can not be kept.
+		return "", false
+	}
+	// The map keys are sorted by json.Marshal, so the key is canonical.
+	key, err := json.Marshal([]interface{}{who.Tenant, who.Class, header, rest})
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+// join add the member to its group, and flush the group if it is full.
+func (b *Batcher) join(key string, who identity, header http.Header, member *batchMember) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	g, ok := b.groups[key]
+	if !ok {
+		g = &batchGroup{key: key, who: who, header: header}
+		g.timer = time.AfterFunc(b.Config.Window, func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			b.flushLocked(g)
+		})
+		b.groups[key] = g
+	}
+	g.members = append(g.members, member)
+	if len(g.members) >= b.Config.MaxBatchSize {
+		g.timer.Stop()
+		b.flushLocked(g)
+	}
+}
+
+func (b *Batcher) flushLocked(g *batchGroup) {
+	if b.groups[g.key] != g {
+		// The group is flushed already.
+		return
+	}
+	delete(b.groups, g.key)
+	go b.run(g)
+}
+
+// run send the batched request and deliver the split responses to the members.
+func (b *Batcher) run(g *batchGroup) {
+	members := g.members
+	payload := make(map[string]interface{}, len(members[0].payload))
+	for k, v := range members[0].payload {
+		payload[k] = v
+	}
+	if len(members) > 1 {
+		payload["batch_size"] = len(members)
+		payload["n_iter"] = 1
+		if b.Config.PerImagePrompts {
+			prompts := make([]interface{}, len(members))
+			seeds := make([]interface{}, len(members))
+			for i, m := range members {
+				prompts[i] = m.payload["prompt"]
+				seeds[i], _ = seedOf(m.payload)
+			}
+			payload["prompt"] = prompts
+			payload["seed"] = seeds
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		b.fail(members, err)
+		return
+	}
+
+	resp, err := b.server.invoke(b.server.ctx, g.who, http.MethodPost, kTxt2ImgPath, g.header, body)
+	if err != nil {
+		b.fail(members, err)
+		return
+	}
+	if len(members) == 1 || resp.code != http.StatusOK {
+		for _, m := range members {
+			m.result <- resp
+		}
+		return
+	}
+	b.server.Echo.Logger.Infof("batch %d txt2img requests into one generation", len(members))
+	split, err := splitBatch(resp, members)
+	if err != nil {
+		b.fail(members, err)
+		return
+	}
+	for i, m := range members {
+		m.result <- split[i]
+	}
+}
+
+func (b *Batcher) fail(members []*batchMember, err error) {
+	b.server.Echo.Logger.Errorf("batch txt2img failed: %v", err)
+	resp := newBufferedResponse()
+	resp.code = http.StatusBadGateway
+	resp.header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	json.NewEncoder(&resp.body).Encode(map[string]string{"error": err.Error()})
+	for _, m := range members {
+		m.result <- resp
+	}
+}
+
+// splitBatch split the batched txt2img response into one response for each member.
+func splitBatch(resp *bufferedResponse, members []*batchMember) ([]*bufferedResponse, error) {
+	var result struct {
+		Images []interface{} `json:"images"`
+		Info   string        `json:"info"`
+	}
+	if err := json.Unmarshal(resp.body.Bytes(), &result); err != nil {
+		return nil, err
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal([]byte(result.Info), &info); err != nil {
+		return nil, fmt.Errorf("invalid info: %v", err)
+	}
+	// The grid image, if any, precedes the images of the batch.
+	first := int(toNumber(info["index_of_first_image"]))
+	if len(result.Images) < first+len(members) {
+		return nil, fmt.Errorf("expect %d images, got %d", first+len(members), len(result.Images))
+	}
+
+	split := make([]*bufferedResponse, len(members))
+	for i, m := range members {
+		memberInfo := make(map[string]interface{}, len(info))
+		for k, v := range info {
+			memberInfo[k] = v
+		}
+		for _, field := range []string{"prompt", "negative_prompt", "seed", "subseed"} {
+			if all, ok := info["all_"+field+"s"].([]interface{}); ok && i < len(all) {
+				memberInfo[field] = all[i]
+				memberInfo["all_"+field+"s"] = []interface{}{all[i]}
+			}
+		}
+		if infotexts, ok := info["infotexts"].([]interface{}); ok && i < len(infotexts) {
+			memberInfo["infotexts"] = []interface{}{infotexts[i]}
+		}
+		memberInfo["batch_size"] = 1
+		memberInfo["index_of_first_image"] = 0
+		infoStr, err := json.Marshal(memberInfo)
+		if err != nil {
+			return nil, err
+		}
+		body, err := json.Marshal(map[string]interface{}{
+			"images":     []interface{}{result.Images[first+i]},
+			"parameters": m.payload,
+			"info":       string(infoStr),
+		})
+		if err != nil {
+			return nil, err
+		}
+		r := newBufferedResponse()
+		r.code = http.StatusOK
+		r.header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		r.body.Write(body)
+		split[i] = r
+	}
+	return split, nil
+}
+
+// isOne report whether the count field is absent or 1.
+func isOne(val interface{}) bool {
+	return val == nil || toNumber(val) == 1
+}
+
+// seedOf return the seed of the payload, -1 means random.
+func seedOf(payload map[string]interface{}) (int64, bool) {
+	switch v := payload["seed"].(type) {
+	case nil:
+		return -1, true
+	case float64:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+func toNumber(val interface{}) float64 {
+	f, _ := val.(float64)
+	return f
+}
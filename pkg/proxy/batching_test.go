@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTxt2Img is a txt2img backend which returns one image per batch item, and a grid image for batches.
+func fakeTxt2Img(calls *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		n := 1
+		if v, ok := payload["batch_size"].(float64); ok {
+			n = int(v)
+		}
+		var images, prompts, seeds []interface{}
+		first := 0
+		if n > 1 {
+			images = append(images, "grid")
+			first = 1
+		}
+		for i := 0; i < n; i++ {
+			images = append(images, fmt.Sprintf("image%d", i))
+			prompts = append(prompts, payload["prompt"])
+			seeds = append(seeds, 100+i)
+		}
+		info, _ := json.Marshal(map[string]interface{}{
+			"prompt":               payload["prompt"],
+			"all_prompts":          prompts,
+			"seed":                 100,
+			"all_seeds":            seeds,
+			"index_of_first_image": first,
+		})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"images":     images,
+			"parameters": payload,
+			"info":       string(info),
+		})
+	}))
+}
+
+func TestBatcher(t *testing.T) {
+	config := DefaultConfig()
+	config.Batching.Enabled = true
+	config.Batching.Window = time.Second
+	config.Batching.MaxBatchSize = 3
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var calls atomic.Int32
+	backend := fakeTxt2Img(&calls)
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	do := func(body string) map[string]interface{} {
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, kTxt2ImgPath, strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var result map[string]interface{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+		return result
+	}
+
+	t.Run("Test compatible requests are batched", func(t *testing.T) {
+		calls.Store(0)
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		images := make(map[interface{}]bool)
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result := do(`{"prompt":"cat","steps":20,"seed":-1}`)
+				assert.Equal(t, 1, len(result["images"].([]interface{})))
+				var info map[string]interface{}
+				assert.NoError(t, json.Unmarshal([]byte(result["info"].(string)), &info))
+				assert.Equal(t, 1, len(info["all_seeds"].([]interface{})))
+				mutex.Lock()
+				images[result["images"].([]interface{})[0]] = true
+				mutex.Unlock()
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, int32(1), calls.Load())
+		require.Equal(t, map[interface{}]bool{"image0": true, "image1": true, "image2": true}, images)
+	})
+
+	t.Run("Test incompatible requests pass through", func(t *testing.T) {
+		calls.Store(0)
+		result := do(`{"prompt":"cat","steps":20,"seed":42}`)
+		require.Equal(t, []interface{}{"image0"}, result["images"])
+		result = do(`{"prompt":"cat","steps":20,"batch_size":2}`)
+		require.Equal(t, []interface{}{"grid", "image0", "image1"}, result["images"])
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("Test group key", func(t *testing.T) {
+		who := identity{Tenant: "tenant1", Class: "standard"}
+		key1, ok := s.Batcher.groupKey(who, nil, map[string]interface{}{"prompt": "cat", "steps": 20.0})
+		require.True(t, ok)
+		key2, ok := s.Batcher.groupKey(who, nil, map[string]interface{}{"steps": 20.0, "prompt": "cat", "seed": -1.0, "batch_size": 1.0})
+		require.True(t, ok)
+		require.Equal(t, key1, key2)
+		key3, ok := s.Batcher.groupKey(who, nil, map[string]interface{}{"prompt": "dog", "steps": 20.0})
+		require.True(t, ok)
+		require.NotEqual(t, key1, key3)
+		key3, ok = s.Batcher.groupKey(identity{Tenant: "tenant2", Class: "standard"}, nil, map[string]interface{}{"prompt": "cat", "steps": 20.0})
+		require.True(t, ok)
+		require.NotEqual(t, key1, key3)
+		key3, ok = s.Batcher.groupKey(identity{Tenant: "tenant1", Class: "batch"}, nil, map[string]interface{}{"prompt": "cat", "steps": 20.0})
+		require.True(t, ok)
+		require.NotEqual(t, key1, key3)
+		header := make(http.Header)
+		header.Set(kPoolHeaderName, "gpu")
+		key3, ok = s.Batcher.groupKey(who, header, map[string]interface{}{"prompt": "cat", "steps": 20.0})
+		require.True(t, ok)
+		require.NotEqual(t, key1, key3)
+
+		s.Batcher.Config.PerImagePrompts = true
+		defer func() { s.Batcher.Config.PerImagePrompts = false }()
+		key3, ok = s.Batcher.groupKey(who, nil, map[string]interface{}{"prompt": "dog", "steps": 20.0, "seed": 42.0})
+		require.True(t, ok)
+		key1, _ = s.Batcher.groupKey(who, nil, map[string]interface{}{"prompt": "cat", "steps": 20.0})
+		require.Equal(t, key1, key3)
+	})
+}
+
+func TestBatcherRouting(t *testing.T) {
+	config := DefaultConfig()
+	config.Batching.Enabled = true
+	config.Batching.Window = 200 * time.Millisecond
+	config.Batching.MaxBatchSize = 2
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var callsA, callsB atomic.Int32
+	backendA := fakeTxt2Img(&callsA)
+	defer backendA.Close()
+	backendB := fakeTxt2Img(&callsB)
+	defer backendB.Close()
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s0", Endpoint: backendA.URL, Labels: map[string]string{"pool": "a"}}))
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s1", Endpoint: backendB.URL, Labels: map[string]string{"pool": "b"}}))
+	require.NoError(t, s.Reload())
+
+	do := func(pools ...string) {
+		var wg sync.WaitGroup
+		for _, pool := range pools {
+			wg.Add(1)
+			go func(pool string) {
+				defer wg.Done()
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodPost, kTxt2ImgPath, strings.NewReader(`{"prompt":"cat","steps":20}`))
+				req.Header.Set(kPoolHeaderName, pool)
+				s.Echo.ServeHTTP(rec, req)
+				assert.Equal(t, http.StatusOK, rec.Code)
+				var result map[string]interface{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+				assert.Equal(t, 1, len(result["images"].([]interface{})))
+			}(pool)
+		}
+		wg.Wait()
+	}
+
+	t.Run("Test requests for different pools are not batched", func(t *testing.T) {
+		do("a", "b")
+		require.Equal(t, int32(1), callsA.Load())
+		require.Equal(t, int32(1), callsB.Load())
+	})
+
+	t.Run("Test batched request is routed to the requested pool", func(t *testing.T) {
+		callsA.Store(0)
+		callsB.Store(0)
+		do("b", "b")
+		require.Equal(t, int32(0), callsA.Load())
+		require.Equal(t, int32(1), callsB.Load())
+	})
+}
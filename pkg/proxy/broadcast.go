@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const kBroadcastHeaderName = "X-SD-Broadcast"
+const kBroadcastSelectorHeaderName = "X-SD-Broadcast-Selector"
+
+// BroadcastConfig is the configuration of the operations which are sent to all the backends.
+type BroadcastConfig struct {
+	Paths   []string      // the paths whose non-GET requests are always broadcast, none by default
+	Timeout time.Duration // the timeout of the request to one backend
+}
+
+// match report whether the request is broadcast. The admin broadcasts any request with the X-SD-Broadcast header,
+// and the non-GET requests of the configured paths are always broadcast.
+func (cfg *BroadcastConfig) match(req *http.Request, admin bool) bool {
+	if req.Header.Get(kBroadcastHeaderName) == "true" && admin {
+		return true
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return false
+	}
+	for _, path := range cfg.Paths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcastResult is the result of the broadcast request on one backend.
+type broadcastResult struct {
+	Backend string      `json:"backend"`
+	Status  int         `json:"status,omitempty"`
+	Body    interface{} `json:"body,omitempty"` // the JSON response, or the response text if it is not JSON
+	Error   string      `json:"error,omitempty"`
+}
+
+func (r *broadcastResult) ok() bool {
+	return r.Error == "" && r.Status >= 200 && r.Status < 300
+}
+
+type broadcastResponse struct {
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Results   []*broadcastResult `json:"results"`
+}
+
+// parseSelector parse the label selector "key=value,key=value", all of which must match.
+func parseSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(selector, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid label selector %s, expect key=value", pair)
+		}
+		labels[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
+
+// selects report whether the backend matches the label selector and the pool.
+func selects(p *ReverseProxy, labels map[string]string, pool string) bool {
+	if pool != "" && p.Pool() != pool {
+		return false
+	}
+	srv := p.Service()
+	for k, v := range labels {
+		if srv.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// broadcastMiddleware send the broadcast requests to all the backends, or the ones matching the label selector,
+// concurrently, and return the result of each backend. The status is 200 if all the backends succeed,
+// 207 if some of them fail, and 502 if all of them fail.
+// The ejected and cordoned backends are included, since the operations are meant for every backend.
+func (s *Server) broadcastMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if !s.Config.Broadcast.match(req, s.isAdmin(req)) {
+			return next(c)
+		}
+		labels, err := parseSelector(req.Header.Get(kBroadcastSelectorHeaderName))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		var targets []*ReverseProxy
+		for _, p := range s.currentProxies() {
+			if selects(p, labels, requestPool(req)) {
+				targets = append(targets, p)
+			}
+		}
+		if len(targets) == 0 {
+			return echo.NewHTTPError(http.StatusServiceUnavailable, ErrNoReverseProxy.Error())
+		}
+		body, replayable, err := bufferBody(req, s.Config.Retry.MaxBodyBytes)
+		if err != nil {
+			return err
+		}
+		if !replayable {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "the request body is too large to broadcast")
+		}
+
+		resp := &broadcastResponse{Results: make([]*broadcastResult, len(targets))}
+		var wg sync.WaitGroup
+		for i, p := range targets {
+			wg.Add(1)
+			go func(i int, p *ReverseProxy) {
+				defer wg.Done()
+				resp.Results[i] = s.broadcastTo(req, body, p)
+			}(i, p)
+		}
+		wg.Wait()
+
+		for _, r := range resp.Results {
+			if r.ok() {
+				resp.Succeeded++
+			} else {
+				resp.Failed++
+			}
+		}
+		code := http.StatusOK
+		if resp.Succeeded == 0 {
+			code = http.StatusBadGateway
+		} else if resp.Failed > 0 {
+			code = http.StatusMultiStatus
+		}
+		return c.JSON(code, resp)
+	}
+}
+
+// broadcastTo send the copy of the request to the backend.
+func (s *Server) broadcastTo(req *http.Request, body []byte, p *ReverseProxy) *broadcastResult {
+	ctx, cancel := context.WithTimeout(req.Context(), s.Config.Broadcast.Timeout)
+	defer cancel()
+	r := req.Clone(ctx)
+	r.Header.Del(kBroadcastHeaderName)
+	r.Header.Del(kBroadcastSelectorHeaderName)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Host = p.Target.Host
+	r.URL.Host = p.Target.Host
+	r.URL.Scheme = p.Target.Scheme
+
+	w := newBufferedResponse()
+	p.ServeHTTP(w, r)
+	result := &broadcastResult{Backend: p.Name, Status: w.code}
+	if result.Status == 0 {
+		result.Status = http.StatusOK
+	}
+	if ctx.Err() != nil {
+		result.Error = ctx.Err().Error()
+	}
+	var v interface{}
+	if err := json.Unmarshal(w.body.Bytes(), &v); err == nil {
+		result.Body = v
+	} else if w.body.Len() > 0 {
+		result.Body = w.body.String()
+	}
+	return result
+}
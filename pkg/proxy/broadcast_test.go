@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroadcast(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "secret"
+	config.Broadcast.Paths = []string{"/sdapi/v1/refresh-checkpoints", "/sdapi/v1/options", "/sdapi/v1/interrupt"}
+	config.Retry.MaxBodyBytes = 16
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var calls [3]atomic.Int32
+	var failing atomic.Bool
+	for i, labels := range []map[string]string{{"gpu": "a10"}, {"gpu": "a10"}, {"gpu": "t4"}} {
+		i := i
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls[i].Add(1)
+			if i == 2 && failing.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("oops"))
+				return
+			}
+			w.Write([]byte("null"))
+		}))
+		defer backend.Close()
+		name := []string{"s0", "s1", "s2"}[i]
+		require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: name, Endpoint: backend.URL, Labels: labels}))
+	}
+	require.NoError(t, s.Reload())
+
+	doBody := func(method string, path string, body string, header map[string]string) (int, *broadcastResponse) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		s.Echo.ServeHTTP(rec, req)
+		resp := &broadcastResponse{}
+		json.Unmarshal(rec.Body.Bytes(), resp)
+		return rec.Code, resp
+	}
+	do := func(method string, path string, header map[string]string) (int, *broadcastResponse) {
+		return doBody(method, path, `{}`, header)
+	}
+	total := func() int32 {
+		return calls[0].Load() + calls[1].Load() + calls[2].Load()
+	}
+	reset := func() {
+		for i := range calls {
+			calls[i].Store(0)
+		}
+	}
+
+	t.Run("Test configured path is sent to all backends", func(t *testing.T) {
+		reset()
+		code, resp := do(http.MethodPost, "/sdapi/v1/refresh-checkpoints", nil)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, 3, resp.Succeeded)
+		for i := range calls {
+			require.Equal(t, int32(1), calls[i].Load())
+		}
+	})
+
+	t.Run("Test GET of configured path is not broadcast", func(t *testing.T) {
+		reset()
+		code, _ := do(http.MethodGet, "/sdapi/v1/options", nil)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, int32(1), total())
+	})
+
+	t.Run("Test unlisted path is broadcast only with the header", func(t *testing.T) {
+		reset()
+		code, _ := do(http.MethodPost, "/sdapi/v1/refresh-loras", nil)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, int32(1), total())
+
+		// The admin broadcasts the request of any path.
+		reset()
+		code, resp := do(http.MethodPost, "/sdapi/v1/refresh-loras", map[string]string{
+			kBroadcastHeaderName:     "true",
+			echo.HeaderAuthorization: "Bearer secret",
+		})
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, 3, resp.Succeeded)
+		require.Equal(t, int32(3), total())
+	})
+
+	t.Run("Test header is ignored without the admin token", func(t *testing.T) {
+		reset()
+		code, _ := do(http.MethodGet, "/sdapi/v1/options", map[string]string{
+			kBroadcastHeaderName:     "true",
+			echo.HeaderAuthorization: "Bearer wrong",
+		})
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, int32(1), total())
+
+		code, resp := do(http.MethodGet, "/sdapi/v1/options", map[string]string{
+			kBroadcastHeaderName:     "true",
+			echo.HeaderAuthorization: "Bearer secret",
+		})
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, 3, resp.Succeeded)
+	})
+
+	t.Run("Test large body is rejected", func(t *testing.T) {
+		reset()
+		code, _ := doBody(http.MethodPost, "/sdapi/v1/options", `{"sd_model_checkpoint": "model"}`, nil)
+		require.Equal(t, http.StatusRequestEntityTooLarge, code)
+		require.Equal(t, int32(0), total())
+	})
+
+	t.Run("Test header and label selector", func(t *testing.T) {
+		reset()
+		code, resp := do(http.MethodPost, "/sdapi/v1/interrupt", map[string]string{
+			kBroadcastHeaderName:         "true",
+			kBroadcastSelectorHeaderName: "gpu=a10",
+			echo.HeaderAuthorization:     "Bearer secret",
+		})
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, 2, resp.Succeeded)
+		require.Equal(t, "s0", resp.Results[0].Backend)
+		require.Equal(t, "s1", resp.Results[1].Backend)
+		require.Equal(t, int32(0), calls[2].Load())
+
+		code, _ = do(http.MethodPost, "/sdapi/v1/interrupt", map[string]string{
+			kBroadcastHeaderName:         "true",
+			kBroadcastSelectorHeaderName: "gpu=h100",
+			echo.HeaderAuthorization:     "Bearer secret",
+		})
+		require.Equal(t, http.StatusServiceUnavailable, code)
+	})
+
+	t.Run("Test partial failure", func(t *testing.T) {
+		failing.Store(true)
+		defer failing.Store(false)
+		code, resp := do(http.MethodPost, "/sdapi/v1/options", nil)
+		require.Equal(t, http.StatusMultiStatus, code)
+		require.Equal(t, 2, resp.Succeeded)
+		require.Equal(t, 1, resp.Failed)
+		require.Equal(t, http.StatusInternalServerError, resp.Results[2].Status)
+		require.Equal(t, "oops", resp.Results[2].Body)
+
+		code, resp = do(http.MethodPost, "/sdapi/v1/options", map[string]string{kBroadcastSelectorHeaderName: "gpu=t4"})
+		require.Equal(t, http.StatusBadGateway, code)
+		require.Equal(t, 1, resp.Failed)
+	})
+}
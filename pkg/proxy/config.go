@@ -0,0 +1,194 @@
+package proxy
+
+import "time"
+
+// Config is the configuration of the proxy server.
+type Config struct {
+	// SessionSecret is the key to sign the session affinity cookie.
+	// All the proxy replicas must share the same secret, otherwise the cookie issued by one replica
+	// is rejected by the others. A random secret is generated if it is empty.
+	SessionSecret string
+
+	// SessionTTL is the idle time after which the session to backend mapping is purged, 0 keeps the mappings forever.
+	SessionTTL time.Duration
+
+	// AdminToken is the bearer token to access the admin API. The admin API is disabled if it is empty.
+	AdminToken string
+
+	// APIKeys map the API keys to the callers' identities.
+	APIKeys map[string]APIKey
+
+	// InterruptOnDisconnect interrupts the generation on the backend when its client is gone,
+	// unless the request opts out with the X-SD-Interrupt-On-Disconnect: false header.
+	// It is off by default, so that a client which drops the connection, e.g. on a network blip, does not lose its generation.
+	InterruptOnDisconnect bool
+
+	HealthCheck   HealthCheckConfig
+	Membership    MembershipConfig
+	Retry         RetryConfig
+	Queue         QueueConfig
+	Batching      BatchingConfig
+	ResultCache   ResultCacheConfig
+	MetadataCache MetadataCacheConfig
+	Aggregation   AggregationConfig
+	Broadcast     BroadcastConfig
+	Reconciler    ReconcilerConfig
+	Mirror        MirrorConfig
+	Jobs          JobsConfig
+	Webhooks      WebhooksConfig
+	TaskEvents    TaskEventsConfig
+	OpenAI        OpenAIConfig
+	Async         AsyncConfig
+	Idempotency   IdempotencyConfig
+}
+
+// DefaultConfig return the default proxy server configuration.
+func DefaultConfig() *Config {
+	return &Config{
+		SessionTTL: 24 * time.Hour,
+		HealthCheck: HealthCheckConfig{
+			Path:               "/sdapi/v1/progress",
+			Interval:           10 * time.Second,
+			Timeout:            5 * time.Second,
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 3,
+			PassiveThreshold:   5,
+			PassiveStatusCodes: []int{502, 503, 504},
+			BaseEjectionTime:   30 * time.Second,
+			MaxEjectionTime:    10 * time.Minute,
+		},
+		Membership: MembershipConfig{
+			ReloadInterval: 10 * time.Second,
+			DrainTimeout:   10 * time.Minute,
+		},
+		Retry: RetryConfig{
+			MaxRetries:   2,
+			BackoffBase:  200 * time.Millisecond,
+			BackoffMax:   2 * time.Second,
+			MaxBodyBytes: 32 << 20,
+			IdempotentPaths: []string{
+				"/sdapi/v1/sd-models",
+				"/sdapi/v1/samplers",
+				"/sdapi/v1/upscalers",
+				"/sdapi/v1/sd-vae",
+				"/sdapi/v1/loras",
+				"/sdapi/v1/embeddings",
+				"/sdapi/v1/hypernetworks",
+				"/sdapi/v1/scripts",
+			},
+		},
+		Queue: QueueConfig{
+			Paths: []string{
+				"/sdapi/v1/txt2img",
+				"/sdapi/v1/img2img",
+			},
+			Policy: "wfq",
+			ClassWeights: map[string]float64{
+				"interactive": 8,
+				"api":         4,
+				"batch":       1,
+			},
+			DefaultClass: "api",
+		},
+		Batching: BatchingConfig{
+			Window:       100 * time.Millisecond,
+			MaxBatchSize: 4,
+		},
+		ResultCache: ResultCacheConfig{
+			Paths: []string{
+				"/sdapi/v1/txt2img",
+				"/sdapi/v1/img2img",
+			},
+			TTL:      24 * time.Hour,
+			MaxBytes: 256 << 20,
+			Backing:  "memory",
+			ModelTTL: time.Minute,
+		},
+		MetadataCache: MetadataCacheConfig{
+			Paths: []string{
+				"/config",
+				"/sdapi/v1/sd-models",
+				"/sdapi/v1/samplers",
+				"/sdapi/v1/upscalers",
+				"/sdapi/v1/sd-vae",
+				"/sdapi/v1/loras",
+				"/sdapi/v1/embeddings",
+				"/sdapi/v1/hypernetworks",
+				"/sdapi/v1/scripts",
+			},
+			TTL:      30 * time.Second,
+			MaxStale: 10 * time.Minute,
+		},
+		Aggregation: AggregationConfig{
+			Timeout:         10 * time.Second,
+			RefreshInterval: time.Minute,
+		},
+		Broadcast: BroadcastConfig{
+			Timeout: 5 * time.Minute,
+		},
+		Reconciler: ReconcilerConfig{
+			Interval: 5 * time.Minute,
+			Timeout:  10 * time.Second,
+		},
+		Mirror: MirrorConfig{
+			Paths: []string{
+				"/sdapi/v1/txt2img",
+			},
+			Timeout:     10 * time.Minute,
+			MaxInFlight: 4,
+			Retention:   7 * 24 * time.Hour,
+		},
+		Jobs: JobsConfig{
+			Endpoints: []string{
+				"/sdapi/v1/txt2img",
+				"/sdapi/v1/img2img",
+				"/sdapi/v1/extra-single-image",
+				"/sdapi/v1/extra-batch-images",
+			},
+			ProgressInterval:  time.Second,
+			Timeout:           time.Hour,
+			MaxAttempts:       3,
+			VisibilityTimeout: 30 * time.Second,
+			PollInterval:      time.Second,
+			BackoffBase:       5 * time.Second,
+			BackoffMax:        5 * time.Minute,
+			MaxConcurrency:    64,
+			MaxPipelineSteps:  16,
+			Retention:         7 * 24 * time.Hour,
+		},
+		Webhooks: WebhooksConfig{
+			Timeout:     10 * time.Second,
+			MaxAttempts: 8,
+			BackoffBase: 5 * time.Second,
+			BackoffMax:  10 * time.Minute,
+			Interval:    time.Second,
+			Retention:   7 * 24 * time.Hour,
+		},
+		TaskEvents: TaskEventsConfig{
+			PollInterval: 250 * time.Millisecond,
+			Heartbeat:    15 * time.Second,
+			Timeout:      30 * time.Minute,
+		},
+		OpenAI: OpenAIConfig{
+			MaxImages: 10,
+			ImageTTL:  time.Hour,
+		},
+		Async: AsyncConfig{
+			Paths:     []string{"/sdapi/v1/txt2img", "/sdapi/v1/img2img"},
+			PollWait:  25 * time.Second,
+			Heartbeat: 10 * time.Second,
+			Timeout:   time.Hour,
+		},
+		Idempotency: IdempotencyConfig{
+			Paths: []string{
+				"/sdapi/v1/txt2img",
+				"/sdapi/v1/img2img",
+				"/v1/jobs",
+				"/v1/pipelines",
+				"/v1/images/generations",
+			},
+			TTL:            24 * time.Hour,
+			PendingTimeout: 30 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The deadline of a generation request is either a duration from its arrival, e.g. 20s,
+// or an RFC 3339 time, e.g. 2024-01-02T15:04:05Z.
+const kDeadlineHeaderName = "X-SD-Deadline"
+
+// kRunTimeSmoothing is the weight of the latest sample in the moving average of the run time.
+const kRunTimeSmoothing = 0.2
+
+// errDeadlineExceeded is returned by the queue for the job dropped since it can no longer meet its deadline.
+var errDeadlineExceeded = errors.New("the deadline can not be met")
+
+// parseDeadline parse the deadline relative to now.
+func parseDeadline(v string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("the deadline %s is not positive", v)
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid deadline %s, expect a duration or an RFC 3339 time", v)
+	}
+	return t, nil
+}
+
+// requestDeadline return the deadline of the request, or the zero time if it has none.
+func requestDeadline(req *http.Request, now time.Time) (time.Time, error) {
+	v := req.Header.Get(kDeadlineHeaderName)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return parseDeadline(v, now)
+}
+
+// generationWork return the amount of work of the generation request in the units of one 512x512 image of 20 steps,
+// which the run time is roughly proportional to.
+func generationWork(body []byte) float64 {
+	params := struct {
+		Steps     float64 `json:"steps"`
+		BatchSize float64 `json:"batch_size"`
+		NIter     float64 `json:"n_iter"`
+		Width     float64 `json:"width"`
+		Height    float64 `json:"height"`
+	}{20, 1, 1, 512, 512}
+	// The invalid body is rejected by the backend, it is estimated as one unit of work.
+	_ = json.Unmarshal(body, &params)
+	work := params.Steps / 20 * params.BatchSize * params.NIter * params.Width * params.Height / (512 * 512)
+	if work <= 0 {
+		return 1
+	}
+	return work
+}
+
+// RunTimeEstimator estimate the run time of the generation requests of each path from the observed ones,
+// by the moving average of the seconds per unit of work.
+type RunTimeEstimator struct {
+	mutex   sync.Mutex
+	seconds map[string]float64 // the path to the seconds per unit of work
+}
+
+func NewRunTimeEstimator() *RunTimeEstimator {
+	return &RunTimeEstimator{
+		seconds: make(map[string]float64),
+	}
+}
+
+// Estimate return the estimated run time, or 0 if no request of the path has been observed.
+func (e *RunTimeEstimator) Estimate(path string, work float64) time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return time.Duration(e.seconds[path] * work * float64(time.Second))
+}
+
+// Observe add the run time of a succeeded request to the average.
+func (e *RunTimeEstimator) Observe(path string, work float64, d time.Duration) {
+	if work <= 0 {
+		return
+	}
+	sample := d.Seconds() / work
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if avg, ok := e.seconds[path]; ok {
+		e.seconds[path] = avg + kRunTimeSmoothing*(sample-avg)
+	} else {
+		e.seconds[path] = sample
+	}
+}
+
+// edfPolicy dispatch the jobs earliest-deadline-first. The jobs without deadline are dispatched in their arrival order
+// after the jobs with deadlines.
+type edfPolicy struct {
+	jobs []*queuedJob
+}
+
+// earlier report whether job a is dispatched before job b by the deadlines.
+func earlier(a *queuedJob, b *queuedJob) bool {
+	switch {
+	case a.deadline.IsZero() != b.deadline.IsZero():
+		return b.deadline.IsZero()
+	case !a.deadline.Equal(b.deadline):
+		return a.deadline.Before(b.deadline)
+	default:
+		return a.seq < b.seq
+	}
+}
+
+func (e *edfPolicy) Push(j *queuedJob) {
+	i := sort.Search(len(e.jobs), func(i int) bool { return earlier(j, e.jobs[i]) })
+	e.jobs = append(e.jobs, nil)
+	copy(e.jobs[i+1:], e.jobs[i:])
+	e.jobs[i] = j
+}
+
+func (e *edfPolicy) Peek() *queuedJob {
+	if len(e.jobs) == 0 {
+		return nil
+	}
+	return e.jobs[0]
+}
+
+func (e *edfPolicy) Remove(j *queuedJob) bool {
+	for i, job := range e.jobs {
+		if job == j {
+			e.jobs = append(e.jobs[:i], e.jobs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (e *edfPolicy) Len() int {
+	return len(e.jobs)
+}
+
+func (e *edfPolicy) Position(id string) int {
+	for i, job := range e.jobs {
+		if job.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *edfPolicy) All() []*queuedJob {
+	return append([]*queuedJob(nil), e.jobs...)
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDeadline(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	d, err := parseDeadline("20s", now)
+	require.NoError(t, err)
+	require.Equal(t, now.Add(20*time.Second), d)
+	d, err = parseDeadline("2024-01-02T15:05:00Z", now)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 1, 2, 15, 5, 0, 0, time.UTC), d)
+	_, err = parseDeadline("-1s", now)
+	require.Error(t, err)
+	_, err = parseDeadline("tomorrow", now)
+	require.Error(t, err)
+}
+
+func TestRunTimeEstimator(t *testing.T) {
+	require.Equal(t, 1.0, generationWork([]byte(`{"prompt": "cat"}`)))
+	require.Equal(t, 8.0, generationWork([]byte(`{"steps": 40, "batch_size": 2, "width": 1024, "height": 512}`)))
+
+	e := NewRunTimeEstimator()
+	require.Equal(t, time.Duration(0), e.Estimate("/sdapi/v1/txt2img", 1))
+	e.Observe("/sdapi/v1/txt2img", 2, 4*time.Second)
+	require.Equal(t, 6*time.Second, e.Estimate("/sdapi/v1/txt2img", 3))
+	e.Observe("/sdapi/v1/txt2img", 1, 7*time.Second)
+	require.Equal(t, 3*time.Second, e.Estimate("/sdapi/v1/txt2img", 1))
+	require.Equal(t, time.Duration(0), e.Estimate("/sdapi/v1/img2img", 1))
+}
+
+func TestEDFPolicy(t *testing.T) {
+	now := time.Now()
+	p := &edfPolicy{}
+	p.Push(&queuedJob{id: "none1", seq: 1})
+	p.Push(&queuedJob{id: "late", seq: 2, deadline: now.Add(time.Minute)})
+	p.Push(&queuedJob{id: "none2", seq: 3})
+	p.Push(&queuedJob{id: "early", seq: 4, deadline: now.Add(time.Second)})
+	require.Equal(t, 0, p.Position("early"))
+	require.Equal(t, 1, p.Position("late"))
+	require.Equal(t, 2, p.Position("none1"))
+	require.Equal(t, 3, p.Position("none2"))
+	require.True(t, p.Remove(p.Peek()))
+	require.Equal(t, "late", p.Peek().id)
+	require.Equal(t, 3, p.Len())
+}
+
+func TestDeadlines(t *testing.T) {
+	config := DefaultConfig()
+	config.Queue.Policy = "edf"
+	config.Retry.MaxRetries = 0
+	config.Jobs.MaxAttempts = 1
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	interrupted := make(chan map[string]interface{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/internal/interrupt":
+			interrupted <- body
+		case "/internal/progress":
+			w.Write([]byte(`{"active": true, "progress": 0.5}`))
+		default:
+			if body["prompt"] == "slow" {
+				// Generate until the request is cancelled.
+				<-r.Context().Done()
+				return
+			}
+			w.Write([]byte(`{"images": ["image"]}`))
+		}
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	generate := func(id string, body string, deadline string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-Id", id)
+		if deadline != "" {
+			req.Header.Set(kDeadlineHeaderName, deadline)
+		}
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Test invalid deadline", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, generate("req0", `{"prompt": "cat"}`, "soon").Code)
+	})
+
+	t.Run("Test the run time is observed", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, generate("req1", `{"prompt": "cat"}`, "10s").Code)
+		require.Greater(t, s.Queue.Estimator.Estimate("/sdapi/v1/txt2img", 1), time.Duration(0))
+	})
+
+	t.Run("Test the infeasible deadline is rejected", func(t *testing.T) {
+		s.Queue.Estimator.Observe("/sdapi/v1/txt2img", 1, time.Minute)
+		defer func() { s.Queue.Estimator = NewRunTimeEstimator() }()
+		rec := generate("req2", `{"prompt": "cat"}`, "1s")
+		require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		require.Contains(t, rec.Body.String(), "the deadline can not be met")
+	})
+
+	t.Run("Test the task missing its deadline is interrupted at once", func(t *testing.T) {
+		rec := generate("req3", `{"prompt": "slow"}`, "100ms")
+		require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		select {
+		case body := <-interrupted:
+			require.Equal(t, rec.Header().Get(kTaskIdHeaderName), body["id_task"])
+			require.Equal(t, true, body["immediate"])
+		case <-time.After(time.Second):
+			require.Fail(t, "the task is not interrupted")
+		}
+	})
+
+	t.Run("Test the job missing its deadline fails", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/jobs", strings.NewReader(`{"endpoint": "txt2img", "payload": {"prompt": "slow"}, "deadline": "100ms"}`))
+		req.Header.Set("Content-Type", "application/json")
+		s.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		var view jobView
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &view))
+		require.Greater(t, view.Deadline, int64(0))
+		require.Eventually(t, func() bool {
+			job, _ := s.JobsDatastore.GetJob(view.Id)
+			return job != nil && job.Status == datastore.JobFailed
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/agent"
+)
+
+// kTaskIdHeaderName is the response header of the task id of the generation request, e.g. to query its progress.
+const kTaskIdHeaderName = "X-SD-Task-Id"
+
+// kInterruptNotifyTimeout is the timeout to report the disconnected client to the backend agent.
+const kInterruptNotifyTimeout = 10 * time.Second
+
+// withTaskId set the task id of the generation request, so that its task can be interrupted if the client is gone.
+// The task id in the body, e.g. the one the client polls the progress with, is kept and the task is interrupted by it.
+// Otherwise the id is set. The body is returned unchanged if it is not a json object.
+func withTaskId(body []byte, id string) ([]byte, string) {
+	var m map[string]interface{}
+	if json.Unmarshal(body, &m) != nil || m == nil {
+		return body, ""
+	}
+	if taskId, ok := m["force_task_id"].(string); ok && taskId != "" {
+		return body, taskId
+	}
+	m["force_task_id"] = id
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return body, ""
+	}
+	return encoded, id
+}
+
+// interruptOnDisconnect report the task of the disconnected client to the agent of the backend,
+// which interrupts the task after its grace period if the task is still running.
+func (s *Server) interruptOnDisconnect(req *http.Request, p *ReverseProxy, taskId string) {
+	if !s.Config.InterruptOnDisconnect || internalFromContext(req.Context()) != nil || agent.InterruptOptedOut(req) {
+		return
+	}
+	s.Echo.Logger.Infof("client of task %s on %s is gone", taskId, p.Name)
+	go s.notifyInterrupt(p, taskId, false)
+}
+
+// notifyInterrupt ask the agent of the backend to interrupt the task, at once or after its grace period.
+func (s *Server) notifyInterrupt(p *ReverseProxy, taskId string, immediate bool) {
+	ctx, cancel := context.WithTimeout(s.ctx, kInterruptNotifyTimeout)
+	defer cancel()
+	body, err := json.Marshal(map[string]interface{}{"id_task": taskId, "immediate": immediate})
+	if err != nil {
+		return
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Target.JoinPath("/internal/interrupt").String(), bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := s.HttpClient.Do(r)
+	if err != nil {
+		s.Echo.Logger.Warnf("report the interruption of task %s to %s failed: %v", taskId, p.Name, err)
+		return
+	}
+	resp.Body.Close()
+}
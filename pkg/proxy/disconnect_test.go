@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/agent"
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterruptOnDisconnect(t *testing.T) {
+	config := DefaultConfig()
+	config.InterruptOnDisconnect = true
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	started := make(chan string, 1)
+	interrupted := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/internal/interrupt":
+			interrupted <- body["id_task"].(string)
+		default:
+			taskId, _ := body["force_task_id"].(string)
+			started <- taskId
+			// Generate until the client is gone.
+			<-r.Context().Done()
+		}
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	// generate send the request with the task id of the client if it is not empty, and return the task id on the backend.
+	generate := func(id string, clientTaskId string, optOut bool) string {
+		ctx, cancel := context.WithCancel(context.Background())
+		body := `{"prompt": "cat"}`
+		if clientTaskId != "" {
+			body = `{"prompt": "cat", "force_task_id": "` + clientTaskId + `"}`
+		}
+		req := httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img", strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set("X-Request-Id", id)
+		if optOut {
+			req.Header.Set(agent.InterruptHeaderName, "false")
+		}
+		rec := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Echo.ServeHTTP(rec, req)
+		}()
+		taskId := <-started
+		require.NotEmpty(t, taskId)
+		if clientTaskId != "" {
+			require.Equal(t, clientTaskId, taskId)
+		}
+		cancel()
+		<-done
+		require.Equal(t, taskId, rec.Header().Get(kTaskIdHeaderName))
+		return taskId
+	}
+
+	t.Run("Test the task of the disconnected client is interrupted", func(t *testing.T) {
+		id := generate("req1", "", false)
+		select {
+		case taskId := <-interrupted:
+			require.Equal(t, id, taskId)
+		case <-time.After(time.Second):
+			require.Fail(t, "the task is not interrupted")
+		}
+	})
+
+	t.Run("Test the task is interrupted by the task id of the client", func(t *testing.T) {
+		generate("req3", "task(client)", false)
+		select {
+		case taskId := <-interrupted:
+			require.Equal(t, "task(client)", taskId)
+		case <-time.After(time.Second):
+			require.Fail(t, "the task is not interrupted")
+		}
+	})
+
+	t.Run("Test opt out of the interruption", func(t *testing.T) {
+		generate("req2", "", true)
+		select {
+		case taskId := <-interrupted:
+			require.Fail(t, "the task is interrupted", taskId)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
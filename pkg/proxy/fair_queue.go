@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"sort"
+)
+
+// wfqPolicy is the weighted fair queuing across the tenants.
+//
+// It is the start-time fair queuing driven by a virtual clock instead of the wall clock, so it is deterministic.
+// Each job is tagged on arrival with
+//
+//	start  = max(virtualTime, finish of the previous job of the same tenant)
+//	finish = start + cost / weight
+//
+// where the weight is the weight of the job's priority class, and the jobs are dispatched in the order of their finish tags.
+// The virtual time advances to the start tag of the dispatched job. So a tenant with a long backlog does not starve the others,
+// and a tenant gets the service in proportion to its weight.
+//
+// The tags are the slots of the tenant, and the jobs of one tenant fill its slots earliest-deadline-first, then in FIFO
+// order. So the deadlines reorder the jobs of a tenant without changing its share.
+type wfqPolicy struct {
+	virtualTime float64
+	lastFinish  map[string]float64      // the finish tag of the last job of each tenant
+	flows       map[string][]*queuedJob // the queued jobs of each tenant, in the order of their tags
+	length      int
+}
+
+func newWFQPolicy() *wfqPolicy {
+	return &wfqPolicy{
+		lastFinish: make(map[string]float64),
+		flows:      make(map[string][]*queuedJob),
+	}
+}
+
+func (w *wfqPolicy) Push(j *queuedJob) {
+	if !j.tagged {
+		start := w.virtualTime
+		if last := w.lastFinish[j.tenant]; last > start {
+			start = last
+		}
+		j.start = start
+		j.finish = start + j.cost/j.weight
+		j.tagged = true
+		w.lastFinish[j.tenant] = j.finish
+	}
+	// The re-queued job keeps its tags and goes back to its original place.
+	flow := w.flows[j.tenant]
+	i := sort.Search(len(flow), func(i int) bool { return before(j, flow[i]) })
+	flow = append(flow, nil)
+	copy(flow[i+1:], flow[i:])
+	flow[i] = j
+	w.flows[j.tenant] = flow
+	w.length++
+}
+
+func (w *wfqPolicy) Peek() *queuedJob {
+	var slot *queuedJob
+	for _, flow := range w.flows {
+		if slot == nil || before(flow[0], slot) {
+			slot = flow[0]
+		}
+	}
+	if slot == nil {
+		return nil
+	}
+	return dispatchOrder(w.flows[slot.tenant])[0]
+}
+
+func (w *wfqPolicy) Remove(j *queuedJob) bool {
+	flow := w.flows[j.tenant]
+	i := indexOfJob(flow, j)
+	if i < 0 {
+		return false
+	}
+	// The job takes the slot it fills in the dispatching order of its tenant, and the jobs between move by one slot.
+	d := indexOfJob(dispatchOrder(flow), j)
+	starts := make([]float64, len(flow))
+	finishes := make([]float64, len(flow))
+	for k, job := range flow {
+		starts[k], finishes[k] = job.start, job.finish
+	}
+	if i < d {
+		copy(flow[i:d], flow[i+1:d+1])
+	} else {
+		copy(flow[d+1:i+1], flow[d:i])
+	}
+	flow[d] = j
+	for k, job := range flow {
+		job.start, job.finish = starts[k], finishes[k]
+	}
+	if w.Peek() == j && j.start > w.virtualTime {
+		w.virtualTime = j.start
+	}
+	flow = append(flow[:d], flow[d+1:]...)
+	if len(flow) == 0 {
+		delete(w.flows, j.tenant)
+	} else {
+		w.flows[j.tenant] = flow
+	}
+	w.length--
+	w.prune()
+	return true
+}
+
+// prune forget the idle tenants which have no credit, so that the map does not grow with the tenants.
+func (w *wfqPolicy) prune() {
+	for tenant, last := range w.lastFinish {
+		if _, ok := w.flows[tenant]; !ok && last <= w.virtualTime {
+			delete(w.lastFinish, tenant)
+		}
+	}
+}
+
+func (w *wfqPolicy) Len() int {
+	return w.length
+}
+
+// All return the jobs in the dispatching order, i.e. the slots in the order of their tags,
+// each filled by the job of its tenant in the dispatching order of the tenant.
+func (w *wfqPolicy) All() []*queuedJob {
+	var slots []*queuedJob
+	orders := make(map[string][]*queuedJob)
+	for tenant, flow := range w.flows {
+		slots = append(slots, flow...)
+		orders[tenant] = dispatchOrder(flow)
+	}
+	sort.Slice(slots, func(i, j int) bool { return before(slots[i], slots[j]) })
+	jobs := make([]*queuedJob, 0, len(slots))
+	filled := make(map[string]int)
+	for _, slot := range slots {
+		jobs = append(jobs, orders[slot.tenant][filled[slot.tenant]])
+		filled[slot.tenant]++
+	}
+	return jobs
+}
+
+func (w *wfqPolicy) Position(id string) int {
+	var target *queuedJob
+	for _, flow := range w.flows {
+		for k, j := range dispatchOrder(flow) {
+			if j.id == id {
+				target = flow[k]
+			}
+		}
+	}
+	if target == nil {
+		return -1
+	}
+	position := 0
+	for _, flow := range w.flows {
+		for _, slot := range flow {
+			if before(slot, target) {
+				position++
+			}
+		}
+	}
+	return position
+}
+
+// dispatchOrder return the jobs of the tenant in the order they fill its slots, i.e. earliest-deadline-first,
+// then in the order of their tags.
+func dispatchOrder(flow []*queuedJob) []*queuedJob {
+	jobs := append([]*queuedJob(nil), flow...)
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return !jobs[i].deadline.Equal(jobs[j].deadline) && earlier(jobs[i], jobs[j])
+	})
+	return jobs
+}
+
+func indexOfJob(jobs []*queuedJob, j *queuedJob) int {
+	for i, job := range jobs {
+		if job == j {
+			return i
+		}
+	}
+	return -1
+}
+
+// before report whether job a is dispatched before job b.
+func before(a *queuedJob, b *queuedJob) bool {
+	if a.finish != b.finish {
+		return a.finish < b.finish
+	}
+	return a.seq < b.seq
+}
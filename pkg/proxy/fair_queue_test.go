@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWFQPolicy(t *testing.T) {
+	var seq uint64
+	push := func(w *wfqPolicy, tenant string, weight float64, n int) {
+		for i := 0; i < n; i++ {
+			seq++
+			w.Push(&queuedJob{
+				id:     fmt.Sprintf("%s%d", tenant, i),
+				seq:    seq,
+				tenant: tenant,
+				weight: weight,
+				cost:   1,
+			})
+		}
+	}
+	pop := func(w *wfqPolicy, n int) []string {
+		var ids []string
+		for i := 0; i < n; i++ {
+			j := w.Peek()
+			require.NotNil(t, j)
+			require.True(t, w.Remove(j))
+			ids = append(ids, j.id)
+		}
+		return ids
+	}
+
+	t.Run("Test a backlog does not starve other tenants", func(t *testing.T) {
+		w := newWFQPolicy()
+		push(w, "a", 1, 6)
+		push(w, "b", 1, 2)
+		require.Equal(t, 8, w.Len())
+		require.Equal(t, []string{"a0", "b0", "a1", "b1", "a2", "a3", "a4", "a5"}, pop(w, 8))
+		require.Nil(t, w.Peek())
+	})
+
+	t.Run("Test the service is in proportion to the class weight", func(t *testing.T) {
+		w := newWFQPolicy()
+		push(w, "batch", 1, 3)
+		push(w, "interactive", 4, 8)
+		require.Equal(t, []string{"interactive0", "interactive1", "interactive2", "batch0", "interactive3"}, pop(w, 5))
+		require.Equal(t, []string{"interactive4", "interactive5", "interactive6", "batch1", "interactive7", "batch2"}, pop(w, 6))
+	})
+
+	t.Run("Test an idle tenant does not accumulate credit", func(t *testing.T) {
+		w := newWFQPolicy()
+		push(w, "a", 1, 4)
+		require.Equal(t, []string{"a0", "a1"}, pop(w, 2))
+		push(w, "b", 1, 3)
+		require.Equal(t, []string{"b0", "a2", "b1", "a3", "b2"}, pop(w, 5))
+	})
+
+	t.Run("Test the deadlines reorder the jobs of a tenant without changing its share", func(t *testing.T) {
+		w := newWFQPolicy()
+		push(w, "a", 1, 2)
+		seq++
+		w.Push(&queuedJob{id: "a2", seq: seq, tenant: "a", weight: 1, cost: 1, deadline: time.Now().Add(time.Minute)})
+		push(w, "b", 1, 1)
+		require.Equal(t, 0, w.Position("a2"))
+		require.Equal(t, 1, w.Position("b0"))
+		require.Equal(t, 2, w.Position("a0"))
+		require.Equal(t, 3, w.Position("a1"))
+		var ids []string
+		for _, j := range w.All() {
+			ids = append(ids, j.id)
+		}
+		require.Equal(t, []string{"a2", "b0", "a0", "a1"}, ids)
+		require.Equal(t, []string{"a2", "b0", "a0", "a1"}, pop(w, 4))
+	})
+
+	t.Run("Test position and removal", func(t *testing.T) {
+		w := newWFQPolicy()
+		push(w, "a", 1, 3)
+		push(w, "b", 1, 1)
+		require.Equal(t, 0, w.Position("a0"))
+		require.Equal(t, 1, w.Position("b0"))
+		require.Equal(t, 3, w.Position("a2"))
+		require.Equal(t, -1, w.Position("c0"))
+
+		// The removed job is not dispatched, and the re-queued job goes back to its place.
+		a1 := w.flows["a"][1]
+		require.True(t, w.Remove(a1))
+		require.False(t, w.Remove(a1))
+		require.Equal(t, 2, w.Position("a2"))
+		w.Push(a1)
+		require.Equal(t, []string{"a0", "b0", "a1", "a2"}, pop(w, 4))
+	})
+}
@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+// HealthCheckConfig is the configuration of the backend health checking.
+type HealthCheckConfig struct {
+	Path               string        // the path of the active probe request
+	Interval           time.Duration // the interval of the active probes, 0 disables the active probes
+	Timeout            time.Duration // the timeout of one active probe
+	HealthyThreshold   int           // the consecutive successes to consider a backend healthy again
+	UnhealthyThreshold int           // the consecutive probe failures to eject a backend
+	PassiveThreshold   int           // the consecutive failed user requests to eject a backend, 0 disables the passive checking
+	PassiveStatusCodes []int         // the response statuses counted as the failures by the passive checking, besides the connection errors
+	BaseEjectionTime   time.Duration // the ejection time is BaseEjectionTime * 2^(ejections-1)
+	MaxEjectionTime    time.Duration // the upper bound of the ejection time
+}
+
+// HealthState is the health state of one backend observed by this proxy.
+type HealthState struct {
+	mutex                sync.Mutex
+	healthy              bool
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	ejections            int
+	ejectedAt            time.Time
+	ejectedUntil         time.Time
+	lastError            string
+	lastChecked          time.Time
+}
+
+func NewHealthState() *HealthState {
+	return &HealthState{healthy: true}
+}
+
+// Available report whether the backend can be selected at the moment.
+// The backend is re-admitted once its ejection time elapses, and ejected again for a longer time if it keeps failing.
+func (h *HealthState) Available(now time.Time) bool {
+	if h == nil {
+		return true
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return !now.Before(h.ejectedUntil)
+}
+
+// recordSuccess return true if the backend turns healthy.
+func (h *HealthState) recordSuccess(cfg *HealthCheckConfig, now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastChecked = now
+	h.consecutiveFailures = 0
+	h.consecutiveSuccesses++
+	if h.healthy || h.consecutiveSuccesses < cfg.HealthyThreshold || now.Before(h.ejectedUntil) {
+		return false
+	}
+	h.healthy = true
+	h.ejections = 0
+	return true
+}
+
+// recordFailure return true if the backend is ejected.
+func (h *HealthState) recordFailure(cfg *HealthCheckConfig, now time.Time, threshold int, err string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastChecked = now
+	h.lastError = err
+	h.consecutiveSuccesses = 0
+	h.consecutiveFailures++
+	if threshold <= 0 || h.consecutiveFailures < threshold || now.Before(h.ejectedUntil) {
+		return false
+	}
+	h.ejectLocked(cfg, now)
+	return true
+}
+
+// eject eject the backend at once, e.g. by the admin.
+func (h *HealthState) eject(cfg *HealthCheckConfig, now time.Time, err string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastChecked = now
+	h.lastError = err
+	h.consecutiveSuccesses = 0
+	h.ejectLocked(cfg, now)
+}
+
+func (h *HealthState) ejectLocked(cfg *HealthCheckConfig, now time.Time) {
+	h.healthy = false
+	h.ejections++
+	ejection := cfg.BaseEjectionTime << (h.ejections - 1)
+	if ejection <= 0 || ejection > cfg.MaxEjectionTime {
+		ejection = cfg.MaxEjectionTime
+	}
+	h.ejectedAt = now
+	h.ejectedUntil = now.Add(ejection)
+	h.consecutiveFailures = 0
+}
+
+// restore re-admit the backend at once and reset its ejections, e.g. by the admin.
+func (h *HealthState) restore(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastChecked = now
+	h.healthy = true
+	h.ejections = 0
+	h.ejectedUntil = time.Time{}
+	h.consecutiveFailures = 0
+}
+
+// adopt take the ejection made by other proxy replicas, and the recovery or the restore made after the ejection.
+func (h *HealthState) adopt(state *datastore.BackendHealthState) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	ejectedUntil := time.UnixMilli(state.EjectedUntil)
+	updatedAt := time.UnixMilli(state.UpdatedAt)
+	if ejectedUntil.After(h.ejectedUntil) {
+		h.healthy = false
+		h.ejectedAt = updatedAt
+		h.ejectedUntil = ejectedUntil
+		h.lastError = state.LastError
+	} else if state.Healthy && !h.healthy && updatedAt.After(h.ejectedAt) {
+		h.healthy = true
+		h.ejections = int(state.Ejections)
+		h.ejectedUntil = ejectedUntil
+		h.consecutiveFailures = 0
+	}
+}
+
+func (h *HealthState) snapshot(name string) *datastore.BackendHealthState {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return &datastore.BackendHealthState{
+		ServiceName:  name,
+		Healthy:      h.healthy,
+		Ejections:    int64(h.ejections),
+		EjectedUntil: h.ejectedUntil.UnixMilli(),
+		LastError:    h.lastError,
+		UpdatedAt:    h.lastChecked.UnixMilli(),
+	}
+}
+
+// HealthChecker probes the backends periodically, and observes the user requests to eject the unhealthy backends.
+type HealthChecker struct {
+	Config    *HealthCheckConfig
+	Datastore *datastore.BackendHealth
+	client    *http.Client
+	proxies   func() []*ReverseProxy
+	logger    echo.Logger
+}
+
+func NewHealthChecker(cfg *HealthCheckConfig, ds *datastore.BackendHealth, proxies func() []*ReverseProxy, logger echo.Logger) *HealthChecker {
+	return &HealthChecker{
+		Config:    cfg,
+		Datastore: ds,
+		client:    &http.Client{Timeout: cfg.Timeout},
+		proxies:   proxies,
+		logger:    logger,
+	}
+}
+
+// Run probe the backends until the context is done.
+func (hc *HealthChecker) Run(ctx context.Context) {
+	if hc.Config.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(hc.Config.Interval)
+	defer ticker.Stop()
+	for {
+		hc.probeAll(ctx)
+		hc.sync()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *HealthChecker) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range hc.proxies() {
+		wg.Add(1)
+		go func(p *ReverseProxy) {
+			defer wg.Done()
+			if err := hc.probe(ctx, p); err != nil {
+				hc.ReportFailure(p, hc.Config.UnhealthyThreshold, err)
+			} else {
+				hc.ReportSuccess(p)
+			}
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (hc *HealthChecker) probe(ctx context.Context, p *ReverseProxy) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.Target.JoinPath(hc.Config.Path).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("probe %s returns status %d", hc.Config.Path, resp.StatusCode)
+	}
+	return nil
+}
+
+// sync adopt the ejections made by the other proxy replicas.
+func (hc *HealthChecker) sync() {
+	states, err := hc.Datastore.ListAllHealth()
+	if err != nil {
+		hc.logger.Errorf("list backend health states failed: %v", err)
+		return
+	}
+	byName := make(map[string]*datastore.BackendHealthState, len(states))
+	for i := range states {
+		byName[states[i].ServiceName] = &states[i]
+	}
+	for _, p := range hc.proxies() {
+		if state, ok := byName[p.Name]; ok {
+			p.Health.adopt(state)
+		}
+	}
+}
+
+// ReportSuccess record a successful probe or request of the backend.
+func (hc *HealthChecker) ReportSuccess(p *ReverseProxy) {
+	if p.Health.recordSuccess(hc.Config, time.Now()) {
+		hc.logger.Infof("backend %s is healthy again", p.Name)
+		hc.persist(p)
+	}
+}
+
+// ReportFailure record a failed probe or request of the backend, and eject it if it reaches the threshold.
+func (hc *HealthChecker) ReportFailure(p *ReverseProxy, threshold int, err error) {
+	if p.Health.recordFailure(hc.Config, time.Now(), threshold, err.Error()) {
+		hc.logger.Warnf("backend %s is ejected: %v", p.Name, err)
+		hc.persist(p)
+	}
+}
+
+// ObserveResponse is the passive checking of the proxied responses. Only the statuses of an unavailable backend
+// are counted as the failures, e.g. not the 500 of a request the backend can not generate.
+func (hc *HealthChecker) ObserveResponse(p *ReverseProxy, resp *http.Response) {
+	if hc.failedStatus(resp.StatusCode) {
+		hc.ReportFailure(p, hc.Config.PassiveThreshold, fmt.Errorf("%s returns status %d", resp.Request.URL.Path, resp.StatusCode))
+		return
+	}
+	hc.ReportSuccess(p)
+}
+
+func (hc *HealthChecker) failedStatus(code int) bool {
+	for _, c := range hc.Config.PassiveStatusCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ObserveError is the passive checking of the proxy errors.
+func (hc *HealthChecker) ObserveError(p *ReverseProxy, err error) {
+	if errors.Is(err, context.Canceled) {
+		// The client goes away, it is not the fault of the backend.
+		return
+	}
+	hc.ReportFailure(p, hc.Config.PassiveThreshold, err)
+}
+
+// Available filter the backends which can be selected at the moment.
+// If all the backends are ejected, all of them are returned, since routing to a possibly broken backend
+// is better than rejecting all the requests.
+func (hc *HealthChecker) Available(proxies []*ReverseProxy) []*ReverseProxy {
+	now := time.Now()
+	available := make([]*ReverseProxy, 0, len(proxies))
+	for _, p := range proxies {
+		if p.Health.Available(now) {
+			available = append(available, p)
+		}
+	}
+	if len(available) == 0 {
+		return proxies
+	}
+	return available
+}
+
+func (hc *HealthChecker) persist(p *ReverseProxy) {
+	if err := hc.Datastore.PutHealth(p.Health.snapshot(p.Name)); err != nil {
+		hc.logger.Errorf("persist health state of %s failed: %v", p.Name, err)
+	}
+}
+
+// healthHandler return the health states of the backends observed by this proxy,
+// and the states persisted by all the proxy replicas.
+func (hc *HealthChecker) healthHandler(c echo.Context) error {
+	type backendHealth struct {
+		Name                 string    `json:"name"`
+		Endpoint             string    `json:"endpoint"`
+		Healthy              bool      `json:"healthy"`
+		Available            bool      `json:"available"`
+		Ejections            int       `json:"ejections"`
+		EjectedUntil         time.Time `json:"ejected_until"`
+		ConsecutiveFailures  int       `json:"consecutive_failures"`
+		ConsecutiveSuccesses int       `json:"consecutive_successes"`
+		LastError            string    `json:"last_error"`
+		LastChecked          time.Time `json:"last_checked"`
+	}
+	now := time.Now()
+	local := []backendHealth{}
+	for _, p := range hc.proxies() {
+		h := p.Health
+		h.mutex.Lock()
+		local = append(local, backendHealth{
+			Name:                 p.Name,
+			Endpoint:             p.Target.String(),
+			Healthy:              h.healthy,
+			Available:            !now.Before(h.ejectedUntil),
+			Ejections:            h.ejections,
+			EjectedUntil:         h.ejectedUntil,
+			ConsecutiveFailures:  h.consecutiveFailures,
+			ConsecutiveSuccesses: h.consecutiveSuccesses,
+			LastError:            h.lastError,
+			LastChecked:          h.lastChecked,
+		})
+		h.mutex.Unlock()
+	}
+	persisted, err := hc.Datastore.ListAllHealth()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"backends":  local,
+		"persisted": persisted,
+	})
+}
+
+// ejectHandler eject the backend from the selection, or restore it at once. The state is persisted,
+// so that the other proxy replicas adopt it on their next sync.
+func (hc *HealthChecker) ejectHandler(ejected bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var target *ReverseProxy
+		for _, p := range hc.proxies() {
+			if p.Name == c.Param("name") {
+				target = p
+				break
+			}
+		}
+		if target == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "service not found")
+		}
+		now := time.Now()
+		if ejected {
+			target.Health.eject(hc.Config, now, "ejected by the admin")
+			hc.logger.Warnf("backend %s is ejected by the admin", target.Name)
+		} else {
+			target.Health.restore(now)
+			hc.logger.Infof("backend %s is restored by the admin", target.Name)
+		}
+		state := target.Health.snapshot(target.Name)
+		if err := hc.Datastore.PutHealth(state); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, state)
+	}
+}
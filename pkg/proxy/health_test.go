@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthState(t *testing.T) {
+	cfg := &HealthCheckConfig{
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+		BaseEjectionTime:   time.Second,
+		MaxEjectionTime:    3 * time.Second,
+	}
+	now := time.Now()
+	h := NewHealthState()
+	fail := func() bool {
+		return h.recordFailure(cfg, now, cfg.UnhealthyThreshold, errors.New("connection refused").Error())
+	}
+
+	t.Run("Test ejection after consecutive failures", func(t *testing.T) {
+		require.False(t, fail())
+		require.False(t, fail())
+		require.True(t, fail())
+		require.False(t, h.Available(now))
+		require.True(t, h.Available(now.Add(time.Second)))
+	})
+
+	t.Run("Test exponential ejection time", func(t *testing.T) {
+		now = now.Add(time.Second)
+		fail()
+		fail()
+		require.True(t, fail())
+		require.False(t, h.Available(now.Add(time.Second)))
+		require.True(t, h.Available(now.Add(2*time.Second)))
+
+		// The ejection time is capped.
+		now = now.Add(2 * time.Second)
+		fail()
+		fail()
+		require.True(t, fail())
+		require.False(t, h.Available(now.Add(2*time.Second)))
+		require.True(t, h.Available(now.Add(3*time.Second)))
+	})
+
+	t.Run("Test recovery resets the ejections", func(t *testing.T) {
+		now = now.Add(3 * time.Second)
+		require.False(t, h.recordSuccess(cfg, now))
+		require.True(t, h.recordSuccess(cfg, now))
+		fail()
+		fail()
+		require.True(t, fail())
+		require.True(t, h.Available(now.Add(time.Second)))
+	})
+
+	t.Run("Test eject and restore", func(t *testing.T) {
+		now = now.Add(time.Second)
+		h.eject(cfg, now, "ejected by the admin")
+		require.False(t, h.Available(now))
+		h.restore(now)
+		require.True(t, h.Available(now))
+		require.Equal(t, 0, h.ejections)
+	})
+
+	t.Run("Test adopt the restore made after the ejection", func(t *testing.T) {
+		h.eject(cfg, now, "ejected by the admin")
+		// The healthy state persisted before the ejection is stale.
+		h.adopt(&datastore.BackendHealthState{Healthy: true, UpdatedAt: now.Add(-time.Second).UnixMilli()})
+		require.False(t, h.Available(now))
+		h.adopt(&datastore.BackendHealthState{Healthy: true, UpdatedAt: now.Add(time.Second).UnixMilli()})
+		require.True(t, h.Available(now))
+	})
+}
+
+func TestPassiveHealthCheck(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "secret"
+	config.Retry.MaxRetries = 0
+	config.HealthCheck.PassiveThreshold = 2
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var status atomic.Int32
+	var calls0, calls1 atomic.Int32
+	b0 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls0.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer b0.Close()
+	b1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls1.Add(1)
+	}))
+	defer b1.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", b0.URL))
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s1", b1.URL))
+	require.NoError(t, s.Reload())
+
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			s.Echo.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/sdapi/v1/memory", nil))
+		}
+	}
+	admin := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	reset := func() {
+		calls0.Store(0)
+		calls1.Store(0)
+	}
+
+	t.Run("Test error of the request is not counted", func(t *testing.T) {
+		status.Store(http.StatusInternalServerError)
+		reset()
+		send(6)
+		require.Equal(t, int32(3), calls0.Load())
+		require.Equal(t, int32(3), calls1.Load())
+	})
+
+	t.Run("Test unavailable backend is ejected", func(t *testing.T) {
+		status.Store(http.StatusServiceUnavailable)
+		reset()
+		send(8)
+		require.Equal(t, int32(2), calls0.Load())
+		require.Equal(t, int32(6), calls1.Load())
+	})
+
+	t.Run("Test admin restore and eject", func(t *testing.T) {
+		status.Store(http.StatusOK)
+		require.Equal(t, http.StatusOK, admin("/admin/health/s0/restore").Code)
+		reset()
+		send(4)
+		require.Equal(t, int32(2), calls0.Load())
+		require.Equal(t, int32(2), calls1.Load())
+
+		require.Equal(t, http.StatusOK, admin("/admin/health/s0/eject").Code)
+		reset()
+		send(4)
+		require.Equal(t, int32(0), calls0.Load())
+		require.Equal(t, int32(4), calls1.Load())
+		state, err := s.BackendHealthDatastore.GetHealth("s0")
+		require.NoError(t, err)
+		require.False(t, state.Healthy)
+
+		require.Equal(t, http.StatusNotFound, admin("/admin/health/s2/eject").Code)
+	})
+}
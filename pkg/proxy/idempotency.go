@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+const kIdempotencyKeyHeaderName = "Idempotency-Key"
+const kIdempotentReplayedHeaderName = "Idempotent-Replayed"
+
+// kMaxIdempotencyKeyLength is the max length of the idempotency key given by the client.
+const kMaxIdempotencyKeyLength = 255
+
+// kIdempotencyPollInterval is the interval to check the request in progress with the same key.
+const kIdempotencyPollInterval = 250 * time.Millisecond
+
+// IdempotencyConfig is the configuration of the idempotency keys.
+type IdempotencyConfig struct {
+	Paths          []string      // the POST paths which honour the Idempotency-Key header
+	TTL            time.Duration // the time the response is replayed for the key
+	PendingTimeout time.Duration // the lease of the first request with the key, renewed while it is served, after which the key is taken over by a retry
+}
+
+func (cfg *IdempotencyConfig) match(req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+	for _, path := range cfg.Paths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFingerprint return the hash of the request. The json body is canonicalized,
+// so the same request serialized with another key order or whitespace has the same fingerprint.
+func requestFingerprint(path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(path))
+	h.Write([]byte("\n"))
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&v); err == nil {
+		if canonical, err := json.Marshal(v); err == nil {
+			body = canonical
+		}
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyMiddleware serve the generation and the job submission with the Idempotency-Key header once.
+// The response of the first request is recorded in the datastore, and replayed to the retries with the same key
+// from the same tenant through any proxy replica. The retry of a request in progress waits for its response.
+// A failed request, i.e. 5xx or 429, is not recorded, so it can be retried with the same key. The request whose
+// response is too large to record, or whose client is gone before the response, is recorded as truncated,
+// so that its retry is rejected with the reference to its task instead of generating again.
+func (s *Server) idempotencyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		key := req.Header.Get(kIdempotencyKeyHeaderName)
+		if key == "" || !s.Config.Idempotency.match(req) || internalFromContext(req.Context()) != nil {
+			return next(c)
+		}
+		if len(key) > kMaxIdempotencyKeyLength {
+			return echo.NewHTTPError(http.StatusBadRequest, "Idempotency-Key is too long")
+		}
+		body, replayable, err := bufferBody(req, s.Config.Retry.MaxBodyBytes)
+		if err != nil {
+			return err
+		}
+		if !replayable {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "the request body is too large for the Idempotency-Key")
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		scoped := s.identify(c).Tenant + "/" + key
+		fingerprint := requestFingerprint(req.URL.Path, body)
+
+		for {
+			record, claimed, err := s.claimIdempotencyKey(scoped, fingerprint)
+			if err != nil {
+				return err
+			}
+			if claimed {
+				return s.serveIdempotent(c, next, record)
+			}
+			if record.Fingerprint != fingerprint {
+				return echo.NewHTTPError(http.StatusUnprocessableEntity, "Idempotency-Key is reused with a different request")
+			}
+			if record.Status != datastore.IdempotencyPending {
+				return s.replayIdempotent(c, record)
+			}
+			select {
+			case <-req.Context().Done():
+				return nil
+			case <-time.After(kIdempotencyPollInterval):
+			}
+		}
+	}
+}
+
+// claimIdempotencyKey record the key as pending, or take it over if it is expired, and return the pending record.
+// It returns the unexpired record of the key and false if the key is already claimed.
+func (s *Server) claimIdempotencyKey(key string, fingerprint string) (*datastore.IdempotencyRecord, bool, error) {
+	ds := s.IdempotencyKeysDatastore
+	for {
+		now := time.Now()
+		record := &datastore.IdempotencyRecord{
+			Key:         key,
+			Fingerprint: fingerprint,
+			Status:      datastore.IdempotencyPending,
+			CreatedAt:   now.UnixMilli(),
+			ExpiresAt:   now.Add(s.Config.Idempotency.PendingTimeout).UnixMilli(),
+		}
+		ok, err := ds.CreateRecord(record)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return record, true, nil
+		}
+		existing, err := ds.GetRecord(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if existing == nil {
+			// The failed request has released the key.
+			continue
+		}
+		if existing.ExpiresAt > now.UnixMilli() {
+			return existing, false, nil
+		}
+		ok, err = ds.ReplaceRecord(record, existing.ExpiresAt)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return record, true, nil
+		}
+	}
+}
+
+// serveIdempotent serve the request which has claimed the key with the pending record, and record its response.
+func (s *Server) serveIdempotent(c echo.Context, next echo.HandlerFunc, pending *datastore.IdempotencyRecord) error {
+	ds := s.IdempotencyKeysDatastore
+	key := pending.Key
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		s.renewIdempotencyKey(stop, pending)
+	}()
+	w := &captureWriter{ResponseWriter: c.Response().Writer, limit: s.Config.Retry.MaxBodyBytes}
+	c.Response().Writer = w
+	err := next(c)
+	c.Response().Writer = w.ResponseWriter
+	close(stop)
+	<-renewed
+
+	resp := c.Response()
+	code := resp.Status
+	if trailer := resp.Header().Get(kAsyncStatusCodeTrailerName); trailer != "" {
+		// The status of the bridged response is sent in the trailer.
+		code, _ = strconv.Atoi(trailer)
+	}
+	failed := err != nil || !resp.Committed || code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+	// The request may be running on the backend after its client is gone, unless it has not left the queue.
+	var queued *echo.HTTPError
+	gone := c.Request().Context().Err() != nil && !(errors.As(err, &queued) && queued.Code == kStatusClientClosedRequest)
+	if failed && !gone {
+		// Release the key so that the request can be retried.
+		if derr := ds.DeleteRecord(key); derr != nil {
+			c.Logger().Errorf("delete idempotency key %s failed: %v", key, derr)
+		}
+		return err
+	}
+	now := time.Now()
+	record := &datastore.IdempotencyRecord{
+		Key:         key,
+		Fingerprint: pending.Fingerprint,
+		Status:      datastore.IdempotencyCompleted,
+		StatusCode:  int64(code),
+		ContentType: resp.Header().Get(echo.HeaderContentType),
+		Body:        w.body.String(),
+		TaskId:      resp.Header().Get(kTaskIdHeaderName),
+		CreatedAt:   now.UnixMilli(),
+		ExpiresAt:   now.Add(s.Config.Idempotency.TTL).UnixMilli(),
+	}
+	if failed || w.overflow {
+		record.Status = datastore.IdempotencyTruncated
+		record.Body = ""
+	} else if path := c.Request().URL.Path; (path == "/v1/jobs" || path == "/v1/pipelines") && code == http.StatusAccepted {
+		var job struct {
+			Id string `json:"id"`
+		}
+		// The replay falls back to the recorded response if the job id is not found.
+		_ = json.Unmarshal(w.body.Bytes(), &job)
+		record.JobId = job.Id
+	}
+	if err := ds.PutRecord(record); err != nil {
+		c.Logger().Errorf("put idempotency key %s failed: %v", key, err)
+	}
+	return err
+}
+
+// renewIdempotencyKey extend the lease of the pending record every third of the pending timeout until stop is closed,
+// so that the request in progress is not taken over by a retry however long it runs.
+func (s *Server) renewIdempotencyKey(stop <-chan struct{}, pending *datastore.IdempotencyRecord) {
+	timeout := s.Config.Idempotency.PendingTimeout
+	if timeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+	expiresAt := pending.ExpiresAt
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		renewed := time.Now().Add(timeout).UnixMilli()
+		ok, err := s.IdempotencyKeysDatastore.RenewRecord(pending.Key, expiresAt, renewed)
+		if err != nil {
+			s.Echo.Logger.Errorf("renew idempotency key %s failed: %v", pending.Key, err)
+			continue
+		}
+		if !ok {
+			// The key is taken over after the lease has expired.
+			s.Echo.Logger.Warnf("idempotency key %s is taken over", pending.Key)
+			return
+		}
+		expiresAt = renewed
+	}
+}
+
+// replayIdempotent send the recorded response, or the latest status of the submitted job.
+func (s *Server) replayIdempotent(c echo.Context, record *datastore.IdempotencyRecord) error {
+	c.Response().Header().Set(kIdempotentReplayedHeaderName, "true")
+	if record.Status == datastore.IdempotencyTruncated {
+		if record.TaskId != "" {
+			c.Response().Header().Set(kTaskIdHeaderName, record.TaskId)
+		}
+		return echo.NewHTTPError(http.StatusConflict, "the request with the Idempotency-Key is served, but its response is not recorded")
+	}
+	if record.JobId != "" {
+		job, err := s.JobsDatastore.GetJob(record.JobId)
+		if err != nil {
+			return err
+		}
+		if job != nil {
+			return c.JSON(int(record.StatusCode), s.Jobs.view(job))
+		}
+	}
+	return c.Blob(int(record.StatusCode), record.ContentType, []byte(record.Body))
+}
+
+// purgeIdempotencyKeys remove the expired idempotency keys periodically.
+func (s *Server) purgeIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.IdempotencyKeysDatastore.PurgeExpiredRecords(time.Now().UnixMilli()); err != nil {
+			s.Echo.Logger.Errorf("purge expired idempotency keys failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	config := DefaultConfig()
+	config.HealthCheck.PassiveThreshold = 0
+	config.Retry.MaxRetries = 0
+	config.Retry.MaxBodyBytes = 1024
+	config.APIKeys = map[string]APIKey{"key1": {Tenant: "tenant1"}, "key2": {Tenant: "tenant2"}}
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var calls atomic.Int32
+	var failures atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if r.URL.Path == "/internal/progress" {
+			w.Write([]byte(`{"active": true, "progress": 0.5}`))
+			return
+		}
+		n := calls.Add(1)
+		switch payload["prompt"] {
+		case "flaky":
+			if failures.Add(1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		case "slow":
+			time.Sleep(300 * time.Millisecond)
+		case "large":
+			json.NewEncoder(w).Encode(map[string]interface{}{"images": []string{strings.Repeat("x", 2048)}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"images": []string{"image"}, "call": n})
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	doWithContext := func(ctx context.Context, path string, apiKey string, key string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)).WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(kAPIKeyHeaderName, apiKey)
+		req.Header.Set(kIdempotencyKeyHeaderName, key)
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	do := func(path string, apiKey string, key string, body string) *httptest.ResponseRecorder {
+		return doWithContext(context.Background(), path, apiKey, key, body)
+	}
+
+	t.Run("Test retry is replayed", func(t *testing.T) {
+		calls.Store(0)
+		first := do(kTxt2ImgPath, "key1", "k1", `{"prompt": "cat", "steps": 20}`)
+		require.Equal(t, http.StatusOK, first.Code)
+		require.Empty(t, first.Header().Get(kIdempotentReplayedHeaderName))
+		// The same request serialized differently.
+		second := do(kTxt2ImgPath, "key1", "k1", `{"steps":20,"prompt":"cat"}`)
+		require.Equal(t, http.StatusOK, second.Code)
+		require.Equal(t, "true", second.Header().Get(kIdempotentReplayedHeaderName))
+		require.Equal(t, first.Body.String(), second.Body.String())
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Test key reused with a different request", func(t *testing.T) {
+		rec := do(kTxt2ImgPath, "key1", "k1", `{"prompt": "dog"}`)
+		require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	})
+
+	t.Run("Test keys are scoped by the tenant", func(t *testing.T) {
+		calls.Store(0)
+		rec := do(kTxt2ImgPath, "key2", "k1", `{"prompt": "dog"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Empty(t, rec.Header().Get(kIdempotentReplayedHeaderName))
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Test failed request is not recorded", func(t *testing.T) {
+		calls.Store(0)
+		rec := do(kTxt2ImgPath, "key1", "k2", `{"prompt": "flaky"}`)
+		require.Equal(t, http.StatusInternalServerError, rec.Code)
+		rec = do(kTxt2ImgPath, "key1", "k2", `{"prompt": "flaky"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Empty(t, rec.Header().Get(kIdempotentReplayedHeaderName))
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("Test retry waits for the request in progress", func(t *testing.T) {
+		calls.Store(0)
+		var wg sync.WaitGroup
+		recs := make([]*httptest.ResponseRecorder, 2)
+		for i := range recs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				recs[i] = do(kTxt2ImgPath, "key1", "k3", `{"prompt": "slow"}`)
+			}(i)
+			time.Sleep(50 * time.Millisecond)
+		}
+		wg.Wait()
+		require.Equal(t, http.StatusOK, recs[0].Code)
+		require.Equal(t, http.StatusOK, recs[1].Code)
+		require.Equal(t, recs[0].Body.String(), recs[1].Body.String())
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Test request in progress renews its key", func(t *testing.T) {
+		s.Config.Idempotency.PendingTimeout = 60 * time.Millisecond
+		defer func() { s.Config.Idempotency.PendingTimeout = config.Idempotency.PendingTimeout }()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			do(kTxt2ImgPath, "key1", "k7", `{"prompt": "slow"}`)
+		}()
+		time.Sleep(200 * time.Millisecond)
+		// The request runs longer than the pending timeout, its key is not taken over.
+		record, err := s.IdempotencyKeysDatastore.GetRecord("tenant1/k7")
+		require.NoError(t, err)
+		require.Equal(t, datastore.IdempotencyPending, record.Status)
+		require.Greater(t, record.ExpiresAt, time.Now().UnixMilli())
+		<-done
+	})
+
+	t.Run("Test response too large to record is not generated again", func(t *testing.T) {
+		calls.Store(0)
+		first := do(kTxt2ImgPath, "key1", "k5", `{"prompt": "large"}`)
+		require.Equal(t, http.StatusOK, first.Code)
+		require.Contains(t, first.Body.String(), strings.Repeat("x", 2048))
+		taskId := first.Header().Get(kTaskIdHeaderName)
+		require.NotEmpty(t, taskId)
+		second := do(kTxt2ImgPath, "key1", "k5", `{"prompt": "large"}`)
+		require.Equal(t, http.StatusConflict, second.Code)
+		require.Equal(t, taskId, second.Header().Get(kTaskIdHeaderName))
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Test request of the disconnected client is not generated again", func(t *testing.T) {
+		calls.Store(0)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		doWithContext(ctx, kTxt2ImgPath, "key1", "k6", `{"prompt": "slow"}`)
+		record, err := s.IdempotencyKeysDatastore.GetRecord("tenant1/k6")
+		require.NoError(t, err)
+		require.Equal(t, datastore.IdempotencyTruncated, record.Status)
+		rec := do(kTxt2ImgPath, "key1", "k6", `{"prompt": "slow"}`)
+		require.Equal(t, http.StatusConflict, rec.Code)
+		require.Equal(t, record.TaskId, rec.Header().Get(kTaskIdHeaderName))
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Test job is submitted once", func(t *testing.T) {
+		submit := func() *jobView {
+			rec := do("/v1/jobs", "key1", "k4", `{"endpoint": "txt2img", "payload": {"prompt": "cat"}}`)
+			require.Equal(t, http.StatusAccepted, rec.Code)
+			var job jobView
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+			return &job
+		}
+		first := submit()
+		require.Eventually(t, func() bool {
+			job, _ := s.JobsDatastore.GetJob(first.Id)
+			return job != nil && job.Status == datastore.JobSucceeded
+		}, 2*time.Second, 10*time.Millisecond)
+		// The replay returns the latest status of the job.
+		second := submit()
+		require.Equal(t, first.Id, second.Id)
+		require.Equal(t, datastore.JobSucceeded, second.Status)
+		jobs, err := s.JobsDatastore.ListAllJobs()
+		require.NoError(t, err)
+		require.Len(t, jobs, 1)
+	})
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+type internalKey struct{}
+
+// internalCall marks the requests made by the proxy itself, e.g. the batched generations,
+// which go through the same routing, queuing and retrying as the client requests.
+type internalCall struct {
+	who identity // the identity on behalf of which the request is made
+}
+
+func internalFromContext(ctx context.Context) *internalCall {
+	call, _ := ctx.Value(internalKey{}).(*internalCall)
+	return call
+}
+
+// bufferedResponse is the in-memory http.ResponseWriter of the internal requests.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header)}
+}
+
+func (r *bufferedResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *bufferedResponse) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+// Flush is required by the reverse proxy to stream the response.
+func (r *bufferedResponse) Flush() {}
+
+// invoke send the request through the proxy itself on behalf of who, and return the buffered response.
+func (s *Server) invoke(ctx context.Context, who identity, method string, path string, header http.Header, body []byte) (*bufferedResponse, error) {
+	ctx = context.WithValue(ctx, internalKey{}, &internalCall{who: who})
+	req, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp := newBufferedResponse()
+	s.Echo.ServeHTTP(resp, req)
+	if resp.code == 0 {
+		resp.code = http.StatusOK
+	}
+	return resp, ctx.Err()
+}
+
+// invokeJSON send the GET request through the proxy itself on behalf of who, and decode the JSON response into v.
+func (s *Server) invokeJSON(ctx context.Context, who identity, path string, v interface{}) error {
+	resp, err := s.invoke(ctx, who, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.code != http.StatusOK {
+		return fmt.Errorf("get %s returns status %d", path, resp.code)
+	}
+	return json.Unmarshal(resp.body.Bytes(), v)
+}
@@ -0,0 +1,713 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+const kSDAPIPrefix = "/sdapi/v1/"
+
+// JobsConfig is the configuration of the asynchronous job API.
+type JobsConfig struct {
+	Endpoints         []string      // the sdapi paths which can be run as jobs
+	ProgressInterval  time.Duration // the interval to poll the progress and the cancellation of a running job, and to renew its lease
+	Timeout           time.Duration // the max time of one attempt of a job, including the time in the queue
+	MaxAttempts       int64         // the job is moved to the dead-letter table after the attempts
+	VisibilityTimeout time.Duration // the lease of a job expires unless it is renewed within the time, then the job is run again by any worker
+	PollInterval      time.Duration // the interval to scan the datastore for the due jobs and the expired leases
+	BackoffBase       time.Duration // the backoff after the n-th failed attempt is a random duration in [0, BackoffBase * 2^(n-1)]
+	BackoffMax        time.Duration // the upper bound of the backoff
+	MaxConcurrency    int           // the max number of the jobs run by this replica at the same time
+	MaxPipelineSteps  int           // the max number of the steps of a pipeline
+	Retention         time.Duration // the finished jobs are purged after the time, 0 keeps them forever
+}
+
+// endpoint resolve the sdapi path of the job, which can be given as the full path or the last segment, e.g. txt2img.
+func (cfg *JobsConfig) endpoint(name string) (string, bool) {
+	path := name
+	if !strings.HasPrefix(path, "/") {
+		path = kSDAPIPrefix + path
+	}
+	for _, e := range cfg.Endpoints {
+		if e == path {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+type backendObserverKey struct{}
+
+// withBackendObserver make the forwarding report each backend selected for the request, e.g. to poll its progress.
+func withBackendObserver(ctx context.Context, observe func(p *ReverseProxy)) context.Context {
+	return context.WithValue(ctx, backendObserverKey{}, observe)
+}
+
+func observeBackend(req *http.Request, p *ReverseProxy) {
+	if observe, ok := req.Context().Value(backendObserverKey{}).(func(p *ReverseProxy)); ok {
+		observe(p)
+	}
+}
+
+// AsyncJobs run the sdapi requests in the background on behalf of the callers, who poll the job status later.
+// The jobs are persisted in the datastore, which is the durable queue shared by the proxy replicas.
+// A worker leases a job before running it and renews the lease while it runs, the job whose lease expires,
+// e.g. its replica crashes, is run again by any worker, so a job is run at least once.
+// The job which fails after all the attempts is moved to the dead-letter table, from which it can be re-driven.
+type AsyncJobs struct {
+	Config        *JobsConfig
+	Datastore     *datastore.Jobs
+	DeadDatastore *datastore.Jobs // the dead-letter table
+	server        *Server
+	worker        string // the lease owner of the jobs run by this replica
+	mutex         sync.Mutex
+	running       map[string]*runningJob // the jobs run by this replica
+}
+
+// runningJob is a job run by this replica.
+type runningJob struct {
+	cancel  context.CancelFunc
+	backend atomic.Pointer[ReverseProxy] // the backend the job is sent to, nil while it is queued
+	lost    atomic.Bool                  // the lease is taken by another worker
+}
+
+func NewAsyncJobs(cfg *JobsConfig, ds *datastore.Jobs, dds *datastore.Jobs, s *Server) *AsyncJobs {
+	worker, err := randomId()
+	if err != nil {
+		panic(fmt.Errorf("create job worker id failed: %v", err))
+	}
+	return &AsyncJobs{
+		Config:        cfg,
+		Datastore:     ds,
+		DeadDatastore: dds,
+		server:        s,
+		worker:        worker,
+		running:       make(map[string]*runningJob),
+	}
+}
+
+// createHandler submit the job, e.g. {"endpoint": "txt2img", "payload": {"prompt": "cat"}, "deadline": "20s"},
+// and return its id at once. The optional deadline is a duration from now or an RFC 3339 time.
+func (j *AsyncJobs) createHandler(c echo.Context) error {
+	var body struct {
+		Endpoint    string          `json:"endpoint"`
+		Payload     json.RawMessage `json:"payload"`
+		CallbackUrl string          `json:"callback_url"`
+		Deadline    string          `json:"deadline"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	var deadline time.Time
+	if body.Deadline != "" {
+		var err error
+		if deadline, err = parseDeadline(body.Deadline, time.Now()); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	who := j.server.identify(c)
+	if body.CallbackUrl != "" {
+		if err := j.server.Webhooks.Config.validateCallbackUrl(who.Tenant, body.CallbackUrl); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	endpoint, ok := j.Config.endpoint(body.Endpoint)
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("endpoint %q cannot be run as a job", body.Endpoint))
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body.Payload, &payload); err != nil || payload == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "payload must be a json object")
+	}
+	id, err := randomId()
+	if err != nil {
+		return err
+	}
+	// Let the backend report the progress of the job by its id.
+	payload["force_task_id"] = id
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	job := &datastore.Job{
+		Id:            id,
+		Status:        datastore.JobQueued,
+		Endpoint:      endpoint,
+		Payload:       string(encoded),
+		Tenant:        who.Tenant,
+		Class:         who.Class,
+		CallbackUrl:   body.CallbackUrl,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		MaxAttempts:   j.Config.MaxAttempts,
+		NextAttemptAt: now,
+	}
+	if !deadline.IsZero() {
+		job.Deadline = deadline.UnixMilli()
+	}
+	if err := j.Datastore.PutJob(job); err != nil {
+		return fmt.Errorf("put job %s failed: %v", id, err)
+	}
+	go j.dispatch(job.Id)
+	return c.JSON(http.StatusAccepted, j.view(job))
+}
+
+// Run lease and run the due jobs periodically, including the retried jobs, the jobs left by the crashed workers,
+// and the jobs submitted while all the workers were down. The finished jobs are purged after the retention.
+func (j *AsyncJobs) Run(ctx context.Context) {
+	if j.Config.PollInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(j.Config.PollInterval)
+	defer ticker.Stop()
+	purge := time.NewTicker(time.Minute)
+	defer purge.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-purge.C:
+			if n, err := j.Datastore.PurgeExpiredJobs(time.Now().UnixMilli()); err != nil {
+				j.server.Echo.Logger.Errorf("purge expired jobs failed: %v", err)
+			} else if n > 0 {
+				j.server.Echo.Logger.Infof("purge %d expired jobs", n)
+			}
+			continue
+		case <-ticker.C:
+		}
+		jobs, err := j.Datastore.ListUnfinishedJobs()
+		if err != nil {
+			j.server.Echo.Logger.Errorf("list jobs failed: %v", err)
+			continue
+		}
+		sort.Slice(jobs, func(a, b int) bool { return jobs[a].CreatedAt < jobs[b].CreatedAt })
+		now := time.Now().UnixMilli()
+		for i := range jobs {
+			switch {
+			case isPipeline(&jobs[i]) && !jobs[i].Done():
+				// The steps may be finished by the crashed workers before they advance the pipeline.
+				go j.advance(jobs[i].Id)
+			case due(&jobs[i], now):
+				go j.dispatch(jobs[i].Id)
+			}
+		}
+	}
+}
+
+// due report whether the job can be leased, i.e. it is queued and its backoff has passed, or its lease has expired.
+// The pipelines are never leased, their steps are.
+func due(job *datastore.Job, now int64) bool {
+	if isPipeline(job) {
+		return false
+	}
+	return job.Status == datastore.JobQueued && job.NextAttemptAt <= now || job.Leased() && job.LeaseExpiresAt <= now
+}
+
+// dispatch lease the job and run it, unless it is not due, it is leased by another worker or this replica is busy.
+func (j *AsyncJobs) dispatch(id string) {
+	j.mutex.Lock()
+	if _, ok := j.running[id]; ok || j.Config.MaxConcurrency > 0 && len(j.running) >= j.Config.MaxConcurrency {
+		j.mutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithTimeout(j.server.ctx, j.Config.Timeout)
+	r := &runningJob{cancel: cancel}
+	j.running[id] = r
+	j.mutex.Unlock()
+	defer func() {
+		j.mutex.Lock()
+		delete(j.running, id)
+		j.mutex.Unlock()
+		cancel()
+	}()
+
+	var dead bool
+	job, err := j.update(id, func(latest *datastore.Job) bool {
+		now := time.Now()
+		if !due(latest, now.UnixMilli()) {
+			return false
+		}
+		if latest.CancelRequested {
+			latest.Status = datastore.JobCancelled
+			return true
+		}
+		if latest.Deadline > 0 && latest.Deadline <= now.UnixMilli() {
+			latest.Status = datastore.JobFailed
+			latest.Error = "the deadline is exceeded"
+			return true
+		}
+		if latest.Leased() && latest.Attempts >= latest.MaxAttempts {
+			// The last attempt is lost with its worker.
+			latest.Status = datastore.JobDead
+			latest.Error = fmt.Sprintf("the lease of attempt %d expired: %s", latest.Attempts, latest.Error)
+			dead = true
+			return true
+		}
+		latest.Status = datastore.JobLeased
+		latest.Attempts++
+		latest.LeaseOwner = j.worker
+		latest.LeaseExpiresAt = now.Add(j.Config.VisibilityTimeout).UnixMilli()
+		latest.Backend = ""
+		latest.Progress = 0
+		latest.Eta = 0
+		return true
+	})
+	if err != nil {
+		j.server.Echo.Logger.Errorf("lease job %s failed: %v", id, err)
+		return
+	}
+	if job == nil {
+		return
+	}
+	switch {
+	case dead:
+		j.bury(job)
+	case job.Done():
+		j.notify(job)
+	default:
+		j.run(ctx, job, r)
+	}
+}
+
+// run send the leased job through the proxy itself, so it waits in the queue and is retried like the client requests.
+func (j *AsyncJobs) run(ctx context.Context, job *datastore.Job, r *runningJob) {
+	ctx = withBackendObserver(ctx, func(p *ReverseProxy) { r.backend.Store(p) })
+	done := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		j.watch(ctx, job.Id, r, done)
+	}()
+
+	header := make(http.Header)
+	header.Set(echo.HeaderXRequestID, job.Id)
+	if job.Deadline > 0 {
+		header.Set(kDeadlineHeaderName, time.UnixMilli(job.Deadline).Format(time.RFC3339Nano))
+	}
+	who := identity{Tenant: job.Tenant, Class: job.Class}
+	resp, err := j.server.invoke(ctx, who, http.MethodPost, job.Endpoint, header, []byte(job.Payload))
+	close(done)
+	<-watched
+	if r.lost.Load() {
+		j.server.Echo.Logger.Warnf("the lease of job %s is lost, discard the result of attempt %d", job.Id, job.Attempts)
+		return
+	}
+
+	shutdown := j.server.ctx.Err() != nil
+	var dead bool
+	final, uerr := j.update(job.Id, func(latest *datastore.Job) bool {
+		if !j.owns(latest) {
+			return false
+		}
+		if p := r.backend.Load(); p != nil {
+			latest.Backend = p.Name
+		}
+		latest.LeaseOwner = ""
+		latest.LeaseExpiresAt = 0
+		switch {
+		case latest.CancelRequested:
+			latest.Status = datastore.JobCancelled
+		case shutdown:
+			// The attempt is aborted by this replica, give it back to the queue.
+			latest.Status = datastore.JobQueued
+			latest.Attempts--
+			latest.NextAttemptAt = time.Now().UnixMilli()
+		case err == nil && resp.code == http.StatusOK:
+			latest.Status = datastore.JobSucceeded
+			latest.Result = resp.body.String()
+			latest.Error = ""
+			latest.Progress = 1
+			latest.Eta = 0
+		default:
+			retryable := true
+			if err != nil {
+				latest.Error = err.Error()
+			} else {
+				latest.Error = fmt.Sprintf("status %d: %s", resp.code, strings.TrimSpace(resp.body.String()))
+				// The invalid request fails again on retry.
+				retryable = resp.code >= http.StatusInternalServerError || resp.code == http.StatusTooManyRequests
+			}
+			if latest.Deadline > 0 && latest.Deadline <= time.Now().UnixMilli()+j.server.Queue.Estimator.Estimate(latest.Endpoint, generationWork([]byte(latest.Payload))).Milliseconds() {
+				// The retry can not meet the deadline either.
+				retryable = false
+			}
+			switch {
+			case !retryable:
+				latest.Status = datastore.JobFailed
+			case latest.Attempts >= latest.MaxAttempts:
+				latest.Status = datastore.JobDead
+				dead = true
+			default:
+				latest.Status = datastore.JobQueued
+				latest.NextAttemptAt = time.Now().Add(jitteredBackoff(j.Config.BackoffBase, j.Config.BackoffMax, latest.Attempts)).UnixMilli()
+			}
+		}
+		return true
+	})
+	if uerr != nil {
+		j.server.Echo.Logger.Errorf("update job %s failed: %v", job.Id, uerr)
+		return
+	}
+	if final == nil {
+		j.server.Echo.Logger.Warnf("the lease of job %s is lost, discard the result of attempt %d", job.Id, job.Attempts)
+		return
+	}
+	if dead {
+		j.bury(final)
+	} else if final.Done() {
+		j.notify(final)
+	}
+}
+
+// owns report whether this replica still holds the lease of the job.
+func (j *AsyncJobs) owns(job *datastore.Job) bool {
+	return job.Leased() && job.LeaseOwner == j.worker
+}
+
+// bury copy the dead job to the dead-letter table.
+func (j *AsyncJobs) bury(job *datastore.Job) {
+	j.server.Echo.Logger.Warnf("job %s is dead after %d attempts: %s", job.Id, job.Attempts, job.Error)
+	if err := j.DeadDatastore.PutJob(job); err != nil {
+		j.server.Echo.Logger.Errorf("put dead job %s failed: %v", job.Id, err)
+	}
+	j.notify(job)
+}
+
+// notify enqueue the completion webhook of the finished job, and advance the pipeline of the finished step.
+func (j *AsyncJobs) notify(job *datastore.Job) {
+	if job.Pipeline != "" {
+		go j.advance(job.Pipeline)
+	}
+	if job.CallbackUrl == "" {
+		return
+	}
+	if err := j.server.Webhooks.Enqueue(job); err != nil {
+		j.server.Echo.Logger.Errorf("enqueue webhook of job %s failed: %v", job.Id, err)
+	}
+}
+
+// watch renew the lease of the job, and poll its progress on its backend and its cancellation in the datastore until it is done.
+func (j *AsyncJobs) watch(ctx context.Context, id string, r *runningJob, done chan struct{}) {
+	ticker := time.NewTicker(j.Config.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		job, err := j.Datastore.GetJob(id)
+		if err != nil || job == nil {
+			continue
+		}
+		if job.CancelRequested {
+			j.cancel(id)
+			return
+		}
+		p := r.backend.Load()
+		var progress, eta float64
+		var perr error
+		if p != nil {
+			if progress, eta, perr = j.progress(ctx, p, id); perr != nil {
+				j.server.Echo.Logger.Warnf("get progress of job %s from %s failed: %v", id, p.Name, perr)
+			}
+		}
+		job, err = j.update(id, func(latest *datastore.Job) bool {
+			if !j.owns(latest) {
+				return false
+			}
+			latest.LeaseExpiresAt = time.Now().Add(j.Config.VisibilityTimeout).UnixMilli()
+			if p == nil {
+				return true
+			}
+			latest.Status = datastore.JobRunning
+			latest.Backend = p.Name
+			if perr == nil {
+				if progress > latest.Progress {
+					latest.Progress = progress
+				}
+				latest.Eta = eta
+			}
+			return true
+		})
+		if err != nil {
+			j.server.Echo.Logger.Errorf("update job %s failed: %v", id, err)
+			continue
+		}
+		if job == nil {
+			// Another worker has taken over the job after the lease expired, stop running it here.
+			r.lost.Store(true)
+			r.cancel()
+			return
+		}
+	}
+}
+
+// progress get the progress of the task from the backend.
+func (j *AsyncJobs) progress(ctx context.Context, p *ReverseProxy, id string) (float64, float64, error) {
+	body, err := json.Marshal(map[string]interface{}{"id_task": id, "id_live_preview": -1})
+	if err != nil {
+		return 0, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Target.JoinPath("/internal/progress").String(), bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := j.server.HttpClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var state struct {
+		Progress float64 `json:"progress"`
+		Eta      float64 `json:"eta"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return 0, 0, err
+	}
+	return state.Progress, state.Eta, nil
+}
+
+// interrupt stop the generation running on the backend.
+func (j *AsyncJobs) interrupt(p *ReverseProxy) {
+	req, err := http.NewRequestWithContext(j.server.ctx, http.MethodPost, p.Target.JoinPath("/sdapi/v1/interrupt").String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := j.server.HttpClient.Do(req)
+	if err != nil {
+		j.server.Echo.Logger.Warnf("interrupt %s failed: %v", p.Name, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// cancel abort the job and interrupt its backend if it is run by this replica.
+func (j *AsyncJobs) cancel(id string) {
+	j.mutex.Lock()
+	r, ok := j.running[id]
+	j.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if p := r.backend.Load(); p != nil {
+		j.interrupt(p)
+	}
+	r.cancel()
+}
+
+// update apply the change to the latest state of the job in the datastore, and apply it again on the concurrent updates.
+// The change returns false to leave the job as is, in which case update returns nil.
+func (j *AsyncJobs) update(id string, change func(job *datastore.Job) bool) (*datastore.Job, error) {
+	for {
+		job, err := j.Datastore.GetJob(id)
+		if err != nil {
+			return nil, err
+		}
+		if job == nil {
+			return nil, fmt.Errorf("job %s does not exist", id)
+		}
+		if !change(job) {
+			return nil, nil
+		}
+		now := time.Now()
+		job.UpdatedAt = now.UnixMilli()
+		switch {
+		case !job.Done():
+			job.ExpiresAt = 0
+		case job.ExpiresAt == 0 && j.Config.Retention > 0:
+			job.ExpiresAt = now.Add(j.Config.Retention).UnixMilli()
+		}
+		ok, err := j.Datastore.CompareAndPutJob(job)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return job, nil
+		}
+	}
+}
+
+// jobView is the job status returned to the callers.
+type jobView struct {
+	*datastore.Job
+	Position *int            `json:"position,omitempty"` // the position in the queue of this replica
+	Result   json.RawMessage `json:"result,omitempty"`   // the sdapi response of the succeeded job
+	Steps    []*stepView     `json:"steps,omitempty"`    // the steps of the pipeline
+}
+
+func (j *AsyncJobs) view(job *datastore.Job) *jobView {
+	if isPipeline(job) {
+		return j.pipelineView(job)
+	}
+	view := &jobView{Job: job}
+	if job.Status == datastore.JobLeased {
+		if position := j.server.Queue.Position(job.Id); position >= 0 {
+			view.Position = &position
+		}
+	}
+	if job.Status == datastore.JobSucceeded && json.Valid([]byte(job.Result)) {
+		view.Result = json.RawMessage(job.Result)
+	}
+	return view
+}
+
+func (j *AsyncJobs) getHandler(c echo.Context) error {
+	job, err := j.Datastore.GetJob(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "job does not exist")
+	}
+	return c.JSON(http.StatusOK, j.view(job))
+}
+
+// cancelHandler cancel the queued job at once, or request the cancellation of the leased job.
+// The worker which runs the job interrupts its backend on the next progress poll, or at once if it is this replica.
+func (j *AsyncJobs) cancelHandler(c echo.Context) error {
+	id := c.Param("id")
+	job, err := j.Datastore.GetJob(id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "job does not exist")
+	}
+	job, finished, err := j.requestCancel(id)
+	if err != nil {
+		return fmt.Errorf("update job %s failed: %v", id, err)
+	}
+	if finished != "" {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("job is already %s", finished))
+	}
+	return c.JSON(http.StatusAccepted, j.view(job))
+}
+
+// requestCancel cancel the job, or return its status if it is already finished.
+// The pipeline is cancelled once the cancellation of its running steps is done.
+func (j *AsyncJobs) requestCancel(id string) (*datastore.Job, string, error) {
+	var finished string
+	job, err := j.update(id, func(latest *datastore.Job) bool {
+		if latest.Done() {
+			finished = latest.Status
+			return false
+		}
+		latest.CancelRequested = true
+		if latest.Status == datastore.JobQueued && !isPipeline(latest) {
+			latest.Status = datastore.JobCancelled
+		}
+		return true
+	})
+	if err != nil || finished != "" {
+		return nil, finished, err
+	}
+	switch {
+	case isPipeline(job):
+		go j.advance(id)
+	case job.Done():
+		j.notify(job)
+	default:
+		j.cancel(id)
+	}
+	return job, "", nil
+}
+
+// listDeadHandler return the dead jobs, newest first.
+func (j *AsyncJobs) listDeadHandler(c echo.Context) error {
+	jobs, err := j.DeadDatastore.ListAllJobs()
+	if err != nil {
+		return err
+	}
+	ret := []*jobView{}
+	for i := range jobs {
+		ret = append(ret, j.view(&jobs[i]))
+	}
+	sort.Slice(ret, func(a, b int) bool { return ret[a].UpdatedAt > ret[b].UpdatedAt })
+	return c.JSON(http.StatusOK, ret)
+}
+
+// getDeadHandler return the dead job with its payload, to inspect why it fails.
+func (j *AsyncJobs) getDeadHandler(c echo.Context) error {
+	job, err := j.DeadDatastore.GetJob(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "dead job does not exist")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"job":     j.view(job),
+		"payload": json.RawMessage(nonEmptyJSON(job.Payload)),
+	})
+}
+
+// redriveHandler queue the dead job again with a fresh attempt budget, e.g. after the backends are fixed.
+func (j *AsyncJobs) redriveHandler(c echo.Context) error {
+	id := c.Param("id")
+	dead, err := j.DeadDatastore.GetJob(id)
+	if err != nil {
+		return err
+	}
+	if dead == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "dead job does not exist")
+	}
+	job, err := j.Datastore.GetJob(id)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		// The job is removed from the jobs table, restore it from the dead-letter table.
+		job = dead
+		job.Version = 0
+		if err := j.Datastore.PutJob(job); err != nil {
+			return fmt.Errorf("put job %s failed: %v", id, err)
+		}
+	}
+	job, err = j.update(id, func(latest *datastore.Job) bool {
+		latest.Status = datastore.JobQueued
+		latest.Attempts = 0
+		latest.MaxAttempts = j.Config.MaxAttempts
+		latest.NextAttemptAt = time.Now().UnixMilli()
+		latest.LeaseOwner = ""
+		latest.LeaseExpiresAt = 0
+		latest.CancelRequested = false
+		latest.Error = ""
+		latest.Progress = 0
+		latest.Eta = 0
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("update job %s failed: %v", id, err)
+	}
+	if err := j.DeadDatastore.DeleteJob(id); err != nil {
+		return fmt.Errorf("delete dead job %s failed: %v", id, err)
+	}
+	go j.dispatch(id)
+	return c.JSON(http.StatusAccepted, j.view(job))
+}
+
+// deleteDeadHandler discard the dead job from the dead-letter table, the job itself stays dead.
+func (j *AsyncJobs) deleteDeadHandler(c echo.Context) error {
+	if err := j.DeadDatastore.DeleteJob(c.Param("id")); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobs(t *testing.T) {
+	config := DefaultConfig()
+	config.Jobs.ProgressInterval = 10 * time.Millisecond
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	interrupted := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/progress":
+			w.Write([]byte(`{"active": true, "progress": 0.5, "eta": 3}`))
+		case "/sdapi/v1/interrupt":
+			interrupted <- struct{}{}
+		default:
+			var payload map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&payload)
+			if payload["prompt"] == "slow" {
+				// Run until the job is cancelled.
+				<-r.Context().Done()
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"images": []string{"image"}, "task": payload["force_task_id"]})
+		}
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	submit := func(body string) string {
+		rec := do(http.MethodPost, "/v1/jobs", body)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		var job jobView
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		require.NotEmpty(t, job.Id)
+		return job.Id
+	}
+	status := func(id string) *jobView {
+		rec := do(http.MethodGet, "/v1/jobs/"+id, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var job jobView
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return &job
+	}
+	waitFor := func(id string, status string) *datastore.Job {
+		var job *datastore.Job
+		require.Eventually(t, func() bool {
+			job, _ = s.JobsDatastore.GetJob(id)
+			return job != nil && job.Status == status
+		}, 2*time.Second, 10*time.Millisecond)
+		return job
+	}
+
+	t.Run("Test job succeeds", func(t *testing.T) {
+		id := submit(`{"endpoint": "txt2img", "payload": {"prompt": "cat"}}`)
+		waitFor(id, datastore.JobSucceeded)
+		job := status(id)
+		require.Equal(t, 1.0, job.Progress)
+		require.Equal(t, "s0", job.Backend)
+		var result map[string]interface{}
+		require.NoError(t, json.Unmarshal(job.Result, &result))
+		require.Equal(t, id, result["task"])
+
+		// The finished job is purged after the retention.
+		finished, err := s.JobsDatastore.GetJob(id)
+		require.NoError(t, err)
+		require.InDelta(t, time.Now().Add(config.Jobs.Retention).UnixMilli(), finished.ExpiresAt, float64(time.Minute.Milliseconds()))
+		n, err := s.JobsDatastore.PurgeExpiredJobs(finished.ExpiresAt)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+		require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/v1/jobs/"+id, "").Code)
+	})
+
+	t.Run("Test job progress and cancellation", func(t *testing.T) {
+		id := submit(`{"endpoint": "/sdapi/v1/txt2img", "payload": {"prompt": "slow"}}`)
+		job := waitFor(id, datastore.JobRunning)
+		require.Eventually(t, func() bool { return status(id).Progress == 0.5 }, time.Second, 10*time.Millisecond)
+		require.Equal(t, "s0", job.Backend)
+
+		rec := do(http.MethodDelete, "/v1/jobs/"+id, "")
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		<-interrupted
+		waitFor(id, datastore.JobCancelled)
+		rec = do(http.MethodDelete, "/v1/jobs/"+id, "")
+		require.Equal(t, http.StatusConflict, rec.Code)
+	})
+
+	t.Run("Test cancellation requested through another replica", func(t *testing.T) {
+		id := submit(`{"endpoint": "txt2img", "payload": {"prompt": "slow"}}`)
+		job := waitFor(id, datastore.JobRunning)
+		// Another replica only flags the job in the shared datastore.
+		job.CancelRequested = true
+		require.NoError(t, s.JobsDatastore.PutJob(job))
+		<-interrupted
+		waitFor(id, datastore.JobCancelled)
+	})
+
+	t.Run("Test invalid job", func(t *testing.T) {
+		rec := do(http.MethodPost, "/v1/jobs", `{"endpoint": "options", "payload": {}}`)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		rec = do(http.MethodPost, "/v1/jobs", `{"endpoint": "txt2img"}`)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		rec = do(http.MethodGet, "/v1/jobs/non_exist_job", "")
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestDurableJobs(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "admin"
+	config.HealthCheck.PassiveThreshold = 0
+	config.Retry.MaxRetries = 0
+	config.Jobs.ProgressInterval = 10 * time.Millisecond
+	config.Jobs.PollInterval = 10 * time.Millisecond
+	config.Jobs.MaxAttempts = 2
+	config.Jobs.BackoffBase = time.Millisecond
+	config.Jobs.BackoffMax = time.Millisecond
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+	go s.Jobs.Run(s.ctx)
+
+	// The backend fails the broken prompt until it is fixed.
+	var fixed atomic.Bool
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		switch {
+		case r.URL.Path == "/internal/progress":
+			w.Write([]byte(`{"active": true, "progress": 0.5, "eta": 3}`))
+		case payload["prompt"] == "invalid":
+			calls.Add(1)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		case payload["prompt"] == "broken" && !fixed.Load():
+			calls.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte(`{"images": ["image"]}`))
+		}
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer admin")
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	submit := func(prompt string) string {
+		rec := do(http.MethodPost, "/v1/jobs", `{"endpoint": "txt2img", "payload": {"prompt": "`+prompt+`"}}`)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		var job jobView
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return job.Id
+	}
+	waitFor := func(id string, status string) *datastore.Job {
+		var job *datastore.Job
+		require.Eventually(t, func() bool {
+			job, _ = s.JobsDatastore.GetJob(id)
+			return job != nil && job.Status == status
+		}, 2*time.Second, 10*time.Millisecond)
+		return job
+	}
+
+	t.Run("Test job is dead after all the attempts and re-driven", func(t *testing.T) {
+		id := submit("broken")
+		job := waitFor(id, datastore.JobDead)
+		require.Equal(t, int64(2), job.Attempts)
+		require.Equal(t, int32(2), calls.Load())
+		require.Contains(t, job.Error, "status 502")
+
+		rec := do(http.MethodGet, "/admin/jobs/dead", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var dead []jobView
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &dead))
+		require.Len(t, dead, 1)
+		require.Equal(t, id, dead[0].Id)
+		rec = do(http.MethodGet, "/admin/jobs/dead/"+id, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), `"prompt":"broken"`)
+
+		fixed.Store(true)
+		rec = do(http.MethodPost, "/admin/jobs/dead/"+id+"/redrive", "")
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		job = waitFor(id, datastore.JobSucceeded)
+		require.Equal(t, int64(1), job.Attempts)
+		rec = do(http.MethodGet, "/admin/jobs/dead/"+id, "")
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Test invalid request is not retried", func(t *testing.T) {
+		calls.Store(0)
+		id := submit("invalid")
+		job := waitFor(id, datastore.JobFailed)
+		require.Equal(t, int64(1), job.Attempts)
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Test job of the crashed worker is run again", func(t *testing.T) {
+		now := time.Now().UnixMilli()
+		require.NoError(t, s.JobsDatastore.PutJob(&datastore.Job{
+			Id:             "job1",
+			Status:         datastore.JobRunning,
+			Endpoint:       kTxt2ImgPath,
+			Payload:        `{"prompt": "cat"}`,
+			MaxAttempts:    2,
+			Attempts:       1,
+			LeaseOwner:     "crashed",
+			LeaseExpiresAt: now - 1,
+			CreatedAt:      now,
+		}))
+		job := waitFor("job1", datastore.JobSucceeded)
+		require.Equal(t, int64(2), job.Attempts)
+	})
+
+	t.Run("Test job of the crashed worker in its last attempt is dead", func(t *testing.T) {
+		now := time.Now().UnixMilli()
+		require.NoError(t, s.JobsDatastore.PutJob(&datastore.Job{
+			Id:             "job2",
+			Status:         datastore.JobLeased,
+			Endpoint:       kTxt2ImgPath,
+			Payload:        `{"prompt": "cat"}`,
+			MaxAttempts:    2,
+			Attempts:       2,
+			LeaseOwner:     "crashed",
+			LeaseExpiresAt: now - 1,
+			CreatedAt:      now,
+		}))
+		waitFor("job2", datastore.JobDead)
+		dead, err := s.DeadJobsDatastore.GetJob("job2")
+		require.NoError(t, err)
+		require.NotNil(t, dead)
+	})
+
+	t.Run("Test the live lease is not taken over", func(t *testing.T) {
+		now := time.Now()
+		require.NoError(t, s.JobsDatastore.PutJob(&datastore.Job{
+			Id:             "job3",
+			Status:         datastore.JobRunning,
+			Endpoint:       kTxt2ImgPath,
+			Payload:        `{"prompt": "cat"}`,
+			MaxAttempts:    2,
+			Attempts:       1,
+			LeaseOwner:     "alive",
+			LeaseExpiresAt: now.Add(time.Minute).UnixMilli(),
+			CreatedAt:      now.UnixMilli(),
+		}))
+		time.Sleep(50 * time.Millisecond)
+		job, err := s.JobsDatastore.GetJob("job3")
+		require.NoError(t, err)
+		require.Equal(t, datastore.JobRunning, job.Status)
+		require.Equal(t, "alive", job.LeaseOwner)
+	})
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MembershipConfig is the configuration of the dynamic backend membership.
+type MembershipConfig struct {
+	ReloadInterval time.Duration // the interval to reload the backend services from the datastore, 0 disables the periodic reloading
+	DrainTimeout   time.Duration // the max time to wait for the in-flight requests of a removed backend
+}
+
+// currentProxies return the snapshot of the backend reverse proxies.
+// The returned slice must not be modified, since the membership changes replace the whole slice.
+func (s *Server) currentProxies() []*ReverseProxy {
+	s.proxiesMutex.RLock()
+	defer s.proxiesMutex.RUnlock()
+	return s.Proxies
+}
+
+// Reload sync the backend reverse proxies with the services in the datastore.
+// The new services are added, and the removed services, or the services whose endpoints are changed,
+// stop receiving new requests at once and are drained in background.
+func (s *Server) Reload() error {
+	services, err := s.SDServicesDatastore.ListAllServiceEndpoints()
+	if err != nil {
+		return fmt.Errorf("list all service endpoints failed: %v", err)
+	}
+	// Keep the order stable, so that the selectors see the same candidates between reloads.
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+
+	if err := s.Versions.Load(); err != nil {
+		return err
+	}
+
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	existing := make(map[string]*ReverseProxy)
+	for _, p := range s.currentProxies() {
+		existing[p.Name] = p
+	}
+
+	proxies := make([]*ReverseProxy, 0, len(services))
+	for _, srv := range services {
+		target, err := url.Parse(srv.Endpoint)
+		if err != nil {
+			s.Echo.Logger.Errorf("parse target %s of %s failed: %v", srv.Endpoint, srv.Name, err)
+			continue
+		}
+		srv := srv
+		if p, ok := existing[srv.Name]; ok && p.Target.String() == target.String() {
+			p.setService(&srv)
+			proxies = append(proxies, p)
+			delete(existing, srv.Name)
+			continue
+		}
+		p := s.newReverseProxy(srv.Name, target)
+		p.setService(&srv)
+		proxies = append(proxies, p)
+		s.Echo.Logger.Infof("create reverse proxy for %s: %s", srv.Name, srv.Endpoint)
+	}
+
+	s.proxiesMutex.Lock()
+	s.Proxies = proxies
+	s.proxiesMutex.Unlock()
+	if s.Queue != nil {
+		s.Queue.Dispatch()
+	}
+
+	for _, p := range existing {
+		p.removed.Store(true)
+		go s.drain(p)
+	}
+	return nil
+}
+
+// drain wait for the in-flight requests of the removed backend, e.g. the websocket generations, to finish,
+// and then close its idle connections. The connections still in use after the timeout are closed by the idle timeout.
+func (s *Server) drain(p *ReverseProxy) {
+	s.Echo.Logger.Infof("drain reverse proxy for %s: %s, in-flight requests: %d", p.Name, p.Target, p.InFlight())
+	deadline := time.Now().Add(s.Config.Membership.DrainTimeout)
+	for p.InFlight() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	if n := p.InFlight(); n > 0 {
+		s.Echo.Logger.Warnf("drain reverse proxy for %s timeout, in-flight requests: %d", p.Name, n)
+	} else {
+		s.Echo.Logger.Infof("reverse proxy for %s is drained", p.Name)
+	}
+	if t, ok := p.Proxy.Transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+	if s.findProxy(p.Name) == nil {
+		if err := s.BackendHealthDatastore.DeleteHealth(p.Name); err != nil {
+			s.Echo.Logger.Errorf("delete health state of %s failed: %v", p.Name, err)
+		}
+	}
+}
+
+// findProxy return the current reverse proxy of the backend service, or nil if it does not exist.
+func (s *Server) findProxy(name string) *ReverseProxy {
+	for _, p := range s.currentProxies() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// runReload reload the backend services periodically until the server is closed.
+func (s *Server) runReload() {
+	if s.Config.Membership.ReloadInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.Config.Membership.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				s.Echo.Logger.Errorf("reload backend services failed: %v", err)
+			}
+		}
+	}
+}
+
+// reloadHandler reload the backend services at once, e.g. after the services are changed in the datastore.
+func (s *Server) reloadHandler(c echo.Context) error {
+	if err := s.Reload(); err != nil {
+		return err
+	}
+	var names []string
+	for _, p := range s.currentProxies() {
+		names = append(names, p.Name)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"backends": names,
+	})
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	s := NewServer("", datastore.SQLite, ":memory:", DefaultConfig())
+	defer s.Close()
+	require.Empty(t, s.currentProxies())
+
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", "http://127.0.0.1:1235"))
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s1", "http://127.0.0.1:1236"))
+	require.NoError(t, s.Reload())
+	proxies := s.currentProxies()
+	require.Equal(t, 2, len(proxies))
+	s0 := s.findProxy("s0")
+	require.NotNil(t, s0)
+
+	// The unchanged backends are kept, the changed and removed backends are replaced.
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s1", "http://127.0.0.1:1237"))
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s2", "http://127.0.0.1:1238"))
+	require.NoError(t, s.Reload())
+	require.Equal(t, 3, len(s.currentProxies()))
+	require.Same(t, s0, s.findProxy("s0"))
+	require.Equal(t, "127.0.0.1:1237", s.findProxy("s1").Target.Host)
+
+	require.NoError(t, s.SDServicesDatastore.DeleteServiceEndpoint("s0"))
+	require.NoError(t, s.Reload())
+	require.Equal(t, 2, len(s.currentProxies()))
+	require.Nil(t, s.findProxy("s0"))
+
+	// The old slice is not modified by the reload.
+	require.Equal(t, 2, len(proxies))
+}
+
+func TestDrain(t *testing.T) {
+	config := DefaultConfig()
+	config.Membership.DrainTimeout = time.Minute
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var closed atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("s0"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+	s0 := s.findProxy("s0")
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sdapi/v1/samplers", nil))
+	}()
+	require.Eventually(t, func() bool { return s0.InFlight() == 1 }, time.Second, 10*time.Millisecond)
+
+	// The removed backend finishes its in-flight request, and then its connection is closed.
+	require.NoError(t, s.SDServicesDatastore.DeleteServiceEndpoint("s0"))
+	require.NoError(t, s.Reload())
+	require.Nil(t, s.findProxy("s0"))
+	require.Equal(t, int32(0), closed.Load())
+	close(release)
+	<-done
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "s0", rec.Body.String())
+	require.Eventually(t, func() bool { return closed.Load() == 1 }, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MetadataCacheConfig is the configuration of the cache of the metadata GETs, e.g. the model and sampler listings.
+type MetadataCacheConfig struct {
+	Enabled  bool
+	Paths    []string      // the GET paths which are coalesced and cached
+	TTL      time.Duration // the time a result is fresh, the stale result is served while it is refreshed in the background
+	MaxStale time.Duration // the max age of the stale result, the older result is refreshed before serving, and served only on backend errors
+}
+
+func (cfg *MetadataCacheConfig) match(req *http.Request) bool {
+	if !cfg.Enabled || req.Method != http.MethodGet {
+		return false
+	}
+	for _, path := range cfg.Paths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// flightGroup coalesces the concurrent calls with the same key into one.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	dups int // the number of the callers which wait for the result of the first one
+	val  interface{}
+	err  error
+}
+
+// Do execute fn once for all the concurrent callers with the same key, and return its result to all of them.
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	if f, ok := g.calls[key]; ok {
+		f.dups++
+		g.mutex.Unlock()
+		<-f.done
+		return f.val, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mutex.Unlock()
+
+	f.val, f.err = fn()
+	close(f.done)
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	return f.val, f.err
+}
+
+type metadataEntry struct {
+	resp      *bufferedResponse
+	fetchedAt time.Time
+}
+
+// MetadataCache coalesces the concurrent identical metadata GETs into one backend call,
+// and caches the results per backend pool, so that a cold backend is not woken up by every page load.
+type MetadataCache struct {
+	Config  *MetadataCacheConfig
+	server  *Server
+	flights flightGroup
+	mutex   sync.Mutex
+	entries map[string]*metadataEntry
+}
+
+func NewMetadataCache(cfg *MetadataCacheConfig, s *Server) *MetadataCache {
+	return &MetadataCache{
+		Config:  cfg,
+		server:  s,
+		entries: make(map[string]*metadataEntry),
+	}
+}
+
+// Middleware serve the metadata GETs from the cache.
+func (mc *MetadataCache) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if !mc.Config.match(req) || internalFromContext(req.Context()) != nil {
+			return next(c)
+		}
+		// The request without pool shares the cached result with the default pool,
+		// but it is still routed to any backend, in case no backend is in the default pool.
+		pool := requestPool(req)
+		key := pool + " " + req.URL.RequestURI()
+		if pool == "" {
+			key = kDefaultPool + " " + req.URL.RequestURI()
+		}
+		who := mc.server.identify(c)
+
+		entry := mc.get(key)
+		if entry != nil {
+			age := time.Since(entry.fetchedAt)
+			if age < mc.Config.TTL {
+				return mc.serve(c, entry.resp, "HIT")
+			}
+			if age < mc.Config.TTL+mc.Config.MaxStale {
+				go mc.fetch(key, who, pool, req.URL.RequestURI())
+				return mc.serve(c, entry.resp, "STALE")
+			}
+		}
+
+		resp, err := mc.fetch(key, who, pool, req.URL.RequestURI())
+		if err != nil || resp.code != http.StatusOK {
+			if entry != nil {
+				return mc.serve(c, entry.resp, "STALE")
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return mc.serve(c, resp, "MISS")
+	}
+}
+
+func (mc *MetadataCache) get(key string) *metadataEntry {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	return mc.entries[key]
+}
+
+// fetch get the result from the backends, the concurrent fetches of the same key are coalesced.
+// The successful result is cached.
+func (mc *MetadataCache) fetch(key string, who identity, pool string, uri string) (*bufferedResponse, error) {
+	val, err := mc.flights.Do(key, func() (interface{}, error) {
+		header := make(http.Header)
+		if pool != "" {
+			header.Set(kPoolHeaderName, pool)
+		}
+		// The fetch is shared by the callers, so it is not canceled when one of them goes away.
+		resp, err := mc.server.invoke(mc.server.ctx, who, http.MethodGet, uri, header, nil)
+		if err != nil {
+			return nil, fmt.Errorf("fetch %s failed: %v", uri, err)
+		}
+		if resp.code == http.StatusOK {
+			mc.put(key, resp)
+		} else {
+			mc.server.Echo.Logger.Warnf("fetch %s returns status %d, the result is not cached", uri, resp.code)
+		}
+		return resp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*bufferedResponse), nil
+}
+
+func (mc *MetadataCache) put(key string, resp *bufferedResponse) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	now := time.Now()
+	// Forget the results which are too old to be served, so that the map does not grow with the query strings.
+	for k, e := range mc.entries {
+		if now.Sub(e.fetchedAt) > mc.Config.TTL+mc.Config.MaxStale {
+			delete(mc.entries, k)
+		}
+	}
+	mc.entries[key] = &metadataEntry{resp: resp, fetchedAt: now}
+}
+
+// Purge forget all the cached results.
+func (mc *MetadataCache) Purge() {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	mc.entries = make(map[string]*metadataEntry)
+}
+
+// serve write the shared response to the client.
+func (mc *MetadataCache) serve(c echo.Context, resp *bufferedResponse, status string) error {
+	for k, v := range resp.header {
+		c.Response().Header()[k] = v
+	}
+	c.Response().Header().Set(kCacheHeaderName, status)
+	return c.Blob(resp.code, resp.header.Get(echo.HeaderContentType), resp.body.Bytes())
+}
+
+func (mc *MetadataCache) purgeHandler(c echo.Context) error {
+	mc.Purge()
+	return c.NoContent(http.StatusNoContent)
+}
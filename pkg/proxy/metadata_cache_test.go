@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataCache(t *testing.T) {
+	config := DefaultConfig()
+	config.MetadataCache.Enabled = true
+	config.MetadataCache.TTL = time.Hour
+	config.Retry.MaxRetries = 0
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var calls atomic.Int32
+	var failing atomic.Bool
+	release := make(chan struct{})
+	backend := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			<-release
+			if failing.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(body))
+		}))
+	}
+	fast := backend(`["fast"]`)
+	defer fast.Close()
+	gpu := backend(`["gpu"]`)
+	defer gpu.Close()
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s0", Endpoint: fast.URL}))
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s1", Endpoint: gpu.URL, Labels: map[string]string{"pool": "gpu"}}))
+	require.NoError(t, s.Reload())
+
+	get := func(pool string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/sdapi/v1/samplers", nil)
+		if pool != "" {
+			req.Header.Set(kPoolHeaderName, pool)
+		}
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Test concurrent GETs are coalesced", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rec := get("gpu")
+				assert.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, `["gpu"]`, rec.Body.String())
+			}()
+		}
+		// Wait until all the requests but the first one wait for the backend call of the first one.
+		require.Eventually(t, func() bool {
+			g := &s.MetadataCache.flights
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			f, ok := g.calls["gpu /sdapi/v1/samplers"]
+			return ok && f.dups == 4
+		}, time.Second, 10*time.Millisecond)
+		close(release)
+		wg.Wait()
+		require.Equal(t, int32(1), calls.Load())
+
+		rec := get("gpu")
+		require.Equal(t, "HIT", rec.Header().Get(kCacheHeaderName))
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("Test cache is per pool", func(t *testing.T) {
+		rec := get(kDefaultPool)
+		require.Equal(t, "MISS", rec.Header().Get(kCacheHeaderName))
+		require.Equal(t, `["fast"]`, rec.Body.String())
+		require.Equal(t, int32(2), calls.Load())
+
+		// The request without pool shares the result of the default pool.
+		rec = get("")
+		require.Equal(t, "HIT", rec.Header().Get(kCacheHeaderName))
+		require.Equal(t, `["fast"]`, rec.Body.String())
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("Test stale result is served on backend errors", func(t *testing.T) {
+		s.MetadataCache.Config.TTL = 0
+		s.MetadataCache.Config.MaxStale = 0
+		failing.Store(true)
+		rec := get("gpu")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "STALE", rec.Header().Get(kCacheHeaderName))
+		require.Equal(t, `["gpu"]`, rec.Body.String())
+	})
+
+	t.Run("Test stale result is refreshed in the background", func(t *testing.T) {
+		s.MetadataCache.Config.MaxStale = time.Hour
+		failing.Store(false)
+		calls.Store(0)
+		rec := get("gpu")
+		require.Equal(t, "STALE", rec.Header().Get(kCacheHeaderName))
+		require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Test request without pool is served by any pool", func(t *testing.T) {
+		s := NewServer("", datastore.SQLite, ":memory:", config)
+		defer s.Close()
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`["gpu"]`))
+		}))
+		defer backend.Close()
+		require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s0", Endpoint: backend.URL, Labels: map[string]string{"pool": "gpu"}}))
+		require.NoError(t, s.Reload())
+
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sdapi/v1/samplers", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "MISS", rec.Header().Get(kCacheHeaderName))
+		require.Equal(t, `["gpu"]`, rec.Body.String())
+	})
+}
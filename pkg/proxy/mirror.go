@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+// MirrorConfig is the configuration of the shadow traffic.
+type MirrorConfig struct {
+	Pool        string        // the shadow pool, whose backends serve the mirrored requests only, empty disables the mirroring
+	Percentage  float64       // the percentage of the matching requests which are mirrored
+	Paths       []string      // the POST paths which are mirrored
+	Timeout     time.Duration // the timeout of the mirrored request
+	MaxInFlight int64         // the max number of in-flight mirrored requests, the request is not mirrored if it is reached
+	Retention   time.Duration // the results are kept for the retention, 0 keeps them forever
+}
+
+func (cfg *MirrorConfig) match(req *http.Request) bool {
+	if cfg.Pool == "" || req.Method != http.MethodPost {
+		return false
+	}
+	for _, path := range cfg.Paths {
+		if req.URL.Path == path {
+			return rand.Float64()*100 < cfg.Percentage
+		}
+	}
+	return false
+}
+
+// Mirror copies a sample of the production requests to the shadow pool asynchronously.
+// The shadow responses are discarded, and their latency, status and image hashes are recorded
+// together with the ones of the production responses for comparison.
+type Mirror struct {
+	Config    *MirrorConfig
+	Datastore *datastore.MirrorResults
+	server    *Server
+	inflight  atomic.Int64
+}
+
+func NewMirror(cfg *MirrorConfig, ds *datastore.MirrorResults, s *Server) *Mirror {
+	return &Mirror{
+		Config:    cfg,
+		Datastore: ds,
+		server:    s,
+	}
+}
+
+// Middleware mirror the sampled requests.
+func (m *Mirror) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if internalFromContext(req.Context()) != nil || !m.Config.match(req) {
+			return next(c)
+		}
+		body, replayable, err := bufferBody(req, m.server.Config.Retry.MaxBodyBytes)
+		if err != nil {
+			return err
+		}
+		if !replayable {
+			return next(c)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if m.inflight.Add(1) > m.Config.MaxInFlight {
+			m.inflight.Add(-1)
+			return next(c)
+		}
+		id := req.Header.Get(echo.HeaderXRequestID)
+		if id == "" {
+			if id, err = randomId(); err != nil {
+				m.inflight.Add(-1)
+				return err
+			}
+		}
+
+		result := &datastore.MirrorResult{
+			Id:        id,
+			Path:      req.URL.Path,
+			CreatedAt: time.Now().UnixMilli(),
+		}
+		// Clone the request before the primary handling modifies it.
+		shadowReq := req.Clone(m.server.ctx)
+		primary := make(chan struct{})
+		defer close(primary)
+		go func() {
+			defer m.inflight.Add(-1)
+			m.shadow(shadowReq, body, result)
+			// Wait for the production response to record them together.
+			<-primary
+			if err := m.Datastore.PutMirrorResult(result); err != nil {
+				m.server.Echo.Logger.Errorf("put mirror result %s failed: %v", id, err)
+			}
+		}()
+
+		w := &captureWriter{ResponseWriter: c.Response().Writer, limit: m.server.Config.Retry.MaxBodyBytes}
+		c.Response().Writer = w
+		start := time.Now()
+		err = next(c)
+		c.Response().Writer = w.ResponseWriter
+		result.PrimaryLatencyMs = time.Since(start).Milliseconds()
+		result.PrimaryStatus = int64(c.Response().Status)
+		if !w.overflow {
+			result.PrimaryImageHashes = imageHashes(w.body.Bytes())
+		}
+		return err
+	}
+}
+
+// Run purge the results older than the retention periodically.
+func (m *Mirror) Run(ctx context.Context) {
+	if m.Config.Retention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := m.Datastore.PurgeMirrorResults(time.Now().Add(-m.Config.Retention).UnixMilli()); err != nil {
+			m.server.Echo.Logger.Errorf("purge mirror results failed: %v", err)
+		}
+	}
+}
+
+// shadow send the copy of the request to the shadow pool, and record its result.
+func (m *Mirror) shadow(req *http.Request, body []byte, result *datastore.MirrorResult) {
+	ctx, cancel := context.WithTimeout(req.Context(), m.Config.Timeout)
+	defer cancel()
+	r := req.WithContext(ctx)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set(kPoolHeaderName, m.Config.Pool)
+	p, err := m.server.ProxySelector.Select(m.server.candidates(nil), r)
+	if err != nil {
+		result.ShadowError = err.Error()
+		return
+	}
+	result.ShadowBackend = p.Name
+	r.Host = p.Target.Host
+	r.URL.Host = p.Target.Host
+	r.URL.Scheme = p.Target.Scheme
+
+	w := newBufferedResponse()
+	start := time.Now()
+	p.ServeHTTP(w, r)
+	result.ShadowLatencyMs = time.Since(start).Milliseconds()
+	if ctx.Err() != nil {
+		result.ShadowError = ctx.Err().Error()
+		return
+	}
+	result.ShadowStatus = int64(w.code)
+	result.ShadowImageHashes = imageHashes(w.body.Bytes())
+}
+
+// imageHashes return the sha256 of the images in the generation response.
+func imageHashes(body []byte) []string {
+	var resp struct {
+		Images []string `json:"images"`
+	}
+	if json.Unmarshal(body, &resp) != nil {
+		return nil
+	}
+	hashes := make([]string, len(resp.Images))
+	for i, image := range resp.Images {
+		sum := sha256.Sum256([]byte(image))
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+	return hashes
+}
+
+// mirrorSummary is the comparison of the production and the shadow traffic.
+type mirrorSummary struct {
+	Total             int     `json:"total"`
+	ShadowErrors      int     `json:"shadow_errors"`
+	StatusMatches     int     `json:"status_matches"`
+	ImageMatches      int     `json:"image_matches"` // the requests whose shadow images are the same as the production ones
+	PrimaryLatencyAvg float64 `json:"primary_latency_avg_ms"`
+	ShadowLatencyAvg  float64 `json:"shadow_latency_avg_ms"`
+}
+
+func (m *Mirror) resultsHandler(c echo.Context) error {
+	results, err := m.Datastore.ListAllMirrorResults()
+	if err != nil {
+		return err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].CreatedAt > results[j].CreatedAt })
+	summary := &mirrorSummary{Total: len(results)}
+	var primaryLatency, shadowLatency int64
+	for _, r := range results {
+		primaryLatency += r.PrimaryLatencyMs
+		shadowLatency += r.ShadowLatencyMs
+		if r.ShadowError != "" {
+			summary.ShadowErrors++
+			continue
+		}
+		if r.ShadowStatus == r.PrimaryStatus {
+			summary.StatusMatches++
+		}
+		if len(r.PrimaryImageHashes) > 0 && equalStrings(r.PrimaryImageHashes, r.ShadowImageHashes) {
+			summary.ImageMatches++
+		}
+	}
+	if len(results) > 0 {
+		summary.PrimaryLatencyAvg = float64(primaryLatency) / float64(len(results))
+		summary.ShadowLatencyAvg = float64(shadowLatency) / float64(len(results))
+	}
+	if c.QueryParam("summary") == "true" {
+		return c.JSON(http.StatusOK, summary)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"summary": summary,
+		"results": results,
+	})
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	config := DefaultConfig()
+	config.Mirror.Pool = "canary"
+	config.Mirror.Percentage = 100
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var primaryCalls, shadowCalls atomic.Int32
+	backend := func(calls *atomic.Int32, image string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"images": []string{image}})
+		}))
+	}
+	primary := backend(&primaryCalls, "image")
+	defer primary.Close()
+	shadow := backend(&shadowCalls, "other")
+	defer shadow.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", primary.URL))
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "shadow0", Endpoint: shadow.URL, Labels: map[string]string{"pool": "canary"}}))
+	require.NoError(t, s.Reload())
+
+	do := func(path string, id string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"prompt": "cat"}`))
+		req.Header.Set("X-Request-Id", id)
+		s.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), `"image"`)
+	}
+
+	t.Run("Test matching request is mirrored to the shadow pool", func(t *testing.T) {
+		do("/sdapi/v1/txt2img", "req1")
+		var result *datastore.MirrorResult
+		require.Eventually(t, func() bool {
+			result, _ = s.MirrorResultsDatastore.GetMirrorResult("req1")
+			return result != nil
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, int32(1), primaryCalls.Load())
+		require.Equal(t, int32(1), shadowCalls.Load())
+		require.Equal(t, "shadow0", result.ShadowBackend)
+		require.Equal(t, int64(http.StatusOK), result.PrimaryStatus)
+		require.Equal(t, int64(http.StatusOK), result.ShadowStatus)
+		require.Len(t, result.PrimaryImageHashes, 1)
+		require.Len(t, result.ShadowImageHashes, 1)
+		require.NotEqual(t, result.PrimaryImageHashes, result.ShadowImageHashes)
+	})
+
+	t.Run("Test other request is not mirrored", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			do("/sdapi/v1/img2img", "req2")
+		}
+		// The shadow pool never serves the production traffic.
+		require.Equal(t, int32(5), primaryCalls.Load())
+		require.Equal(t, int32(1), shadowCalls.Load())
+		result, err := s.MirrorResultsDatastore.GetMirrorResult("req2")
+		require.NoError(t, err)
+		require.Nil(t, result)
+	})
+}
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+// OpenAIConfig is the configuration of the OpenAI-compatible Images API.
+type OpenAIConfig struct {
+	Models       map[string]string // the model name to the checkpoint, an empty checkpoint keeps the checkpoint loaded by the backend
+	DefaultModel string            // the model of the requests without a model
+	MaxImages    int               // the max number of images of one request
+	ImageTTL     time.Duration     // the time the images of the url response format are served, 0 means forever
+	BaseUrl      string            // the public url of the proxy in the image urls, the url response format is rejected if it is empty
+}
+
+// openAIImageRequest is the request of POST /v1/images/generations.
+type openAIImageRequest struct {
+	Prompt         string `json:"prompt"`
+	N              *int   `json:"n"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format"`
+	Model          string `json:"model"`
+}
+
+type openAIImage struct {
+	Url     string `json:"url,omitempty"`
+	B64Json string `json:"b64_json,omitempty"`
+}
+
+type openAIImageResponse struct {
+	Created int64         `json:"created"`
+	Data    []openAIImage `json:"data"`
+}
+
+// openAIError is the OpenAI-style error object.
+type openAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// openAIErrorResponse write the OpenAI-style error. The param and the code are optional.
+func openAIErrorResponse(c echo.Context, status int, message string, param string, code string) error {
+	e := &openAIError{Message: message, Type: openAIErrorType(status)}
+	if param != "" {
+		e.Param = &param
+	}
+	if code != "" {
+		e.Code = &code
+	}
+	return c.JSON(status, map[string]interface{}{"error": e})
+}
+
+func openAIErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return "authentication_error"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	default:
+		return "invalid_request_error"
+	}
+}
+
+// backendErrorMessage extract the error message from the error response of the proxy or the backend.
+func backendErrorMessage(body []byte) string {
+	var m map[string]interface{}
+	if json.Unmarshal(body, &m) == nil {
+		for _, k := range []string{"message", "detail", "error"} {
+			if s, ok := m[k].(string); ok && s != "" {
+				return s
+			}
+		}
+	}
+	if s := strings.TrimSpace(string(body)); s != "" {
+		return s
+	}
+	return "the image generation failed"
+}
+
+// parseSize parse the size like 512x768.
+func parseSize(size string) (int, int, bool) {
+	w, h, found := strings.Cut(size, "x")
+	if !found {
+		return 0, 0, false
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil {
+		return 0, 0, false
+	}
+	height, err := strconv.Atoi(h)
+	if err != nil {
+		return 0, 0, false
+	}
+	valid := func(v int) bool { return v >= 64 && v <= 2048 && v%8 == 0 }
+	return width, height, valid(width) && valid(height)
+}
+
+// imageGenerationsHandler translate the OpenAI image generation into a txt2img call.
+func (s *Server) imageGenerationsHandler(c echo.Context) error {
+	cfg := &s.Config.OpenAI
+	var body openAIImageRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return openAIErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("invalid json body: %v", err), "", "")
+	}
+	if strings.TrimSpace(body.Prompt) == "" {
+		return openAIErrorResponse(c, http.StatusBadRequest, "prompt is required", "prompt", "")
+	}
+	n := 1
+	if body.N != nil {
+		n = *body.N
+	}
+	if n < 1 || n > cfg.MaxImages {
+		return openAIErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("n must be between 1 and %d", cfg.MaxImages), "n", "")
+	}
+	if body.Size == "" {
+		body.Size = "512x512"
+	}
+	width, height, ok := parseSize(body.Size)
+	if !ok {
+		return openAIErrorResponse(c, http.StatusBadRequest, fmt.Sprintf("invalid size %s, expect WIDTHxHEIGHT in multiples of 8 between 64 and 2048", body.Size), "size", "")
+	}
+	if body.ResponseFormat == "" {
+		body.ResponseFormat = "url"
+	}
+	if body.ResponseFormat != "url" && body.ResponseFormat != "b64_json" {
+		return openAIErrorResponse(c, http.StatusBadRequest, "response_format must be url or b64_json", "response_format", "")
+	}
+	if body.ResponseFormat == "url" && cfg.BaseUrl == "" {
+		// The Host of the request is not trusted to build the image urls, it is given by the client.
+		return openAIErrorResponse(c, http.StatusBadRequest, "response_format url is not available since the base url of the proxy is not configured, use b64_json", "response_format", "")
+	}
+	if body.Model == "" {
+		body.Model = cfg.DefaultModel
+	}
+	checkpoint, ok := cfg.Models[body.Model]
+	if !ok && body.Model != "" {
+		return openAIErrorResponse(c, http.StatusNotFound, fmt.Sprintf("the model %s does not exist", body.Model), "model", "model_not_found")
+	}
+	if !ok && len(cfg.Models) > 0 {
+		return openAIErrorResponse(c, http.StatusBadRequest, "model is required", "model", "")
+	}
+
+	payload := map[string]interface{}{
+		"prompt":     body.Prompt,
+		"batch_size": n,
+		"n_iter":     1,
+		"width":      width,
+		"height":     height,
+	}
+	if checkpoint != "" {
+		payload["override_settings"] = map[string]interface{}{"sd_model_checkpoint": checkpoint}
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	who := s.identify(c)
+	resp, err := s.invoke(c.Request().Context(), who, http.MethodPost, kTxt2ImgPath, routingHeader(c.Request()), encoded)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return openAIErrorResponse(c, http.StatusInternalServerError, err.Error(), "", "")
+	}
+	if resp.code != http.StatusOK {
+		status := resp.code
+		if status == http.StatusUnprocessableEntity {
+			status = http.StatusBadRequest
+		}
+		return openAIErrorResponse(c, status, backendErrorMessage(resp.body.Bytes()), "", "")
+	}
+	var generated struct {
+		Images []string `json:"images"`
+	}
+	if err := json.Unmarshal(resp.body.Bytes(), &generated); err != nil || len(generated.Images) < n {
+		return openAIErrorResponse(c, http.StatusBadGateway, "invalid txt2img response from the backend", "", "")
+	}
+	// The grid, if any, is before the images.
+	images := generated.Images[len(generated.Images)-n:]
+
+	ret := &openAIImageResponse{Created: time.Now().Unix()}
+	for _, image := range images {
+		if _, data, found := strings.Cut(image, ";base64,"); found {
+			image = data
+		}
+		if body.ResponseFormat == "b64_json" {
+			ret.Data = append(ret.Data, openAIImage{B64Json: image})
+			continue
+		}
+		url, err := s.storeImage(who, image)
+		if err != nil {
+			return openAIErrorResponse(c, http.StatusInternalServerError, err.Error(), "", "")
+		}
+		ret.Data = append(ret.Data, openAIImage{Url: url})
+	}
+	return c.JSON(http.StatusOK, ret)
+}
+
+// storeImage persist the base64 encoded image and return its url.
+func (s *Server) storeImage(who identity, image string) (string, error) {
+	cfg := &s.Config.OpenAI
+	decoded, err := base64.StdEncoding.DecodeString(image)
+	if err != nil {
+		return "", fmt.Errorf("decode image failed: %v", err)
+	}
+	id, err := randomId()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	record := &datastore.Image{
+		Id:          id,
+		ContentType: http.DetectContentType(decoded),
+		Data:        image,
+		Tenant:      who.Tenant,
+		CreatedAt:   now.UnixMilli(),
+	}
+	if cfg.ImageTTL > 0 {
+		record.ExpiresAt = now.Add(cfg.ImageTTL).UnixMilli()
+	}
+	if err := s.ImagesDatastore.PutImage(record); err != nil {
+		return "", fmt.Errorf("put image failed: %v", err)
+	}
+	return strings.TrimSuffix(cfg.BaseUrl, "/") + "/v1/images/" + id, nil
+}
+
+// getImageHandler serve the generated image of the url response format.
+func (s *Server) getImageHandler(c echo.Context) error {
+	image, err := s.ImagesDatastore.GetImage(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if image == nil || image.ExpiresAt > 0 && image.ExpiresAt <= time.Now().UnixMilli() {
+		return openAIErrorResponse(c, http.StatusNotFound, "the image does not exist or has expired", "", "")
+	}
+	data, err := base64.StdEncoding.DecodeString(image.Data)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "private, max-age=3600")
+	return c.Blob(http.StatusOK, image.ContentType, data)
+}
+
+// purgeImages remove the expired images periodically.
+func (s *Server) purgeImages(ctx context.Context) {
+	if s.Config.OpenAI.ImageTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.ImagesDatastore.PurgeExpiredImages(time.Now().UnixMilli()); err != nil {
+			s.Echo.Logger.Errorf("purge expired images failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIImages(t *testing.T) {
+	config := DefaultConfig()
+	config.Retry.MaxRetries = 0
+	config.HealthCheck.PassiveThreshold = 0
+	config.OpenAI.Models = map[string]string{"sd-xl": "sd_xl_base_1.0.safetensors", "any": ""}
+	config.OpenAI.DefaultModel = "any"
+	config.OpenAI.BaseUrl = "https://proxy.example.com/"
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var checkpoint, pool atomic.Value
+	png := "\x89PNG\r\n\x1a\nimage"
+	encoded := base64.StdEncoding.EncodeToString([]byte(png))
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		if payload["prompt"] == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error": "RuntimeError", "detail": "CUDA out of memory"}`))
+			return
+		}
+		assert.Equal(t, 768.0, payload["width"])
+		assert.Equal(t, 512.0, payload["height"])
+		var images []string
+		for i := 0; i < int(payload["batch_size"].(float64)); i++ {
+			images = append(images, encoded)
+		}
+		pool.Store(r.Header.Get(kPoolHeaderName))
+		settings, _ := payload["override_settings"].(map[string]interface{})
+		checkpoint.Store(fmt.Sprint(settings["sd_model_checkpoint"]))
+		json.NewEncoder(w).Encode(map[string]interface{}{"images": images})
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	generate := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(kPoolHeaderName, kDefaultPool)
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	errorOf := func(rec *httptest.ResponseRecorder) openAIError {
+		var resp struct {
+			Error openAIError `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.Error
+	}
+
+	t.Run("Test b64_json response", func(t *testing.T) {
+		rec := generate(`{"prompt": "cat", "n": 2, "size": "768x512", "response_format": "b64_json", "model": "sd-xl"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp openAIImageResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.NotZero(t, resp.Created)
+		require.Equal(t, []openAIImage{{B64Json: encoded}, {B64Json: encoded}}, resp.Data)
+		require.Equal(t, "sd_xl_base_1.0.safetensors", checkpoint.Load())
+		// The routing headers are forwarded to the backend.
+		require.Equal(t, kDefaultPool, pool.Load())
+	})
+
+	t.Run("Test url response", func(t *testing.T) {
+		rec := generate(`{"prompt": "cat", "size": "768x512"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp openAIImageResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.Len(t, resp.Data, 1)
+		// The default model keeps the loaded checkpoint.
+		require.Equal(t, "<nil>", checkpoint.Load())
+		require.True(t, strings.HasPrefix(resp.Data[0].Url, "https://proxy.example.com/v1/images/"))
+
+		rec = httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(resp.Data[0].Url, "https://proxy.example.com"), nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+		require.Equal(t, png, rec.Body.String())
+
+		rec = httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/images/non_exist_image", nil))
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("Test OpenAI-style errors", func(t *testing.T) {
+		rec := generate(`{"prompt": "cat", "model": "dall-e-3"}`)
+		require.Equal(t, http.StatusNotFound, rec.Code)
+		e := errorOf(rec)
+		require.Equal(t, "invalid_request_error", e.Type)
+		require.Equal(t, "model_not_found", *e.Code)
+
+		rec = generate(`{"prompt": "cat", "size": "100x100"}`)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		require.Equal(t, "size", *errorOf(rec).Param)
+
+		// The url is not built from the Host of the request.
+		s.Config.OpenAI.BaseUrl = ""
+		rec = generate(`{"prompt": "cat", "size": "768x512"}`)
+		s.Config.OpenAI.BaseUrl = "https://proxy.example.com/"
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		require.Equal(t, "response_format", *errorOf(rec).Param)
+
+		rec = generate(`{"n": 1}`)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		require.Equal(t, "prompt", *errorOf(rec).Param)
+
+		rec = generate(`{"prompt": "fail", "size": "768x512"}`)
+		require.Equal(t, http.StatusInternalServerError, rec.Code)
+		e = errorOf(rec)
+		require.Equal(t, "server_error", e.Type)
+		require.Equal(t, "CUDA out of memory", e.Message)
+	})
+}
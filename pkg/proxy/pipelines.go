@@ -0,0 +1,436 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+// kPipelineEndpoint is the endpoint of the pipeline jobs, which are never sent to the backends themselves.
+const kPipelineEndpoint = "pipeline"
+
+// kStepWaiting is the status of the step whose inputs are not ready yet.
+const kStepWaiting = "waiting"
+
+var stepIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+var stepInputPattern = regexp.MustCompile(`^([A-Za-z0-9_-]{1,64})(?:\[(\d+)\])?$`)
+
+// pipelineStep is one sdapi call of a pipeline.
+type pipelineStep struct {
+	Id       string                 `json:"id"`
+	Endpoint string                 `json:"endpoint"`
+	Payload  map[string]interface{} `json:"payload"`
+	// Inputs map the payload fields to the output images of the earlier steps, e.g. {"init_images": "base"},
+	// or "base[1]" for the second image of the batch. The fields ending with "images" are set to a list of the image.
+	Inputs map[string]string `json:"inputs,omitempty"`
+}
+
+func isPipeline(job *datastore.Job) bool {
+	return job.Endpoint == kPipelineEndpoint
+}
+
+func stepJobId(pipeline string, step string) string {
+	return pipeline + "-" + step
+}
+
+// parseStepInput parse the reference to the n-th output image of a step, e.g. base or base[1].
+func parseStepInput(ref string) (string, int, error) {
+	m := stepInputPattern.FindStringSubmatch(ref)
+	if m == nil {
+		return "", 0, fmt.Errorf("invalid input %q, expect a step id with an optional image index, e.g. base[1]", ref)
+	}
+	n := 0
+	if m[2] != "" {
+		var err error
+		if n, err = strconv.Atoi(m[2]); err != nil {
+			return "", 0, fmt.Errorf("invalid input %q: %v", ref, err)
+		}
+	}
+	return m[1], n, nil
+}
+
+// validatePipeline check the steps and resolve their endpoints, the steps must form a DAG by their inputs.
+func (cfg *JobsConfig) validatePipeline(steps []pipelineStep) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("steps is required")
+	}
+	if cfg.MaxPipelineSteps > 0 && len(steps) > cfg.MaxPipelineSteps {
+		return fmt.Errorf("the pipeline has %d steps, at most %d are allowed", len(steps), cfg.MaxPipelineSteps)
+	}
+	deps := make(map[string][]string)
+	for i := range steps {
+		step := &steps[i]
+		if !stepIdPattern.MatchString(step.Id) {
+			return fmt.Errorf("invalid step id %q, expect 1 to 64 letters, digits, _ or -", step.Id)
+		}
+		if _, ok := deps[step.Id]; ok {
+			return fmt.Errorf("duplicate step id %q", step.Id)
+		}
+		endpoint, ok := cfg.endpoint(step.Endpoint)
+		if !ok {
+			return fmt.Errorf("endpoint %q of step %s cannot be run as a job", step.Endpoint, step.Id)
+		}
+		step.Endpoint = endpoint
+		if step.Payload == nil {
+			return fmt.Errorf("payload of step %s must be a json object", step.Id)
+		}
+		deps[step.Id] = []string{}
+		for field, ref := range step.Inputs {
+			source, _, err := parseStepInput(ref)
+			if err != nil {
+				return fmt.Errorf("input %s of step %s: %v", field, step.Id, err)
+			}
+			deps[step.Id] = append(deps[step.Id], source)
+		}
+	}
+	// Depth-first search for the unknown steps and the cycles.
+	const visiting, visited = 1, 2
+	state := make(map[string]int)
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("the steps form a cycle through step %s", id)
+		case visited:
+			return nil
+		}
+		state[id] = visiting
+		for _, source := range deps[id] {
+			if _, ok := deps[source]; !ok {
+				return fmt.Errorf("step %s takes the input of unknown step %s", id, source)
+			}
+			if err := visit(source); err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for _, step := range steps {
+		if err := visit(step.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createPipelineHandler submit a pipeline of sdapi steps, whose output images feed the inputs of the later steps, e.g.
+//
+//	{"steps": [
+//	  {"id": "base", "endpoint": "txt2img", "payload": {"prompt": "cat"}},
+//	  {"id": "refine", "endpoint": "img2img", "payload": {"denoising_strength": 0.3}, "inputs": {"init_images": "base"}},
+//	  {"id": "upscale", "endpoint": "extra-single-image", "payload": {"upscaling_resize": 2}, "inputs": {"image": "refine"}}]}
+//
+// The pipeline is a job whose status reports its steps, and each step is run as a job once its inputs are ready.
+// The callback_url and the deadline apply to the whole pipeline.
+func (j *AsyncJobs) createPipelineHandler(c echo.Context) error {
+	var body struct {
+		Steps       []pipelineStep `json:"steps"`
+		CallbackUrl string         `json:"callback_url"`
+		Deadline    string         `json:"deadline"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	var deadline time.Time
+	if body.Deadline != "" {
+		var err error
+		if deadline, err = parseDeadline(body.Deadline, time.Now()); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	who := j.server.identify(c)
+	if body.CallbackUrl != "" {
+		if err := j.server.Webhooks.Config.validateCallbackUrl(who.Tenant, body.CallbackUrl); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if err := j.Config.validatePipeline(body.Steps); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	encoded, err := json.Marshal(body.Steps)
+	if err != nil {
+		return err
+	}
+	id, err := randomId()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixMilli()
+	job := &datastore.Job{
+		Id:          id,
+		Status:      datastore.JobQueued,
+		Endpoint:    kPipelineEndpoint,
+		Payload:     string(encoded),
+		Tenant:      who.Tenant,
+		Class:       who.Class,
+		CallbackUrl: body.CallbackUrl,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if !deadline.IsZero() {
+		job.Deadline = deadline.UnixMilli()
+	}
+	if err := j.Datastore.PutJob(job); err != nil {
+		return fmt.Errorf("put pipeline %s failed: %v", id, err)
+	}
+	// Start the first steps before answering, so that they are in the status.
+	j.advance(id)
+	if latest, err := j.Datastore.GetJob(id); err == nil && latest != nil {
+		job = latest
+	}
+	return c.JSON(http.StatusAccepted, j.view(job))
+}
+
+// pipelineSteps return the steps of the pipeline and their jobs, the steps which are not started have no job.
+func (j *AsyncJobs) pipelineSteps(pipeline *datastore.Job) ([]pipelineStep, map[string]*datastore.Job, error) {
+	var steps []pipelineStep
+	if err := json.Unmarshal([]byte(pipeline.Payload), &steps); err != nil {
+		return nil, nil, fmt.Errorf("invalid steps of pipeline %s: %v", pipeline.Id, err)
+	}
+	jobs := make(map[string]*datastore.Job)
+	for _, step := range steps {
+		job, err := j.Datastore.GetJob(stepJobId(pipeline.Id, step.Id))
+		if err != nil {
+			return nil, nil, err
+		}
+		if job != nil {
+			jobs[step.Id] = job
+		}
+	}
+	return steps, jobs, nil
+}
+
+// advance start the steps of the pipeline whose inputs are ready, and finish the pipeline once all its steps succeed,
+// any of them fails, or it is cancelled. It can be called any time by any replica, since each step is created once
+// by its id and the pipeline is finished once by the compare-and-put.
+func (j *AsyncJobs) advance(id string) {
+	pipeline, err := j.Datastore.GetJob(id)
+	if err != nil {
+		j.server.Echo.Logger.Errorf("get pipeline %s failed: %v", id, err)
+		return
+	}
+	if pipeline == nil || pipeline.Done() {
+		return
+	}
+	steps, jobs, err := j.pipelineSteps(pipeline)
+	if err != nil {
+		j.server.Echo.Logger.Errorf("get steps of pipeline %s failed: %v", id, err)
+		return
+	}
+
+	var failure string
+	for _, step := range steps {
+		if job := jobs[step.Id]; job != nil && job.Done() && job.Status != datastore.JobSucceeded && failure == "" {
+			failure = fmt.Sprintf("step %s is %s", step.Id, job.Status)
+			if job.Error != "" {
+				failure += ": " + job.Error
+			}
+		}
+	}
+	if failure == "" && !pipeline.CancelRequested {
+		for i := range steps {
+			step := &steps[i]
+			if jobs[step.Id] != nil || !stepReady(step, jobs) {
+				continue
+			}
+			job, err := j.createStep(pipeline, step, jobs)
+			if err != nil {
+				failure = fmt.Sprintf("start step %s failed: %v", step.Id, err)
+				break
+			}
+			jobs[step.Id] = job
+		}
+	}
+
+	unfinished, succeeded := 0, 0
+	for _, job := range jobs {
+		switch {
+		case !job.Done():
+			unfinished++
+		case job.Status == datastore.JobSucceeded:
+			succeeded++
+		}
+	}
+	if failure != "" || pipeline.CancelRequested {
+		// Stop the other steps, the pipeline can not succeed any more.
+		for _, job := range jobs {
+			if job.Done() {
+				continue
+			}
+			if _, _, err := j.requestCancel(job.Id); err != nil {
+				j.server.Echo.Logger.Errorf("cancel step %s failed: %v", job.Id, err)
+			}
+		}
+	}
+
+	var status string
+	switch {
+	case pipeline.CancelRequested:
+		if unfinished == 0 {
+			status = datastore.JobCancelled
+		}
+	case failure != "":
+		status = datastore.JobFailed
+	case succeeded == len(steps):
+		status = datastore.JobSucceeded
+	case len(jobs) > 0:
+		status = datastore.JobRunning
+	}
+	final, err := j.update(id, func(latest *datastore.Job) bool {
+		if status == "" || latest.Done() || latest.Status == status {
+			return false
+		}
+		latest.Status = status
+		switch status {
+		case datastore.JobFailed:
+			latest.Error = failure
+		case datastore.JobSucceeded:
+			latest.Progress = 1
+		}
+		return true
+	})
+	if err != nil {
+		j.server.Echo.Logger.Errorf("update pipeline %s failed: %v", id, err)
+		return
+	}
+	if final != nil && final.Done() {
+		j.server.Echo.Logger.Infof("pipeline %s is %s", id, final.Status)
+		j.notify(final)
+	}
+}
+
+// stepReady report whether all the inputs of the step have succeeded.
+func stepReady(step *pipelineStep, jobs map[string]*datastore.Job) bool {
+	for _, ref := range step.Inputs {
+		source, _, err := parseStepInput(ref)
+		if err != nil {
+			return false
+		}
+		if job := jobs[source]; job == nil || job.Status != datastore.JobSucceeded {
+			return false
+		}
+	}
+	return true
+}
+
+// createStep create the job of the step with the output images of its inputs, and dispatch it.
+// It returns the existing job if the step is already created by another replica.
+func (j *AsyncJobs) createStep(pipeline *datastore.Job, step *pipelineStep, jobs map[string]*datastore.Job) (*datastore.Job, error) {
+	payload := make(map[string]interface{}, len(step.Payload)+len(step.Inputs)+1)
+	for k, v := range step.Payload {
+		payload[k] = v
+	}
+	for field, ref := range step.Inputs {
+		source, n, err := parseStepInput(ref)
+		if err != nil {
+			return nil, err
+		}
+		image, err := stepImage(jobs[source].Result, n)
+		if err != nil {
+			return nil, fmt.Errorf("input %s from step %s: %v", field, source, err)
+		}
+		if strings.HasSuffix(field, "images") {
+			payload[field] = []string{image}
+		} else {
+			payload[field] = image
+		}
+	}
+	id := stepJobId(pipeline.Id, step.Id)
+	// Let the backend report the progress of the step by its id.
+	payload["force_task_id"] = id
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	job := &datastore.Job{
+		Id:            id,
+		Status:        datastore.JobQueued,
+		Endpoint:      step.Endpoint,
+		Payload:       string(encoded),
+		Tenant:        pipeline.Tenant,
+		Class:         pipeline.Class,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		MaxAttempts:   j.Config.MaxAttempts,
+		NextAttemptAt: now,
+		Deadline:      pipeline.Deadline,
+		Pipeline:      pipeline.Id,
+	}
+	created, err := j.Datastore.CreateJob(job)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		existing, err := j.Datastore.GetJob(id)
+		if err != nil || existing == nil {
+			return nil, fmt.Errorf("get job %s failed: %v", id, err)
+		}
+		return existing, nil
+	}
+	go j.dispatch(id)
+	return job, nil
+}
+
+// stepImage return the n-th output image of the sdapi response, i.e. images of txt2img and img2img,
+// or image of extra-single-image.
+func stepImage(result string, n int) (string, error) {
+	var resp struct {
+		Images []string `json:"images"`
+		Image  string   `json:"image"`
+	}
+	if err := json.Unmarshal([]byte(result), &resp); err != nil {
+		return "", fmt.Errorf("invalid response: %v", err)
+	}
+	if resp.Image != "" && n == 0 {
+		return resp.Image, nil
+	}
+	if n < len(resp.Images) {
+		return resp.Images[n], nil
+	}
+	return "", fmt.Errorf("the response has no image %d", n)
+}
+
+// stepView is the status of a step of the pipeline.
+type stepView struct {
+	Id       string            `json:"id"`
+	Endpoint string            `json:"endpoint"`
+	Inputs   map[string]string `json:"inputs,omitempty"`
+	Status   string            `json:"status"` // the status of the step job, or waiting for the inputs
+	Job      *jobView          `json:"job,omitempty"`
+}
+
+// pipelineView report the pipeline with its steps, the progress of the unfinished pipeline is the mean of its steps.
+func (j *AsyncJobs) pipelineView(pipeline *datastore.Job) *jobView {
+	copied := *pipeline
+	view := &jobView{Job: &copied}
+	steps, jobs, err := j.pipelineSteps(pipeline)
+	if err != nil {
+		j.server.Echo.Logger.Errorf("get steps of pipeline %s failed: %v", pipeline.Id, err)
+		return view
+	}
+	var progress float64
+	for _, step := range steps {
+		sv := &stepView{Id: step.Id, Endpoint: step.Endpoint, Inputs: step.Inputs, Status: kStepWaiting}
+		if job := jobs[step.Id]; job != nil {
+			sv.Status = job.Status
+			sv.Job = j.view(job)
+			progress += job.Progress
+		}
+		view.Steps = append(view.Steps, sv)
+	}
+	if !copied.Done() && len(steps) > 0 {
+		copied.Progress = progress / float64(len(steps))
+	}
+	return view
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePipeline(t *testing.T) {
+	cfg := DefaultConfig().Jobs
+	step := func(id string, endpoint string, inputs map[string]string) pipelineStep {
+		return pipelineStep{Id: id, Endpoint: endpoint, Payload: map[string]interface{}{}, Inputs: inputs}
+	}
+
+	steps := []pipelineStep{
+		step("base", "txt2img", nil),
+		step("refine", "img2img", map[string]string{"init_images": "base[1]"}),
+	}
+	require.NoError(t, cfg.validatePipeline(steps))
+	require.Equal(t, "/sdapi/v1/img2img", steps[1].Endpoint)
+
+	for name, steps := range map[string][]pipelineStep{
+		"empty":            nil,
+		"invalid id":       {step("a b", "txt2img", nil)},
+		"duplicate id":     {step("a", "txt2img", nil), step("a", "txt2img", nil)},
+		"invalid endpoint": {step("a", "options", nil)},
+		"invalid input":    {step("a", "txt2img", nil), step("b", "img2img", map[string]string{"init_images": "a[x]"})},
+		"unknown input":    {step("a", "img2img", map[string]string{"init_images": "b"})},
+		"cycle": {
+			step("a", "img2img", map[string]string{"init_images": "c"}),
+			step("b", "img2img", map[string]string{"init_images": "a"}),
+			step("c", "img2img", map[string]string{"init_images": "b"}),
+		},
+	} {
+		require.Error(t, cfg.validatePipeline(steps), name)
+	}
+}
+
+func TestPipelines(t *testing.T) {
+	config := DefaultConfig()
+	config.Jobs.ProgressInterval = 10 * time.Millisecond
+	config.Jobs.MaxAttempts = 1
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	interrupted := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		switch r.URL.Path {
+		case "/internal/progress":
+			w.Write([]byte(`{"active": true, "progress": 0.5}`))
+		case "/sdapi/v1/interrupt":
+			interrupted <- struct{}{}
+		case "/sdapi/v1/txt2img":
+			switch payload["prompt"] {
+			case "slow":
+				<-r.Context().Done()
+			case "invalid":
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"detail": "invalid prompt"}`))
+			default:
+				json.NewEncoder(w).Encode(map[string]interface{}{"images": []string{payload["prompt"].(string) + "0", payload["prompt"].(string) + "1"}})
+			}
+		case "/sdapi/v1/img2img":
+			image := payload["init_images"].([]interface{})[0].(string)
+			json.NewEncoder(w).Encode(map[string]interface{}{"images": []string{image + "-refined"}})
+		case "/sdapi/v1/extra-single-image":
+			json.NewEncoder(w).Encode(map[string]interface{}{"image": payload["image"].(string) + "-upscaled"})
+		}
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	submit := func(prompt string) string {
+		rec := do(http.MethodPost, "/v1/pipelines", fmt.Sprintf(`{"steps": [
+			{"id": "base", "endpoint": "txt2img", "payload": {"prompt": %q, "batch_size": 2}},
+			{"id": "refine", "endpoint": "img2img", "payload": {"denoising_strength": 0.3}, "inputs": {"init_images": "base"}},
+			{"id": "variant", "endpoint": "img2img", "payload": {}, "inputs": {"init_images": "base[1]"}},
+			{"id": "upscale", "endpoint": "extra-single-image", "payload": {"upscaling_resize": 2}, "inputs": {"image": "refine"}}]}`, prompt))
+		require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+		var view jobView
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &view))
+		require.Equal(t, kPipelineEndpoint, view.Endpoint)
+		require.Len(t, view.Steps, 4)
+		require.Equal(t, kStepWaiting, view.Steps[1].Status)
+		return view.Id
+	}
+	type pipelineStatus struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Steps  []struct {
+			Id     string `json:"id"`
+			Status string `json:"status"`
+			Job    *struct {
+				Pipeline string          `json:"pipeline"`
+				Result   json.RawMessage `json:"result"`
+			} `json:"job"`
+		} `json:"steps"`
+	}
+	waitFor := func(id string, status string) *pipelineStatus {
+		require.Eventually(t, func() bool {
+			job, _ := s.JobsDatastore.GetJob(id)
+			return job != nil && job.Status == status
+		}, 2*time.Second, 10*time.Millisecond)
+		rec := do(http.MethodGet, "/v1/jobs/"+id, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var view pipelineStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &view))
+		require.Equal(t, status, view.Status)
+		for _, step := range view.Steps {
+			if step.Job != nil {
+				require.Equal(t, id, step.Job.Pipeline)
+			}
+		}
+		return &view
+	}
+
+	t.Run("Test the output images feed the next steps", func(t *testing.T) {
+		id := submit("cat")
+		view := waitFor(id, datastore.JobSucceeded)
+		results := make(map[string]string)
+		for _, step := range view.Steps {
+			require.Equal(t, datastore.JobSucceeded, step.Status)
+			results[step.Id] = string(step.Job.Result)
+		}
+		require.JSONEq(t, `{"images": ["cat0", "cat1"]}`, results["base"])
+		require.JSONEq(t, `{"images": ["cat0-refined"]}`, results["refine"])
+		require.JSONEq(t, `{"images": ["cat1-refined"]}`, results["variant"])
+		require.JSONEq(t, `{"image": "cat0-refined-upscaled"}`, results["upscale"])
+	})
+
+	t.Run("Test the failed step fails the pipeline", func(t *testing.T) {
+		id := submit("invalid")
+		view := waitFor(id, datastore.JobFailed)
+		require.Contains(t, view.Error, "step base is failed")
+		require.Contains(t, view.Error, "invalid prompt")
+		require.Equal(t, kStepWaiting, view.Steps[3].Status)
+	})
+
+	t.Run("Test cancel the pipeline", func(t *testing.T) {
+		id := submit("slow")
+		require.Eventually(t, func() bool {
+			job, _ := s.JobsDatastore.GetJob(stepJobId(id, "base"))
+			return job != nil && job.Status == datastore.JobRunning
+		}, 2*time.Second, 10*time.Millisecond)
+		require.Equal(t, http.StatusAccepted, do(http.MethodDelete, "/v1/jobs/"+id, "").Code)
+		select {
+		case <-interrupted:
+		case <-time.After(time.Second):
+			require.Fail(t, "the running step is not interrupted")
+		}
+		view := waitFor(id, datastore.JobCancelled)
+		require.Equal(t, datastore.JobCancelled, view.Steps[0].Status)
+		require.Equal(t, kStepWaiting, view.Steps[1].Status)
+	})
+
+	t.Run("Test invalid pipeline", func(t *testing.T) {
+		rec := do(http.MethodPost, "/v1/pipelines", `{"steps": [{"id": "a", "endpoint": "img2img", "payload": {}, "inputs": {"init_images": "a"}}]}`)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+const kPoolHeaderName = "X-SD-Pool"
+const kPoolLabelName = "pool"
+const kDefaultPool = "default"
+
+// Pool return the pool of the backend, which is the "pool" label of the service, or the default pool.
+func (p *ReverseProxy) Pool() string {
+	if pool := p.Service().Labels[kPoolLabelName]; pool != "" {
+		return pool
+	}
+	return kDefaultPool
+}
+
+// requestPool return the backend pool requested by the X-SD-Pool header, or empty string if any backend can serve the request.
+func requestPool(req *http.Request) string {
+	return req.Header.Get(kPoolHeaderName)
+}
+
+// PoolSelector restricts the request to the backends of the pool it requests,
+// and delegates the selection among them to the next selector.
+// The backends of the reserved pools, e.g. the shadow pool, serve only the requests for their pool.
+type PoolSelector struct {
+	Next     ReverseProxySelector
+	Reserved []string
+}
+
+func NewPoolSelector(next ReverseProxySelector) *PoolSelector {
+	return &PoolSelector{Next: next}
+}
+
+func (s *PoolSelector) Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+	pool := requestPool(req)
+	var members []*ReverseProxy
+	for _, p := range proxies {
+		if p.Pool() == pool || pool == "" && !s.reserved(p.Pool()) {
+			members = append(members, p)
+		}
+	}
+	if len(members) == 0 {
+		return nil, ErrNoReverseProxy
+	}
+	return s.Next.Select(members, req)
+}
+
+func (s *PoolSelector) reserved(pool string) bool {
+	for _, r := range s.Reserved {
+		if r == pool {
+			return true
+		}
+	}
+	return false
+}
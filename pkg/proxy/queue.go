@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// QueueConfig is the configuration of the proxy-side generation queue.
+type QueueConfig struct {
+	Paths        []string           // the generation paths to queue, the requests of other paths are forwarded at once
+	MaxLength    int                // the max number of queued requests, the new requests are rejected with 429 beyond it, 0 means unlimited
+	Policy       string             // the dispatching order, "fifo", "wfq" (weighted fair queuing across tenants, earliest deadline first within a tenant) or "edf" (earliest deadline first)
+	ClassWeights map[string]float64 // the weight of each priority class, e.g. interactive, api and batch
+	DefaultClass string             // the priority class of the requests without API key
+}
+
+func (cfg *QueueConfig) newPolicy() queuePolicy {
+	switch cfg.Policy {
+	case "fifo":
+		return &fifoPolicy{}
+	case "edf":
+		return &edfPolicy{}
+	default:
+		return newWFQPolicy()
+	}
+}
+
+func (cfg *QueueConfig) weight(class string) float64 {
+	if w := cfg.ClassWeights[class]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (cfg *QueueConfig) match(req *http.Request) bool {
+	for _, path := range cfg.Paths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// queuedJob is one generation request waiting for a free backend slot.
+type queuedJob struct {
+	id         string
+	seq        uint64 // the arrival order, which is kept when the job is re-queued for retry
+	req        *http.Request
+	excluded   map[*ReverseProxy]bool // the backends already tried by the job
+	enqueuedAt time.Time
+	granted    chan struct{} // closed when the job is dispatched to proxy, or dropped
+	proxy      *ReverseProxy
+	deadline   time.Time     // the time by which the job must finish, zero if it has no deadline
+	estimate   time.Duration // the estimated run time of the job
+	dropped    bool          // the job is dropped since it can no longer meet its deadline
+
+	tenant string
+	class  string
+	weight float64 // the weight of the priority class
+	cost   float64 // the relative cost of the job, 1 for a normal generation
+	start  float64 // the virtual start tag assigned by the fair queuing
+	finish float64 // the virtual finish tag assigned by the fair queuing
+	tagged bool
+}
+
+// queuePolicy decides the dispatching order of the queued jobs.
+type queuePolicy interface {
+	Push(j *queuedJob)
+	// Peek return the next job to dispatch, or nil if the queue is empty.
+	Peek() *queuedJob
+	// Remove remove the job from the queue, and return false if it is not in the queue.
+	Remove(j *queuedJob) bool
+	Len() int
+	// Position return the number of jobs to be dispatched before the job, or -1 if it is not in the queue.
+	Position(id string) int
+	// All return the queued jobs in the dispatching order.
+	All() []*queuedJob
+}
+
+// fifoPolicy dispatch the jobs in their arrival order.
+type fifoPolicy struct {
+	jobs []*queuedJob
+}
+
+func (f *fifoPolicy) Push(j *queuedJob) {
+	// The re-queued job goes back to its original place.
+	i := sort.Search(len(f.jobs), func(i int) bool { return f.jobs[i].seq > j.seq })
+	f.jobs = append(f.jobs, nil)
+	copy(f.jobs[i+1:], f.jobs[i:])
+	f.jobs[i] = j
+}
+
+func (f *fifoPolicy) Peek() *queuedJob {
+	if len(f.jobs) == 0 {
+		return nil
+	}
+	return f.jobs[0]
+}
+
+func (f *fifoPolicy) Remove(j *queuedJob) bool {
+	for i, job := range f.jobs {
+		if job == j {
+			f.jobs = append(f.jobs[:i], f.jobs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fifoPolicy) Len() int {
+	return len(f.jobs)
+}
+
+func (f *fifoPolicy) All() []*queuedJob {
+	return append([]*queuedJob(nil), f.jobs...)
+}
+
+func (f *fifoPolicy) Position(id string) int {
+	for i, job := range f.jobs {
+		if job.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// JobQueue holds the generation requests until a backend has a free slot.
+// A backend has max_concurrency slots, or unlimited slots if max_concurrency is 0.
+type JobQueue struct {
+	Config      *QueueConfig
+	mutex       sync.Mutex
+	policy      queuePolicy
+	running     map[*ReverseProxy]int // the number of dispatched jobs of each backend
+	seq         uint64
+	dispatching bool // a goroutine is dispatching the jobs
+	redispatch  bool // the queue or the slots are changed while dispatching, so another round is needed
+	candidates  func(excluded map[*ReverseProxy]bool) []*ReverseProxy
+	selector    ReverseProxySelector
+	Estimator   *RunTimeEstimator // the run time of the generation requests, to drop the jobs which can not meet their deadlines
+}
+
+func NewJobQueue(cfg *QueueConfig, candidates func(excluded map[*ReverseProxy]bool) []*ReverseProxy, selector ReverseProxySelector) *JobQueue {
+	return &JobQueue{
+		Config:     cfg,
+		policy:     cfg.newPolicy(),
+		running:    make(map[*ReverseProxy]int),
+		candidates: candidates,
+		selector:   selector,
+		Estimator:  NewRunTimeEstimator(),
+	}
+}
+
+// Enqueue add the request of the tenant to the queue. It returns nil if the queue is full.
+// The job with a deadline is dropped once the deadline can not be met with its estimated run time.
+func (q *JobQueue) Enqueue(id string, req *http.Request, who identity, deadline time.Time, estimate time.Duration) *queuedJob {
+	q.mutex.Lock()
+	if q.Config.MaxLength > 0 && q.policy.Len() >= q.Config.MaxLength {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.seq++
+	j := &queuedJob{
+		id:         id,
+		seq:        q.seq,
+		req:        req,
+		excluded:   make(map[*ReverseProxy]bool),
+		enqueuedAt: time.Now(),
+		granted:    make(chan struct{}),
+		tenant:     who.Tenant,
+		class:      who.Class,
+		weight:     q.Config.weight(who.Class),
+		cost:       1,
+		deadline:   deadline,
+		estimate:   estimate,
+	}
+	q.policy.Push(j)
+	q.mutex.Unlock()
+	q.Dispatch()
+	return j
+}
+
+// Requeue put the job back to the queue to retry it on another backend.
+func (q *JobQueue) Requeue(j *queuedJob) {
+	q.mutex.Lock()
+	j.excluded[j.proxy] = true
+	j.proxy = nil
+	j.granted = make(chan struct{})
+	q.policy.Push(j)
+	q.mutex.Unlock()
+	q.Dispatch()
+}
+
+// Wait block until the job is dispatched to a backend, or the context is done.
+func (q *JobQueue) Wait(ctx context.Context, j *queuedJob) (*ReverseProxy, error) {
+	q.mutex.Lock()
+	granted := j.granted
+	q.mutex.Unlock()
+	select {
+	case <-granted:
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		if j.dropped {
+			return nil, errDeadlineExceeded
+		}
+		return j.proxy, nil
+	case <-ctx.Done():
+		q.mutex.Lock()
+		q.redispatch = true
+		released := !q.policy.Remove(j) && j.proxy != nil
+		if released {
+			// The job is dispatched concurrently, give back the slot.
+			q.releaseLocked(j.proxy)
+		}
+		q.mutex.Unlock()
+		if released {
+			q.Dispatch()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Release give back the backend slot of the finished job.
+func (q *JobQueue) Release(p *ReverseProxy) {
+	q.mutex.Lock()
+	q.releaseLocked(p)
+	q.mutex.Unlock()
+	q.Dispatch()
+}
+
+func (q *JobQueue) releaseLocked(p *ReverseProxy) {
+	q.running[p]--
+	if q.running[p] <= 0 {
+		delete(q.running, p)
+	}
+}
+
+// Dispatch try to dispatch the queued jobs, e.g. after the backends are changed.
+//
+// The jobs are tried in the dispatching order, and the job which can not be served by the free backends,
+// e.g. its pool is busy or its session is pinned to a busy backend, does not hold back the jobs after it.
+// The backend is selected outside the mutex, since the selectors may read the datastore, e.g. the session affinity.
+// One goroutine dispatches at a time to keep the order of the jobs, the others leave another round to it.
+func (q *JobQueue) Dispatch() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.dispatching {
+		q.redispatch = true
+		return
+	}
+	q.dispatching = true
+	defer func() { q.dispatching = false }()
+	for q.dispatchOneLocked() {
+	}
+}
+
+// dispatchOneLocked dispatch the first job which can be served by a free backend, and report whether the queue
+// should be tried again, i.e. a job is dispatched, or the queue or the slots are changed meanwhile.
+func (q *JobQueue) dispatchOneLocked() bool {
+	q.redispatch = false
+	q.dropLocked()
+	for _, j := range q.policy.All() {
+		free := q.freeLocked(j)
+		if len(free) == 0 {
+			continue
+		}
+		// The affinity is resolved against all the candidates, so that a session waits for its busy backend
+		// instead of being remapped, while the load balancing chooses among the free backends.
+		candidates := q.candidates(j.excluded)
+		q.mutex.Unlock()
+		p, err := q.selector.Select(candidates, withFreeProxies(j.req, free))
+		q.mutex.Lock()
+		if q.redispatch {
+			// The job may be removed, or be overtaken by another job, and the backend may be removed meanwhile.
+			return true
+		}
+		if err != nil || !containsProxy(q.freeLocked(j), p) {
+			continue
+		}
+		q.policy.Remove(j)
+		q.running[p]++
+		j.proxy = p
+		close(j.granted)
+		return true
+	}
+	return false
+}
+
+// freeLocked return the backends which have a free slot for the job.
+func (q *JobQueue) freeLocked(j *queuedJob) []*ReverseProxy {
+	var free []*ReverseProxy
+	for _, p := range q.candidates(j.excluded) {
+		if limit := p.Service().MaxConcurrency; limit <= 0 || int64(q.running[p]) < limit {
+			free = append(free, p)
+		}
+	}
+	return free
+}
+
+type freeProxiesKey struct{}
+
+// withFreeProxies attach the backends with a free slot to the queued request.
+func withFreeProxies(req *http.Request, free []*ReverseProxy) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), freeProxiesKey{}, free))
+}
+
+// freeProxies return the proxies which have a free slot for the queued request, or all the proxies
+// if the request is not queued. The load balancing selectors choose among them.
+func freeProxies(proxies []*ReverseProxy, req *http.Request) []*ReverseProxy {
+	free, ok := req.Context().Value(freeProxiesKey{}).([]*ReverseProxy)
+	if !ok {
+		return proxies
+	}
+	var ret []*ReverseProxy
+	for _, p := range proxies {
+		if containsProxy(free, p) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+func containsProxy(proxies []*ReverseProxy, p *ReverseProxy) bool {
+	for _, proxy := range proxies {
+		if proxy == p {
+			return true
+		}
+	}
+	return false
+}
+
+// dropLocked drop the queued jobs which can no longer meet their deadlines.
+func (q *JobQueue) dropLocked() {
+	now := time.Now()
+	for _, j := range q.policy.All() {
+		if j.deadline.IsZero() || !now.Add(j.estimate).After(j.deadline) {
+			continue
+		}
+		q.policy.Remove(j)
+		j.dropped = true
+		close(j.granted)
+	}
+}
+
+// Position return the number of jobs to be dispatched before the job, or -1 if it is not queued.
+func (q *JobQueue) Position(id string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.policy.Position(id)
+}
+
+// Run dispatch the queued jobs periodically, since the backends may become available without any job finishing,
+// e.g. a backend is added or re-admitted.
+func (q *JobQueue) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			q.Dispatch()
+		}
+	}
+}
+
+func (q *JobQueue) queueHandler(c echo.Context) error {
+	type backendSlots struct {
+		Name           string `json:"name"`
+		Running        int    `json:"running"`
+		MaxConcurrency int64  `json:"max_concurrency"`
+	}
+	q.mutex.Lock()
+	length := q.policy.Len()
+	running := make(map[string]*backendSlots)
+	for p, n := range q.running {
+		running[p.Name] = &backendSlots{Name: p.Name, Running: n, MaxConcurrency: p.Service().MaxConcurrency}
+	}
+	q.mutex.Unlock()
+
+	backends := []*backendSlots{}
+	for _, p := range q.candidates(nil) {
+		if slots, ok := running[p.Name]; ok {
+			backends = append(backends, slots)
+		} else {
+			backends = append(backends, &backendSlots{Name: p.Name, MaxConcurrency: p.Service().MaxConcurrency})
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"length":     length,
+		"max_length": q.Config.MaxLength,
+		"policy":     q.Config.Policy,
+		"backends":   backends,
+	})
+}
+
+func (q *JobQueue) positionHandler(c echo.Context) error {
+	position := q.Position(c.Param("id"))
+	if position < 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "request is not queued")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"id":       c.Param("id"),
+		"position": position,
+	})
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobQueue(t *testing.T) {
+	config := DefaultConfig()
+	config.Queue.MaxLength = 2
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var running, maxRunning int
+	var order []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		order = append(order, r.Header.Get("X-Request-Id"))
+		mutex.Unlock()
+		<-release
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s0", Endpoint: backend.URL, MaxConcurrency: 1}))
+	require.NoError(t, s.Reload())
+
+	do := func(id string) int {
+		req := httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img", strings.NewReader("{}"))
+		req.Header.Set("X-Request-Id", id)
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	position := func(id string) int {
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/queue/"+id, nil))
+		if rec.Code != http.StatusOK {
+			return -1
+		}
+		return s.Queue.Position(id)
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range []string{"job0", "job1", "job2"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			assert.Equal(t, http.StatusOK, do(id))
+		}(id)
+		// Make the arrival order deterministic.
+		require.Eventually(t, func() bool {
+			if id == "job0" {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return running == 1
+			}
+			return position(id) >= 0
+		}, time.Second, time.Millisecond)
+	}
+	require.Equal(t, 0, position("job1"))
+	require.Equal(t, 1, position("job2"))
+	require.Equal(t, -1, position("job0"))
+
+	// The queue is full.
+	require.Equal(t, http.StatusTooManyRequests, do("job3"))
+
+	close(release)
+	wg.Wait()
+	require.Equal(t, 1, maxRunning)
+	require.Equal(t, []string{"job0", "job1", "job2"}, order)
+}
+
+// lockingSelector select the first backend after it reads the queue, which deadlocks if it is called under the queue mutex.
+type lockingSelector struct {
+	queue *JobQueue
+}
+
+func (l *lockingSelector) Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+	l.queue.Position("")
+	return proxies[0], nil
+}
+
+func TestJobQueueWait(t *testing.T) {
+	s := NewServer("", datastore.SQLite, ":memory:", DefaultConfig())
+	defer s.Close()
+	s.Queue.selector = &lockingSelector{queue: s.Queue}
+
+	// Each value sent to release finishes one request.
+	release := make(chan struct{}, 8)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s0", Endpoint: backend.URL, MaxConcurrency: 1}))
+	require.NoError(t, s.Reload())
+
+	do := func(ctx context.Context, id string) chan int {
+		done := make(chan int, 1)
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img", strings.NewReader("{}")).WithContext(ctx)
+			req.Header.Set("X-Request-Id", id)
+			rec := httptest.NewRecorder()
+			s.Echo.ServeHTTP(rec, req)
+			done <- rec.Code
+		}()
+		return done
+	}
+	running := func() int {
+		s.Queue.mutex.Lock()
+		defer s.Queue.mutex.Unlock()
+		return len(s.Queue.running)
+	}
+
+	t.Run("Test the backend is selected outside the queue mutex", func(t *testing.T) {
+		done := do(context.Background(), "job0")
+		require.Eventually(t, func() bool { return running() == 1 }, time.Second, time.Millisecond)
+		release <- struct{}{}
+		select {
+		case code := <-done:
+			require.Equal(t, http.StatusOK, code)
+		case <-time.After(time.Second):
+			require.Fail(t, "the request is not finished")
+		}
+	})
+
+	t.Run("Test the client cancelled in the queue gets 499", func(t *testing.T) {
+		first := do(context.Background(), "job1")
+		require.Eventually(t, func() bool { return running() == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := do(ctx, "job2")
+		require.Eventually(t, func() bool { return s.Queue.Position("job2") == 0 }, time.Second, time.Millisecond)
+		cancel()
+		require.Equal(t, kStatusClientClosedRequest, <-done)
+		require.Equal(t, -1, s.Queue.Position("job2"))
+
+		release <- struct{}{}
+		require.Equal(t, http.StatusOK, <-first)
+	})
+}
+
+func TestJobQueueDispatch(t *testing.T) {
+	s := NewServer("", datastore.SQLite, ":memory:", DefaultConfig())
+	defer s.Close()
+
+	// Each value sent to release finishes one request.
+	release := make(chan struct{}, 8)
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.Write([]byte(name))
+		}))
+	}
+	s0 := backend("s0")
+	defer s0.Close()
+	s1 := backend("s1")
+	defer s1.Close()
+	// Unblock the backends before they are closed.
+	defer close(release)
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s0", Endpoint: s0.URL, MaxConcurrency: 1}))
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s1", Endpoint: s1.URL, MaxConcurrency: 1, Labels: map[string]string{"pool": "gpu"}}))
+	require.NoError(t, s.Reload())
+
+	type result struct {
+		code int
+		body string
+	}
+	do := func(id string, header http.Header, query string) chan result {
+		done := make(chan result, 1)
+		go func() {
+			req := httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img"+query, strings.NewReader("{}"))
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			req.Header.Set("X-Request-Id", id)
+			rec := httptest.NewRecorder()
+			s.Echo.ServeHTTP(rec, req)
+			done <- result{rec.Code, rec.Body.String()}
+		}()
+		return done
+	}
+	running := func(name string) int {
+		s.Queue.mutex.Lock()
+		defer s.Queue.mutex.Unlock()
+		return s.Queue.running[s.findProxy(name)]
+	}
+
+	t.Run("Test the job which can not be served does not hold back the later jobs", func(t *testing.T) {
+		gpu := make(http.Header)
+		gpu.Set(kPoolHeaderName, "gpu")
+		first := do("gpu0", gpu, "")
+		require.Eventually(t, func() bool { return running("s1") == 1 }, time.Second, time.Millisecond)
+		second := do("gpu1", gpu, "")
+		require.Eventually(t, func() bool { return s.Queue.Position("gpu1") == 0 }, time.Second, time.Millisecond)
+
+		// The default pool is free, so the job is dispatched before the gpu job queued ahead of it.
+		third := do("default0", nil, "")
+		require.Eventually(t, func() bool { return running("s0") == 1 }, time.Second, time.Millisecond)
+		require.Equal(t, 0, s.Queue.Position("gpu1"))
+
+		for i := 0; i < 3; i++ {
+			release <- struct{}{}
+		}
+		require.Equal(t, result{http.StatusOK, "s1"}, <-first)
+		require.Equal(t, result{http.StatusOK, "s1"}, <-second)
+		require.Equal(t, result{http.StatusOK, "s0"}, <-third)
+	})
+
+	t.Run("Test the session waits for its busy backend", func(t *testing.T) {
+		first := do("session0", nil, "?session_hash=abc")
+		var pinned string
+		require.Eventually(t, func() bool {
+			pinned, _ = s.SessionAffinityDatastore.GetSession("gradio-abc")
+			return pinned != "" && running(pinned) == 1
+		}, time.Second, time.Millisecond)
+		other := "s0"
+		if pinned == "s0" {
+			other = "s1"
+		}
+
+		// The other backend is free, but the session is not moved away from its busy backend.
+		second := do("session1", nil, "?session_hash=abc")
+		require.Eventually(t, func() bool { return s.Queue.Position("session1") == 0 }, time.Second, time.Millisecond)
+		require.Equal(t, 0, running(other))
+		stored, err := s.SessionAffinityDatastore.GetSession("gradio-abc")
+		require.NoError(t, err)
+		require.Equal(t, pinned, stored)
+
+		release <- struct{}{}
+		require.Equal(t, result{http.StatusOK, pinned}, <-first)
+		release <- struct{}{}
+		require.Equal(t, result{http.StatusOK, pinned}, <-second)
+	})
+}
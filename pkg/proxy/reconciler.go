@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+const kOptionsPath = "/sdapi/v1/options"
+
+// ReconcilerConfig is the configuration of the options drift reconciler.
+type ReconcilerConfig struct {
+	Interval time.Duration // the interval to check the options of the backends, 0 disables the periodic checking
+	Timeout  time.Duration // the timeout of the options request to one backend
+}
+
+// optionDrift is an option whose current value differs from the desired one.
+type optionDrift struct {
+	Option  string      `json:"option"`
+	Desired interface{} `json:"desired"`
+	Actual  interface{} `json:"actual"`
+}
+
+// driftReport is the result of the last check of a backend.
+type driftReport struct {
+	Backend   string        `json:"backend"`
+	Pool      string        `json:"pool"`
+	Drift     []optionDrift `json:"drift"`
+	Healed    bool          `json:"healed"`          // the desired values are pushed to the backend
+	Error     string        `json:"error,omitempty"` // the error to check or heal the backend
+	CheckedAt int64         `json:"checked_at"`      // the unix time in milliseconds of the check
+}
+
+// Reconciler diffs the options of each backend against the desired options profile of its pool,
+// reports the drift, and pushes the desired values to the drifted backends if the profile is in auto-heal mode.
+type Reconciler struct {
+	Config    *ReconcilerConfig
+	Datastore *datastore.OptionsProfiles
+	server    *Server
+	mutex     sync.Mutex
+	reports   map[string]*driftReport // the last report of each backend
+}
+
+func NewReconciler(cfg *ReconcilerConfig, ds *datastore.OptionsProfiles, s *Server) *Reconciler {
+	return &Reconciler{
+		Config:    cfg,
+		Datastore: ds,
+		server:    s,
+		reports:   make(map[string]*driftReport),
+	}
+}
+
+// Run reconcile the backends periodically until the context is canceled.
+func (r *Reconciler) Run(ctx context.Context) {
+	if r.Config.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.Config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := r.ReconcileAll(ctx); err != nil {
+			r.server.Echo.Logger.Errorf("reconcile options failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReconcileAll check all the backends whose pool has a profile, and return the reports ordered by the backend name.
+func (r *Reconciler) ReconcileAll(ctx context.Context) ([]*driftReport, error) {
+	profiles, err := r.Datastore.ListAllProfiles()
+	if err != nil {
+		return nil, fmt.Errorf("list options profiles failed: %v", err)
+	}
+	byPool := make(map[string]*datastore.OptionsProfile)
+	for i := range profiles {
+		byPool[profiles[i].Pool] = &profiles[i]
+	}
+
+	var proxies []*ReverseProxy
+	for _, p := range r.server.currentProxies() {
+		if byPool[p.Pool()] != nil {
+			proxies = append(proxies, p)
+		}
+	}
+	reports := make([]*driftReport, len(proxies))
+	var wg sync.WaitGroup
+	for i, p := range proxies {
+		wg.Add(1)
+		go func(i int, p *ReverseProxy) {
+			defer wg.Done()
+			reports[i] = r.reconcile(ctx, p, byPool[p.Pool()])
+		}(i, p)
+	}
+	wg.Wait()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reports = make(map[string]*driftReport, len(reports))
+	for _, report := range reports {
+		r.reports[report.Backend] = report
+		if len(report.Drift) > 0 {
+			r.server.Echo.Logger.Warnf("options of %s drift from the profile of pool %s: %d options, healed: %v", report.Backend, report.Pool, len(report.Drift), report.Healed)
+		}
+	}
+	return reports, nil
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, p *ReverseProxy, profile *datastore.OptionsProfile) *driftReport {
+	report := &driftReport{
+		Backend:   p.Name,
+		Pool:      profile.Pool,
+		Drift:     []optionDrift{},
+		CheckedAt: time.Now().UnixMilli(),
+	}
+	var current map[string]interface{}
+	if err := r.call(ctx, p, http.MethodGet, nil, &current); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Drift = diffOptions(profile.Options, current)
+	if len(report.Drift) == 0 || !profile.AutoHeal {
+		return report
+	}
+
+	corrections := make(map[string]interface{}, len(report.Drift))
+	for _, d := range report.Drift {
+		corrections[d.Option] = d.Desired
+	}
+	if err := r.call(ctx, p, http.MethodPost, corrections, nil); err != nil {
+		report.Error = fmt.Sprintf("heal failed: %v", err)
+		return report
+	}
+	report.Healed = true
+	return report
+}
+
+// diffOptions return the options whose current value differs from the desired one, ordered by the option name.
+func diffOptions(desired map[string]interface{}, current map[string]interface{}) []optionDrift {
+	drift := []optionDrift{}
+	for option, want := range desired {
+		// Both sides are decoded from JSON, so the same values have the same types.
+		if got, ok := current[option]; !ok || !reflect.DeepEqual(want, got) {
+			drift = append(drift, optionDrift{Option: option, Desired: want, Actual: got})
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Option < drift[j].Option })
+	return drift
+}
+
+// call send the options request to the backend directly, bypassing the broadcast.
+func (r *Reconciler) call(ctx context.Context, p *ReverseProxy, method string, in interface{}, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, r.Config.Timeout)
+	defer cancel()
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, p.Target.JoinPath(kOptionsPath).String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	resp, err := r.server.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s options returns status %d", method, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Reports return the last reports ordered by the backend name.
+func (r *Reconciler) Reports() []*driftReport {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	reports := make([]*driftReport, 0, len(r.reports))
+	for _, report := range r.reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Backend < reports[j].Backend })
+	return reports
+}
+
+func (r *Reconciler) listProfilesHandler(c echo.Context) error {
+	profiles, err := r.Datastore.ListAllProfiles()
+	if err != nil {
+		return err
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Pool < profiles[j].Pool })
+	return c.JSON(http.StatusOK, profiles)
+}
+
+func (r *Reconciler) getProfileHandler(c echo.Context) error {
+	profile, err := r.Datastore.GetProfile(c.Param("pool"))
+	if err != nil {
+		return err
+	}
+	if profile == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "options profile not found")
+	}
+	return c.JSON(http.StatusOK, profile)
+}
+
+func (r *Reconciler) putProfileHandler(c echo.Context) error {
+	profile := &datastore.OptionsProfile{}
+	if err := c.Bind(profile); err != nil {
+		return err
+	}
+	profile.Pool = c.Param("pool")
+	if len(profile.Options) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "options cannot be empty")
+	}
+	profile.UpdatedAt = time.Now().UnixMilli()
+	if err := r.Datastore.PutProfile(profile); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, profile)
+}
+
+func (r *Reconciler) deleteProfileHandler(c echo.Context) error {
+	if err := r.Datastore.DeleteProfile(c.Param("pool")); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (r *Reconciler) driftHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, r.Reports())
+}
+
+func (r *Reconciler) reconcileHandler(c echo.Context) error {
+	reports, err := r.ReconcileAll(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, reports)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOptionsBackend is a backend which keeps its options in memory.
+func fakeOptionsBackend(options map[string]interface{}) *httptest.Server {
+	var mutex sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Method == http.MethodPost {
+			var update map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&update)
+			for k, v := range update {
+				options[k] = v
+			}
+		}
+		json.NewEncoder(w).Encode(options)
+	}))
+}
+
+func TestReconciler(t *testing.T) {
+	s := NewServer("", datastore.SQLite, ":memory:", DefaultConfig())
+	defer s.Close()
+
+	b0 := fakeOptionsBackend(map[string]interface{}{"CLIP_stop_at_last_layers": 2, "sd_vae": "auto"})
+	defer b0.Close()
+	b1 := fakeOptionsBackend(map[string]interface{}{"CLIP_stop_at_last_layers": 1, "sd_vae": "auto"})
+	defer b1.Close()
+	b2 := fakeOptionsBackend(map[string]interface{}{"CLIP_stop_at_last_layers": 1})
+	defer b2.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", b0.URL))
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s1", b1.URL))
+	require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: "s2", Endpoint: b2.URL, Labels: map[string]string{"pool": "other"}}))
+	require.NoError(t, s.Reload())
+
+	profile := &datastore.OptionsProfile{
+		Pool:    kDefaultPool,
+		Options: map[string]interface{}{"CLIP_stop_at_last_layers": float64(2), "sd_vae": "auto"},
+	}
+	require.NoError(t, s.OptionsProfilesDatastore.PutProfile(profile))
+
+	t.Run("Test drift is reported", func(t *testing.T) {
+		reports, err := s.Reconciler.ReconcileAll(context.Background())
+		require.NoError(t, err)
+		// The backend without profile is not checked.
+		require.Len(t, reports, 2)
+		require.Empty(t, reports[0].Drift)
+		require.Equal(t, []optionDrift{{Option: "CLIP_stop_at_last_layers", Desired: float64(2), Actual: float64(1)}}, reports[1].Drift)
+		require.False(t, reports[1].Healed)
+		require.Equal(t, reports, s.Reconciler.Reports())
+	})
+
+	t.Run("Test drift is healed in auto-heal mode", func(t *testing.T) {
+		profile.AutoHeal = true
+		require.NoError(t, s.OptionsProfilesDatastore.PutProfile(profile))
+		reports, err := s.Reconciler.ReconcileAll(context.Background())
+		require.NoError(t, err)
+		require.True(t, reports[1].Healed)
+
+		reports, err = s.Reconciler.ReconcileAll(context.Background())
+		require.NoError(t, err)
+		require.Empty(t, reports[1].Drift)
+	})
+
+	t.Run("Test unreachable backend is reported", func(t *testing.T) {
+		b1.Close()
+		reports, err := s.Reconciler.ReconcileAll(context.Background())
+		require.NoError(t, err)
+		require.NotEmpty(t, reports[1].Error)
+	})
+}
@@ -0,0 +1,472 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+const kCacheHeaderName = "X-Cache"
+
+// ResultCacheConfig is the configuration of the cache of the deterministic generation results.
+type ResultCacheConfig struct {
+	Enabled  bool
+	Paths    []string      // the POST paths whose responses are cached
+	TTL      time.Duration // the time to live of the cached results
+	MaxBytes int64         // the size bound of the in-memory cache
+	// Backing is where the cached results are kept, "memory" or "datastore".
+	// The datastore backing is shared by all the proxy replicas, and the in-memory cache is in front of it.
+	Backing  string
+	ModelTTL time.Duration // the time to cache the backend model and the model hashes
+}
+
+func (cfg *ResultCacheConfig) match(req *http.Request) bool {
+	if !cfg.Enabled || req.Method != http.MethodPost {
+		return false
+	}
+	for _, path := range cfg.Paths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// ResultStore keeps the cached results. It is implemented by the in-memory LRU, the datastore,
+// or any other storage, e.g. an object store.
+type ResultStore interface {
+	GetResult(key string) (*datastore.CachedResult, error) // return nil if the result does not exist
+	PutResult(result *datastore.CachedResult) error
+	DeleteResult(key string) error
+	PurgeResults() error
+	PurgeExpiredResults(now int64) (int64, error) // remove the results whose time to live has passed, and return the number of them
+}
+
+// memoryResultStore is the in-memory LRU result store bounded by the total size of the results.
+type memoryResultStore struct {
+	maxBytes int64
+	mutex    sync.Mutex
+	bytes    int64
+	lru      *list.List // the most recently used result is at the front
+	entries  map[string]*list.Element
+}
+
+func newMemoryResultStore(maxBytes int64) *memoryResultStore {
+	return &memoryResultStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func resultSize(r *datastore.CachedResult) int64 {
+	return int64(len(r.Key) + len(r.ContentType) + len(r.Body))
+}
+
+func (m *memoryResultStore) GetResult(key string) (*datastore.CachedResult, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	m.lru.MoveToFront(e)
+	return e.Value.(*datastore.CachedResult), nil
+}
+
+func (m *memoryResultStore) PutResult(result *datastore.CachedResult) error {
+	if resultSize(result) > m.maxBytes {
+		// The result never fits, keep the others.
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeLocked(result.Key)
+	m.entries[result.Key] = m.lru.PushFront(result)
+	m.bytes += resultSize(result)
+	for m.bytes > m.maxBytes {
+		m.removeLocked(m.lru.Back().Value.(*datastore.CachedResult).Key)
+	}
+	return nil
+}
+
+func (m *memoryResultStore) DeleteResult(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeLocked(key)
+	return nil
+}
+
+func (m *memoryResultStore) PurgeResults() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lru.Init()
+	m.entries = make(map[string]*list.Element)
+	m.bytes = 0
+	return nil
+}
+
+func (m *memoryResultStore) PurgeExpiredResults(now int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var n int64
+	for key, e := range m.entries {
+		if r := e.Value.(*datastore.CachedResult); r.ExpiresAt > 0 && r.ExpiresAt <= now {
+			m.removeLocked(key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryResultStore) removeLocked(key string) {
+	if e, ok := m.entries[key]; ok {
+		m.lru.Remove(e)
+		delete(m.entries, key)
+		m.bytes -= resultSize(e.Value.(*datastore.CachedResult))
+	}
+}
+
+// tieredResultStore is the in-memory cache in front of a shared result store.
+type tieredResultStore struct {
+	front ResultStore
+	back  ResultStore
+}
+
+func (t *tieredResultStore) GetResult(key string) (*datastore.CachedResult, error) {
+	if r, err := t.front.GetResult(key); err != nil || r != nil {
+		return r, err
+	}
+	r, err := t.back.GetResult(key)
+	if err != nil || r == nil {
+		return r, err
+	}
+	return r, t.front.PutResult(r)
+}
+
+func (t *tieredResultStore) PutResult(result *datastore.CachedResult) error {
+	if err := t.back.PutResult(result); err != nil {
+		return err
+	}
+	return t.front.PutResult(result)
+}
+
+func (t *tieredResultStore) DeleteResult(key string) error {
+	if err := t.back.DeleteResult(key); err != nil {
+		return err
+	}
+	return t.front.DeleteResult(key)
+}
+
+func (t *tieredResultStore) PurgeResults() error {
+	if err := t.back.PurgeResults(); err != nil {
+		return err
+	}
+	return t.front.PurgeResults()
+}
+
+func (t *tieredResultStore) PurgeExpiredResults(now int64) (int64, error) {
+	n, err := t.back.PurgeExpiredResults(now)
+	if err != nil {
+		return n, err
+	}
+	_, err = t.front.PurgeExpiredResults(now)
+	return n, err
+}
+
+// ResultCache serves the repeated deterministic generations from the cache.
+//
+// The cache key is the hash of the path, the hash of the model and the canonical JSON of the request,
+// and only the requests with a fixed seed are cached, since the others are not expected to return the same images.
+type ResultCache struct {
+	Config *ResultCacheConfig
+	Store  ResultStore
+	server *Server
+	hits   atomic.Int64
+	misses atomic.Int64
+
+	modelFlights   flightGroup // coalesce the concurrent fetches of the models
+	modelMutex     sync.Mutex
+	defaultModel   string            // the checkpoint loaded by the backends when the request does not override it
+	modelHashes    map[string]string // the checkpoint title or name to its hash
+	modelFetchedAt time.Time
+}
+
+func NewResultCache(cfg *ResultCacheConfig, store ResultStore, s *Server) *ResultCache {
+	return &ResultCache{
+		Config: cfg,
+		Store:  store,
+		server: s,
+	}
+}
+
+// Middleware serve the cached result of the request, or cache the response of the backend.
+func (rc *ResultCache) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if !rc.Config.match(req) || internalFromContext(req.Context()) != nil {
+			return next(c)
+		}
+		body, replayable, err := bufferBody(req, rc.server.Config.Retry.MaxBodyBytes)
+		if err != nil {
+			return err
+		}
+		modelHash, key, ok := "", "", false
+		if replayable {
+			// The buffered body is restored for the handler.
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			modelHash, key, ok = rc.key(rc.server.identify(c), req.URL.Path, body)
+		}
+		if !ok {
+			c.Response().Header().Set(kCacheHeaderName, "BYPASS")
+			return next(c)
+		}
+
+		cached, err := rc.get(key)
+		if err != nil {
+			c.Logger().Warnf("get cached result %s failed: %v", key, err)
+		}
+		if cached != nil {
+			rc.hits.Add(1)
+			c.Response().Header().Set(kCacheHeaderName, "HIT")
+			c.Response().Header().Set("Age", strconv.FormatInt(int64(time.Since(time.UnixMilli(cached.CreatedAt)).Seconds()), 10))
+			return c.Blob(http.StatusOK, cached.ContentType, []byte(cached.Body))
+		}
+		rc.misses.Add(1)
+
+		c.Response().Header().Set(kCacheHeaderName, "MISS")
+		w := &captureWriter{ResponseWriter: c.Response().Writer, limit: rc.Config.MaxBytes}
+		c.Response().Writer = w
+		err = next(c)
+		c.Response().Writer = w.ResponseWriter
+		if err != nil || c.Response().Status != http.StatusOK || w.overflow {
+			return err
+		}
+		if !generatedBy(w.body.Bytes(), modelHash) {
+			// The backend loaded another model than the one the key is computed for.
+			return nil
+		}
+		result := &datastore.CachedResult{
+			Key:         key,
+			ContentType: c.Response().Header().Get(echo.HeaderContentType),
+			Body:        w.body.String(),
+			CreatedAt:   time.Now().UnixMilli(),
+		}
+		if rc.Config.TTL > 0 {
+			result.ExpiresAt = time.Now().Add(rc.Config.TTL).UnixMilli()
+		}
+		if err := rc.Store.PutResult(result); err != nil {
+			c.Logger().Warnf("put cached result %s failed: %v", key, err)
+		}
+		return nil
+	}
+}
+
+// Run remove the expired results periodically, so that the shared result store does not grow with them.
+func (rc *ResultCache) Run(ctx context.Context) {
+	if !rc.Config.Enabled || rc.Config.TTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n, err := rc.Store.PurgeExpiredResults(time.Now().UnixMilli()); err != nil {
+			rc.server.Echo.Logger.Errorf("purge expired results failed: %v", err)
+		} else if n > 0 {
+			rc.server.Echo.Logger.Infof("purge %d expired results", n)
+		}
+	}
+}
+
+// get return the cached result, or nil if it does not exist or it is expired.
+func (rc *ResultCache) get(key string) (*datastore.CachedResult, error) {
+	r, err := rc.Store.GetResult(key)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	if rc.Config.TTL > 0 && time.Since(time.UnixMilli(r.CreatedAt)) > rc.Config.TTL {
+		return nil, rc.Store.DeleteResult(key)
+	}
+	return r, nil
+}
+
+// key return the model hash and the cache key of the request, and false if the request can not be cached.
+func (rc *ResultCache) key(who identity, path string, body []byte) (string, string, bool) {
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", "", false
+	}
+	if seed, ok := seedOf(payload); !ok || seed == -1 {
+		return "", "", false
+	}
+	if toNumber(payload["subseed_strength"]) != 0 {
+		if subseed, ok := payload["subseed"].(float64); !ok || subseed == -1 {
+			return "", "", false
+		}
+	}
+	checkpoint := ""
+	if overrides, ok := payload["override_settings"].(map[string]interface{}); ok {
+		checkpoint, _ = overrides["sd_model_checkpoint"].(string)
+	}
+	modelHash, err := rc.modelHash(who, checkpoint)
+	if err != nil {
+		rc.server.Echo.Logger.Warnf("resolve model hash failed, the result is not cached: %v", err)
+		return "", "", false
+	}
+	// The map keys are sorted by json.Marshal, so the JSON is canonical.
+	canonical, err := json.Marshal(payload)
+	if err != nil {
+		return "", "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", path, modelHash)
+	h.Write(canonical)
+	return modelHash, hex.EncodeToString(h.Sum(nil)), true
+}
+
+// modelHash return the hash of the checkpoint, or of the checkpoint loaded by the backends if it is empty.
+// The models are fetched without holding the mutex, and the concurrent fetches are coalesced into one.
+func (rc *ResultCache) modelHash(who identity, checkpoint string) (string, error) {
+	rc.modelMutex.Lock()
+	stale := rc.modelHashes == nil || time.Since(rc.modelFetchedAt) > rc.Config.ModelTTL
+	rc.modelMutex.Unlock()
+	if stale {
+		if _, err := rc.modelFlights.Do("", func() (interface{}, error) { return nil, rc.fetchModels(who) }); err != nil {
+			return "", err
+		}
+	}
+	rc.modelMutex.Lock()
+	defer rc.modelMutex.Unlock()
+	if checkpoint == "" {
+		checkpoint = rc.defaultModel
+	}
+	hash, ok := rc.modelHashes[checkpoint]
+	if !ok {
+		return "", fmt.Errorf("unknown checkpoint %q", checkpoint)
+	}
+	return hash, nil
+}
+
+// fetchModels get the loaded checkpoint and the model hashes from the backends.
+// The fetch is shared by the callers, so it is not canceled when one of them goes away.
+func (rc *ResultCache) fetchModels(who identity) error {
+	ctx := rc.server.ctx
+	var options struct {
+		Checkpoint string `json:"sd_model_checkpoint"`
+	}
+	if err := rc.server.invokeJSON(ctx, who, "/sdapi/v1/options", &options); err != nil {
+		return err
+	}
+	var models []struct {
+		Title     string `json:"title"`
+		ModelName string `json:"model_name"`
+		Hash      string `json:"hash"`
+		Sha256    string `json:"sha256"`
+	}
+	if err := rc.server.invokeJSON(ctx, who, "/sdapi/v1/sd-models", &models); err != nil {
+		return err
+	}
+	hashes := make(map[string]string)
+	for _, m := range models {
+		hash := m.Sha256
+		if hash == "" {
+			hash = m.Hash
+		}
+		if hash == "" {
+			// The hash is not calculated by the backend yet, the title is the best we have.
+			hash = m.Title
+		}
+		hashes[m.Title] = hash
+		hashes[m.ModelName] = hash
+	}
+	rc.modelMutex.Lock()
+	defer rc.modelMutex.Unlock()
+	rc.defaultModel = options.Checkpoint
+	rc.modelHashes = hashes
+	rc.modelFetchedAt = time.Now()
+	return nil
+}
+
+// generatedBy report whether the generation response is generated by the model with the hash.
+// The response without the model hash is trusted.
+func generatedBy(body []byte, modelHash string) bool {
+	var result struct {
+		Info string `json:"info"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false
+	}
+	var info struct {
+		ModelHash string `json:"sd_model_hash"`
+	}
+	if json.Unmarshal([]byte(result.Info), &info) != nil || info.ModelHash == "" {
+		return true
+	}
+	return strings.HasPrefix(modelHash, info.ModelHash)
+}
+
+// captureWriter write the response to the client, and keep a copy of it up to limit bytes.
+type captureWriter struct {
+	http.ResponseWriter
+	limit    int64
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rc *ResultCache) statsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]int64{
+		"hits":   rc.hits.Load(),
+		"misses": rc.misses.Load(),
+	})
+}
+
+func (rc *ResultCache) purgeHandler(c echo.Context) error {
+	if err := rc.Store.PurgeResults(); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (rc *ResultCache) deleteHandler(c echo.Context) error {
+	if err := rc.Store.DeleteResult(c.Param("key")); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
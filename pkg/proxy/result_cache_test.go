@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeModelBackend is a backend with two checkpoints, which reports the loaded model in the generation info.
+func fakeModelBackend(calls *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sdapi/v1/options":
+			json.NewEncoder(w).Encode(map[string]interface{}{"sd_model_checkpoint": "a.safetensors [aaaa]"})
+		case "/sdapi/v1/sd-models":
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"title": "a.safetensors [aaaa]", "model_name": "a", "hash": "aaaa", "sha256": "aaaa1111"},
+				{"title": "b.safetensors [bbbb]", "model_name": "b", "hash": "bbbb", "sha256": "bbbb2222"},
+			})
+		default:
+			calls.Add(1)
+			info, _ := json.Marshal(map[string]interface{}{"sd_model_hash": "aaaa"})
+			json.NewEncoder(w).Encode(map[string]interface{}{"images": []string{"image"}, "info": string(info)})
+		}
+	}))
+}
+
+func TestResultCache(t *testing.T) {
+	config := DefaultConfig()
+	config.ResultCache.Enabled = true
+	config.ResultCache.Backing = "datastore"
+	config.AdminToken = "secret"
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	var calls atomic.Int32
+	backend := fakeModelBackend(&calls)
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	do := func(body string) string {
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, kTxt2ImgPath, strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Body.String(), "image")
+		return rec.Header().Get(kCacheHeaderName)
+	}
+
+	t.Run("Test repeated request with fixed seed is served from cache", func(t *testing.T) {
+		calls.Store(0)
+		require.Equal(t, "MISS", do(`{"prompt": "cat", "seed": 1, "steps": 20}`))
+		require.Equal(t, "HIT", do(`{"steps": 20, "seed": 1, "prompt": "cat"}`))
+		require.Equal(t, "MISS", do(`{"prompt": "cat", "seed": 2, "steps": 20}`))
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("Test random seed bypasses cache", func(t *testing.T) {
+		calls.Store(0)
+		require.Equal(t, "BYPASS", do(`{"prompt": "dog", "seed": -1}`))
+		require.Equal(t, "BYPASS", do(`{"prompt": "dog", "seed": -1}`))
+		require.Equal(t, "BYPASS", do(`{"prompt": "dog"}`))
+		require.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("Test result of another model is not cached", func(t *testing.T) {
+		calls.Store(0)
+		body := `{"prompt": "cat", "seed": 1, "override_settings": {"sd_model_checkpoint": "b"}}`
+		require.Equal(t, "MISS", do(body))
+		require.Equal(t, "MISS", do(body))
+		require.Equal(t, "BYPASS", do(`{"prompt": "cat", "seed": 1, "override_settings": {"sd_model_checkpoint": "c"}}`))
+		require.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("Test result is shared through the datastore", func(t *testing.T) {
+		require.Equal(t, "MISS", do(`{"prompt": "bird", "seed": 1}`))
+		require.NoError(t, s.ResultCache.Store.(*tieredResultStore).front.PurgeResults())
+		require.Equal(t, "HIT", do(`{"prompt": "bird", "seed": 1}`))
+	})
+
+	t.Run("Test admin purge", func(t *testing.T) {
+		require.Equal(t, "HIT", do(`{"prompt": "cat", "seed": 1, "steps": 20}`))
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/admin/cache", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		s.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		require.Equal(t, "MISS", do(`{"prompt": "cat", "seed": 1, "steps": 20}`))
+	})
+
+	t.Run("Test expired result is purged from the datastore", func(t *testing.T) {
+		require.Equal(t, "MISS", do(`{"prompt": "fish", "seed": 1}`))
+		n, err := s.ResultCacheDatastore.PurgeExpiredResults(time.Now().Add(config.ResultCache.TTL).UnixMilli())
+		require.NoError(t, err)
+		require.NotZero(t, n)
+		require.NoError(t, s.ResultCache.Store.(*tieredResultStore).front.PurgeResults())
+		require.Equal(t, "MISS", do(`{"prompt": "fish", "seed": 1}`))
+	})
+}
+
+func TestResultCacheModelHash(t *testing.T) {
+	s := NewServer("", datastore.SQLite, ":memory:", DefaultConfig())
+	defer s.Close()
+
+	// The first fetch of the options blocks until release is closed.
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sdapi/v1/options":
+			fetches.Add(1)
+			<-release
+			json.NewEncoder(w).Encode(map[string]interface{}{"sd_model_checkpoint": "a"})
+		case "/sdapi/v1/sd-models":
+			json.NewEncoder(w).Encode([]map[string]interface{}{{"title": "a.safetensors [aaaa]", "model_name": "a", "sha256": "aaaa1111"}})
+		}
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	rc := s.ResultCache
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hash, err := rc.modelHash(identity{}, "")
+			require.NoError(t, err)
+			require.Equal(t, "aaaa1111", hash)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		rc.modelFlights.mutex.Lock()
+		defer rc.modelFlights.mutex.Unlock()
+		f := rc.modelFlights.calls[""]
+		return f != nil && f.dups == 3
+	}, time.Second, time.Millisecond)
+	// The mutex is not held while the models are fetched.
+	require.True(t, rc.modelMutex.TryLock())
+	rc.modelMutex.Unlock()
+
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), fetches.Load())
+}
+
+func TestMemoryResultStore(t *testing.T) {
+	store := newMemoryResultStore(30)
+	put := func(key string) {
+		require.NoError(t, store.PutResult(&datastore.CachedResult{Key: key, Body: "0123456789"}))
+	}
+	get := func(key string) *datastore.CachedResult {
+		r, err := store.GetResult(key)
+		require.NoError(t, err)
+		return r
+	}
+
+	put("k1")
+	put("k2")
+	require.NotNil(t, get("k1"))
+	// The least recently used result is evicted.
+	put("k3")
+	require.NotNil(t, get("k1"))
+	require.Nil(t, get("k2"))
+	require.NotNil(t, get("k3"))
+	require.Equal(t, int64(24), store.bytes)
+
+	// The result larger than the bound is not kept.
+	require.NoError(t, store.PutResult(&datastore.CachedResult{Key: "big", Body: strings.Repeat("x", 100)}))
+	require.Nil(t, get("big"))
+	require.NotNil(t, get("k3"))
+
+	// The expired result is purged.
+	require.NoError(t, store.PutResult(&datastore.CachedResult{Key: "k4", Body: "0123456789", ExpiresAt: 2000}))
+	n, err := store.PurgeExpiredResults(2000)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	require.Nil(t, get("k4"))
+	require.NotNil(t, get("k3"))
+}
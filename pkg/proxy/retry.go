@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RetryConfig is the configuration of the failover of the failed backend requests.
+type RetryConfig struct {
+	MaxRetries      int           // the retry budget of one request, 0 disables the retries
+	BackoffBase     time.Duration // the backoff before the n-th retry is a random duration in [0, BackoffBase * 2^(n-1)]
+	BackoffMax      time.Duration // the upper bound of the backoff
+	MaxBodyBytes    int64         // the requests with larger body are not retried, since the body has to be buffered for replaying
+	IdempotentPaths []string      // the GET paths which are also retried on the connection errors after the request is sent, or 502/503/504
+}
+
+func (cfg *RetryConfig) isIdempotent(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	for _, path := range cfg.IdempotentPaths {
+		if req.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// jitteredBackoff return the backoff before the n-th retry, or after the n-th failed attempt,
+// which is a random duration in [0, min(base * 2^(n-1), limit)].
+func jitteredBackoff(base time.Duration, limit time.Duration, n int64) time.Duration {
+	d := base << (n - 1)
+	if d <= 0 || d > limit {
+		d = limit
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// observeRunTime add the run time of the succeeded generation to the estimation.
+func (s *Server) observeRunTime(c echo.Context, path string, work float64, start time.Time) {
+	if c.Response().Status == http.StatusOK && c.Response().Header().Get(kAsyncStatusCodeTrailerName) == "" {
+		s.Queue.Estimator.Observe(path, work, time.Since(start))
+	}
+}
+
+// kStatusClientClosedRequest is the nginx status of the requests whose client is gone before the response.
+const kStatusClientClosedRequest = 499
+
+// errRetryableStatus is returned by ModifyResponse to discard the response and retry the request.
+var errRetryableStatus = errors.New("proxy: retryable response status")
+
+type attemptKey struct{}
+
+// attempt is the state of one try of the request, which is shared with the reverse proxy hooks through the request context.
+type attempt struct {
+	idempotent bool
+	last       bool  // the last attempt can not be retried, its error is returned to the client
+	err        error // the error to retry
+}
+
+func attemptFromContext(ctx context.Context) *attempt {
+	a, _ := ctx.Value(attemptKey{}).(*attempt)
+	return a
+}
+
+// retryResponse return true if the response should be discarded and the request should be retried.
+func (a *attempt) retryResponse(resp *http.Response) bool {
+	if a == nil || a.last || !a.idempotent {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryError return true if the error should be hidden from the client and the request should be retried.
+func (a *attempt) retryError(err error) bool {
+	if a == nil || a.last || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if a.idempotent || errors.Is(err, errRetryableStatus) || notSent(err) {
+		a.err = err
+		return true
+	}
+	return false
+}
+
+// notSent report whether the request never reached the backend, so that it is safe to send it again.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// bufferBody read the request body into memory if it is no larger than limit, so that the request can be replayed.
+// Otherwise, the body is restored as a stream and the request is not replayable.
+func bufferBody(req *http.Request, limit int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > limit {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return body, true, nil
+}
+
+// forward proxy the request to one of the backends. The failed request is retried on a different backend
+// if it never reached the backend, or it is idempotent, within the retry budget.
+// The generation requests wait in the queue until a backend has a free slot, and the ones with a deadline
+// are rejected or dropped once it can not be met, or interrupted if it is exceeded while running.
+func (s *Server) forward(c echo.Context) error {
+	req := c.Request()
+	cfg := &s.Config.Retry
+	body, replayable, err := bufferBody(req, cfg.MaxBodyBytes)
+	if err != nil {
+		return err
+	}
+	req = withRequirement(req, body)
+	budget := cfg.MaxRetries
+	if !replayable {
+		budget = 0
+	}
+
+	tried := make(map[*ReverseProxy]bool)
+	var job *queuedJob
+	var taskId string
+	var deadline time.Time
+	var work float64
+	if s.Queue.Config.match(req) {
+		id := req.Header.Get(echo.HeaderXRequestID)
+		if id == "" {
+			if id, err = randomId(); err != nil {
+				return err
+			}
+		}
+		if replayable && body != nil {
+			var generated string
+			if generated, err = randomId(); err != nil {
+				return err
+			}
+			body, taskId = withTaskId(body, generated)
+			if taskId != "" {
+				c.Response().Header().Set(kTaskIdHeaderName, taskId)
+			}
+		}
+		now := time.Now()
+		if deadline, err = requestDeadline(req, now); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		work = generationWork(body)
+		estimate := s.Queue.Estimator.Estimate(req.URL.Path, work)
+		if !deadline.IsZero() && now.Add(estimate).After(deadline) {
+			return echo.NewHTTPError(http.StatusGatewayTimeout, fmt.Sprintf("the deadline can not be met with the estimated run time %s", estimate.Round(time.Millisecond)))
+		}
+		if job = s.Queue.Enqueue(id, req, s.identify(c), deadline, estimate); job == nil {
+			return echo.NewHTTPError(http.StatusTooManyRequests, "the generation queue is full")
+		}
+		tried = job.excluded
+	}
+
+	for retry := 0; ; retry++ {
+		var p *ReverseProxy
+		if job != nil {
+			if retry > 0 {
+				s.Queue.Requeue(job)
+			}
+			if p, err = s.Queue.Wait(req.Context(), job); errors.Is(err, errDeadlineExceeded) {
+				return echo.NewHTTPError(http.StatusGatewayTimeout, "the deadline can not be met with the estimated run time")
+			} else if err != nil {
+				// The client is gone, the status is only for the access log.
+				return echo.NewHTTPError(kStatusClientClosedRequest, "the client closed the request while waiting in the queue")
+			}
+		} else if p, err = s.selectProxy(req, tried); err != nil {
+			return err
+		}
+		tried[p] = true
+		observeBackend(req, p)
+
+		a := &attempt{
+			idempotent: cfg.isIdempotent(req),
+			last:       retry >= budget,
+		}
+		ctx := context.WithValue(req.Context(), attemptKey{}, a)
+		var cancel context.CancelFunc
+		if deadline.IsZero() {
+			ctx, cancel = context.WithCancel(ctx)
+		} else {
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+		}
+		r := req.WithContext(ctx)
+		if replayable && body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+		r.Host = p.Target.Host
+		r.URL.Host = p.Target.Host
+		r.URL.Scheme = p.Target.Scheme
+		var w http.ResponseWriter = c.Response()
+		if s.Config.Async.match(r) {
+			r.Header.Set(kAsyncHeaderName, "true")
+			w = &asyncWriter{ResponseWriter: w}
+		}
+		start := time.Now()
+		p.ServeHTTP(w, r)
+		if aw, ok := w.(*asyncWriter); ok && aw.taskId != "" {
+			// The backend runs the request in the background, it still occupies the backend until the response is ready.
+			err := s.bridgeAsync(c, r, p, aw.taskId)
+			cancel()
+			if job != nil {
+				s.Queue.Release(p)
+				s.observeRunTime(c, req.URL.Path, work, start)
+			}
+			return err
+		}
+		missed := errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
+		if job != nil {
+			s.Queue.Release(p)
+		}
+		if taskId != "" && missed {
+			s.Echo.Logger.Infof("task %s on %s missed its deadline", taskId, p.Name)
+			go s.notifyInterrupt(p, taskId, true)
+		} else if taskId != "" && req.Context().Err() != nil {
+			s.interruptOnDisconnect(req, p, taskId)
+		}
+		if a.err == nil {
+			if job != nil {
+				s.observeRunTime(c, req.URL.Path, work, start)
+			}
+			return nil
+		}
+
+		backoff := jitteredBackoff(cfg.BackoffBase, cfg.BackoffMax, int64(retry+1))
+		s.Echo.Logger.Warnf("retry %s %s in %s, attempt %d to %s failed: %v", req.Method, req.URL.Path, backoff, retry+1, p.Name, a.err)
+		select {
+		case <-req.Context().Done():
+			return fmt.Errorf("request canceled while waiting for retry: %v", req.Context().Err())
+		case <-time.After(backoff):
+		}
+	}
+}
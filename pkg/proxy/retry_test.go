@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetry(t *testing.T) {
+	config := DefaultConfig()
+	config.Retry.BackoffBase = time.Millisecond
+	config.Retry.BackoffMax = time.Millisecond
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	// The refused backend never receives the request.
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte("ok:" + string(body)))
+	}))
+	defer ok.Close()
+
+	setBackends := func(endpoints ...string) {
+		for _, p := range s.currentProxies() {
+			require.NoError(t, s.SDServicesDatastore.DeleteServiceEndpoint(p.Name))
+		}
+		for i, endpoint := range endpoints {
+			require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint(string(rune('a'+i)), endpoint))
+		}
+		require.NoError(t, s.Reload())
+	}
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.Echo.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	t.Run("Test retry the request never sent", func(t *testing.T) {
+		setBackends(refused.URL, ok.URL)
+		for i := 0; i < 4; i++ {
+			rec := do(http.MethodPost, "/sdapi/v1/txt2img", "payload")
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Equal(t, "ok:payload", rec.Body.String())
+		}
+	})
+
+	t.Run("Test retry the idempotent request", func(t *testing.T) {
+		setBackends(unavailable.URL, ok.URL)
+		for i := 0; i < 4; i++ {
+			require.Equal(t, http.StatusOK, do(http.MethodGet, "/sdapi/v1/sd-models", "").Code)
+		}
+	})
+
+	t.Run("Test do not retry the non-idempotent request", func(t *testing.T) {
+		setBackends(unavailable.URL)
+		require.Equal(t, http.StatusServiceUnavailable, do(http.MethodPost, "/sdapi/v1/txt2img", "payload").Code)
+	})
+
+	t.Run("Test retry budget is exhausted", func(t *testing.T) {
+		setBackends(refused.URL)
+		require.Equal(t, http.StatusBadGateway, do(http.MethodPost, "/sdapi/v1/txt2img", "payload").Code)
+	})
+}
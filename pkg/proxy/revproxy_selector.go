@@ -1,24 +1,114 @@
 package proxy
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"sync"
+	"sync/atomic"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
 )
 
 type ReverseProxy struct {
 	Name   string // the name of downstream stable diffusion service
 	Target *url.URL
 	Proxy  *httputil.ReverseProxy
+	Health *HealthState // the health state observed by this proxy, nil means always healthy
+
+	inflight atomic.Int64                                // the number of requests being served, including the websocket connections
+	service  atomic.Pointer[datastore.SDServiceEndpoint] // the service metadata, updated by the reloads
+	removed  atomic.Bool                                 // set once the backend is removed by a reload
+}
+
+// Service return the metadata of the backend service.
+func (p *ReverseProxy) Service() *datastore.SDServiceEndpoint {
+	if srv := p.service.Load(); srv != nil {
+		return srv
+	}
+	return &datastore.SDServiceEndpoint{Name: p.Name}
 }
 
+func (p *ReverseProxy) setService(srv *datastore.SDServiceEndpoint) {
+	p.service.Store(srv)
+}
+
+// Weight return the load balancing weight of the backend, which is at least 1.
+func (p *ReverseProxy) Weight() int64 {
+	if w := p.Service().Weight; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// Removed report whether the backend is removed by a reload, e.g. to forget its state.
+func (p *ReverseProxy) Removed() bool {
+	return p.removed.Load()
+}
+
+// ServeHTTP proxy the request to the backend and track it as in-flight until it finishes.
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.inflight.Add(1)
+	defer p.inflight.Add(-1)
+	p.Proxy.ServeHTTP(w, withStart(req))
+}
+
+// InFlight return the number of requests being served.
+func (p *ReverseProxy) InFlight() int64 {
+	return p.inflight.Load()
+}
+
+var ErrNoReverseProxy = errors.New("proxy: no available backend service")
+
 type ReverseProxySelector interface {
 	// Select select one reverse proxy from the source for the request.
 	// Select can be executed by multiple goroutines concurrently.
 	Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error)
 }
 
+// WeightedRoundRobinReverseProxySelector is the smooth weighted round-robin selector,
+// which spreads the requests to the backends in proportion to their weights.
+type WeightedRoundRobinReverseProxySelector struct {
+	current map[*ReverseProxy]int64 // the current weight of each backend
+	mutex   sync.Mutex
+}
+
+func NewWeightedRoundRobinReverseProxySelector() *WeightedRoundRobinReverseProxySelector {
+	return &WeightedRoundRobinReverseProxySelector{
+		current: make(map[*ReverseProxy]int64),
+	}
+}
+
+func (wrr *WeightedRoundRobinReverseProxySelector) Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+	if len(proxies) == 0 {
+		return nil, ErrNoReverseProxy
+	}
+
+	wrr.mutex.Lock()
+	defer wrr.mutex.Unlock()
+	// The candidates are often a subset of the backends, e.g. of a pool, the current weights of the others are kept.
+	// Only the removed backends are forgotten, so that they do not leak.
+	for p := range wrr.current {
+		if p.Removed() {
+			delete(wrr.current, p)
+		}
+	}
+	var total int64
+	var best *ReverseProxy
+	for _, p := range proxies {
+		w := p.Weight()
+		wrr.current[p] += w
+		total += w
+		if best == nil || wrr.current[p] > wrr.current[best] {
+			best = p
+		}
+	}
+	wrr.current[best] -= total
+
+	return best, nil
+}
+
 // Usually be used for testing purposes.
 type RoundRobinReverseProxySelector struct {
 	i     int
@@ -31,10 +121,15 @@ func NewRoundRobinReverseProxySelector() *RoundRobinReverseProxySelector {
 
 func (rr *RoundRobinReverseProxySelector) Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
 	length := len(proxies)
-	ret := proxies[rr.i]
+	if length == 0 {
+		return nil, ErrNoReverseProxy
+	}
 
 	rr.mutex.Lock()
 	defer rr.mutex.Unlock()
+	// The candidates may change between calls, e.g. some backends are ejected.
+	rr.i = rr.i % length
+	ret := proxies[rr.i]
 	rr.i = (rr.i + 1) % length
 
 	return ret, nil
@@ -2,12 +2,16 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
 
 	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
 	"github.com/labstack/echo/v4"
@@ -15,20 +19,50 @@ import (
 )
 
 type Server struct {
-	Proxies               []*ReverseProxy // the reverse proxy for each downstream sd service
-	ProxySelector         ReverseProxySelector
-	Echo                  *echo.Echo              // the echo server for reverse proxy
-	SDServicesDatastore   *datastore.SDServices   // the datastore for the backend stable-diffusion services
-	TaskProgressDatastore *datastore.TaskProgress // the datastore to store the task states
+	Proxies                  []*ReverseProxy // the reverse proxy for each downstream sd service, guarded by proxiesMutex
+	ProxySelector            ReverseProxySelector
+	Echo                     *echo.Echo                   // the echo server for reverse proxy
+	Config                   *Config                      // the proxy server configuration
+	SDServicesDatastore      *datastore.SDServices        // the datastore for the backend stable-diffusion services
+	TaskProgressDatastore    *datastore.TaskProgress      // the datastore to store the task states
+	SessionAffinityDatastore *datastore.SessionAffinity   // the datastore to store the session to backend mappings
+	BackendHealthDatastore   *datastore.BackendHealth     // the datastore to share the backend health states
+	ResultCacheDatastore     *datastore.ResultCache       // the datastore to share the cached generation results
+	OptionsProfilesDatastore *datastore.OptionsProfiles   // the datastore of the desired options of the backend pools
+	MirrorResultsDatastore   *datastore.MirrorResults     // the datastore of the results of the shadow traffic
+	TrafficSplitsDatastore   *datastore.TrafficSplits     // the datastore of the traffic splits between the backend versions
+	JobsDatastore            *datastore.Jobs              // the datastore of the asynchronous jobs
+	DeadJobsDatastore        *datastore.Jobs              // the dead-letter datastore of the jobs which fail after all the attempts
+	WebhooksDatastore        *datastore.WebhookDeliveries // the datastore of the webhook retry queue and delivery log
+	ImagesDatastore          *datastore.Images            // the datastore of the generated images served by url
+	IdempotencyKeysDatastore *datastore.IdempotencyKeys   // the datastore of the idempotency keys and the recorded responses
+	HealthChecker            *HealthChecker
+	Queue                    *JobQueue      // the queue of the generation requests
+	Batcher                  *Batcher       // the coalescer of the txt2img requests
+	ResultCache              *ResultCache   // the cache of the deterministic generation results
+	MetadataCache            *MetadataCache // the cache of the metadata GETs
+	Aggregator               *Aggregator    // the cluster-wide listings and the model catalog
+	Reconciler               *Reconciler    // the reconciler of the backend options
+	Mirror                   *Mirror        // the shadow traffic
+	Versions                 *Versions      // the traffic splits and the stats of the backend versions
+	Jobs                     *AsyncJobs     // the asynchronous job API
+	Webhooks                 *Webhooks      // the completion webhooks of the jobs
+	TaskEvents               *TaskEvents    // the progress event streams of the tasks
+	HttpClient               *http.Client   // the http client for the requests made by the proxy itself
+
+	proxiesMutex sync.RWMutex
+	reloadMutex  sync.Mutex      // serialize the membership changes
+	ctx          context.Context // the context of the background goroutines
+	cancel       context.CancelFunc
 }
 
-func NewServer(targetStr string, dbType datastore.DatastoreType, dbName string) *Server {
+func NewServer(targetStr string, dbType datastore.DatastoreType, dbName string, config *Config) *Server {
 	s := &Server{
-		Echo: echo.New(),
+		Echo:       echo.New(),
+		Config:     config,
+		HttpClient: &http.Client{},
 	}
-
-	// TODO: Make proxy selector configurable.
-	s.ProxySelector = NewRoundRobinReverseProxySelector()
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	sdsd, err := datastore.NewSDServices(dbType, dbName)
 	if err != nil {
@@ -42,58 +76,335 @@ func NewServer(targetStr string, dbType datastore.DatastoreType, dbName string)
 	}
 	s.TaskProgressDatastore = tpds
 
+	sads, err := datastore.NewSessionAffinity(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create session affinity datastore failed: %v", err))
+	}
+	s.SessionAffinityDatastore = sads
+
+	bhds, err := datastore.NewBackendHealth(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create backend health datastore failed: %v", err))
+	}
+	s.BackendHealthDatastore = bhds
+
+	rcds, err := datastore.NewResultCache(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create result cache datastore failed: %v", err))
+	}
+	s.ResultCacheDatastore = rcds
+
+	opds, err := datastore.NewOptionsProfiles(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create options profiles datastore failed: %v", err))
+	}
+	s.OptionsProfilesDatastore = opds
+
+	mrds, err := datastore.NewMirrorResults(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create mirror results datastore failed: %v", err))
+	}
+	s.MirrorResultsDatastore = mrds
+
+	tsds, err := datastore.NewTrafficSplits(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create traffic splits datastore failed: %v", err))
+	}
+	s.TrafficSplitsDatastore = tsds
+
+	jds, err := datastore.NewJobs(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create jobs datastore failed: %v", err))
+	}
+	s.JobsDatastore = jds
+
+	djds, err := datastore.NewDeadJobs(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create dead jobs datastore failed: %v", err))
+	}
+	s.DeadJobsDatastore = djds
+
+	wds, err := datastore.NewWebhookDeliveries(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create webhook deliveries datastore failed: %v", err))
+	}
+	s.WebhooksDatastore = wds
+
+	ids, err := datastore.NewImages(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create images datastore failed: %v", err))
+	}
+	s.ImagesDatastore = ids
+
+	ikds, err := datastore.NewIdempotencyKeys(dbType, dbName)
+	if err != nil {
+		panic(fmt.Errorf("create idempotency keys datastore failed: %v", err))
+	}
+	s.IdempotencyKeysDatastore = ikds
+
 	// s.Echo.Debug = true
 	s.Echo.Use(middleware.Logger())
 	s.Echo.Use(middleware.Recover())
 
-	services, err := s.SDServicesDatastore.ListAllServiceEndpoints()
-	if err != nil {
-		panic(fmt.Errorf("list all service endpoints failed: %v", err))
-	}
-	for _, srv := range services {
-		target, err := url.Parse(srv.Endpoint)
-		if err != nil {
-			panic(fmt.Errorf("parse target %s failed: %v", srv.Endpoint, err))
+	secret := []byte(config.SessionSecret)
+	if len(secret) == 0 {
+		s.Echo.Logger.Warnf("session secret is not set, the session cookies can not be shared among proxy replicas")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(fmt.Errorf("generate session secret failed: %v", err))
 		}
-		proxy := httputil.NewSingleHostReverseProxy(target)
-		s.Proxies = append(s.Proxies, &ReverseProxy{
-			Name:   srv.Name,
-			Target: target,
-			Proxy:  proxy,
-		})
-		s.Echo.Logger.Infof("create reverse proxy for %s: %s", srv.Name, srv.Endpoint)
+	}
+	// TODO: Make proxy selector configurable.
+	// The version is chosen only for the new or remapped sessions, so that a session stays on its backend during a canary.
+	s.Versions = NewVersions(s.TrafficSplitsDatastore)
+	sessionSelector := NewSessionAffinitySelector(NewVersionSelector(NewWeightedRoundRobinReverseProxySelector(), s.Versions), s.SessionAffinityDatastore, secret)
+	sessionSelector.TTL = config.SessionTTL
+	s.Aggregator = NewAggregator(&config.Aggregation, NewModelCatalog(), s)
+	poolSelector := NewPoolSelector(NewModelSelector(sessionSelector, s.Aggregator.Catalog))
+	if config.Mirror.Pool != "" {
+		poolSelector.Reserved = []string{config.Mirror.Pool}
+	}
+	s.ProxySelector = poolSelector
+	s.Echo.Use(sessionSelector.Middleware)
+
+	s.Echo.Use(s.broadcastMiddleware)
+	s.Echo.Use(s.idempotencyMiddleware)
+
+	var store ResultStore = newMemoryResultStore(config.ResultCache.MaxBytes)
+	switch config.ResultCache.Backing {
+	case "memory":
+	case "datastore":
+		store = &tieredResultStore{front: store, back: s.ResultCacheDatastore}
+	default:
+		panic(fmt.Errorf("unknown result cache backing %s", config.ResultCache.Backing))
+	}
+	s.ResultCache = NewResultCache(&config.ResultCache, store, s)
+	s.Echo.Use(s.ResultCache.Middleware)
+
+	s.MetadataCache = NewMetadataCache(&config.MetadataCache, s)
+	s.Echo.Use(s.MetadataCache.Middleware)
+
+	s.Mirror = NewMirror(&config.Mirror, s.MirrorResultsDatastore, s)
+	s.Echo.Use(s.Mirror.Middleware)
+
+	s.HealthChecker = NewHealthChecker(&config.HealthCheck, s.BackendHealthDatastore, s.currentProxies, s.Echo.Logger)
+
+	s.Reconciler = NewReconciler(&config.Reconciler, s.OptionsProfilesDatastore, s)
+
+	s.Queue = NewJobQueue(&config.Queue, s.candidates, s.ProxySelector)
+
+	if err := s.Reload(); err != nil {
+		panic(err)
 	}
 
 	s.Echo.POST("/internal/progress", s.progressHandler)
+	s.TaskEvents = NewTaskEvents(&config.TaskEvents, s.TaskProgressDatastore, s)
+	s.Echo.GET("/v1/tasks/:id/events", s.TaskEvents.eventsHandler)
+	s.Echo.GET("/v1/queue", s.Queue.queueHandler)
+	s.Echo.GET("/v1/queue/:id", s.Queue.positionHandler)
+
+	s.Webhooks = NewWebhooks(&config.Webhooks, s.WebhooksDatastore, s)
+	s.Jobs = NewAsyncJobs(&config.Jobs, s.JobsDatastore, s.DeadJobsDatastore, s)
+	s.Echo.POST("/v1/jobs", s.Jobs.createHandler)
+	s.Echo.GET("/v1/jobs/:id", s.Jobs.getHandler)
+	s.Echo.DELETE("/v1/jobs/:id", s.Jobs.cancelHandler)
+	s.Echo.POST("/v1/pipelines", s.Jobs.createPipelineHandler)
+
+	s.Echo.POST("/v1/images/generations", s.imageGenerationsHandler)
+	s.Echo.GET("/v1/images/:id", s.getImageHandler)
+
+	s.Batcher = NewBatcher(&config.Batching, s)
+	if config.Batching.Enabled {
+		s.Echo.POST(kTxt2ImgPath, s.Batcher.txt2imgHandler)
+	}
+
+	if config.Aggregation.Enabled {
+		for _, l := range listings {
+			s.Echo.GET(l.path, s.Aggregator.handler(l))
+		}
+	}
+
+	if config.AdminToken == "" {
+		s.Echo.Logger.Warnf("admin token is not set, the admin API is disabled")
+	}
+	admin := s.Echo.Group("/admin", s.adminAuth)
+	admin.GET("/health", s.HealthChecker.healthHandler)
+	admin.POST("/health/:name/eject", s.HealthChecker.ejectHandler(true))
+	admin.POST("/health/:name/restore", s.HealthChecker.ejectHandler(false))
+	admin.POST("/reload", s.reloadHandler)
+	admin.GET("/services", s.listServicesHandler)
+	admin.POST("/services", s.createServiceHandler)
+	admin.GET("/services/:name", s.getServiceHandler)
+	admin.PUT("/services/:name", s.updateServiceHandler)
+	admin.DELETE("/services/:name", s.deleteServiceHandler)
+	admin.POST("/services/:name/cordon", s.cordonServiceHandler(true))
+	admin.POST("/services/:name/uncordon", s.cordonServiceHandler(false))
+	admin.GET("/cache", s.ResultCache.statsHandler)
+	admin.DELETE("/cache", s.ResultCache.purgeHandler)
+	admin.DELETE("/cache/:key", s.ResultCache.deleteHandler)
+	admin.DELETE("/metadata-cache", s.MetadataCache.purgeHandler)
+	admin.GET("/options-profiles", s.Reconciler.listProfilesHandler)
+	admin.GET("/options-profiles/:pool", s.Reconciler.getProfileHandler)
+	admin.PUT("/options-profiles/:pool", s.Reconciler.putProfileHandler)
+	admin.DELETE("/options-profiles/:pool", s.Reconciler.deleteProfileHandler)
+	admin.GET("/drift", s.Reconciler.driftHandler)
+	admin.GET("/mirror/results", s.Mirror.resultsHandler)
+	admin.GET("/versions", s.listVersionsHandler)
+	admin.PUT("/versions/splits/:pool", s.putSplitHandler)
+	admin.DELETE("/versions/splits/:pool", s.deleteSplitHandler)
+	admin.POST("/versions/:version/promote", s.promoteVersionHandler)
+	admin.POST("/versions/rollback", s.rollbackSplitHandler)
+	admin.POST("/drift/reconcile", s.Reconciler.reconcileHandler)
+	admin.GET("/webhooks/deliveries", s.Webhooks.listDeliveriesHandler)
+	admin.GET("/webhooks/deliveries/:id", s.Webhooks.getDeliveryHandler)
+	admin.POST("/webhooks/deliveries/:id/redeliver", s.Webhooks.redeliverHandler)
+	admin.GET("/jobs/dead", s.Jobs.listDeadHandler)
+	admin.GET("/jobs/dead/:id", s.Jobs.getDeadHandler)
+	admin.POST("/jobs/dead/:id/redrive", s.Jobs.redriveHandler)
+	admin.DELETE("/jobs/dead/:id", s.Jobs.deleteDeadHandler)
 
 	// Handler for all other cases.
-	s.Echo.Any("/*", func(c echo.Context) error {
-		req := c.Request()
-		p, err := s.ProxySelector.Select(s.Proxies, req)
-		if err != nil {
-			return err
+	s.Echo.Any("/*", s.forward)
+
+	return s
+}
+
+// newReverseProxy create the reverse proxy for the backend service,
+// whose responses and errors are observed by the health checker.
+func (s *Server) newReverseProxy(name string, target *url.URL) *ReverseProxy {
+	p := &ReverseProxy{
+		Name:   name,
+		Target: target,
+		Proxy:  httputil.NewSingleHostReverseProxy(target),
+		Health: NewHealthState(),
+	}
+	// Each backend has its own connections, so that they are closed once the backend is drained.
+	p.Proxy.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	p.Proxy.ModifyResponse = func(resp *http.Response) error {
+		s.HealthChecker.ObserveResponse(p, resp)
+		s.Versions.Observe(p, resp.Request, resp.StatusCode)
+		if attemptFromContext(resp.Request.Context()).retryResponse(resp) {
+			return errRetryableStatus
 		}
-		req.Host = p.Target.Host
-		req.URL.Host = p.Target.Host
-		req.URL.Scheme = p.Target.Scheme
-		p.Proxy.ServeHTTP(c.Response(), c.Request())
 		return nil
-	})
+	}
+	p.Proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if errors.Is(err, context.DeadlineExceeded) && req.Context().Err() != nil {
+			// The request misses its deadline, it is not the fault of the backend.
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		if !errors.Is(err, errRetryableStatus) {
+			s.HealthChecker.ObserveError(p, err)
+			if !errors.Is(err, context.Canceled) {
+				s.Versions.Observe(p, req, 0)
+			}
+		}
+		if attemptFromContext(req.Context()).retryError(err) {
+			// Nothing is written, the request will be retried on another backend.
+			return
+		}
+		s.Echo.Logger.Errorf("proxy %s to %s failed: %v", req.URL.Path, p.Name, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return p
+}
 
-	return s
+// selectProxy select one of the available backends for the request.
+// The excluded backends, e.g. the ones already tried by the request, are selected only if there is no other choice.
+func (s *Server) selectProxy(req *http.Request, excluded map[*ReverseProxy]bool) (*ReverseProxy, error) {
+	p, err := s.ProxySelector.Select(s.candidates(excluded), req)
+	if errors.Is(err, ErrNoReverseProxy) {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	return p, err
+}
+
+// candidates return the backends which can be selected.
+// The cordoned backends and the backends ejected by the health checker are not included.
+// The excluded backends are included only if there is no other choice.
+func (s *Server) candidates(excluded map[*ReverseProxy]bool) []*ReverseProxy {
+	var uncordoned []*ReverseProxy
+	for _, p := range s.currentProxies() {
+		if !p.Service().Cordoned {
+			uncordoned = append(uncordoned, p)
+		}
+	}
+	available := s.HealthChecker.Available(uncordoned)
+	if len(excluded) == 0 {
+		return available
+	}
+	var candidates []*ReverseProxy
+	for _, p := range available {
+		if !excluded[p] {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return available
+	}
+	return candidates
 }
 
 func (s *Server) Start(address string) error {
+	go s.HealthChecker.Run(s.ctx)
+	go s.runReload()
+	go s.Queue.Run(s.ctx)
+	if s.Config.Aggregation.Enabled {
+		go s.Aggregator.Run(s.ctx)
+	}
+	go s.Reconciler.Run(s.ctx)
+	go s.Jobs.Run(s.ctx)
+	go s.Webhooks.Run(s.ctx)
+	go s.ResultCache.Run(s.ctx)
+	go s.Mirror.Run(s.ctx)
+	go s.purgeImages(s.ctx)
+	go s.purgeIdempotencyKeys(s.ctx)
+	go s.purgeSessions(s.ctx)
 	return s.Echo.Start(address)
 }
 
 func (s *Server) Close() error {
+	s.cancel()
+	if err := s.IdempotencyKeysDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.ImagesDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.WebhooksDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.DeadJobsDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.JobsDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.TrafficSplitsDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.MirrorResultsDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.OptionsProfilesDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.ResultCacheDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.BackendHealthDatastore.Close(); err != nil {
+		return err
+	}
+	if err := s.SessionAffinityDatastore.Close(); err != nil {
+		return err
+	}
 	return s.TaskProgressDatastore.Close()
 }
 
 func (s *Server) progressHandler(c echo.Context) error {
 	req := c.Request()
-	proxy, err := s.ProxySelector.Select(s.Proxies, req)
+	proxy, err := s.selectProxy(req, nil)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+const kSessionCookieName = "sd_proxy_session"
+
+// SessionAffinitySelector pins a browser session to one reverse proxy.
+//
+// The gradio web UI assumes a single server: the uploaded files, the /file= assets and the /queue/join websocket
+// must be served by the same backend. The session is identified by the signed session cookie,
+// or the gradio session_hash query parameter if there is no cookie.
+// The session is remapped only when the pinned backend is not in the candidate proxies any more,
+// a queued request of the session waits for its pinned backend if it is busy.
+// Requests without session, e.g. the API calls, are delegated to the fallback selector, which chooses among the free backends.
+// The mapping expires after the session is idle for TTL, it is renewed by the requests of the session.
+type SessionAffinitySelector struct {
+	Fallback  ReverseProxySelector
+	Datastore *datastore.SessionAffinity
+	TTL       time.Duration // the idle time after which the session is purged, 0 keeps the sessions forever
+	secret    []byte
+}
+
+func NewSessionAffinitySelector(fallback ReverseProxySelector, ds *datastore.SessionAffinity, secret []byte) *SessionAffinitySelector {
+	return &SessionAffinitySelector{
+		Fallback:  fallback,
+		Datastore: ds,
+		secret:    secret,
+	}
+}
+
+func (s *SessionAffinitySelector) Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+	sessionId := s.sessionId(req)
+	if sessionId == "" {
+		return s.fallback(proxies, req)
+	}
+
+	session, err := s.Datastore.LookupSession(sessionId)
+	if err != nil {
+		return nil, fmt.Errorf("get session %s failed: %v", sessionId, err)
+	}
+	expected := ""
+	if session != nil {
+		expected = session.ServiceName
+		if p := findByName(proxies, session.ServiceName); p != nil {
+			s.renew(sessionId, session)
+			return p, nil
+		}
+	}
+
+	// The session is new or the pinned backend has been ejected, (re)map it.
+	p, err := s.fallback(proxies, req)
+	if err != nil {
+		return nil, err
+	}
+	name, err := s.Datastore.PinSession(sessionId, p.Name, expected, s.expiresAt())
+	if err != nil {
+		return nil, fmt.Errorf("put session %s failed: %v", sessionId, err)
+	}
+	// Another replica may have (re)mapped the session at the same time, follow its mapping.
+	if pinned := findByName(proxies, name); pinned != nil {
+		return pinned, nil
+	}
+	return p, nil
+}
+
+func findByName(proxies []*ReverseProxy, name string) *ReverseProxy {
+	for _, p := range proxies {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *SessionAffinitySelector) expiresAt() int64 {
+	if s.TTL <= 0 {
+		return 0
+	}
+	return time.Now().Add(s.TTL).UnixMilli()
+}
+
+// renew extend the expiry of the session once half of its TTL has passed, so that not every request writes it.
+func (s *SessionAffinitySelector) renew(sessionId string, session *datastore.Session) {
+	if s.TTL <= 0 || session.ExpiresAt > time.Now().Add(s.TTL/2).UnixMilli() {
+		return
+	}
+	// The renewal is best effort, the next request of the session retries it before the session expires.
+	s.Datastore.RenewSession(sessionId, session.ServiceName, s.expiresAt())
+}
+
+// purgeSessions remove the idle sessions periodically.
+func (s *Server) purgeSessions(ctx context.Context) {
+	if s.Config.SessionTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.SessionAffinityDatastore.PurgeExpiredSessions(time.Now().UnixMilli()); err != nil {
+			s.Echo.Logger.Errorf("purge expired sessions failed: %v", err)
+		}
+	}
+}
+
+// fallback select among the proxies which have a free slot for the request.
+func (s *SessionAffinitySelector) fallback(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+	free := freeProxies(proxies, req)
+	if len(free) == 0 {
+		return nil, ErrNoReverseProxy
+	}
+	return s.Fallback.Select(free, req)
+}
+
+// sessionId return the session id of the request, or empty string if the request does not belong to any session.
+func (s *SessionAffinitySelector) sessionId(req *http.Request) string {
+	if cookie, err := req.Cookie(kSessionCookieName); err == nil {
+		if id, ok := s.verify(cookie.Value); ok {
+			return id
+		}
+	}
+	if hash := req.URL.Query().Get("session_hash"); hash != "" {
+		return "gradio-" + hash
+	}
+	return ""
+}
+
+// Middleware issue the session cookie to the browser page loads which do not carry a valid one yet.
+// The cookie is also added to the current request, so that the page itself is served by the pinned backend.
+func (s *SessionAffinitySelector) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method != http.MethodGet || !strings.Contains(req.Header.Get("Accept"), "text/html") {
+			return next(c)
+		}
+		if cookie, err := req.Cookie(kSessionCookieName); err == nil {
+			if _, ok := s.verify(cookie.Value); ok {
+				return next(c)
+			}
+		}
+
+		id, err := randomId()
+		if err != nil {
+			return err
+		}
+		cookie := &http.Cookie{
+			Name:     kSessionCookieName,
+			Value:    s.sign(id),
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		}
+		c.SetCookie(cookie)
+		req.AddCookie(cookie)
+		return next(c)
+	}
+}
+
+func (s *SessionAffinitySelector) sign(id string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *SessionAffinitySelector) verify(value string) (string, bool) {
+	id, _, found := strings.Cut(value, ".")
+	if !found || id == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(value), []byte(s.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// randomId return a random hex string, which is used as the session id.
+func randomId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
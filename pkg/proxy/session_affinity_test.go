@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionAffinitySelector(t *testing.T) {
+	ds, err := datastore.NewSessionAffinity(datastore.SQLite, ":memory:")
+	require.NoError(t, err)
+	defer ds.Close()
+
+	proxies := []*ReverseProxy{{Name: "s0"}, {Name: "s1"}, {Name: "s2"}}
+	selector := NewSessionAffinitySelector(NewRoundRobinReverseProxySelector(), ds, []byte("secret"))
+	cookie := &http.Cookie{Name: kSessionCookieName, Value: selector.sign("session1")}
+
+	t.Run("Test session is pinned", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/file=foo.png", nil)
+		req.AddCookie(cookie)
+		first, err := selector.Select(proxies, req)
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			p, err := selector.Select(proxies, req)
+			require.NoError(t, err)
+			require.Equal(t, first.Name, p.Name)
+		}
+	})
+
+	t.Run("Test session is remapped after the backend is ejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/queue/join", nil)
+		req.AddCookie(cookie)
+		pinned, err := selector.Select(proxies, req)
+		require.NoError(t, err)
+
+		var rest []*ReverseProxy
+		for _, p := range proxies {
+			if p != pinned {
+				rest = append(rest, p)
+			}
+		}
+		remapped, err := selector.Select(rest, req)
+		require.NoError(t, err)
+		require.NotEqual(t, pinned.Name, remapped.Name)
+
+		// The new mapping is persisted and survives re-admission of the old backend.
+		p, err := selector.Select(proxies, req)
+		require.NoError(t, err)
+		require.Equal(t, remapped.Name, p.Name)
+	})
+
+	t.Run("Test the concurrent mapping of another replica is kept", func(t *testing.T) {
+		// Another replica pins the new session to s2 while this one selects s0 for it.
+		racing := NewSessionAffinitySelector(selectorFunc(func(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+			_, err := ds.PinSession("gradio-race", "s2", "", 0)
+			require.NoError(t, err)
+			return proxies[0], nil
+		}), ds, []byte("secret"))
+		req := httptest.NewRequest(http.MethodGet, "/queue/join?session_hash=race", nil)
+		p, err := racing.Select(proxies, req)
+		require.NoError(t, err)
+		require.Equal(t, "s2", p.Name)
+		service, err := ds.GetSession("gradio-race")
+		require.NoError(t, err)
+		require.Equal(t, "s2", service)
+	})
+
+	t.Run("Test session expires unless it is renewed", func(t *testing.T) {
+		selector.TTL = time.Hour
+		defer func() { selector.TTL = 0 }()
+		req := httptest.NewRequest(http.MethodGet, "/queue/join?session_hash=ttl", nil)
+		_, err := selector.Select(proxies, req)
+		require.NoError(t, err)
+		session, err := ds.LookupSession("gradio-ttl")
+		require.NoError(t, err)
+		require.InDelta(t, time.Now().Add(time.Hour).UnixMilli(), session.ExpiresAt, float64(time.Minute.Milliseconds()))
+
+		// The session is renewed once half of its TTL has passed.
+		require.NoError(t, ds.RenewSession("gradio-ttl", session.ServiceName, time.Now().Add(time.Minute).UnixMilli()))
+		_, err = selector.Select(proxies, req)
+		require.NoError(t, err)
+		renewed, err := ds.LookupSession("gradio-ttl")
+		require.NoError(t, err)
+		require.Greater(t, renewed.ExpiresAt, time.Now().Add(30*time.Minute).UnixMilli())
+
+		n, err := ds.PurgeExpiredSessions(renewed.ExpiresAt)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+		service, err := ds.GetSession("gradio-ttl")
+		require.NoError(t, err)
+		require.Equal(t, "", service)
+	})
+
+	t.Run("Test forged cookie is ignored", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: kSessionCookieName, Value: "session1.forged"})
+		require.Equal(t, "", selector.sessionId(req))
+
+		req = httptest.NewRequest(http.MethodGet, "/queue/join?session_hash=abc", nil)
+		require.Equal(t, "gradio-abc", selector.sessionId(req))
+	})
+}
+
+// selectorFunc adapt a function to the ReverseProxySelector.
+type selectorFunc func(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error)
+
+func (f selectorFunc) Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+	return f(proxies, req)
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+// TaskEventsConfig is the configuration of the task progress event streams.
+type TaskEventsConfig struct {
+	PollInterval time.Duration // the interval to read the progress of a watched task from the datastore
+	Heartbeat    time.Duration // the interval of the keep-alive comments while the progress does not change
+	Timeout      time.Duration // the max duration of one stream, the client resumes it with Last-Event-ID
+}
+
+// TaskEvents streams the task progress written by the agents as Server-Sent Events.
+// All the streams of a task on this replica share one poller, so the datastore is read
+// once per poll interval for each watched task, however many clients watch it.
+type TaskEvents struct {
+	Config    *TaskEventsConfig
+	Datastore *datastore.TaskProgress
+	server    *Server
+	mutex     sync.Mutex
+	watches   map[string]*taskWatch
+}
+
+func NewTaskEvents(cfg *TaskEventsConfig, ds *datastore.TaskProgress, s *Server) *TaskEvents {
+	return &TaskEvents{
+		Config:    cfg,
+		Datastore: ds,
+		server:    s,
+		watches:   make(map[string]*taskWatch),
+	}
+}
+
+// taskWatch is the latest progress of a watched task.
+type taskWatch struct {
+	subscribers int
+	state       *datastore.TaskProgressState // guarded by the mutex of TaskEvents
+	changed     chan struct{}                // closed and replaced when the state changes
+	done        chan struct{}                // closed when there is no subscriber
+}
+
+func (te *TaskEvents) subscribe(id string) *taskWatch {
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
+	w, ok := te.watches[id]
+	if !ok {
+		w = &taskWatch{
+			changed: make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		te.watches[id] = w
+		go te.poll(id, w)
+	}
+	w.subscribers++
+	return w
+}
+
+func (te *TaskEvents) unsubscribe(id string, w *taskWatch) {
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
+	if w.subscribers--; w.subscribers == 0 {
+		delete(te.watches, id)
+		close(w.done)
+	}
+}
+
+// latest return the latest state, and the channel closed on the next change.
+func (te *TaskEvents) latest(w *taskWatch) (*datastore.TaskProgressState, chan struct{}) {
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
+	return w.state, w.changed
+}
+
+// poll read the progress of the task until it is done or nobody watches it.
+func (te *TaskEvents) poll(id string, w *taskWatch) {
+	ticker := time.NewTicker(te.Config.PollInterval)
+	defer ticker.Stop()
+	for {
+		state, err := te.Datastore.GetProgressState(id)
+		if err != nil {
+			te.server.Echo.Logger.Errorf("get progress of task %s failed: %v", id, err)
+		} else if state != nil {
+			te.mutex.Lock()
+			if w.state == nil || state.Revision != w.state.Revision {
+				w.state = state
+				close(w.changed)
+				w.changed = make(chan struct{})
+			}
+			te.mutex.Unlock()
+			if state.Done() {
+				return
+			}
+		}
+		select {
+		case <-w.done:
+			return
+		case <-te.server.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// taskProgress is the response of the backend /internal/progress.
+type taskProgress struct {
+	Active        bool     `json:"active"`
+	Queued        bool     `json:"queued"`
+	Progress      *float64 `json:"progress"`
+	Eta           *float64 `json:"eta"`
+	LivePreview   *string  `json:"live_preview"`
+	IdLivePreview int64    `json:"id_live_preview"`
+	TextInfo      *string  `json:"textinfo"`
+}
+
+// sseEvent is one event of the stream.
+type sseEvent struct {
+	name string
+	data interface{}
+}
+
+// taskEvents return the events of the new state compared to the previous progress, and update the previous progress.
+func taskEvents(prev *taskProgress, state *datastore.TaskProgressState) []sseEvent {
+	cur := taskProgress{IdLivePreview: -1}
+	// The progress may be empty or invalid, e.g. the task failed before any progress, send the state only.
+	_ = json.Unmarshal([]byte(state.Progress), &cur)
+	var events []sseEvent
+	events = append(events, sseEvent{"progress", map[string]interface{}{
+		"active":   cur.Active,
+		"queued":   cur.Queued,
+		"progress": cur.Progress,
+		"eta":      cur.Eta,
+	}})
+	if cur.TextInfo != nil && (prev.TextInfo == nil || *cur.TextInfo != *prev.TextInfo) {
+		events = append(events, sseEvent{"textinfo", map[string]interface{}{"textinfo": *cur.TextInfo}})
+	}
+	if cur.LivePreview != nil && cur.IdLivePreview != prev.IdLivePreview {
+		// The preview image is not sent in the stream, the client fetches it with /internal/progress.
+		events = append(events, sseEvent{"preview", map[string]interface{}{"id_live_preview": cur.IdLivePreview}})
+	}
+	if state.Done() {
+		events = append(events, sseEvent{state.State, json.RawMessage(nonEmptyJSON(state.Progress))})
+	}
+	*prev = cur
+	return events
+}
+
+func nonEmptyJSON(s string) string {
+	if !json.Valid([]byte(s)) {
+		return "{}"
+	}
+	return s
+}
+
+// eventsHandler stream the progress of the task until it is completed, failed or cancelled.
+// The id of the events is the revision of the progress, the events up to the Last-Event-ID are not sent again.
+// The task without the progress is streamed only if it is a pending job, which has not started yet.
+func (te *TaskEvents) eventsHandler(c echo.Context) error {
+	id := c.Param("id")
+	var last int64
+	lastEventId := c.Request().Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = c.QueryParam("last_event_id")
+	}
+	if lastEventId != "" {
+		var err error
+		if last, err = strconv.ParseInt(lastEventId, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid Last-Event-ID")
+		}
+	}
+
+	state, err := te.Datastore.GetProgressState(id)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		job, err := te.server.JobsDatastore.GetJob(id)
+		if err != nil {
+			return err
+		}
+		if job == nil || job.Done() {
+			return echo.NewHTTPError(http.StatusNotFound, "task does not exist")
+		}
+	}
+	if state != nil && state.Done() && state.Revision <= last {
+		// The client has got the terminal event, 204 tells the EventSource not to reconnect.
+		return c.NoContent(http.StatusNoContent)
+	}
+	w := te.subscribe(id)
+	defer te.unsubscribe(id, w)
+	latest, changed := te.latest(w)
+	if latest != nil {
+		state = latest
+	}
+
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("X-Accel-Buffering", "no")
+	resp.WriteHeader(http.StatusOK)
+	resp.Flush()
+
+	heartbeat := time.NewTicker(te.Config.Heartbeat)
+	defer heartbeat.Stop()
+	timeout := time.NewTimer(te.Config.Timeout)
+	defer timeout.Stop()
+	prev := taskProgress{IdLivePreview: -1}
+	for {
+		if state != nil && state.Revision > last {
+			for _, e := range taskEvents(&prev, state) {
+				data, err := json.Marshal(e.data)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(resp, "id: %d\nevent: %s\ndata: %s\n\n", state.Revision, e.name, data); err != nil {
+					return nil
+				}
+			}
+			resp.Flush()
+			last = state.Revision
+			if state.Done() {
+				return nil
+			}
+		}
+		select {
+		case <-changed:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(resp, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			resp.Flush()
+		case <-timeout.C:
+			return nil
+		case <-c.Request().Context().Done():
+			return nil
+		}
+		state, changed = te.latest(w)
+	}
+}
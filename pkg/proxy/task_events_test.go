@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+type testEvent struct {
+	id, name, data string
+}
+
+// readEvents read the events of the stream until it ends.
+func readEvents(t *testing.T, resp *http.Response) []testEvent {
+	var events []testEvent
+	var e testEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if e.name != "" {
+				events = append(events, e)
+			}
+			e = testEvent{}
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return events
+}
+
+func TestTaskEvents(t *testing.T) {
+	config := DefaultConfig()
+	config.TaskEvents.PollInterval = 5 * time.Millisecond
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+	server := httptest.NewServer(s.Echo)
+	defer server.Close()
+
+	stream := func(id string, lastEventId string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/tasks/"+id+"/events", nil)
+		require.NoError(t, err)
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Test stream the progress until completed", func(t *testing.T) {
+		// The job has not started yet.
+		require.NoError(t, s.JobsDatastore.PutJob(&datastore.Job{Id: "task1", Status: datastore.JobQueued}))
+		resp := stream("task1", "")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		updates := []struct{ progress, state string }{
+			{`{"active": true, "queued": false, "progress": 0.2, "eta": 8, "textinfo": "Step 1", "live_preview": null, "id_live_preview": -1}`, datastore.TaskRunning},
+			{`{"active": true, "queued": false, "progress": 0.6, "eta": 4, "textinfo": "Step 3", "live_preview": "data:image/png;base64,", "id_live_preview": 1}`, datastore.TaskRunning},
+			{`{"active": false, "queued": false, "completed": true, "progress": null, "eta": null, "textinfo": "Step 3", "live_preview": null, "id_live_preview": 1}`, datastore.TaskCompleted},
+		}
+		go func() {
+			for _, u := range updates {
+				require.NoError(t, s.TaskProgressDatastore.PutProgressState("task1", u.progress, u.state))
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+
+		events := readEvents(t, resp)
+		var names []string
+		for _, e := range events {
+			names = append(names, e.name)
+		}
+		require.Equal(t, []string{"progress", "textinfo", "progress", "textinfo", "preview", "progress", "completed"}, names)
+		require.JSONEq(t, `{"active": true, "queued": false, "progress": 0.2, "eta": 8}`, events[0].data)
+		require.JSONEq(t, `{"id_live_preview": 1}`, events[4].data)
+		require.NotEqual(t, events[0].id, events[2].id)
+
+		// Resume after the second update, the snapshot of the latest progress is sent.
+		resp = stream("task1", events[2].id)
+		defer resp.Body.Close()
+		resumed := readEvents(t, resp)
+		require.Len(t, resumed, 3)
+		require.Equal(t, events[6], resumed[2])
+
+		// The stream has ended.
+		resp = stream("task1", events[6].id)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
+	t.Run("Test failed task", func(t *testing.T) {
+		require.NoError(t, s.TaskProgressDatastore.PutProgressState("task2", "", datastore.TaskFailed))
+		resp := stream("task2", "")
+		defer resp.Body.Close()
+		events := readEvents(t, resp)
+		require.Len(t, events, 2)
+		require.Equal(t, "failed", events[1].name)
+		require.Equal(t, "{}", events[1].data)
+	})
+
+	t.Run("Test unknown task", func(t *testing.T) {
+		resp := stream("task3", "")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		// The finished job has no progress to stream.
+		require.NoError(t, s.JobsDatastore.PutJob(&datastore.Job{Id: "task4", Status: datastore.JobSucceeded}))
+		resp = stream("task4", "")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
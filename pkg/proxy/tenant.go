@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const kAPIKeyHeaderName = "X-API-Key"
+const kPriorityHeaderName = "X-Priority"
+
+// APIKey is the identity of an API caller.
+type APIKey struct {
+	Tenant string `json:"tenant"`
+	Class  string `json:"class"` // the highest priority class the caller can use, the default class if it is empty
+}
+
+// identity is the tenant and the priority class of a request.
+type identity struct {
+	Tenant string
+	Class  string
+}
+
+// identify resolve the tenant and the priority class of the request.
+// The tenant is resolved by the API key, or the client IP for the anonymous callers.
+// The caller can request a lower priority class with the X-Priority header, but never a higher one than its API key allows.
+func (s *Server) identify(c echo.Context) identity {
+	req := c.Request()
+	if call := internalFromContext(req.Context()); call != nil {
+		return call.who
+	}
+	id := identity{
+		Tenant: "anonymous/" + c.RealIP(),
+		Class:  s.Config.Queue.DefaultClass,
+	}
+	key := req.Header.Get(kAPIKeyHeaderName)
+	if key == "" {
+		key, _ = strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer ")
+	}
+	if apiKey, ok := s.Config.APIKeys[key]; ok && key != "" {
+		id.Tenant = apiKey.Tenant
+		if apiKey.Class != "" {
+			id.Class = apiKey.Class
+		}
+	}
+	weights := s.Config.Queue.ClassWeights
+	if requested := req.Header.Get(kPriorityHeaderName); requested != "" {
+		if w, ok := weights[requested]; ok && w <= weights[id.Class] {
+			id.Class = requested
+		}
+	}
+	return id
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentify(t *testing.T) {
+	config := DefaultConfig()
+	config.APIKeys = map[string]APIKey{
+		"key1": {Tenant: "tenant1", Class: "interactive"},
+		"key2": {Tenant: "tenant2"},
+	}
+	s := &Server{Echo: echo.New(), Config: config}
+	identify := func(header http.Header) identity {
+		req := httptest.NewRequest(http.MethodPost, "/sdapi/v1/txt2img", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		return s.identify(s.Echo.NewContext(req, httptest.NewRecorder()))
+	}
+
+	require.Equal(t, identity{Tenant: "anonymous/10.0.0.1", Class: "api"}, identify(nil))
+	require.Equal(t, identity{Tenant: "tenant1", Class: "interactive"}, identify(http.Header{"X-Api-Key": {"key1"}}))
+	require.Equal(t, identity{Tenant: "tenant2", Class: "api"}, identify(http.Header{"Authorization": {"Bearer key2"}}))
+
+	// The caller can lower its priority, but can not raise it.
+	require.Equal(t, identity{Tenant: "tenant1", Class: "batch"}, identify(http.Header{"X-Api-Key": {"key1"}, "X-Priority": {"batch"}}))
+	require.Equal(t, identity{Tenant: "tenant2", Class: "api"}, identify(http.Header{"X-Api-Key": {"key2"}, "X-Priority": {"interactive"}}))
+	require.Equal(t, identity{Tenant: "anonymous/10.0.0.1", Class: "api"}, identify(http.Header{"X-Api-Key": {"unknown"}}))
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+const kVersionHeaderName = "X-SD-Version"
+
+// kLatencySamples is the number of the latest latencies kept for the percentiles of a version.
+const kLatencySamples = 512
+
+type startKey struct{}
+
+// Versions splits the traffic of each pool between the backend versions by the percentages in the datastore,
+// and keeps the error and latency stats of each version, so that a canary can be promoted or rolled back.
+type Versions struct {
+	Datastore *datastore.TrafficSplits
+	splits    atomic.Pointer[map[string]*datastore.TrafficSplit] // the pool to its split, loaded by the reloads
+	mutex     sync.Mutex
+	stats     map[string]*versionStats
+}
+
+func NewVersions(ds *datastore.TrafficSplits) *Versions {
+	v := &Versions{
+		Datastore: ds,
+		stats:     make(map[string]*versionStats),
+	}
+	v.splits.Store(&map[string]*datastore.TrafficSplit{})
+	return v
+}
+
+// Load reload the traffic splits from the datastore.
+func (v *Versions) Load() error {
+	splits, err := v.Datastore.ListAllSplits()
+	if err != nil {
+		return fmt.Errorf("list traffic splits failed: %v", err)
+	}
+	m := make(map[string]*datastore.TrafficSplit, len(splits))
+	for i := range splits {
+		m[splits[i].Pool] = &splits[i]
+	}
+	v.splits.Store(&m)
+	return nil
+}
+
+func (v *Versions) split(pool string) *datastore.TrafficSplit {
+	return (*v.splits.Load())[pool]
+}
+
+// VersionSelector restricts the request to the backends of one version, which is pinned by the X-SD-Version header,
+// or chosen randomly by the traffic split of the pool. When a pool has a split, the backends of the versions
+// not in the split do not receive the traffic unless they are pinned, but if none of the versions in the split
+// has a candidate, all the candidates are kept. It is the fallback of the session affinity, so that the requests
+// of a browser session stay on the backend pinned by the first split.
+type VersionSelector struct {
+	Next     ReverseProxySelector
+	Versions *Versions
+}
+
+func NewVersionSelector(next ReverseProxySelector, versions *Versions) *VersionSelector {
+	return &VersionSelector{
+		Next:     next,
+		Versions: versions,
+	}
+}
+
+func (s *VersionSelector) Select(proxies []*ReverseProxy, req *http.Request) (*ReverseProxy, error) {
+	if pinned := req.Header.Get(kVersionHeaderName); pinned != "" {
+		members := versionMembers(proxies, pinned)
+		if len(members) == 0 {
+			return nil, ErrNoReverseProxy
+		}
+		return s.Next.Select(members, req)
+	}
+	pool := requestPool(req)
+	if pool == "" {
+		pool = kDefaultPool
+	}
+	split := s.Versions.split(pool)
+	if split == nil {
+		return s.Next.Select(proxies, req)
+	}
+
+	// Choose among the versions which have candidates, in proportion to their weights.
+	var versions []string
+	var total float64
+	for version, w := range split.Weights {
+		if w > 0 && len(versionMembers(proxies, version)) > 0 {
+			versions = append(versions, version)
+			total += w
+		}
+	}
+	if len(versions) == 0 {
+		return s.Next.Select(proxies, req)
+	}
+	sort.Strings(versions)
+	r := rand.Float64() * total
+	chosen := versions[len(versions)-1]
+	for _, version := range versions {
+		if r -= split.Weights[version]; r < 0 {
+			chosen = version
+			break
+		}
+	}
+	return s.Next.Select(versionMembers(proxies, chosen), req)
+}
+
+func versionMembers(proxies []*ReverseProxy, version string) []*ReverseProxy {
+	var members []*ReverseProxy
+	for _, p := range proxies {
+		if p.Service().Version == version {
+			members = append(members, p)
+		}
+	}
+	return members
+}
+
+// versionStats is the error and latency stats of a version since the last change of the split.
+type versionStats struct {
+	Requests  int64 `json:"requests"`
+	Errors    int64 `json:"errors"` // the 5xx responses and the proxy errors
+	latencies []time.Duration
+	next      int
+}
+
+func (st *versionStats) add(latency time.Duration) {
+	if len(st.latencies) < kLatencySamples {
+		st.latencies = append(st.latencies, latency)
+		return
+	}
+	st.latencies[st.next] = latency
+	st.next = (st.next + 1) % kLatencySamples
+}
+
+// versionStatsView is the stats of a version with the latency percentiles of the latest requests.
+type versionStatsView struct {
+	Requests  int64   `json:"requests"`
+	Errors    int64   `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	P50Ms     int64   `json:"p50_ms"`
+	P95Ms     int64   `json:"p95_ms"`
+	MaxMs     int64   `json:"max_ms"`
+}
+
+func (st *versionStats) view() *versionStatsView {
+	view := &versionStatsView{Requests: st.Requests, Errors: st.Errors}
+	if st.Requests > 0 {
+		view.ErrorRate = float64(st.Errors) / float64(st.Requests)
+	}
+	if len(st.latencies) > 0 {
+		sorted := append([]time.Duration(nil), st.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		percentile := func(p float64) int64 {
+			return sorted[int(p*float64(len(sorted)-1))].Milliseconds()
+		}
+		view.P50Ms = percentile(0.5)
+		view.P95Ms = percentile(0.95)
+		view.MaxMs = sorted[len(sorted)-1].Milliseconds()
+	}
+	return view
+}
+
+// Observe record the result of the request to the backend. The code is 0 if the request failed without response.
+func (v *Versions) Observe(p *ReverseProxy, req *http.Request, code int) {
+	start, ok := req.Context().Value(startKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	version := p.Service().Version
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	st, ok := v.stats[version]
+	if !ok {
+		st = &versionStats{}
+		v.stats[version] = st
+	}
+	st.Requests++
+	if code == 0 || code >= http.StatusInternalServerError {
+		st.Errors++
+	}
+	st.add(time.Since(start))
+}
+
+func (v *Versions) resetStats() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.stats = make(map[string]*versionStats)
+}
+
+// withStart record the start time of the backend request in its context, for the latency stats.
+func withStart(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), startKey{}, time.Now()))
+}
+
+// versionView is a version with its backends and stats.
+type versionView struct {
+	Backends []string          `json:"backends"`
+	Stats    *versionStatsView `json:"stats"`
+}
+
+func (s *Server) listVersionsHandler(c echo.Context) error {
+	views := make(map[string]*versionView)
+	view := func(version string) *versionView {
+		if _, ok := views[version]; !ok {
+			views[version] = &versionView{Backends: []string{}, Stats: &versionStatsView{}}
+		}
+		return views[version]
+	}
+	for _, p := range s.currentProxies() {
+		vv := view(p.Service().Version)
+		vv.Backends = append(vv.Backends, p.Name)
+	}
+	s.Versions.mutex.Lock()
+	for version, st := range s.Versions.stats {
+		view(version).Stats = st.view()
+	}
+	s.Versions.mutex.Unlock()
+
+	var splits []*datastore.TrafficSplit
+	for _, split := range *s.Versions.splits.Load() {
+		splits = append(splits, split)
+	}
+	sort.Slice(splits, func(i, j int) bool { return splits[i].Pool < splits[j].Pool })
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"splits":   splits,
+		"versions": views,
+	})
+}
+
+// putSplitHandler set the traffic split of the pool, e.g. {"weights": {"v1": 90, "v2": 10}}.
+func (s *Server) putSplitHandler(c echo.Context) error {
+	var body struct {
+		Weights map[string]float64 `json:"weights"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	return s.updateSplit(c, c.Param("pool"), body.Weights)
+}
+
+// promoteVersionHandler send all the traffic of the pool to the version.
+func (s *Server) promoteVersionHandler(c echo.Context) error {
+	return s.updateSplit(c, poolParam(c), map[string]float64{c.Param("version"): 100})
+}
+
+// rollbackSplitHandler restore the traffic split of the pool before the last update.
+func (s *Server) rollbackSplitHandler(c echo.Context) error {
+	pool := poolParam(c)
+	split, err := s.Versions.Datastore.GetSplit(pool)
+	if err != nil {
+		return err
+	}
+	if split == nil || len(split.PreviousWeights) == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "no previous traffic split to roll back to")
+	}
+	return s.updateSplit(c, pool, split.PreviousWeights)
+}
+
+func (s *Server) deleteSplitHandler(c echo.Context) error {
+	if err := s.Versions.Datastore.DeleteSplit(c.Param("pool")); err != nil {
+		return err
+	}
+	if err := s.Versions.Load(); err != nil {
+		return err
+	}
+	s.Versions.resetStats()
+	return c.NoContent(http.StatusNoContent)
+}
+
+func poolParam(c echo.Context) string {
+	if pool := c.QueryParam("pool"); pool != "" {
+		return pool
+	}
+	return kDefaultPool
+}
+
+// updateSplit persist the split and apply it to this proxy at once, the stats are reset to compare the versions afresh.
+// The other proxy replicas apply it on their next reload.
+func (s *Server) updateSplit(c echo.Context, pool string, weights map[string]float64) error {
+	var total float64
+	for version, w := range weights {
+		if w < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("weight of version %s cannot be negative", version))
+		}
+		total += w
+	}
+	if total <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "weights are required")
+	}
+	split := &datastore.TrafficSplit{Pool: pool, Weights: weights}
+	existing, err := s.Versions.Datastore.GetSplit(pool)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		split.PreviousWeights = existing.Weights
+	}
+	split.UpdatedAt = time.Now().UnixMilli()
+	if err := s.Versions.Datastore.PutSplit(split); err != nil {
+		return err
+	}
+	if err := s.Versions.Load(); err != nil {
+		return err
+	}
+	s.Versions.resetStats()
+	s.Echo.Logger.Infof("traffic split of pool %s is updated: %v", pool, weights)
+	return c.JSON(http.StatusOK, split)
+}
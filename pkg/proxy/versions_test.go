@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersions(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "secret"
+	config.Retry.MaxRetries = 0
+	// v2 always fails, do not eject it.
+	config.HealthCheck.PassiveThreshold = 0
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+
+	for _, srv := range []struct{ name, version string }{{"s0", "v1"}, {"s1", "v1"}, {"s2", "v2"}} {
+		name := srv.name
+		status := http.StatusOK
+		if srv.version == "v2" {
+			status = http.StatusInternalServerError
+		}
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(name))
+		}))
+		defer backend.Close()
+		require.NoError(t, s.SDServicesDatastore.PutService(&datastore.SDServiceEndpoint{Name: srv.name, Endpoint: backend.URL, Version: srv.version}))
+	}
+	require.NoError(t, s.Reload())
+
+	generate := func(version string) string {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/sdapi/v1/samplers", nil)
+		if version != "" {
+			req.Header.Set(kVersionHeaderName, version)
+		}
+		s.Echo.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	admin := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", "application/json")
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	count := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			counts[generate("")]++
+		}
+		return counts
+	}
+
+	t.Run("Test pin version by header", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			require.Equal(t, "s2", generate("v2"))
+		}
+		require.Contains(t, generate("v3"), "no available backend")
+	})
+
+	t.Run("Test traffic split by percentage", func(t *testing.T) {
+		rec := admin(http.MethodPut, "/admin/versions/splits/default", `{"weights": {"v1": 100}}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		counts := count(20)
+		require.Equal(t, 0, counts["s2"])
+
+		rec = admin(http.MethodPut, "/admin/versions/splits/default", `{"weights": {"v1": 50, "v2": 50}}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		counts = count(400)
+		require.InDelta(t, 200, counts["s2"], 60)
+		require.InDelta(t, 200, counts["s0"]+counts["s1"], 60)
+	})
+
+	t.Run("Test per-version stats", func(t *testing.T) {
+		rec := admin(http.MethodGet, "/admin/versions", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var result struct {
+			Splits   []datastore.TrafficSplit `json:"splits"`
+			Versions map[string]struct {
+				Backends []string         `json:"backends"`
+				Stats    versionStatsView `json:"stats"`
+			} `json:"versions"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+		require.Equal(t, []string{"s0", "s1"}, result.Versions["v1"].Backends)
+		v1, v2 := result.Versions["v1"].Stats, result.Versions["v2"].Stats
+		require.Equal(t, int64(400), v1.Requests+v2.Requests)
+		require.Equal(t, int64(0), v1.Errors)
+		require.Equal(t, v2.Requests, v2.Errors)
+		require.Equal(t, 1.0, v2.ErrorRate)
+	})
+
+	t.Run("Test promote and rollback", func(t *testing.T) {
+		rec := admin(http.MethodPost, "/admin/versions/v2/promote", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, map[string]int{"s2": 10}, count(10))
+
+		rec = admin(http.MethodPost, "/admin/versions/rollback", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		split, err := s.TrafficSplitsDatastore.GetSplit(kDefaultPool)
+		require.NoError(t, err)
+		require.Equal(t, map[string]float64{"v1": 50, "v2": 50}, split.Weights)
+	})
+
+	t.Run("Test session stays on its backend while a split is active", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", "text/html")
+		s.Echo.ServeHTTP(rec, req)
+		cookies := rec.Result().Cookies()
+		require.Len(t, cookies, 1)
+		pinned := rec.Body.String()
+
+		for i := 0; i < 20; i++ {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/file=upload.png", nil)
+			req.AddCookie(cookies[0])
+			s.Echo.ServeHTTP(rec, req)
+			require.Equal(t, pinned, rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/labstack/echo/v4"
+)
+
+const kWebhookIdHeaderName = "X-SD-Webhook-Id"
+const kWebhookTimestampHeaderName = "X-SD-Webhook-Timestamp"
+const kWebhookSignatureHeaderName = "X-SD-Webhook-Signature"
+
+// WebhooksConfig is the configuration of the completion webhooks.
+type WebhooksConfig struct {
+	Secrets       map[string]string // the tenant to the secret to sign its webhooks
+	DefaultSecret string            // the secret to sign the webhooks of the tenants not in Secrets, the callback_url is rejected for them if empty
+	AllowPrivate  bool              // allow the callback urls to reach the loopback, private and link-local addresses, e.g. for the internal receivers
+	Timeout       time.Duration     // the timeout of one delivery attempt
+	MaxAttempts   int64             // the delivery fails after the attempts
+	BackoffBase   time.Duration     // the backoff after the n-th failed attempt is a random duration in [0, BackoffBase * 2^(n-1)]
+	BackoffMax    time.Duration     // the upper bound of the backoff
+	Interval      time.Duration     // the interval to scan the retry queue for the due deliveries
+	Retention     time.Duration     // the finished deliveries are purged after the time, 0 keeps them forever
+	BaseUrl       string            // the public url of the proxy in the job urls of the events, the urls are relative if it is empty
+}
+
+// secret return the secret to sign the webhooks of the tenant, or "" if they can not be signed.
+func (cfg *WebhooksConfig) secret(tenant string) string {
+	if secret := cfg.Secrets[tenant]; secret != "" {
+		return secret
+	}
+	return cfg.DefaultSecret
+}
+
+// validateCallbackUrl check the callback url of the tenant is an absolute http(s) url whose webhooks can be signed.
+// The literal private addresses are rejected here, and the resolved ones are rejected when the webhook is sent.
+func (cfg *WebhooksConfig) validateCallbackUrl(tenant string, s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("callback_url must be an absolute http or https url")
+	}
+	if cfg.secret(tenant) == "" {
+		return fmt.Errorf("callback_url requires a webhook secret for the tenant")
+	}
+	if cfg.AllowPrivate {
+		return nil
+	}
+	if ip := net.ParseIP(u.Hostname()); (ip != nil && privateIP(ip)) || strings.EqualFold(u.Hostname(), "localhost") {
+		return fmt.Errorf("callback_url must not be a private address")
+	}
+	return nil
+}
+
+// privateIP report whether the ip is a loopback, private, link-local, multicast or unspecified address,
+// e.g. 169.254.169.254 of the cloud metadata service.
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// newWebhookClient return the http client to send the webhooks. Unless the private addresses are allowed,
+// it refuses to connect to them after the dns resolution, including through the redirects.
+func newWebhookClient(cfg *WebhooksConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dialer.Control = func(network string, address string, c syscall.RawConn) error {
+		if cfg.AllowPrivate {
+			return nil
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+			return fmt.Errorf("the webhook to the private address %s is refused", host)
+		}
+		return nil
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// signWebhook return the hex HMAC-SHA256 of "<timestamp>.<body>" with the secret.
+// The timestamp is signed to let the receivers reject the replayed events.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookEvent is the payload POSTed to the callback url when a job is finished.
+type webhookEvent struct {
+	Id        string      `json:"id"`   // the delivery id, which is the same for all the attempts
+	Type      string      `json:"type"` // job.succeeded, job.failed, job.cancelled or job.dead
+	CreatedAt int64       `json:"created_at"`
+	Job       *webhookJob `json:"job"`
+}
+
+// webhookJob is the finished job in the event. The result, e.g. the base64 images, is not sent,
+// the receiver gets it from the job url.
+type webhookJob struct {
+	Id     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Url    string `json:"url"`
+}
+
+// Webhooks deliver the job events to the callback urls. The pending deliveries are kept in the datastore,
+// which is both the retry queue shared by the proxy replicas and the delivery log.
+// A delivery may be attempted more than once, e.g. by two replicas, the receivers should dedupe by the event id.
+type Webhooks struct {
+	Config    *WebhooksConfig
+	Datastore *datastore.WebhookDeliveries
+	server    *Server
+	client    *http.Client // the http client to send the webhooks
+	mutex     sync.Mutex
+	inflight  map[string]bool // the deliveries being attempted by this replica
+}
+
+func NewWebhooks(cfg *WebhooksConfig, ds *datastore.WebhookDeliveries, s *Server) *Webhooks {
+	return &Webhooks{
+		Config:    cfg,
+		Datastore: ds,
+		server:    s,
+		client:    newWebhookClient(cfg),
+		inflight:  make(map[string]bool),
+	}
+}
+
+// Enqueue persist the event of the finished job and attempt its first delivery.
+func (w *Webhooks) Enqueue(job *datastore.Job) error {
+	id, err := randomId()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	event := &webhookEvent{
+		Id:        id,
+		Type:      "job." + job.Status,
+		CreatedAt: now,
+		Job: &webhookJob{
+			Id:     job.Id,
+			Status: job.Status,
+			Error:  job.Error,
+			Url:    strings.TrimSuffix(w.Config.BaseUrl, "/") + "/v1/jobs/" + job.Id,
+		},
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	d := &datastore.WebhookDelivery{
+		Id:            id,
+		JobId:         job.Id,
+		Tenant:        job.Tenant,
+		Url:           job.CallbackUrl,
+		EventType:     event.Type,
+		Payload:       string(payload),
+		Status:        datastore.DeliveryPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := w.Datastore.PutDelivery(d); err != nil {
+		return fmt.Errorf("put webhook delivery %s failed: %v", id, err)
+	}
+	go w.attempt(w.server.ctx, id)
+	return nil
+}
+
+// Run attempt the due deliveries periodically, including the ones enqueued by the other replicas which are gone.
+// The finished deliveries are purged after the retention.
+func (w *Webhooks) Run(ctx context.Context) {
+	if w.Config.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.Config.Interval)
+	defer ticker.Stop()
+	purge := time.NewTicker(time.Minute)
+	defer purge.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-purge.C:
+			if n, err := w.Datastore.PurgeExpiredDeliveries(time.Now().UnixMilli()); err != nil {
+				w.server.Echo.Logger.Errorf("purge expired webhook deliveries failed: %v", err)
+			} else if n > 0 {
+				w.server.Echo.Logger.Infof("purge %d expired webhook deliveries", n)
+			}
+			continue
+		case <-ticker.C:
+		}
+		deliveries, err := w.Datastore.ListPendingDeliveries()
+		if err != nil {
+			w.server.Echo.Logger.Errorf("list pending webhook deliveries failed: %v", err)
+			continue
+		}
+		now := time.Now().UnixMilli()
+		for _, d := range deliveries {
+			if d.NextAttemptAt <= now {
+				go w.attempt(ctx, d.Id)
+			}
+		}
+	}
+}
+
+// attempt deliver the event if it is due, and record the result of the attempt.
+func (w *Webhooks) attempt(ctx context.Context, id string) {
+	w.mutex.Lock()
+	if w.inflight[id] {
+		w.mutex.Unlock()
+		return
+	}
+	w.inflight[id] = true
+	w.mutex.Unlock()
+	defer func() {
+		w.mutex.Lock()
+		delete(w.inflight, id)
+		w.mutex.Unlock()
+	}()
+
+	d, err := w.Datastore.GetDelivery(id)
+	if err != nil || d == nil {
+		return
+	}
+	if d.Status != datastore.DeliveryPending || d.NextAttemptAt > time.Now().UnixMilli() {
+		return
+	}
+
+	start := time.Now()
+	code, err := w.send(ctx, d)
+	a := datastore.DeliveryAttempt{
+		At:         start.UnixMilli(),
+		StatusCode: int64(code),
+		LatencyMs:  time.Since(start).Milliseconds(),
+	}
+	if err == nil && (code < http.StatusOK || code >= http.StatusMultipleChoices) {
+		err = fmt.Errorf("callback returns status %d", code)
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	d.Log = append(d.Log, a)
+	d.Attempts++
+	switch {
+	case err == nil:
+		d.Status = datastore.DeliveryDelivered
+	case d.Attempts >= w.Config.MaxAttempts:
+		d.Status = datastore.DeliveryFailed
+		w.server.Echo.Logger.Warnf("webhook %s of job %s failed after %d attempts: %v", id, d.JobId, d.Attempts, err)
+	default:
+		d.NextAttemptAt = time.Now().Add(jitteredBackoff(w.Config.BackoffBase, w.Config.BackoffMax, d.Attempts)).UnixMilli()
+	}
+	d.UpdatedAt = time.Now().UnixMilli()
+	if d.Status != datastore.DeliveryPending && w.Config.Retention > 0 {
+		d.ExpiresAt = time.Now().Add(w.Config.Retention).UnixMilli()
+	}
+	if err := w.Datastore.PutDelivery(d); err != nil {
+		w.server.Echo.Logger.Errorf("put webhook delivery %s failed: %v", id, err)
+	}
+}
+
+// send POST the signed event to the callback url, and return the response status code.
+func (w *Webhooks) send(ctx context.Context, d *datastore.WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.Config.Timeout)
+	defer cancel()
+	body := []byte(d.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	// The secret may be removed after the job is submitted, never send the webhook unsigned.
+	secret := w.Config.secret(d.Tenant)
+	if secret == "" {
+		return 0, fmt.Errorf("no webhook secret for the tenant %q", d.Tenant)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(kWebhookIdHeaderName, d.Id)
+	req.Header.Set(kWebhookTimestampHeaderName, timestamp)
+	req.Header.Set(kWebhookSignatureHeaderName, "sha256="+signWebhook(secret, timestamp, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// listDeliveriesHandler return the delivery log, newest first, filtered by the job_id, tenant and status query parameters.
+func (w *Webhooks) listDeliveriesHandler(c echo.Context) error {
+	ret, err := w.Datastore.ListDeliveries(datastore.DeliveryFilter{
+		JobId:  c.QueryParam("job_id"),
+		Tenant: c.QueryParam("tenant"),
+		Status: c.QueryParam("status"),
+	})
+	if err != nil {
+		return err
+	}
+	if ret == nil {
+		ret = []datastore.WebhookDelivery{}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt > ret[j].CreatedAt })
+	return c.JSON(http.StatusOK, ret)
+}
+
+// getDeliveryHandler return the delivery with its event.
+func (w *Webhooks) getDeliveryHandler(c echo.Context) error {
+	d, err := w.Datastore.GetDelivery(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "webhook delivery does not exist")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"delivery": d,
+		"event":    json.RawMessage(d.Payload),
+	})
+}
+
+// redeliverHandler queue the delivery again with a fresh attempt budget, e.g. after the receiver is fixed.
+func (w *Webhooks) redeliverHandler(c echo.Context) error {
+	d, err := w.Datastore.GetDelivery(c.Param("id"))
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "webhook delivery does not exist")
+	}
+	d.Status = datastore.DeliveryPending
+	d.Attempts = 0
+	d.ExpiresAt = 0
+	d.NextAttemptAt = time.Now().UnixMilli()
+	d.UpdatedAt = d.NextAttemptAt
+	if err := w.Datastore.PutDelivery(d); err != nil {
+		return err
+	}
+	go w.attempt(w.server.ctx, d.Id)
+	return c.JSON(http.StatusAccepted, d)
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hryang/stable-diffusion-webui-proxy/pkg/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhooks(t *testing.T) {
+	config := DefaultConfig()
+	config.AdminToken = "admin"
+	config.APIKeys = map[string]APIKey{"key1": {Tenant: "tenant1"}}
+	config.Webhooks.Secrets = map[string]string{"tenant1": "secret"}
+	// The receiver listens on the loopback.
+	config.Webhooks.AllowPrivate = true
+	config.Webhooks.MaxAttempts = 3
+	config.Webhooks.BackoffBase = 10 * time.Millisecond
+	config.Webhooks.BackoffMax = 10 * time.Millisecond
+	config.Webhooks.Interval = 10 * time.Millisecond
+	config.Webhooks.BaseUrl = "https://proxy.example.com/"
+	s := NewServer("", datastore.SQLite, ":memory:", config)
+	defer s.Close()
+	go s.Webhooks.Run(s.ctx)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"images": ["image"]}`))
+	}))
+	defer backend.Close()
+	require.NoError(t, s.SDServicesDatastore.PutServiceEndpoint("s0", backend.URL))
+	require.NoError(t, s.Reload())
+
+	// The receiver fails until healthy is set.
+	var healthy atomic.Bool
+	var calls atomic.Int32
+	events := make(chan *webhookEvent, 8)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		signature := "sha256=" + signWebhook("secret", r.Header.Get(kWebhookTimestampHeaderName), body)
+		assert.Equal(t, signature, r.Header.Get(kWebhookSignatureHeaderName))
+		var event webhookEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, event.Id, r.Header.Get(kWebhookIdHeaderName))
+		events <- &event
+	}))
+	defer receiver.Close()
+
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if strings.HasPrefix(path, "/admin") {
+			req.Header.Set("Authorization", "Bearer admin")
+		} else {
+			req.Header.Set(kAPIKeyHeaderName, "key1")
+		}
+		s.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	deliveries := func(jobId string) []datastore.WebhookDelivery {
+		rec := do(http.MethodGet, "/admin/webhooks/deliveries?job_id="+jobId, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var ret []datastore.WebhookDelivery
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+		return ret
+	}
+	submit := func() string {
+		rec := do(http.MethodPost, "/v1/jobs", `{"endpoint": "txt2img", "payload": {"prompt": "cat"}, "callback_url": "`+receiver.URL+`"}`)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		var job jobView
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		return job.Id
+	}
+
+	t.Run("Test failed delivery gives up after max attempts", func(t *testing.T) {
+		id := submit()
+		require.Eventually(t, func() bool {
+			d := deliveries(id)
+			return len(d) == 1 && d[0].Status == datastore.DeliveryFailed
+		}, 2*time.Second, 10*time.Millisecond)
+		d := deliveries(id)[0]
+		require.Equal(t, int64(3), d.Attempts)
+		require.Len(t, d.Log, 3)
+		require.Equal(t, int64(http.StatusInternalServerError), d.Log[0].StatusCode)
+		require.Equal(t, "job.succeeded", d.EventType)
+		require.Equal(t, "tenant1", d.Tenant)
+
+		// Redeliver after the receiver is fixed.
+		healthy.Store(true)
+		rec := do(http.MethodPost, "/admin/webhooks/deliveries/"+d.Id+"/redeliver", "")
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		event := <-events
+		require.Equal(t, d.Id, event.Id)
+		require.Equal(t, id, event.Job.Id)
+		require.Eventually(t, func() bool {
+			return deliveries(id)[0].Status == datastore.DeliveryDelivered
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Test signed event is delivered", func(t *testing.T) {
+		id := submit()
+		event := <-events
+		require.Equal(t, "job.succeeded", event.Type)
+		require.Equal(t, datastore.JobSucceeded, event.Job.Status)
+		require.Equal(t, "https://proxy.example.com/v1/jobs/"+id, event.Job.Url)
+		require.Eventually(t, func() bool {
+			d := deliveries(id)
+			return len(d) == 1 && d[0].Status == datastore.DeliveryDelivered && d[0].Attempts == 1
+		}, time.Second, 10*time.Millisecond)
+
+		// The result is not in the event, it is got from the job url.
+		rec := do(http.MethodGet, "/v1/jobs/"+id, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var job jobView
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &job))
+		require.JSONEq(t, `{"images": ["image"]}`, string(job.Result))
+
+		// The finished delivery expires after the retention.
+		d := deliveries(id)[0]
+		require.NotZero(t, d.ExpiresAt)
+		_, err := s.Webhooks.Datastore.PurgeExpiredDeliveries(d.ExpiresAt)
+		require.NoError(t, err)
+		require.Empty(t, deliveries(id))
+	})
+
+	t.Run("Test invalid callback url", func(t *testing.T) {
+		rec := do(http.MethodPost, "/v1/jobs", `{"endpoint": "txt2img", "payload": {}, "callback_url": "ftp://example.com"}`)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("Test callback url is rejected for the tenant without secret", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/jobs", strings.NewReader(`{"endpoint": "txt2img", "payload": {}, "callback_url": "https://example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		s.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+		require.Contains(t, rec.Body.String(), "requires a webhook secret")
+
+		s.Webhooks.Config.DefaultSecret = "default"
+		defer func() { s.Webhooks.Config.DefaultSecret = "" }()
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodPost, "/v1/jobs", strings.NewReader(`{"endpoint": "txt2img", "payload": {}, "callback_url": "https://example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		s.Echo.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+	})
+
+	t.Run("Test callback url to private address is rejected", func(t *testing.T) {
+		s.Webhooks.Config.AllowPrivate = false
+		defer func() { s.Webhooks.Config.AllowPrivate = true }()
+		for _, u := range []string{"http://169.254.169.254/latest/meta-data", "http://127.0.0.1:8080", "http://10.0.0.1", "http://[::1]/", "http://localhost/"} {
+			rec := do(http.MethodPost, "/v1/jobs", `{"endpoint": "txt2img", "payload": {}, "callback_url": "`+u+`"}`)
+			require.Equal(t, http.StatusBadRequest, rec.Code, u)
+		}
+	})
+}
+
+func TestWebhookClient(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+
+	cfg := DefaultConfig().Webhooks
+	client := newWebhookClient(&cfg)
+	_, err := client.Post(receiver.URL, "application/json", strings.NewReader("{}"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "private address")
+
+	cfg.AllowPrivate = true
+	resp, err := client.Post(receiver.URL, "application/json", strings.NewReader("{}"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}